@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSystemdListenerWithoutActivation(t *testing.T) {
+	t.Setenv("LISTEN_PID", "")
+	t.Setenv("LISTEN_FDS", "")
+	if listener, err := systemdListener(); listener != nil || err != nil {
+		t.Errorf("systemdListener without activation = %v, %v, want nil, nil", listener, err)
+	}
+
+	// The sockets are meant for another process
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	t.Setenv("LISTEN_FDS", "1")
+	if listener, err := systemdListener(); listener != nil || err != nil {
+		t.Errorf("systemdListener for another pid = %v, %v, want nil, nil", listener, err)
+	}
+}
+
+// TestSystemdListenerServesInheritedSocket starts the test binary again with a listening socket
+// as file descriptor 3, the way systemd passes it, and requests a page from the child through it
+func TestSystemdListenerServesInheritedSocket(t *testing.T) {
+	if os.Getenv("LB_TEST_SOCKET_ACTIVATED") == "1" {
+		// systemd sets LISTEN_PID after forking, which only the child can do here
+		os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+		listener, err := systemdListener()
+		if err != nil || listener == nil {
+			os.Exit(1)
+		}
+		http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "activated")
+		}))
+		os.Exit(1)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	file, err := listener.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	child := exec.Command(os.Args[0], "-test.run=^TestSystemdListenerServesInheritedSocket$")
+	child.Env = append(os.Environ(), "LB_TEST_SOCKET_ACTIVATED=1", "LISTEN_FDS=1")
+	child.ExtraFiles = []*os.File{file}
+	if err := child.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		child.Process.Kill()
+		child.Wait()
+	}()
+	// Only the child accepts connections on the socket
+	listener.Close()
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get("http://" + listener.Addr().String())
+	if err != nil {
+		t.Fatalf("requesting the socket-activated server: %s", err)
+	}
+	defer resp.Body.Close()
+	if body, _ := io.ReadAll(resp.Body); string(body) != "activated" {
+		t.Errorf("body = %q, want %q", body, "activated")
+	}
+}
@@ -1,228 +1,540 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"flag"
 	"fmt"
+	"io"
+	"log"
+	"net"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
-	"sync"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
+
+	"github.com/zerbinidamata/lb-challenge/lb"
 )
 
-// Backend defines the interface for a backend server
-type Backend interface {
-	ServeHTTP(w http.ResponseWriter, r *http.Request)
-	SetAlive(alive bool)
-	IsAlive() bool
-	GetURL() *url.URL
-	GetActiveConnections() int
-	PerformHealthCheck(interval time.Duration)
-}
+func main() {
+	// Define a command-line flag for the selection strategy
+	var strategyName string
+	flag.StringVar(&strategyName, "strategy", "round-robin", "Backend selection strategy (round-robin, weighted-random, smooth-weighted, least-load, lowest-cost, least-connections, locality, error-rate, latency-percentile)")
+
+	// Define a command-line flag for the percentile compared by the latency-percentile strategy
+	var latencyPercentile float64
+	flag.Float64Var(&latencyPercentile, "latency-percentile", 0.95, "Response time percentile, between 0 and 1, compared by the latency-percentile strategy")
+
+	// Define a command-line flag for the error rate above which the error-rate strategy shifts traffic away
+	var errorRateThreshold float64
+	flag.Float64Var(&errorRateThreshold, "error-rate-threshold", 0.1, "Fraction of recent 5xx responses above which the error-rate strategy reduces a backend's weight")
+
+	// Define a command-line flag for breaking ties between backends with equally few connections
+	var tieBreakName string
+	flag.StringVar(&tieBreakName, "tie-break", string(lb.TieBreakLowestIndex), "Tie-break for least-connections (lowest-index, round-robin, random)")
+
+	// Define a command-line flag for never selecting the same backend twice in a row
+	var excludeLast bool
+	flag.BoolVar(&excludeLast, "exclude-last", false, "Never select the backend selected last while another one is available, whatever the strategy")
+
+	// Define a command-line flag for the zone of the load balancer, used by the locality strategy
+	var zone string
+	flag.StringVar(&zone, "zone", "", "Availability zone of the load balancer, preferred by the locality strategy")
+
+	// Define a command-line flag for the health check latency threshold
+	var healthLatencyThreshold time.Duration
+	flag.DurationVar(&healthLatencyThreshold, "health-latency-threshold", 0, "Mark backends unhealthy when a health check takes longer than this (0 disables)")
+
+	// Define command-line flags for the health check failure rate window
+	var healthWindowSize int
+	var healthFailureRate float64
+	flag.IntVar(&healthWindowSize, "health-window", 1, "Number of recent health checks the failure rate is computed over")
+	flag.Float64Var(&healthFailureRate, "health-failure-rate", 0, "Largest fraction of failed health checks in the window at which a backend stays healthy")
+
+	// Define a command-line flag for the staleness threshold of health checks
+	var staleAfter time.Duration
+	flag.DurationVar(&staleAfter, "stale-after", 0, "Take backends out of rotation while they have not passed a health check for this long, e.g. when checks are stuck (0 disables)")
+
+	// Define command-line flags for the per-backend circuit breaker
+	var breakerThreshold int
+	var breakerCooldown time.Duration
+	flag.IntVar(&breakerThreshold, "breaker-threshold", 0, "Consecutive failed requests that open a backend's circuit breaker (0 disables)")
+	flag.DurationVar(&breakerCooldown, "breaker-cooldown", 30*time.Second, "Time an open circuit breaker waits before letting requests through again")
+
+	// Define command-line flags for the warm-up requests keeping upstream connections open
+	var warmUpInterval time.Duration
+	var warmUpCount int
+	flag.DurationVar(&warmUpInterval, "warm-up-interval", 0, "Interval between warm-up requests keeping idle connections to each backend open (0 disables)")
+	flag.IntVar(&warmUpCount, "warm-up-count", 2, "Number of idle connections to each backend kept open by warm-up requests")
+
+	// Define a command-line flag for the size of the response cache
+	var cacheSize int
+	flag.IntVar(&cacheSize, "cache-size", 0, "Number of cacheable GET responses kept in memory (0 disables the cache)")
+
+	// Define a command-line flag for the number of concurrent requests allowed per client IP
+	var maxRequestsPerIP int
+	flag.IntVar(&maxRequestsPerIP, "max-requests-per-ip", 0, "Concurrent requests allowed from a single client IP before answering with 429 (0 disables the limit)")
+
+	// Define command-line flags for weighted fair queuing of requests between tenants
+	fairQueue := lb.FairQueueConfig{Weights: make(map[string]int)}
+	flag.StringVar(&fairQueue.Header, "fair-queue-header", "X-Tenant", "Request header identifying the tenant for fair queuing")
+	flag.IntVar(&fairQueue.Capacity, "fair-queue-capacity", 0, "Requests proxied at once before further ones are queued fairly per tenant (0 disables fair queuing)")
+	flag.DurationVar(&fairQueue.Timeout, "fair-queue-timeout", 0, "Time a request waits in its tenant's queue before it is answered with 503 (0 waits as long as the client)")
+	flag.Func("fair-queue-weight", "Share of the capacity given to a tenant under contention, as \"tenant=weight\" (repeatable, default weight 1)", func(value string) error {
+		tenant, weight, ok := strings.Cut(value, "=")
+		if !ok {
+			return fmt.Errorf("expected tenant=weight, got %q", value)
+		}
+		n, err := strconv.Atoi(weight)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("weight of tenant %q must be a positive integer", tenant)
+		}
+		fairQueue.Weights[tenant] = n
+		return nil
+	})
 
-// backend is a simple round-robin load balancer
-type backend struct {
-	URL               *url.URL
-	alive             bool
-	activeConnections int
-	mutex             sync.RWMutex
-	reverseProxy      *httputil.ReverseProxy
-	healthCheckURL    string
-}
+	// Define a command-line flag for the longest request URL proxied
+	var maxURLLength int
+	flag.IntVar(&maxURLLength, "max-url-length", 0, "Longest request path and query in bytes, longer ones are answered with 414 (0 means no limit)")
 
-func NewBackend(URL string) Backend {
-	u, err := url.Parse(URL)
-	if err != nil {
-		panic(err)
-	}
+	// Define a command-line flag for normalizing request paths
+	var normalizePaths bool
+	flag.BoolVar(&normalizePaths, "normalize-paths", false, "Collapse duplicate slashes and resolve dot segments of request paths before routing and proxying")
 
-	return &backend{
-		URL:            u,
-		alive:          true,
-		reverseProxy:   httputil.NewSingleHostReverseProxy(u),
-		healthCheckURL: URL + "/health", // Assuming a simple health check endpoint at /health
-	}
-}
+	// Define a command-line flag for keeping the requests of a client connection on one backend
+	var connectionStickiness bool
+	flag.BoolVar(&connectionStickiness, "connection-stickiness", false, "Send all requests on a client connection to the same backend while it is available")
 
-func (b *backend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// Print details of the incoming request
-	fmt.Printf("Received request from %s\n", r.RemoteAddr)
-	fmt.Printf("%s %s %s\n", r.Method, r.URL, r.Proto)
-	fmt.Println("Host:", r.Host)
-	fmt.Println("User-Agent:", r.UserAgent())
-	fmt.Println("Accept:", r.Header.Get("Accept"))
+	// Define a command-line flag for the request header holding the client IP
+	var clientIPHeader string
+	flag.StringVar(&clientIPHeader, "client-ip-header", "", "Request header holding the client IP, e.g. True-Client-IP or CF-Connecting-IP, falling back to X-Forwarded-For (empty uses the connection address)")
 
-	// Set the Host header for the outgoing request
-	r.Host = b.URL.Host
+	// Define a command-line flag for the proxies trusted with the client IP header
+	var trustedProxies string
+	flag.StringVar(&trustedProxies, "trusted-proxies", "", "Comma separated address ranges, e.g. 10.0.0.0/8, of the proxies whose -client-ip-header and X-Forwarded-For are believed")
 
-	// Forward the request to the backend server
-	b.mutex.RLock()
-	defer b.mutex.RUnlock()
+	// Define a command-line flag for the clients trusted with the X-LB-Exclude header
+	var excludeHeaderClients string
+	flag.StringVar(&excludeHeaderClients, "exclude-header-clients", "", "Comma separated client IP ranges, e.g. 10.0.0.0/8, whose X-LB-Exclude header lists backends to avoid (empty ignores the header)")
 
-	if b.alive {
-		b.activeConnections++
+	// Define a command-line flag for the request methods that are proxied
+	var allowedMethods string
+	flag.StringVar(&allowedMethods, "allowed-methods", "", "Comma separated request methods to proxy, others are answered with 405 (empty allows all)")
 
-		b.reverseProxy.ServeHTTP(w, r)
-		b.activeConnections--
-	} else {
-		http.Error(w, "Backend server is not available", http.StatusServiceUnavailable)
-	}
-}
-
-func (b *backend) SetAlive(alive bool) {
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
-	b.alive = alive
-}
+	// Define a repeatable command-line flag for headers added to every response
+	var responseHooks []lb.ResponseHook
+	flag.Func("response-header", "Header set on every backend response, as \"Name: value\" (repeatable)", func(header string) error {
+		hook, err := lb.ParseResponseHeader(header)
+		if err != nil {
+			return err
+		}
+		responseHooks = append(responseHooks, hook)
+		return nil
+	})
 
-func (b *backend) IsAlive() bool {
-	b.mutex.RLock()
-	defer b.mutex.RUnlock()
-	return b.alive
-}
+	// Define a repeatable command-line flag for status codes rewritten on the way to the client
+	statusRemap := make(map[int]int)
+	flag.Func("status-remap", "Backend response status code sent to clients as another, as \"from=to\", e.g. 418=400 (repeatable)", func(value string) error {
+		from, to, ok := strings.Cut(value, "=")
+		if !ok {
+			return fmt.Errorf("expected from=to, got %q", value)
+		}
+		fromCode, err := strconv.Atoi(from)
+		if err != nil {
+			return fmt.Errorf("invalid status code %q", from)
+		}
+		toCode, err := strconv.Atoi(to)
+		if err != nil {
+			return fmt.Errorf("invalid status code %q", to)
+		}
+		statusRemap[fromCode] = toCode
+		return nil
+	})
 
-func (b *backend) GetURL() *url.URL {
-	return b.URL
-}
+	// Define a command-line flag for the DNS re-resolution interval of backend host names
+	var dnsRefreshInterval time.Duration
+	flag.DurationVar(&dnsRefreshInterval, "dns-refresh-interval", 0, "Interval at which backend host names are re-resolved, moving connections to changed addresses (0 disables)")
+
+	// Define a command-line flag for the lifetime of upstream connections
+	var connectionMaxAge time.Duration
+	flag.DurationVar(&connectionMaxAge, "connection-max-age", 0, "Close idle upstream connections once they have been open for longer than this (0 disables)")
+
+	// Define command-line flags for the files served by the load balancer itself
+	var favicon, robotsTxt string
+	flag.StringVar(&favicon, "favicon", "", "File served for /favicon.ico without asking a backend, \"none\" answers 204 (empty proxies it)")
+	flag.StringVar(&robotsTxt, "robots-txt", "", "File served for /robots.txt without asking a backend, \"none\" answers 204 (empty proxies it)")
+
+	// Define a command-line flag for the host names of the load balancer, to detect backends redirecting to it
+	var selfHosts string
+	flag.StringVar(&selfHosts, "self-hosts", "", "Comma separated host names of the load balancer; backend redirects to them are logged and counted as possible loops")
+
+	// Define a command-line flag for the page served while paused or without available backends
+	var maintenancePath string
+	flag.StringVar(&maintenancePath, "maintenance-page", "", "File served with 503 while the pool is paused or no backend is available, read once at startup")
+
+	// Define a command-line flag for the admin API port
+	var adminPort int
+	flag.IntVar(&adminPort, "admin-port", 3100, "Port for the admin API to listen on")
+
+	// Define a command-line flag for the response header size limit
+	var maxResponseHeaderBytes int64
+	flag.Int64Var(&maxResponseHeaderBytes, "max-response-header-bytes", lb.DefaultMaxResponseHeaderBytes, "Largest response headers accepted from a backend, in bytes")
+
+	// Define a command-line flag for the instance ID, defaulting to the hostname
+	hostname, _ := os.Hostname()
+	var instanceID string
+	flag.StringVar(&instanceID, "instance-id", hostname, "Identifies this load balancer in the X-LB-Instance response header and log lines")
+
+	// Define a command-line flag for the fast mode
+	var fastMode bool
+	flag.BoolVar(&fastMode, "fast", false, "Skip per-request diagnostic logging for higher throughput")
+
+	// Define a command-line flag for the backend trailer of streamed responses
+	var backendTrailer bool
+	flag.BoolVar(&backendTrailer, "backend-trailer", false, "Send the URL of the backend that served a streamed response in the X-LB-Backend trailer")
+
+	// Define a command-line flag for the timing response headers
+	var timingHeaders bool
+	flag.BoolVar(&timingHeaders, "timing-headers", false, "Add X-LB-Upstream-Time and X-LB-Total-Time headers to responses")
+
+	// Define command-line flags for requests arriving while every backend is at its connection cap
+	var overflowName string
+	var overflowQueueTimeout time.Duration
+	flag.StringVar(&overflowName, "overflow", string(lb.OverflowReject), "Policy when every backend is at its connection cap (reject, queue, least-saturated)")
+	flag.DurationVar(&overflowQueueTimeout, "overflow-queue-timeout", time.Second, "Time a request waits for a backend below its connection cap with the queue overflow policy")
+
+	// Define a command-line flag for the share of requests proxied rather than shed
+	var trafficDial int
+	flag.IntVar(&trafficDial, "traffic-dial", 100, "Percentage of requests proxied, from 1 to 100, the others are answered with 503 to relieve the backends (adjustable on the admin API, down to 0)")
+
+	// Define a command-line flag for the number of primary backends below which standby ones are used
+	var standbyThreshold int
+	flag.IntVar(&standbyThreshold, "standby-threshold", 1, "Send requests to the standby backends of the config file while fewer than this many primary backends are available")
+
+	// Define command-line flags for the access log
+	var accessLogPath, accessLogFormat string
+	flag.StringVar(&accessLogPath, "access-log", "", "File to append a line to for every proxied request, - for standard output (empty disables it)")
+	flag.StringVar(&accessLogFormat, "access-log-format", string(lb.AccessLogText), "Format of the access log lines (text for the Combined Log Format, json)")
+
+	// Define command-line flags for logging a sample of request and response bodies
+	var bodyLog lb.BodyLogConfig
+	var bodyLogRedact string
+	flag.Float64Var(&bodyLog.SampleRate, "body-log-rate", 0, "Fraction of requests, from 0 to 1, whose headers and bodies are logged along with their responses (0 disables it)")
+	flag.IntVar(&bodyLog.MaxBytes, "body-log-max-bytes", 4096, "Length at which each logged body is truncated")
+	flag.StringVar(&bodyLogRedact, "body-log-redact", "", "Comma separated headers logged without their values, besides Authorization, Proxy-Authorization, Cookie and Set-Cookie")
+
+	// Define command-line flags for the autoscaling webhook
+	var autoscale lb.AutoscaleConfig
+	flag.StringVar(&autoscale.WebhookURL, "autoscale-webhook", "", "URL to POST autoscaling signals to when active connections cross the marks (empty disables it)")
+	flag.IntVar(&autoscale.HighWater, "autoscale-high-water", 0, "Active connections over all backends above which scaling up is signalled")
+	flag.IntVar(&autoscale.LowWater, "autoscale-low-water", 0, "Active connections at or below which the scale-up signal recovers (defaults to the high-water mark)")
+	flag.DurationVar(&autoscale.Sustain, "autoscale-sustain", 30*time.Second, "Time active connections must stay past a mark before the webhook is called")
+
+	// Define command-line flags for serving over TLS
+	var tlsCert, tlsKey string
+	flag.StringVar(&tlsCert, "tls-cert", "", "Certificate file to serve TLS with, reloaded when it changes (requires -tls-key)")
+	flag.StringVar(&tlsKey, "tls-key", "", "Private key file of the -tls-cert certificate")
+
+	// Define a command-line flag for reading the client address from PROXY protocol headers
+	var acceptProxyProtocol bool
+	flag.BoolVar(&acceptProxyProtocol, "accept-proxy-protocol", false, "Require a PROXY protocol header on incoming connections and take the client address from it")
+
+	// Define a command-line flag for sharing the port with another load balancer process
+	var reusePort bool
+	flag.BoolVar(&reusePort, "reuse-port", false, "Listen with SO_REUSEPORT so a new process can take over the port while this one drains")
+
+	// Define a command-line flag for how long shutdown waits for requests in flight
+	var shutdownTimeout time.Duration
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second, "Time to wait for requests in flight to finish on SIGTERM or SIGINT")
+
+	// Define a command-line flag for the state file
+	var statePath string
+	flag.StringVar(&statePath, "state-file", "", "Path to a file where the selection state is saved and restored from on startup")
+
+	// Define a command-line flag for the trace exporter
+	var traceExporter string
+	flag.StringVar(&traceExporter, "trace-exporter", "none", "Exporter for request spans (none, stdout, otlp)")
+
+	// Define command-line flags for discovering backends from DNS SRV records
+	var srv lb.SRVConfig
+	flag.StringVar(&srv.Name, "srv", "", "DNS SRV name to discover backends from, e.g. _http._tcp.api.example.com, alongside those of -config")
+	flag.StringVar(&srv.Scheme, "srv-scheme", "http", "Scheme of the backends discovered from SRV records (http, https)")
+	flag.DurationVar(&srv.Interval, "srv-interval", 30*time.Second, "Interval between lookups of the -srv records")
+
+	// Define a command-line flag for the config file
+	var configPath string
+	flag.StringVar(&configPath, "config", "", "Path to a JSON config file listing the backends, reloaded on SIGHUP")
+
+	// Define a command-line flag for validating the config file without starting the load balancer
+	var check bool
+	flag.BoolVar(&check, "check", false, "Validate the config file given with -config and exit")
+
+	// Define a command-line flag for simulating the distribution of requests over the backends
+	var simulate int
+	flag.IntVar(&simulate, "simulate", 0, "Print how this many requests would be spread over the backends of the config file given with -config under -strategy, and exit")
+
+	// Parse the command-line arguments
+	flag.Parse()
+
+	// Prefix every log line with the instance ID
+	log.SetFlags(0)
+	if instanceID != "" {
+		log.SetPrefix("[" + instanceID + "] ")
+	}
 
-func (b *backend) GetActiveConnections() int {
-	b.mutex.RLock()
-	defer b.mutex.RUnlock()
-	return b.activeConnections
-}
+	bodyLog.RedactHeaders = splitList(bodyLogRedact)
 
-// PerformHealthCheck periodically checks if the backend server is alive
-func (b *backend) PerformHealthCheck(interval time.Duration) {
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
+	strategyConfig := lb.StrategyConfig{
+		Zone:               zone,
+		ErrorRateThreshold: errorRateThreshold,
+		LatencyPercentile:  latencyPercentile,
+		TieBreak:           tieBreakName,
+		ExcludeLast:        excludeLast,
+	}
 
-	for {
-		select {
-		case <-ticker.C:
-			if err := b.checkHealth(); err != nil {
-				fmt.Printf("Health check failed for %s: %s\n", b.healthCheckURL, err)
-				b.SetAlive(false)
-			} else {
-				fmt.Printf("Health check passed for %s\n", b.healthCheckURL)
-				b.SetAlive(true)
-			}
+	if simulate > 0 {
+		if configPath == "" {
+			log.Println("-simulate requires -config")
+			os.Exit(2)
+		}
+		strategy, err := lb.NewStrategy(strategyName, strategyConfig)
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		config, err := lb.LoadConfig(configPath)
+		if err != nil {
+			log.Printf("Error loading config: %s", err)
+			os.Exit(1)
 		}
+		printSimulation(os.Stdout, config, lb.Simulate(config, strategy, simulate), simulate)
+		return
 	}
-}
 
-func (b *backend) checkHealth() error {
-	resp, err := http.Get(b.healthCheckURL)
-	if err != nil {
-		return err
+	if check {
+		if configPath == "" {
+			log.Println("-check requires -config")
+			os.Exit(2)
+		}
+		summary, err := lb.CheckConfig(configPath)
+		if err != nil {
+			log.Printf("Invalid config: %s", err)
+			os.Exit(1)
+		}
+		fmt.Println(summary)
+		return
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	// The zero value of Config.TrafficDial selects 100, shedding every request takes the admin API
+	if trafficDial < 1 || trafficDial > 100 {
+		log.Printf("-traffic-dial must be between 1 and 100, got %d", trafficDial)
+		os.Exit(2)
 	}
 
-	return nil
-}
+	if err := lb.SetupTracing(traceExporter); err != nil {
+		log.Printf("Error setting up tracing: %s", err)
+		os.Exit(1)
+	}
 
-// ServerPool represents a pool of backend servers
-type ServerPool interface {
-	GetBackends() []Backend
-	GetNextValidPeer() Backend
-	AddBackend(Backend)
-	GetServerPoolSize() int
-}
+	overflow, err := lb.ParseOverflowPolicy(overflowName)
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
 
-// RoundRobinServerPool represents a pool of backend servers using round-robin selection
-type RoundRobinServerPool struct {
-	backends []Backend
-	index    int
-	mutex    sync.RWMutex
-}
+	var accessLog io.Writer
+	switch accessLogPath {
+	case "":
+	case "-":
+		accessLog = os.Stdout
+	default:
+		file, err := os.OpenFile(accessLogPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err != nil {
+			log.Printf("Error opening access log: %s", err)
+			os.Exit(1)
+		}
+		defer file.Close()
+		accessLog = file
+	}
 
-// NewRoundRobinServerPool creates a new RoundRobinServerPool instance
-func NewRoundRobinServerPool() *RoundRobinServerPool {
-	return &RoundRobinServerPool{
-		backends: make([]Backend, 0),
+	config := lb.Config{
+		Strategy:               strategyName,
+		StrategyConfig:         strategyConfig,
+		HealthLatencyThreshold: healthLatencyThreshold,
+		HealthWindow:           healthWindowSize,
+		HealthFailureRate:      healthFailureRate,
+		StaleAfter:             staleAfter,
+		BreakerThreshold:       breakerThreshold,
+		BreakerCooldown:        breakerCooldown,
+		MaxResponseHeaderBytes: maxResponseHeaderBytes,
+		WarmUpInterval:         warmUpInterval,
+		WarmUpCount:            warmUpCount,
+		DNSRefreshInterval:     dnsRefreshInterval,
+		ConnectionMaxAge:       connectionMaxAge,
+		ResponseHooks:          responseHooks,
+		StatusRemap:            statusRemap,
+		SelfHosts:              splitList(selfHosts),
+		Proxy: lb.ProxyOptions{
+			FastMode:             fastMode,
+			InstanceID:           instanceID,
+			TimingHeaders:        timingHeaders,
+			BackendTrailer:       backendTrailer,
+			Overflow:             overflow,
+			OverflowQueueTimeout: overflowQueueTimeout,
+		},
+		MaintenancePage:      maintenancePath,
+		Favicon:              favicon,
+		RobotsTxt:            robotsTxt,
+		CacheSize:            cacheSize,
+		MaxRequestsPerIP:     maxRequestsPerIP,
+		FairQueue:            fairQueue,
+		ClientIPHeader:       clientIPHeader,
+		TrustedProxies:       splitList(trustedProxies),
+		ExcludeHeaderClients: splitList(excludeHeaderClients),
+		AllowedMethods:       splitList(allowedMethods),
+		NormalizePaths:       normalizePaths,
+		MaxURLLength:         maxURLLength,
+		ConnectionStickiness: connectionStickiness,
+		SRV:                  srv,
+		TrafficDial:          trafficDial,
+		StandbyThreshold:     standbyThreshold,
+		AccessLog:            accessLog,
+		AccessLogFormat:      lb.AccessLogFormat(accessLogFormat),
+		BodyLog:              bodyLog,
+		Autoscale:            autoscale,
+		StatePath:            statePath,
 	}
-}
 
-// GetBackends returns the list of backend servers in the pool
-func (sp *RoundRobinServerPool) GetBackends() []Backend {
-	sp.mutex.RLock()
-	defer sp.mutex.RUnlock()
-	return sp.backends
-}
+	if configPath != "" {
+		// Add the backends and routes listed in the config file and reload them on SIGHUP
+		fileConfig, err := lb.LoadConfig(configPath)
+		if err != nil {
+			log.Printf("Error loading config: %s", err)
+			os.Exit(1)
+		}
+		config.Backends = fileConfig.Backends
+		config.Routes = fileConfig.Routes
+		config.ActiveGroup = fileConfig.ActiveGroup
+	} else {
+		config.Backends = []lb.BackendConfig{{URL: "http://localhost:3001"}, {URL: "http://localhost:3002"}}
+	}
 
-// GetNextValidPeer returns the next available backend server in a round-robin fashion
-func (sp *RoundRobinServerPool) GetNextValidPeer() Backend {
-	sp.mutex.Lock()
-	defer sp.mutex.Unlock()
+	// Create the load balancer and start health checking its backends
+	balancer, err := lb.NewLoadBalancer(config)
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	balancer.Start(ctx)
+	if configPath != "" {
+		go reloadOnSignal(balancer, configPath)
+	}
 
-	for range sp.backends {
-		backend := sp.backends[sp.index]
-		sp.index = (sp.index + 1) % len(sp.backends)
+	// Specify the port number to listen on
+	port := 3000
 
-		if backend.IsAlive() {
-			return backend
+	// Serve on the socket passed by systemd when socket activated, so restarts do not drop connections
+	listener, err := systemdListener()
+	socketActivated := listener != nil
+	if err == nil && !socketActivated {
+		if reusePort {
+			listener, err = listenReusePort(fmt.Sprintf(":%d", port))
+		} else {
+			listener, err = net.Listen("tcp", fmt.Sprintf(":%d", port))
 		}
 	}
+	if err != nil {
+		log.Printf("Error starting the load balancer: %s", err)
+		os.Exit(1)
+	}
+	if acceptProxyProtocol {
+		listener = &lb.ProxyProtocolListener{Listener: listener}
+	}
+	// TLS goes inside the PROXY protocol, whose header comes first on the connection
+	if tlsCert != "" || tlsKey != "" {
+		if tlsCert == "" || tlsKey == "" {
+			log.Println("Error starting the load balancer: -tls-cert and -tls-key must be set together")
+			os.Exit(1)
+		}
+		certs, err := lb.NewCertReloader(tlsCert, tlsKey)
+		if err != nil {
+			log.Printf("Error starting the load balancer: %s", err)
+			os.Exit(1)
+		}
+		listener = tls.NewListener(listener, &tls.Config{
+			GetCertificate: certs.GetCertificate,
+			NextProtos:     []string{"h2", "http/1.1"},
+		})
+	}
 
-	return nil
-}
-
-// AddBackend adds a backend server to the pool
-func (sp *RoundRobinServerPool) AddBackend(backend Backend) {
-	sp.mutex.Lock()
-	defer sp.mutex.Unlock()
-	sp.backends = append(sp.backends, backend)
+	// Start the load balancer server
+	server := &http.Server{Handler: balancer.Handler(), ConnContext: balancer.ConnContext, ConnState: balancer.ConnState}
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			log.Printf("Error starting the load balancer: %s", err)
+		}
+	}()
 
-	// Start health check for the new backend
-	go backend.PerformHealthCheck(10 * time.Second) // Adjust the interval as needed
-}
+	// Start the admin API server
+	go func() {
+		err := http.ListenAndServe(fmt.Sprintf(":%d", adminPort), balancer.AdminHandler())
+		if err != nil {
+			log.Printf("Error starting the admin API: %s", err)
+		}
+	}()
 
-// GetServerPoolSize returns the number of backend servers in the pool
-func (sp *RoundRobinServerPool) GetServerPoolSize() int {
-	sp.mutex.RLock()
-	defer sp.mutex.RUnlock()
-	return len(sp.backends)
+	if socketActivated {
+		log.Printf("Load balancer started on socket-activated listener %s", listener.Addr())
+	} else {
+		log.Printf("Load balancer started on port %d", port)
+	}
+	log.Printf("Admin API started on port %d", adminPort)
+
+	// Stop accepting connections on SIGTERM or SIGINT and let requests in flight finish, so a new
+	// process sharing the port with --reuse-port takes over without dropping requests
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	<-signals
+
+	log.Printf("Shutting down, waiting up to %s for requests in flight", shutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Error shutting down the load balancer: %s", err)
+	}
 }
 
-func main() {
-	// Create a new RoundRobinServerPool
-	serverPool := NewRoundRobinServerPool()
-
-	// Create two Backend instances representing backend servers
-	backend1 := NewBackend("http://localhost:3001")
-	backend2 := NewBackend("http://localhost:3002")
+// reloadOnSignal re-reads the config file and applies it to the load balancer every time SIGHUP is received
+func reloadOnSignal(balancer *lb.LoadBalancer, path string) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
 
-	// Add the backends to the server pool
-	serverPool.AddBackend(backend1)
-	serverPool.AddBackend(backend2)
+	for range signals {
+		log.Printf("Reloading config from %s", path)
 
-	// Use the ServerPool as the handler for incoming requests
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		peer := serverPool.GetNextValidPeer()
-
-		fmt.Printf("Selected peer at %s\n", peer.GetURL())
-
-		if peer != nil {
-			peer.ServeHTTP(w, r)
-			fmt.Println("Response from backend server")
-		} else {
-			http.Error(w, "No backend server is available", http.StatusServiceUnavailable)
+		config, err := lb.LoadConfig(path)
+		if err != nil {
+			log.Printf("Error reloading config, keeping the current backends: %s", err)
+			continue
 		}
-	})
 
-	// Specify the port number to listen on
-	port := 3000
+		balancer.Reload(config)
+	}
+}
 
-	// Start the load balancer server
-	go func() {
-		err := http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
-		if err != nil {
-			fmt.Printf("Error starting the load balancer: %s\n", err)
+// splitList splits a comma separated flag value, dropping empty elements
+func splitList(list string) []string {
+	var values []string
+	for _, value := range strings.Split(list, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
 		}
-	}()
-
-	fmt.Printf("Load balancer started on port %d\n", port)
-	select {}
+	}
+	return values
 }
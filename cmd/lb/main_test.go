@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// mainArgsEnv carries the arguments main runs with when the test binary is started by runMain
+const mainArgsEnv = "LB_TEST_MAIN_ARGS"
+
+func TestMain(m *testing.M) {
+	if args, ok := os.LookupEnv(mainArgsEnv); ok {
+		os.Args = append([]string{"lb"}, strings.Fields(args)...)
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runMain runs the command with args in a new process, returning its output and exit code
+func runMain(t *testing.T, args ...string) (stdout, stderr string, code int) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), mainArgsEnv+"="+strings.Join(args, " "))
+	var out, errOut bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &errOut
+
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		code = exitErr.ExitCode()
+	} else if err != nil {
+		t.Fatalf("running lb %s: %s", strings.Join(args, " "), err)
+	}
+	return out.String(), errOut.String(), code
+}
+
+// writeFile writes contents to name in a temporary directory and returns its path
+func writeFile(t *testing.T, name, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCheckConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		code   int
+		output string
+	}{
+		{"valid", `{"backends": [{"url": "http://a:3001"}, {"url": "http://b:3001", "weight": 2}], "routes": [{"prefix": "/api"}]}`, 0, "OK, 2 backends, 1 routes"},
+		{"negative weight", `{"backends": [{"url": "http://a:3001", "weight": -1}]}`, 1, "Invalid config: validating"},
+		{"unknown field", `{"backends": [{"url": "http://a:3001", "wieght": 2}]}`, 1, `unknown field "wieght"`},
+		{"not JSON", `backends: []`, 1, "Invalid config: parsing"},
+	}
+	for _, tt := range tests {
+		stdout, stderr, code := runMain(t, "-check", "-config", writeFile(t, "lb.json", tt.config))
+		if code != tt.code || !strings.Contains(stdout+stderr, tt.output) {
+			t.Errorf("%s: exit %d with %q, want exit %d with %q", tt.name, code, stdout+stderr, tt.code, tt.output)
+		}
+	}
+
+	if _, stderr, code := runMain(t, "-check"); code != 2 || !strings.Contains(stderr, "-check requires -config") {
+		t.Errorf("-check without -config: exit %d with %q, want exit 2", code, stderr)
+	}
+}
+
+func TestSimulatePrintsDistribution(t *testing.T) {
+	config := writeFile(t, "lb.json", `{"backends": [{"url": "http://a:3001"}, {"url": "http://b:3001", "weight": 3}, {"url": "http://c:3001", "weight": 0}]}`)
+	stdout, stderr, code := runMain(t, "-simulate", "400", "-strategy", "smooth-weighted", "-config", config)
+	if code != 0 {
+		t.Fatalf("exit %d: %s", code, stderr)
+	}
+
+	want := []string{
+		"BACKEND        WEIGHT  REQUESTS  SHARE",
+		"http://a:3001  1       100       25.0%",
+		"http://b:3001  3       300       75.0%",
+		"http://c:3001  0       0         0.0%",
+	}
+	if got := strings.Split(strings.TrimSpace(stdout), "\n"); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("output:\n%s\nwant:\n%s", stdout, strings.Join(want, "\n"))
+	}
+}
+
+func TestTrafficDialFlagOutOfRange(t *testing.T) {
+	for _, dial := range []string{"0", "101"} {
+		if _, stderr, code := runMain(t, "-traffic-dial", dial); code != 2 || !strings.Contains(stderr, "-traffic-dial must be between 1 and 100") {
+			t.Errorf("-traffic-dial %s: exit %d with %q, want exit 2", dial, code, stderr)
+		}
+	}
+}
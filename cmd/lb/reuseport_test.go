@@ -0,0 +1,28 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestListenReusePortSharesPort(t *testing.T) {
+	first, err := listenReusePort("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("first listener: %s", err)
+	}
+	defer first.Close()
+
+	second, err := listenReusePort(first.Addr().String())
+	if err != nil {
+		t.Fatalf("second listener on %s: %s", first.Addr(), err)
+	}
+	defer second.Close()
+
+	// Without the option the port stays taken
+	if plain, err := net.Listen("tcp", first.Addr().String()); err == nil {
+		plain.Close()
+		t.Errorf("a listener without SO_REUSEPORT could bind %s as well", first.Addr())
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"text/tabwriter"
+
+	"github.com/zerbinidamata/lb-challenge/lb"
+)
+
+// printSimulation writes the outcome of Simulate as a table in config order
+func printSimulation(w io.Writer, config *lb.FileConfig, counts map[string]int, requests int) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "BACKEND\tWEIGHT\tREQUESTS\tSHARE")
+	selected := 0
+	for _, bc := range config.Backends {
+		// URLs have already been validated by LoadConfig
+		u, _ := url.Parse(bc.URL)
+		count := counts[u.String()]
+		selected += count
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.1f%%\n", bc.URL, bc.GetWeight(), count, 100*float64(count)/float64(requests))
+	}
+	if unserved := requests - selected; unserved > 0 {
+		fmt.Fprintf(tw, "(no backend)\t\t%d\t%.1f%%\n", unserved, 100*float64(unserved)/float64(requests))
+	}
+	tw.Flush()
+}
@@ -0,0 +1,138 @@
+package lb
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// AccessLogFormat is the format of the access log lines
+type AccessLogFormat string
+
+const (
+	// AccessLogText writes lines in the Combined Log Format
+	AccessLogText AccessLogFormat = "text"
+	// AccessLogJSON writes a JSON object per line, see AccessLogEntry
+	AccessLogJSON AccessLogFormat = "json"
+)
+
+// requestIDHeader carries the ID of a request, access logs take it from the client or set a new one
+const requestIDHeader = "X-Request-Id"
+
+// AccessLogEntry is a line of the JSON access log
+type AccessLogEntry struct {
+	Time       time.Time `json:"time"`
+	RequestID  string    `json:"requestId"`
+	ClientIP   string    `json:"clientIP"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Status     int       `json:"status"`
+	DurationMs float64   `json:"durationMs"`
+	// Backend is the URL of the backend that served the request, empty if none did
+	Backend string `json:"backend"`
+	Bytes   int64  `json:"bytes"`
+}
+
+// accessLogBackendKey is the context key under which the backend of a request is recorded for the access log
+type accessLogBackendKey struct{}
+
+// accessLogBackend holds the backend that served a request, set by the proxy
+type accessLogBackend struct {
+	url string
+}
+
+// recordBackend notes the backend selected for the request in its access log line
+func recordBackend(r *http.Request, backend Backend) {
+	if record, ok := r.Context().Value(accessLogBackendKey{}).(*accessLogBackend); ok {
+		record.url = backend.GetURL().String()
+	}
+}
+
+// accessLogResponseWriter records the status and body size of a response
+type accessLogResponseWriter struct {
+	statusResponseWriter
+	bytes int64
+}
+
+func (aw *accessLogResponseWriter) Write(p []byte) (int, error) {
+	n, err := aw.statusResponseWriter.Write(p)
+	aw.bytes += int64(n)
+	return n, err
+}
+
+// accessLogHandler writes a line to out in the given format for every request served by next.
+// Requests without an X-Request-Id header are given one, which is passed on to the backend.
+func accessLogHandler(format AccessLogFormat, out io.Writer, next http.Handler) http.Handler {
+	var mutex sync.Mutex
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		requestID := r.Header.Get(requestIDHeader)
+		if requestID == "" {
+			requestID = newRequestID()
+			r.Header.Set(requestIDHeader, requestID)
+		}
+		backend := &accessLogBackend{}
+		aw := &accessLogResponseWriter{statusResponseWriter: statusResponseWriter{ResponseWriter: w}}
+
+		next.ServeHTTP(aw, r.WithContext(context.WithValue(r.Context(), accessLogBackendKey{}, backend)))
+
+		var line []byte
+		if format == AccessLogJSON {
+			line, _ = json.Marshal(AccessLogEntry{
+				Time:       start,
+				RequestID:  requestID,
+				ClientIP:   ClientIP(r),
+				Method:     r.Method,
+				Path:       r.URL.Path,
+				Status:     aw.Status(),
+				DurationMs: float64(time.Since(start)) / float64(time.Millisecond),
+				Backend:    backend.url,
+				Bytes:      aw.bytes,
+			})
+		} else {
+			line = []byte(combinedLogLine(r, start, aw.Status(), aw.bytes))
+		}
+
+		mutex.Lock()
+		defer mutex.Unlock()
+		out.Write(append(line, '\n'))
+	})
+}
+
+// combinedLogLine formats the request in the Combined Log Format
+func combinedLogLine(r *http.Request, start time.Time, status int, bytes int64) string {
+	user := "-"
+	if r.URL.User != nil && r.URL.User.Username() != "" {
+		user = r.URL.User.Username()
+	} else if username, _, ok := r.BasicAuth(); ok && username != "" {
+		user = username
+	}
+	size := "-"
+	if bytes > 0 {
+		size = fmt.Sprint(bytes)
+	}
+	return fmt.Sprintf("%s - %s [%s] %q %d %s %q %q", ClientIP(r), user, start.Format("02/Jan/2006:15:04:05 -0700"),
+		r.Method+" "+r.URL.RequestURI()+" "+r.Proto, status, size, orDash(r.Referer()), orDash(r.UserAgent()))
+}
+
+// orDash returns value, or "-" for a missing one as the Combined Log Format has it
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+// newRequestID returns a random request ID
+func newRequestID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
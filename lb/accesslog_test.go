@@ -0,0 +1,76 @@
+package lb
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJSONAccessLogHasEveryField(t *testing.T) {
+	requestIDs := make(chan string, 1)
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		requestIDs <- r.Header.Get("X-Request-Id")
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, "created")
+	})
+	out := &logBuffer{}
+	handler := startTestLoadBalancer(t, Config{
+		Backends:        []BackendConfig{{URL: server.URL}},
+		AccessLog:       out,
+		AccessLogFormat: AccessLogJSON,
+	}).Handler()
+
+	start := time.Now()
+	serve(handler, http.MethodPost, "/orders?id=1")
+	line := strings.TrimSuffix(out.String(), "\n")
+	if strings.Contains(line, "\n") {
+		t.Fatalf("access log = %q, want a single line", line)
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(line), &fields); err != nil {
+		t.Fatalf("access log line %q is not JSON: %s", line, err)
+	}
+	for _, name := range []string{"time", "requestId", "clientIP", "method", "path", "status", "durationMs", "backend", "bytes"} {
+		if _, ok := fields[name]; !ok {
+			t.Errorf("access log line %q has no %s field", line, name)
+		}
+	}
+
+	var entry AccessLogEntry
+	json.Unmarshal([]byte(line), &entry)
+	requestID := <-requestIDs
+	if entry.RequestID == "" || entry.RequestID != requestID {
+		t.Errorf("request ID %q, backend received %q, want the same generated ID", entry.RequestID, requestID)
+	}
+	if entry.Method != http.MethodPost || entry.Path != "/orders" || entry.Status != http.StatusCreated || entry.Bytes != 7 ||
+		entry.Backend != server.URL || entry.ClientIP != "192.0.2.1" {
+		t.Errorf("access log entry = %+v, want POST /orders from 192.0.2.1 answered 201 with 7 bytes by %s", entry, server.URL)
+	}
+	if entry.Time.Before(start.Add(-time.Second)) || entry.DurationMs < 0 || entry.DurationMs > float64(time.Since(start).Milliseconds()+1) {
+		t.Errorf("access log time %s and duration %.3fms, want the request started at %s", entry.Time, entry.DurationMs, start)
+	}
+}
+
+func TestTextAccessLogUsesCombinedFormat(t *testing.T) {
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "ok") })
+	out := &logBuffer{}
+	handler := startTestLoadBalancer(t, Config{Backends: []BackendConfig{{URL: server.URL}}, AccessLog: out}).Handler()
+
+	r := httptest.NewRequest(http.MethodGet, "/page?q=1", nil)
+	r.SetBasicAuth("alice", "secret")
+	r.Header.Set("Referer", "http://example.com/")
+	r.Header.Set("User-Agent", "test-agent")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	line := out.String()
+	for _, want := range []string{`192.0.2.1 - alice [`, `] "GET /page?q=1 HTTP/1.1" 200 2 "http://example.com/" "test-agent"`} {
+		if !strings.Contains(line, want) {
+			t.Errorf("access log %q does not contain %q", line, want)
+		}
+	}
+}
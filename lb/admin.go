@@ -0,0 +1,181 @@
+package lb
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// adminHandler serves the admin API, which is kept off the proxy listener. Strategies switched to
+// on the API start out with strategyConfig.
+func adminHandler(pool ServerPool, strategyConfig StrategyConfig) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", statsHandler(pool))
+	mux.HandleFunc("/version", versionHandler)
+	mux.HandleFunc("/config/strategy", strategyHandler(pool, strategyConfig))
+	mux.HandleFunc("/debug/connections", connectionsHandler(pool))
+	mux.HandleFunc("/pause", pauseHandler(pool, true))
+	mux.HandleFunc("/resume", pauseHandler(pool, false))
+	mux.HandleFunc("/group", groupHandler(pool))
+	mux.HandleFunc("/dial", dialHandler(pool))
+
+	backends := backendsHandler(pool)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Escaped backend URLs decode to paths containing "//", which ServeMux would redirect
+		if strings.HasPrefix(r.URL.Path, "/backends/") {
+			backends(w, r)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// backendsHandler serves actions on a single backend at /backends/{url}/{action},
+// where {url} is the path-escaped backend URL
+func backendsHandler(pool ServerPool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		escaped, action, _ := strings.Cut(strings.TrimPrefix(r.URL.EscapedPath(), "/backends/"), "/")
+		rawURL, err := url.PathUnescape(escaped)
+		if err != nil {
+			http.Error(w, "Invalid backend URL", http.StatusBadRequest)
+			return
+		}
+
+		backend := findBackend(pool, rawURL)
+		if backend == nil {
+			http.Error(w, "Backend server not found", http.StatusNotFound)
+			return
+		}
+
+		switch action {
+		case "breaker/reset":
+			if r.Method != http.MethodPost {
+				w.Header().Set("Allow", http.MethodPost)
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			backend.ResetBreaker()
+			w.WriteHeader(http.StatusNoContent)
+		case "cost":
+			if r.Method != http.MethodPut {
+				w.Header().Set("Allow", http.MethodPut)
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			var body struct {
+				Cost *float64 `json:"cost"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Cost == nil {
+				http.Error(w, `Expected a JSON body such as {"cost": 1.5}`, http.StatusBadRequest)
+				return
+			}
+			backend.SetCost(*body.Cost)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.NotFound(w, r)
+		}
+	}
+}
+
+// strategySettings describes the strategy of the pool on /config/strategy
+type strategySettings struct {
+	Name               string  `json:"name"`
+	Zone               string  `json:"zone"`
+	ErrorRateThreshold float64 `json:"errorRateThreshold"`
+	LatencyPercentile  float64 `json:"latencyPercentile"`
+	TieBreak           string  `json:"tieBreak"`
+	ExcludeLast        bool    `json:"excludeLast"`
+}
+
+// strategyHandler serves the name and settings of the pool's strategy on GET, and switches to
+// another strategy on PUT with a body such as {"name": "least-connections"}. Settings left out of
+// the body keep their current values. Routes with a strategy of their own keep it.
+func strategyHandler(pool ServerPool, config StrategyConfig) http.HandlerFunc {
+	var mutex sync.Mutex
+
+	settings := func() strategySettings {
+		name := "round-robin"
+		if strategy := pool.GetStrategy(); strategy != nil {
+			name = strategy.Name()
+		}
+		return strategySettings{
+			Name:               name,
+			Zone:               config.Zone,
+			ErrorRateThreshold: config.ErrorRateThreshold,
+			LatencyPercentile:  config.LatencyPercentile,
+			TieBreak:           config.TieBreak,
+			ExcludeLast:        config.ExcludeLast,
+		}
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			body := settings()
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, `Expected a JSON body such as {"name": "least-connections"}`, http.StatusBadRequest)
+				return
+			}
+			updated := StrategyConfig{
+				Zone:               body.Zone,
+				ErrorRateThreshold: body.ErrorRateThreshold,
+				LatencyPercentile:  body.LatencyPercentile,
+				TieBreak:           body.TieBreak,
+				ExcludeLast:        body.ExcludeLast,
+			}
+			strategy, err := NewStrategy(body.Name, updated)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			pool.SetStrategy(strategy)
+			config = updated
+			log.Printf("Switched to the %s strategy", body.Name)
+		default:
+			w.Header().Set("Allow", "GET, PUT")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(settings())
+	}
+}
+
+// pauseHandler pauses or resumes the pool
+func pauseHandler(pool ServerPool, pause bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if pause {
+			pool.Pause()
+			log.Println("Pool paused, rejecting requests")
+		} else {
+			pool.Resume()
+			log.Println("Pool resumed")
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// findBackend returns the backend in the pool with the given URL, or nil
+func findBackend(pool ServerPool, rawURL string) Backend {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil
+	}
+
+	backend, _ := pool.GetBackendByURL(u)
+	return backend
+}
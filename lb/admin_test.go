@@ -0,0 +1,181 @@
+package lb
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// getStats decodes the backends listed by /stats of balancer
+func getStats(t *testing.T, balancer *LoadBalancer) []BackendStats {
+	t.Helper()
+	var stats struct {
+		Backends []BackendStats `json:"backends"`
+	}
+	w := serve(balancer.AdminHandler(), http.MethodGet, "/stats")
+	if err := json.NewDecoder(w.Body).Decode(&stats); err != nil {
+		t.Fatalf("decoding /stats: %s", err)
+	}
+	return stats.Backends
+}
+
+func TestBreakerStateAndReset(t *testing.T) {
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	balancer := startTestLoadBalancer(t, Config{
+		Backends:         []BackendConfig{{URL: server.URL}},
+		BreakerThreshold: 2,
+	})
+
+	for i := 0; i < 2; i++ {
+		serve(balancer.Handler(), http.MethodGet, "/")
+	}
+	if stats := getStats(t, balancer); len(stats) != 1 || stats[0].Breaker != BreakerOpen {
+		t.Fatalf("/stats backends = %+v, want one backend with an open breaker", stats)
+	}
+
+	admin := balancer.AdminHandler()
+	target := "/backends/" + url.PathEscape(server.URL) + "/breaker/reset"
+	if w := serve(admin, http.MethodGet, target); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET %s = %d, want %d", target, w.Code, http.StatusMethodNotAllowed)
+	}
+	if w := serve(admin, http.MethodPost, "/backends/"+url.PathEscape("http://unknown:1")+"/breaker/reset"); w.Code != http.StatusNotFound {
+		t.Errorf("resetting an unknown backend = %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if w := serve(admin, http.MethodPost, target); w.Code != http.StatusNoContent {
+		t.Fatalf("POST %s = %d, want %d", target, w.Code, http.StatusNoContent)
+	}
+	if stats := getStats(t, balancer); stats[0].Breaker != BreakerClosed {
+		t.Errorf("breaker after reset = %s, want %s", stats[0].Breaker, BreakerClosed)
+	}
+}
+
+func TestLowestCostSelectionFollowsAdminUpdates(t *testing.T) {
+	var backends []BackendConfig
+	names := make(map[string]string)
+	for _, name := range []string{"a", "b", "c"} {
+		name := name
+		server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name)
+		})
+		backends = append(backends, BackendConfig{URL: server.URL})
+		names[name] = server.URL
+	}
+	balancer := startTestLoadBalancer(t, Config{Backends: backends, Strategy: "lowest-cost"})
+	admin := balancer.AdminHandler()
+	setCost := func(name, body string) int {
+		r := httptest.NewRequest(http.MethodPut, "/backends/"+url.PathEscape(names[name])+"/cost", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	for _, tt := range []struct {
+		costs map[string]string
+		want  string
+	}{
+		{map[string]string{"a": "5", "b": "2", "c": "9"}, "b"},
+		// A scraper reporting a deeper queue on b moves the traffic to the next cheapest
+		{map[string]string{"b": "7.5"}, "a"},
+		{map[string]string{"c": "0.5"}, "c"},
+	} {
+		for name, cost := range tt.costs {
+			if code := setCost(name, `{"cost": `+cost+`}`); code != http.StatusNoContent {
+				t.Fatalf("PUT cost %s of %s = %d, want %d", cost, name, code, http.StatusNoContent)
+			}
+		}
+		for i := 0; i < 3; i++ {
+			if got := serve(balancer.Handler(), http.MethodGet, "/").Body.String(); got != tt.want {
+				t.Errorf("after costs %v: request served by %q, want %q", tt.costs, got, tt.want)
+			}
+		}
+	}
+
+	// The cheapest backend is skipped while it is down
+	for _, backend := range balancer.pool.GetBackends() {
+		if backend.GetURL().String() == names["c"] {
+			backend.SetAlive(false)
+		}
+	}
+	if got := serve(balancer.Handler(), http.MethodGet, "/").Body.String(); got != "a" {
+		t.Errorf("with c down: request served by %q, want a", got)
+	}
+
+	if code := setCost("a", `{"weight": 1}`); code != http.StatusBadRequest {
+		t.Errorf("PUT without a cost = %d, want %d", code, http.StatusBadRequest)
+	}
+	if w := serve(admin, http.MethodGet, "/backends/"+url.PathEscape(names["a"])+"/cost"); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET cost = %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestStrategyIsReadAndSwitchedOnAdminAPI(t *testing.T) {
+	light := newTestServer(t, func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "light") })
+	heavy := newTestServer(t, func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "heavy") })
+	balancer := startTestLoadBalancer(t, Config{
+		Backends:       []BackendConfig{{URL: light.URL}, {URL: heavy.URL, Weight: intPtr(3)}},
+		StrategyConfig: StrategyConfig{TieBreak: "random"},
+	})
+	strategy := func(method, body string) (int, strategySettings) {
+		r := httptest.NewRequest(method, "/config/strategy", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		balancer.AdminHandler().ServeHTTP(w, r)
+		var settings strategySettings
+		json.Unmarshal(w.Body.Bytes(), &settings)
+		return w.Code, settings
+	}
+	heavyShare := func() int {
+		n := 0
+		for i := 0; i < 40; i++ {
+			if serve(balancer.Handler(), http.MethodGet, "/").Body.String() == "heavy" {
+				n++
+			}
+		}
+		return n
+	}
+
+	if code, settings := strategy(http.MethodGet, ""); code != http.StatusOK || settings.Name != "round-robin" || settings.TieBreak != "random" {
+		t.Errorf("GET strategy = %d %+v, want round-robin with the random tie break", code, settings)
+	}
+	if n := heavyShare(); n != 20 {
+		t.Errorf("round-robin sent %d of 40 requests to the heavy backend, want 20", n)
+	}
+
+	code, settings := strategy(http.MethodPut, `{"name": "smooth-weighted"}`)
+	if code != http.StatusOK || settings.Name != "smooth-weighted" || settings.TieBreak != "random" {
+		t.Errorf("PUT smooth-weighted = %d %+v, want smooth-weighted keeping the random tie break", code, settings)
+	}
+	if _, settings := strategy(http.MethodGet, ""); settings.Name != "smooth-weighted" {
+		t.Errorf("GET strategy after switching = %+v, want smooth-weighted", settings)
+	}
+	if n := heavyShare(); n != 30 {
+		t.Errorf("smooth-weighted sent %d of 40 requests to the heavy backend, want its weighted 30", n)
+	}
+
+	if code, _ := strategy(http.MethodPut, `{"name": "fastest"}`); code != http.StatusBadRequest {
+		t.Errorf("PUT of an unknown strategy = %d, want %d", code, http.StatusBadRequest)
+	}
+	if code, _ := strategy(http.MethodDelete, ""); code != http.StatusMethodNotAllowed {
+		t.Errorf("DELETE strategy = %d, want %d", code, http.StatusMethodNotAllowed)
+	}
+	if _, settings := strategy(http.MethodGet, ""); settings.Name != "smooth-weighted" {
+		t.Errorf("GET strategy after rejected updates = %+v, want smooth-weighted", settings)
+	}
+}
+
+func TestStatsAreOnlyServedOnAdminAPI(t *testing.T) {
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "backend") })
+	balancer := startTestLoadBalancer(t, Config{Backends: []BackendConfig{{URL: server.URL}}})
+
+	if got := serve(balancer.Handler(), http.MethodGet, "/stats").Body.String(); got != "backend" {
+		t.Errorf("GET /stats on the proxy = %q, want it proxied to the backend", got)
+	}
+	if stats := getStats(t, balancer); len(stats) != 1 || stats[0].URL != server.URL {
+		t.Errorf("GET /stats on the admin API = %+v, want the backend", stats)
+	}
+}
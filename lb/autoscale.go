@@ -0,0 +1,137 @@
+package lb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// AutoscaleConfig configures the webhook notified when the load on the backends calls for more of
+// them, and when it no longer does
+type AutoscaleConfig struct {
+	// WebhookURL receives a POST with an AutoscaleEvent when the signal changes, empty disables it
+	WebhookURL string
+	// HighWater is the number of active connections over all backends above which scaling up is
+	// signalled, once they have stayed above it for Sustain
+	HighWater int
+	// LowWater is the number of active connections at or below which the signal recovers, once
+	// they have stayed there for Sustain. Defaults to HighWater.
+	LowWater int
+	// Sustain is how long the connections must stay past a mark before the webhook fires,
+	// so that short bursts do not trigger it
+	Sustain time.Duration
+}
+
+// Autoscale event names
+const (
+	AutoscaleScaleUp   = "scale-up"
+	AutoscaleRecovered = "recovered"
+)
+
+// AutoscaleEvent is the payload posted to the autoscaling webhook
+type AutoscaleEvent struct {
+	Event             string    `json:"event"`
+	ActiveConnections int       `json:"activeConnections"`
+	HighWater         int       `json:"highWater"`
+	LowWater          int       `json:"lowWater"`
+	Time              time.Time `json:"time"`
+}
+
+// autoscaleSampleInterval is how often the active connections are compared to the marks
+const autoscaleSampleInterval = time.Second
+
+// autoscaleWebhookTimeout bounds each webhook call
+const autoscaleWebhookTimeout = 5 * time.Second
+
+// autoscaler tracks the active connections of a pool against the marks of an AutoscaleConfig
+type autoscaler struct {
+	config AutoscaleConfig
+	client *http.Client
+	// scaledUp is whether scaling up was signalled last, since is when the connections last
+	// crossed the mark that would change it, zero while they are on the side of the signal
+	scaledUp bool
+	since    time.Time
+}
+
+func newAutoscaler(config AutoscaleConfig) *autoscaler {
+	if config.LowWater <= 0 {
+		config.LowWater = config.HighWater
+	}
+	return &autoscaler{config: config, client: &http.Client{Timeout: autoscaleWebhookTimeout}}
+}
+
+// watch samples the active connections of pool at interval until ctx is done
+func (as *autoscaler) watch(ctx context.Context, pool ServerPool, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			active := 0
+			for _, stats := range pool.Snapshot() {
+				active += stats.ActiveConnections
+			}
+			as.sample(ctx, active, time.Now())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// sample records the active connections at now, calling the webhook when they have been past
+// the mark for long enough
+func (as *autoscaler) sample(ctx context.Context, active int, now time.Time) {
+	crossed := active > as.config.HighWater
+	if as.scaledUp {
+		crossed = active <= as.config.LowWater
+	}
+	if !crossed {
+		as.since = time.Time{}
+		return
+	}
+	if as.since.IsZero() {
+		as.since = now
+	}
+	if now.Sub(as.since) < as.config.Sustain {
+		return
+	}
+
+	as.scaledUp = !as.scaledUp
+	as.since = time.Time{}
+	event := AutoscaleEvent{Event: AutoscaleRecovered, ActiveConnections: active, HighWater: as.config.HighWater, LowWater: as.config.LowWater, Time: now}
+	if as.scaledUp {
+		event.Event = AutoscaleScaleUp
+	}
+	log.Printf("Autoscaling signal %s at %d active connections", event.Event, active)
+	if err := as.notify(ctx, event); err != nil {
+		log.Printf("Error calling the autoscaling webhook: %s", err)
+	}
+}
+
+// notify posts event to the webhook
+func (as *autoscaler) notify(ctx context.Context, event AutoscaleEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, as.config.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := as.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
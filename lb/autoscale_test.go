@@ -0,0 +1,107 @@
+package lb
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newWebhook starts a server collecting the autoscaling events posted to it
+func newWebhook(t *testing.T) (url string, events <-chan AutoscaleEvent) {
+	t.Helper()
+	received := make(chan AutoscaleEvent, 10)
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		var event AutoscaleEvent
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" || json.NewDecoder(r.Body).Decode(&event) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received <- event
+	})
+	return server.URL, received
+}
+
+func TestAutoscaleWebhookFiresOnceWhileConnectionsStayHigh(t *testing.T) {
+	release := make(chan struct{})
+	var held atomic.Int32
+	backend := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		held.Add(1)
+		<-release
+	})
+	balancer := startTestLoadBalancer(t, Config{Backends: []BackendConfig{{URL: backend.URL}}})
+	url, events := newWebhook(t)
+	config := AutoscaleConfig{WebhookURL: url, HighWater: 2, Sustain: 50 * time.Millisecond}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go newAutoscaler(config).watch(ctx, balancer.pool, 10*time.Millisecond)
+
+	// 3 held requests keep the active connections above the high-water mark
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serve(balancer.Handler(), http.MethodGet, "/")
+		}()
+	}
+	waitFor(t, "held requests did not reach the backend", func() bool { return held.Load() == 3 })
+
+	select {
+	case event := <-events:
+		if event.Event != AutoscaleScaleUp || event.ActiveConnections != 3 || event.HighWater != 2 || event.LowWater != 2 {
+			t.Errorf("event = %+v, want scale-up at 3 active connections with marks of 2", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("webhook not called while the connections stayed high")
+	}
+	select {
+	case event := <-events:
+		t.Errorf("webhook called again with %+v while the connections stayed high", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	wg.Wait()
+	select {
+	case event := <-events:
+		if event.Event != AutoscaleRecovered || event.ActiveConnections != 0 {
+			t.Errorf("event after the connections dropped = %+v, want recovered at 0", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("webhook not called once the connections dropped")
+	}
+}
+
+func TestAutoscaleIgnoresShortBursts(t *testing.T) {
+	url, events := newWebhook(t)
+	as := newAutoscaler(AutoscaleConfig{WebhookURL: url, HighWater: 10, LowWater: 5, Sustain: time.Minute})
+	start := time.Now()
+
+	for _, sample := range []struct {
+		active int
+		at     time.Duration
+	}{
+		// A burst shorter than the sustain window, then a sustained one
+		{20, 0}, {20, 30 * time.Second}, {4, 45 * time.Second},
+		{20, 2 * time.Minute}, {20, 3 * time.Minute},
+		// Dropping below the high-water mark but not to the low-water mark does not recover
+		{8, 4 * time.Minute}, {8, 6 * time.Minute},
+	} {
+		as.sample(context.Background(), sample.active, start.Add(sample.at))
+	}
+	if !as.scaledUp {
+		t.Fatal("not scaled up after 1m above the high-water mark")
+	}
+	if event := <-events; event.Event != AutoscaleScaleUp {
+		t.Errorf("event = %s, want %s", event.Event, AutoscaleScaleUp)
+	}
+	select {
+	case event := <-events:
+		t.Errorf("unexpected event %+v, the connections never stayed below the low-water mark", event)
+	default:
+	}
+}
@@ -0,0 +1,1865 @@
+package lb
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Backend defines the interface for a backend server
+type Backend interface {
+	ServeHTTP(w http.ResponseWriter, r *http.Request)
+	SetAlive(alive bool)
+	IsAlive() bool
+	SetDraining(draining bool)
+	IsDraining() bool
+	GetURL() *url.URL
+	GetActiveConnections() int
+	GetMaxConnections() int
+	IsSaturated() bool
+	IsThrottled() bool
+	ThrottledUntil() time.Time
+	GetLoad() float64
+	SetCost(cost float64)
+	GetCost() float64
+	GetErrorRate() float64
+	GetLatencyPercentile(p float64) time.Duration
+	GetBytesTransferred() (in, out int64)
+	GetSelfRedirects() int64
+	GetBreakerState() BreakerState
+	ResetBreaker()
+	Stats() BackendStats
+	InFlight() []InFlightRequest
+	SetWeight(weight int)
+	GetWeight() int
+	GetTags() map[string]string
+	GetZone() string
+	GetGroup() string
+	IsStandby() bool
+	GetConfig() BackendConfig
+	SetPromoted(promoted bool)
+	IsPromoted() bool
+	PerformHealthCheck(interval time.Duration)
+	WatchDrainFile(interval time.Duration)
+	KeepWarm()
+	RefreshDNS()
+	RecycleConnections()
+	WatchStaleness()
+	IsStale() bool
+	WatchMaintenance(interval time.Duration)
+	IsInMaintenance() bool
+	Stop()
+}
+
+// errBackendUnavailable is the error of an attempt on a backend that went down after being selected
+var errBackendUnavailable = errors.New("backend server is not available")
+
+// loadHeader is the response header backends may use to report their load
+const loadHeader = "X-Backend-Load"
+
+// loadSmoothing is the weight given to a new load sample in the moving average
+const loadSmoothing = 0.3
+
+// HostMode controls the Host header sent to a backend
+type HostMode string
+
+const (
+	// HostModeBackend sends the host of the backend URL
+	HostModeBackend HostMode = "backend"
+	// HostModePreserve sends the Host the client requested
+	HostModePreserve HostMode = "preserve"
+	// HostModeOverride sends an explicitly configured host
+	HostModeOverride HostMode = "override"
+)
+
+// DefaultMaxResponseHeaderBytes limits the size of backend response headers unless configured otherwise
+const DefaultMaxResponseHeaderBytes = 1 << 20
+
+// stateVersion is bumped whenever backends join or leave a pool or a backend's
+// selectability or weight changes, letting selection cache derived state
+var stateVersion atomic.Uint64
+
+// backend is a simple round-robin load balancer
+type backend struct {
+	URL               *url.URL
+	alive             bool
+	draining          bool
+	activeConnections int
+	// totalRequests counts the requests proxied to the backend
+	totalRequests int64
+	// inFlight holds the requests being proxied to the backend, keyed by their number in
+	// totalRequests
+	inFlight map[int64]InFlightRequest
+	// maxConnections stops the backend from being selected while it has this many active
+	// connections, 0 means no limit
+	maxConnections int
+	// rateLimit stops the backend from being selected while it has used up its requests per
+	// second, nil means no limit
+	rateLimit *tokenBucket
+	// ramp configures the requests let through after the backend recovers. ramping gates them
+	// until rampSucceeded reaches ramp.Stable, both are guarded by mutex and ramping is nil once
+	// the backend has full traffic.
+	ramp          RampConfig
+	ramping       *tokenBucket
+	rampSucceeded int
+	// resetConnectionsAfter closes the idle upstream connections after this many consecutive
+	// proxy errors, counted in proxyErrors under mutex. 0 never closes them.
+	resetConnectionsAfter int
+	proxyErrors           int
+	// selfHosts are the host names of the load balancer, redirects to them are counted in selfRedirects
+	selfHosts     map[string]bool
+	selfRedirects atomic.Int64
+	load          float64
+	// cost is a metric set from outside the load balancer, e.g. a queue depth, see CostStrategy
+	cost         float64
+	loadReported bool
+	bytesIn      atomic.Int64
+	bytesOut     atomic.Int64
+	weight       int
+	tags         map[string]string
+	zone         string
+	mutex        sync.RWMutex
+	reverseProxy *httputil.ReverseProxy
+	transport    *http.Transport
+	hostMode     HostMode
+	hostOverride string
+	// acceptEncoding rewrites the Accept-Encoding header of proxied requests, see rewriteAcceptEncoding
+	acceptEncoding string
+	// removeHeaders are removed from proxied requests, in addition to those of the route
+	removeHeaders []string
+	breaker       *circuitBreaker
+	responses     *errorWindow
+	responseHooks []ResponseHook
+	// statusRemap replaces backend response status codes on the way to the client
+	statusRemap    map[int]int
+	latencies      *latencyWindow
+	healthCheckURL string
+	// healthCheckURLs are all endpoints checked, combined by healthAggregation, starting with healthCheckURL
+	healthCheckURLs   []string
+	healthAggregation HealthAggregation
+	healthMethod      string
+	// healthBody is sent with every health check as healthContentType, nil sends no body
+	healthBody        []byte
+	healthContentType string
+	// healthLatencyThreshold marks the backend unhealthy when a health check is slower, 0 disables it
+	healthLatencyThreshold time.Duration
+	// healthStatusCodes are the health check responses that count as healthy
+	healthStatusCodes []int
+	healthMode        HealthMode
+	healthClient      *http.Client
+	// healthTransport is the health client's own transport, unless health checks go over transport
+	healthTransport *http.Transport
+	healthTimeout   time.Duration
+	// healthEvents receives the result of every health check, nil sends none
+	healthEvents chan<- HealthEvent
+	healthWindow *healthWindow
+	// staleAfter takes the backend out of rotation once its last passing health check is older,
+	// 0 disables it. lastHealthy and stale are guarded by mutex.
+	staleAfter  time.Duration
+	lastHealthy time.Time
+	stale       bool
+	// group is the deployment, e.g. blue or green, the backend belongs to, see SetActiveGroup
+	group string
+	// standby keeps the backend out of rotation unless promoted is set, which happens while too
+	// few primary backends are available. promoted is guarded by mutex.
+	standby  bool
+	promoted bool
+	// config is the BackendConfig the backend was created from, see WithConfig
+	config BackendConfig
+	// startupGracePeriod keeps failed health checks from counting against a backend that is still starting
+	startupGracePeriod time.Duration
+	// warmUpInterval and warmUpCount control the requests that keep idle upstream connections open,
+	// an interval of 0 disables them
+	warmUpInterval time.Duration
+	warmUpCount    int
+	// proxyProtocol sends a PROXY protocol header with the client address on every connection, empty disables it
+	proxyProtocol ProxyProtocol
+	// dnsDialer dials the backend by its resolved addresses, nil leaves name resolution to the transport
+	dnsDialer *dnsDialer
+	// connMaxAge is the lifetime after which idle upstream connections are closed, 0 keeps them
+	// open for as long as the transport does. conns tracks their age.
+	connMaxAge time.Duration
+	conns      *connTracker
+	// drainFile drains the backend while it exists, empty disables watching
+	drainFile string
+	// maintenanceWindows take the backend out of rotation without counting failed health checks,
+	// inMaintenance is set while one of them is active and guarded by mutex
+	maintenanceWindows []MaintenanceWindow
+	inMaintenance      bool
+	stop               chan struct{}
+	stopOnce           sync.Once
+}
+
+// BackendOption configures optional behaviour of a backend
+type BackendOption func(*backend)
+
+// WithHealthLatencyThreshold fails health checks that take longer than threshold
+func WithHealthLatencyThreshold(threshold time.Duration) BackendOption {
+	return func(b *backend) {
+		b.healthLatencyThreshold = threshold
+	}
+}
+
+// WithHealthWindow marks the backend unhealthy when more than maxFailureRate of its last
+// size health checks failed, by default a single failed check marks it unhealthy
+func WithHealthWindow(size int, maxFailureRate float64) BackendOption {
+	return func(b *backend) {
+		b.healthWindow = newHealthWindow(size, maxFailureRate)
+	}
+}
+
+// WithStartupGracePeriod keeps the backend out of rotation until a health check passes, ignoring
+// failed checks for up to period after health checking starts
+func WithStartupGracePeriod(period time.Duration) BackendOption {
+	return func(b *backend) {
+		b.startupGracePeriod = period
+	}
+}
+
+// WithHealthEndpoints checks each of the given paths instead of /health, combining their results
+// with aggregation. Without paths the backend keeps checking /health only.
+func WithHealthEndpoints(paths []string, aggregation HealthAggregation) BackendOption {
+	return func(b *backend) {
+		if aggregation != "" {
+			b.healthAggregation = aggregation
+		}
+		if len(paths) == 0 {
+			return
+		}
+
+		base := strings.TrimSuffix(b.URL.String(), "/")
+		b.healthCheckURLs = make([]string, len(paths))
+		for i, path := range paths {
+			b.healthCheckURLs[i] = base + path
+		}
+		b.healthCheckURL = b.healthCheckURLs[0]
+	}
+}
+
+// WithHealthMethod sets the HTTP method of health checks, e.g. HEAD for backends that should
+// not generate a body. Empty keeps GET.
+func WithHealthMethod(method string) BackendOption {
+	return func(b *backend) {
+		if method != "" {
+			b.healthMethod = method
+		}
+	}
+}
+
+// WithHealthTimeout bounds each health check, which fails when the backend takes longer to
+// respond. Zero keeps the default of 5s.
+func WithHealthTimeout(timeout time.Duration) BackendOption {
+	return func(b *backend) {
+		if timeout > 0 {
+			b.healthTimeout = timeout
+		}
+	}
+}
+
+// WithHealthEvents sends the result of every health check to events. Events are dropped while
+// the channel is full, give it a buffer to ride out a slow consumer.
+func WithHealthEvents(events chan<- HealthEvent) BackendOption {
+	return func(b *backend) {
+		b.healthEvents = events
+	}
+}
+
+// WithHealthBody sends body with every health check, with the given Content-Type or else
+// application/json, for readiness endpoints that expect a POST payload. An empty body sends none.
+func WithHealthBody(body, contentType string) BackendOption {
+	return func(b *backend) {
+		if body == "" {
+			return
+		}
+		if contentType == "" {
+			contentType = "application/json"
+		}
+		b.healthBody = []byte(body)
+		b.healthContentType = contentType
+	}
+}
+
+// WithWarmUp sends count concurrent requests to the health check URL every interval, keeping
+// that many idle connections to the backend open for proxied requests. The transport is allowed
+// at least count idle connections so the warmed connections are not closed.
+func WithWarmUp(interval time.Duration, count int) BackendOption {
+	return func(b *backend) {
+		b.warmUpInterval = interval
+		b.warmUpCount = count
+
+		idle := b.transport.MaxIdleConnsPerHost
+		if idle <= 0 {
+			idle = http.DefaultMaxIdleConnsPerHost
+		}
+		if interval > 0 && count > idle {
+			b.transport.MaxIdleConnsPerHost = count
+		}
+	}
+}
+
+// WithResponseHooks runs hooks, in order, over every response from the backend before it is
+// sent to the client
+func WithResponseHooks(hooks ...ResponseHook) BackendOption {
+	return func(b *backend) {
+		b.responseHooks = append(b.responseHooks, hooks...)
+	}
+}
+
+// WithStatusRemap sends clients the status code remap maps a backend response status code to,
+// e.g. 418 to 400. Codes already remapped keep their mapping, so the options of a single
+// backend take precedence over those shared by all backends.
+func WithStatusRemap(remap map[int]int) BackendOption {
+	return func(b *backend) {
+		if len(remap) == 0 {
+			return
+		}
+		if b.statusRemap == nil {
+			b.statusRemap = make(map[int]int, len(remap))
+		}
+		for from, to := range remap {
+			if _, ok := b.statusRemap[from]; !ok {
+				b.statusRemap[from] = to
+			}
+		}
+	}
+}
+
+// WithDNSRefresh resolves the backend host name every interval, so new connections follow changes
+// of its addresses and idle connections to addresses it no longer has are closed. An interval of
+// 0 leaves name resolution to the transport.
+func WithDNSRefresh(interval time.Duration) BackendOption {
+	return func(b *backend) {
+		if interval <= 0 {
+			return
+		}
+		b.dnsDialer = newDNSDialer(net.DefaultResolver, interval)
+		b.transport.DialContext = b.dnsDialer.DialContext
+	}
+}
+
+// WithConnectionMaxAge closes idle upstream connections once they have been open for longer than
+// maxAge, so that connections are recycled even under steady traffic. A maxAge of 0 disables it.
+func WithConnectionMaxAge(maxAge time.Duration) BackendOption {
+	return func(b *backend) {
+		b.connMaxAge = maxAge
+	}
+}
+
+// WithStaleness stops trusting the last known state of the backend once it has not passed a
+// health check for longer than after, e.g. because health checks are stuck, and keeps it out of
+// rotation until one passes again. An after of 0 disables it.
+func WithStaleness(after time.Duration) BackendOption {
+	return func(b *backend) {
+		b.staleAfter = after
+	}
+}
+
+// WithMaxConnections caps the active connections of the backend, it is not selected while it has
+// max of them. A max of 0 leaves it uncapped.
+func WithMaxConnections(max int) BackendOption {
+	return func(b *backend) {
+		b.maxConnections = max
+	}
+}
+
+// WithMaxRPS caps the requests sent to the backend at rps per second, with bursts of up to a
+// second's worth. The backend is not selected while the cap is used up. 0 means no cap.
+func WithMaxRPS(rps float64) BackendOption {
+	return func(b *backend) {
+		if rps > 0 {
+			b.rateLimit = newTokenBucket(rps, math.Max(rps, 1))
+		}
+	}
+}
+
+// WithConnectionReset closes the idle connections to the backend after errors consecutive
+// failed attempts to proxy to it, so that it is not sent requests on half-broken connections once
+// it recovers. 0 keeps the connections.
+func WithConnectionReset(errors int) BackendOption {
+	return func(b *backend) {
+		b.resetConnectionsAfter = errors
+	}
+}
+
+// WithRamp lets only config.Requests requests per config.Interval through to the backend once
+// it recovers from failed health checks, until config.Stable of them in a row succeed
+func WithRamp(config RampConfig) BackendOption {
+	return func(b *backend) {
+		if config.Requests <= 0 {
+			return
+		}
+		if config.Interval <= 0 {
+			config.Interval = Duration(time.Second)
+		}
+		if config.Stable <= 0 {
+			config.Stable = config.Requests
+		}
+		b.ramp = config
+	}
+}
+
+// WithSelfRedirectDetection logs a warning and counts a self redirect whenever the backend
+// redirects to one of hosts, the host names of the load balancer, which can send clients round
+// in a loop. No hosts disables the detection.
+func WithSelfRedirectDetection(hosts []string) BackendOption {
+	return func(b *backend) {
+		b.selfHosts = hostSet(hosts)
+	}
+}
+
+// WithProxyProtocol starts every connection to the backend with a PROXY protocol header of the
+// given version carrying the client address. Connections are then not reused, as each one carries
+// the address of the client it was opened for. An empty version disables the header.
+func WithProxyProtocol(version ProxyProtocol) BackendOption {
+	return func(b *backend) {
+		b.proxyProtocol = version
+	}
+}
+
+// WithAcceptEncoding sets the Accept-Encoding header of requests to the backend to value, or removes
+// it when value is "strip". An empty value forwards the client's header.
+func WithAcceptEncoding(value string) BackendOption {
+	return func(b *backend) {
+		b.acceptEncoding = value
+	}
+}
+
+// WithRemovedHeaders removes the named headers from requests before they are sent to the backend,
+// e.g. internal credentials that must not leak to it
+func WithRemovedHeaders(names ...string) BackendOption {
+	return func(b *backend) {
+		b.removeHeaders = names
+	}
+}
+
+// WithTags labels the backend with metadata such as region=us-east, used to restrict selection
+func WithTags(tags map[string]string) BackendOption {
+	return func(b *backend) {
+		b.tags = make(map[string]string, len(tags))
+		for key, value := range tags {
+			b.tags[key] = value
+		}
+	}
+}
+
+// WithZone places the backend in an availability zone for locality-aware selection
+func WithZone(zone string) BackendOption {
+	return func(b *backend) {
+		b.zone = zone
+	}
+}
+
+// WithGroup places the backend in a group of backends, e.g. blue or green, that receives
+// requests only while it is the active group of the pool
+func WithGroup(group string) BackendOption {
+	return func(b *backend) {
+		b.group = group
+	}
+}
+
+// WithStandby makes the backend a standby, which only receives requests while too few primary
+// backends are available
+func WithStandby(standby bool) BackendOption {
+	return func(b *backend) {
+		b.standby = standby
+	}
+}
+
+// WithConfig records the BackendConfig the backend is created from, so that a reload can tell
+// whether it changed, see ApplyConfig
+func WithConfig(config BackendConfig) BackendOption {
+	return func(b *backend) {
+		b.config = config
+	}
+}
+
+// WithKeepAlive tunes reuse of the upstream connections to the backend
+func WithKeepAlive(config KeepAliveConfig) BackendOption {
+	return func(b *backend) {
+		b.transport.DisableKeepAlives = config.Disable
+		if config.MaxIdleConns > 0 {
+			b.transport.MaxIdleConnsPerHost = config.MaxIdleConns
+		}
+		if config.IdleTimeout > 0 {
+			b.transport.IdleConnTimeout = time.Duration(config.IdleTimeout)
+		}
+	}
+}
+
+// WithMaxResponseHeaderBytes limits the size of the response headers accepted from the backend,
+// larger responses fail with 502 Bad Gateway
+func WithMaxResponseHeaderBytes(limit int64) BackendOption {
+	return func(b *backend) {
+		if limit > 0 {
+			b.transport.MaxResponseHeaderBytes = limit
+		}
+	}
+}
+
+// WithHealthStatusCodes sets the health check status codes that count as healthy, replacing the default of 200
+func WithHealthStatusCodes(codes ...int) BackendOption {
+	return func(b *backend) {
+		if len(codes) > 0 {
+			b.healthStatusCodes = codes
+		}
+	}
+}
+
+// WithHealthMode sets which health check responses count as healthy, HealthModeStrict by default
+func WithHealthMode(mode HealthMode) BackendOption {
+	return func(b *backend) {
+		if mode != "" {
+			b.healthMode = mode
+		}
+	}
+}
+
+// WithDrainFile drains the backend while a marker file exists at path
+func WithDrainFile(path string) BackendOption {
+	return func(b *backend) {
+		b.drainFile = path
+	}
+}
+
+// WithMaintenanceWindows schedules periods of maintenance of the backend, during which it is
+// treated as drained and failed health checks do not mark it unhealthy
+func WithMaintenanceWindows(windows ...MaintenanceWindow) BackendOption {
+	return func(b *backend) {
+		b.maintenanceWindows = append(b.maintenanceWindows, windows...)
+	}
+}
+
+// WithHostMode sets the Host header sent to the backend, host is only used by HostModeOverride
+func WithHostMode(mode HostMode, host string) BackendOption {
+	return func(b *backend) {
+		if mode != "" {
+			b.hostMode = mode
+		}
+		b.hostOverride = host
+	}
+}
+
+// WithCircuitBreaker takes the backend out of rotation for cooldown after threshold consecutive
+// failed requests, a threshold of 0 disables the breaker
+func WithCircuitBreaker(threshold int, cooldown time.Duration) BackendOption {
+	return func(b *backend) {
+		b.breaker = newCircuitBreaker(threshold, cooldown)
+	}
+}
+
+func NewBackend(URL string, opts ...BackendOption) Backend {
+	u, err := url.Parse(URL)
+	if err != nil {
+		panic(err)
+	}
+
+	b := &backend{
+		URL:               u,
+		alive:             true,
+		weight:            1,
+		inFlight:          make(map[int64]InFlightRequest),
+		reverseProxy:      httputil.NewSingleHostReverseProxy(u),
+		transport:         http.DefaultTransport.(*http.Transport).Clone(),
+		breaker:           newCircuitBreaker(0, 0),
+		responses:         newErrorWindow(errorWindowSize),
+		latencies:         newLatencyWindow(latencyWindowSize),
+		healthCheckURL:    URL + "/health", // Assuming a simple health check endpoint at /health
+		healthAggregation: HealthAggregationAll,
+		healthMethod:      http.MethodGet,
+		healthStatusCodes: []int{http.StatusOK},
+		healthMode:        HealthModeStrict,
+		healthTimeout:     defaultHealthTimeout,
+		healthClient: &http.Client{
+			// Redirects are not followed so the health check reflects the endpoint itself
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		healthWindow: newHealthWindow(1, 0),
+		lastHealthy:  time.Now(),
+		stop:         make(chan struct{}),
+	}
+	b.transport.MaxResponseHeaderBytes = DefaultMaxResponseHeaderBytes
+	b.reverseProxy.Transport = b.transport
+	b.reverseProxy.Director = b.director(b.reverseProxy.Director)
+	b.reverseProxy.ModifyResponse = b.modifyResponse
+	b.reverseProxy.ErrorHandler = b.errorHandler
+	b.reverseProxy.ErrorLog = log.New(proxyLogWriter{backend: u}, "", 0)
+
+	for _, opt := range opts {
+		opt(b)
+	}
+	if len(b.healthCheckURLs) == 0 {
+		b.healthCheckURLs = []string{b.healthCheckURL}
+	}
+	b.healthTransport = newHealthTransport(len(b.healthCheckURLs), b.healthTimeout)
+	b.healthClient.Transport = b.healthTransport
+	b.healthClient.Timeout = b.healthTimeout
+
+	// Wrapping the dialer last keeps the header in front of whichever dialer the options set up
+	if b.proxyProtocol != "" {
+		b.transport.DialContext = proxyProtocolDialer(b.proxyProtocol, b.transport.DialContext)
+		b.transport.DisableKeepAlives = true
+		// Health checks have to speak the PROXY protocol too, they go without a client address
+		b.healthClient.Transport = b.transport
+	}
+	if b.connMaxAge > 0 {
+		b.conns = newConnTracker()
+		b.transport.DialContext = b.conns.dialer(b.transport.DialContext)
+	}
+
+	// A starting backend only joins the rotation once it passes a health check
+	if b.startupGracePeriod > 0 {
+		b.alive = false
+	}
+
+	return b
+}
+
+func (b *backend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Only NewBackend sets up the proxy, answer rather than panic for a backend made any other way
+	if b.reverseProxy == nil {
+		log.Printf("Backend %s has no reverse proxy, it must be created with NewBackend", b.URL)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	// Forward the request to the backend server
+	b.mutex.Lock()
+	if !b.alive {
+		b.mutex.Unlock()
+		// The backend went down after it was selected, another one may still be tried
+		if attempt, ok := r.Context().Value(proxyAttemptKey{}).(*proxyAttempt); ok {
+			attempt.err = errBackendUnavailable
+			if attempt.retryable {
+				return
+			}
+		}
+		http.Error(w, "Backend server is not available", http.StatusServiceUnavailable)
+		return
+	}
+	b.activeConnections++
+	b.totalRequests++
+	if b.rateLimit != nil {
+		b.rateLimit.take()
+	}
+	if b.ramping != nil {
+		b.ramping.take()
+	}
+	id := b.totalRequests
+	b.inFlight[id] = InFlightRequest{ID: id, Method: r.Method, Path: r.URL.Path, ClientIP: ClientIP(r), Start: time.Now()}
+	b.mutex.Unlock()
+
+	// The reverse proxy panics with http.ErrAbortHandler when copying a response is aborted, the
+	// request must not stay counted as active then
+	defer func() {
+		b.mutex.Lock()
+		b.activeConnections--
+		delete(b.inFlight, id)
+		b.mutex.Unlock()
+		slotReleased.notify()
+	}()
+
+	// Count the body bytes sent to and received from the backend server
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = &countingReader{ReadCloser: r.Body, count: &b.bytesIn}
+	}
+	w = &countingResponseWriter{ResponseWriter: w, count: &b.bytesOut}
+
+	// Routes may flush responses differently, the proxy is copied to override FlushInterval
+	proxy := b.reverseProxy
+	if attempt, ok := r.Context().Value(proxyAttemptKey{}).(*proxyAttempt); ok {
+		if flushInterval := attempt.route.flushInterval(); flushInterval != 0 {
+			routeProxy := *proxy
+			routeProxy.FlushInterval = flushInterval
+			proxy = &routeProxy
+		}
+	}
+
+	// The lock is not held while proxying so that response hooks can update the backend
+	ctx := withRequestStart(r.Context())
+	if b.proxyProtocol != "" {
+		ctx = context.WithValue(ctx, clientAddrKey{}, r.RemoteAddr)
+	}
+	if b.conns != nil {
+		ctx = b.conns.trace(ctx)
+	}
+	proxy.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// InFlight returns the requests being proxied to the backend, oldest first
+func (b *backend) InFlight() []InFlightRequest {
+	b.mutex.RLock()
+	requests := make([]InFlightRequest, 0, len(b.inFlight))
+	for _, request := range b.inFlight {
+		requests = append(requests, request)
+	}
+	b.mutex.RUnlock()
+
+	sort.Slice(requests, func(i, j int) bool {
+		return requests[i].ID < requests[j].ID
+	})
+	return requests
+}
+
+// director wraps the default reverse proxy director to rewrite the path according to the
+// matched route and to set the Host header of the outgoing request
+func (b *backend) director(director func(*http.Request)) func(*http.Request) {
+	return func(req *http.Request) {
+		// The path is rewritten before the default director joins it to the backend URL path
+		acceptEncoding := b.acceptEncoding
+		var routeRemoveHeaders []string
+		if attempt, ok := req.Context().Value(proxyAttemptKey{}).(*proxyAttempt); ok {
+			attempt.route.rewritePath(req.URL)
+			if attempt.route.AcceptEncoding != "" {
+				acceptEncoding = attempt.route.AcceptEncoding
+			}
+			routeRemoveHeaders = attempt.route.RemoveHeaders
+		}
+
+		director(req)
+		injectTraceContext(req)
+		rewriteAcceptEncoding(req, acceptEncoding)
+		for _, name := range b.removeHeaders {
+			req.Header.Del(name)
+		}
+		for _, name := range routeRemoveHeaders {
+			req.Header.Del(name)
+		}
+
+		switch b.hostMode {
+		case HostModePreserve:
+			// The outgoing request already carries the client's Host
+		case HostModeOverride:
+			req.Host = b.hostOverride
+		default:
+			req.Host = b.URL.Host
+		}
+	}
+}
+
+// acceptEncodingStrip removes the Accept-Encoding header from proxied requests
+const acceptEncodingStrip = "strip"
+
+// rewriteAcceptEncoding applies an Accept-Encoding policy to an outgoing request: empty keeps the
+// client's header, "strip" removes it and anything else replaces it, e.g. "identity" to have the
+// backend send uncompressed responses
+func rewriteAcceptEncoding(req *http.Request, policy string) {
+	switch policy {
+	case "":
+	case acceptEncodingStrip:
+		req.Header.Del("Accept-Encoding")
+	default:
+		req.Header.Set("Accept-Encoding", policy)
+	}
+}
+
+// modifyResponse inspects responses coming back from the backend server
+func (b *backend) modifyResponse(resp *http.Response) error {
+	if resp.StatusCode >= http.StatusInternalServerError {
+		b.breaker.RecordFailure()
+	} else {
+		b.breaker.RecordSuccess()
+	}
+	b.responses.Record(resp.StatusCode >= http.StatusInternalServerError)
+	b.recordRampResult(resp.StatusCode < http.StatusInternalServerError)
+	b.recordProxyResult(true)
+	if latency, ok := requestDuration(resp.Request.Context()); ok {
+		b.latencies.Record(latency)
+	}
+
+	if value := resp.Header.Get(loadHeader); value != "" {
+		if load, err := strconv.ParseFloat(value, 64); err == nil && load >= 0 {
+			b.recordLoad(load)
+		}
+	}
+
+	if location, ok := selfRedirectTarget(resp, b.selfHosts); ok {
+		b.selfRedirects.Add(1)
+		log.Printf("Warning: %s redirected %s to the load balancer itself (%s), clients may be caught in a redirect loop", b.URL, resp.Request.URL.Path, location)
+	}
+
+	// The breaker and error rate above go by what the backend answered, the client and the
+	// response hooks see the remapped status
+	if to, ok := b.statusRemap[resp.StatusCode]; ok {
+		resp.StatusCode = to
+		resp.Status = fmt.Sprintf("%d %s", to, http.StatusText(to))
+	}
+
+	for _, hook := range b.responseHooks {
+		if err := hook(resp); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// errorHandler handles failures to proxy a request to the backend server, leaving the
+// response untouched when the handler is going to retry on another backend
+func (b *backend) errorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	// A client going away says nothing about the health of the backend. The upstream request
+	// was cancelled along with the client's, so the backend can stop working on it.
+	if errors.Is(r.Context().Err(), context.Canceled) {
+		log.Printf("Client went away, cancelled request to %s", b.URL)
+	} else {
+		log.Printf("Error proxying to %s: %s", b.URL, err)
+		b.breaker.RecordFailure()
+		b.responses.Record(true)
+		b.recordRampResult(false)
+		b.recordProxyResult(false)
+	}
+
+	// A timed out request took at least this long, leaving it out would make a backend that
+	// stops responding look fast
+	if errors.Is(err, context.DeadlineExceeded) {
+		if latency, ok := requestDuration(r.Context()); ok {
+			b.latencies.Record(latency)
+		}
+	}
+
+	// Nothing is listening on the backend, take it out of rotation right away rather than
+	// waiting for the next health check, which restores it once it is back
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		log.Printf("Connection to %s refused, marking it as dead", b.URL)
+		b.SetAlive(false)
+	}
+
+	if attempt, ok := r.Context().Value(proxyAttemptKey{}).(*proxyAttempt); ok {
+		attempt.err = err
+		if attempt.retryable {
+			return
+		}
+	}
+
+	// Timeouts, of the attempt or of the whole request, are told apart from other failures of
+	// the backend
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(r.Context().Err(), context.DeadlineExceeded) {
+		w.WriteHeader(http.StatusGatewayTimeout)
+		return
+	}
+	w.WriteHeader(http.StatusBadGateway)
+}
+
+// proxyLogWriter forwards the reverse proxy's own log messages, such as errors copying a response
+// body, to the standard logger with the backend they concern
+type proxyLogWriter struct {
+	backend *url.URL
+}
+
+func (pw proxyLogWriter) Write(p []byte) (int, error) {
+	log.Printf("Proxy error for %s: %s", pw.backend, strings.TrimSpace(string(p)))
+	return len(p), nil
+}
+
+// recordLoad folds a reported load sample into the smoothed load value
+func (b *backend) recordLoad(load float64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if !b.loadReported {
+		b.load = load
+		b.loadReported = true
+		return
+	}
+	b.load = loadSmoothing*load + (1-loadSmoothing)*b.load
+}
+
+func (b *backend) SetAlive(alive bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.alive != alive {
+		b.alive = alive
+		stateVersion.Add(1)
+		if alive {
+			slotReleased.notify()
+		}
+		if alive && b.ramp.Requests > 0 {
+			log.Printf("%s recovered, ramping up from %d requests per %s", b.URL, b.ramp.Requests, time.Duration(b.ramp.Interval))
+			b.ramping = newTokenBucket(float64(b.ramp.Requests)/time.Duration(b.ramp.Interval).Seconds(), float64(b.ramp.Requests))
+			b.rampSucceeded = 0
+		}
+	}
+}
+
+// recordProxyResult counts consecutive failed attempts to proxy to the backend, closing its idle
+// connections once there are resetConnectionsAfter of them. Any response from the backend, even
+// a 5xx, proves the connection works and clears the count.
+func (b *backend) recordProxyResult(success bool) {
+	if b.resetConnectionsAfter <= 0 {
+		return
+	}
+
+	b.mutex.Lock()
+	if success {
+		b.proxyErrors = 0
+		b.mutex.Unlock()
+		return
+	}
+	b.proxyErrors++
+	reset := b.proxyErrors >= b.resetConnectionsAfter
+	if reset {
+		b.proxyErrors = 0
+	}
+	b.mutex.Unlock()
+
+	if reset {
+		log.Printf("%d errors in a row proxying to %s, closing idle connections", b.resetConnectionsAfter, b.URL)
+		b.transport.CloseIdleConnections()
+	}
+}
+
+// recordRampResult counts a request towards the backend proving stable after it recovered
+func (b *backend) recordRampResult(success bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.ramping == nil {
+		return
+	}
+	if !success {
+		b.rampSucceeded = 0
+		return
+	}
+	if b.rampSucceeded++; b.rampSucceeded >= b.ramp.Stable {
+		log.Printf("%s proved stable after %d successful requests, sending it full traffic", b.URL, b.rampSucceeded)
+		b.ramping = nil
+	}
+}
+
+func (b *backend) IsAlive() bool {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return b.alive
+}
+
+// SetDraining stops new requests from being sent to the backend while draining is set
+func (b *backend) SetDraining(draining bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.draining != draining {
+		b.draining = draining
+		stateVersion.Add(1)
+	}
+}
+
+// IsDraining reports whether the backend is being drained
+func (b *backend) IsDraining() bool {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return b.draining
+}
+
+func (b *backend) GetURL() *url.URL {
+	return b.URL
+}
+
+func (b *backend) GetActiveConnections() int {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return b.activeConnections
+}
+
+// IsThrottled reports whether the backend has used up its requests per second, see WithMaxRPS,
+// or the requests it is let through while ramping up after it recovered, see WithRamp
+func (b *backend) IsThrottled() bool {
+	if b.rateLimit != nil && !b.rateLimit.ready() {
+		return true
+	}
+	b.mutex.RLock()
+	ramping := b.ramping
+	b.mutex.RUnlock()
+	return ramping != nil && !ramping.ready()
+}
+
+// ThrottledUntil returns when the backend is next let a request through by its caps on requests,
+// see IsThrottled, or the zero time if it is not throttled
+func (b *backend) ThrottledUntil() time.Time {
+	var until time.Time
+	b.mutex.RLock()
+	ramping := b.ramping
+	b.mutex.RUnlock()
+	for _, bucket := range []*tokenBucket{b.rateLimit, ramping} {
+		if bucket == nil {
+			continue
+		}
+		if at := bucket.nextToken(); at.After(until) {
+			until = at
+		}
+	}
+	return until
+}
+
+// GetMaxConnections returns the cap on active connections of the backend, 0 if it is uncapped
+func (b *backend) GetMaxConnections() int {
+	return b.maxConnections
+}
+
+// IsSaturated reports whether the backend has reached its cap on active connections or has used
+// up its requests per second
+func (b *backend) IsSaturated() bool {
+	if b.IsThrottled() {
+		return true
+	}
+	if b.maxConnections <= 0 {
+		return false
+	}
+
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return b.activeConnections >= b.maxConnections
+}
+
+// GetLoad returns the smoothed load reported by the backend, or 0 if it never reported one
+func (b *backend) GetLoad() float64 {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return b.load
+}
+
+// SetCost sets the cost of sending a request to the backend, compared by CostStrategy
+func (b *backend) SetCost(cost float64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.cost = cost
+}
+
+// GetCost returns the cost set with SetCost, 0 if none was set
+func (b *backend) GetCost() float64 {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return b.cost
+}
+
+// GetErrorRate returns the fraction of the backend's recent responses that were 5xx or proxy errors
+func (b *backend) GetErrorRate() float64 {
+	return b.responses.Rate()
+}
+
+// GetLatencyPercentile returns the response time of the backend at percentile p, between 0 and 1,
+// over its recent responses, or 0 if it has not responded yet
+func (b *backend) GetLatencyPercentile(p float64) time.Duration {
+	return b.latencies.Percentile(p)
+}
+
+// GetBytesTransferred returns the request body bytes sent to the backend and the
+// response body bytes received from it
+func (b *backend) GetBytesTransferred() (in, out int64) {
+	return b.bytesIn.Load(), b.bytesOut.Load()
+}
+
+// GetSelfRedirects returns how many times the backend redirected to the load balancer itself
+func (b *backend) GetSelfRedirects() int64 {
+	return b.selfRedirects.Load()
+}
+
+// GetBreakerState returns the state of the backend's circuit breaker
+func (b *backend) GetBreakerState() BreakerState {
+	return b.breaker.State()
+}
+
+// Stats returns the state of the backend, read in one go under its lock so that the numbers do
+// not mix states from before and after a request. Getters taking the lock again are not called,
+// as a read lock must not be taken twice.
+func (b *backend) Stats() BackendStats {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	bytesIn, bytesOut := b.GetBytesTransferred()
+	return BackendStats{
+		URL:               b.URL.String(),
+		Alive:             b.alive,
+		Draining:          b.draining,
+		Stale:             b.stale,
+		Standby:           b.standby,
+		Promoted:          b.standby && b.promoted,
+		Maintenance:       b.inMaintenance,
+		Breaker:           b.breaker.State(),
+		Weight:            b.weight,
+		ActiveConnections: b.activeConnections,
+		Throttled:         (b.rateLimit != nil && !b.rateLimit.ready()) || (b.ramping != nil && !b.ramping.ready()),
+		TotalRequests:     b.totalRequests,
+		Load:              b.load,
+		Cost:              b.cost,
+		ErrorRate:         b.responses.Rate(),
+		LatencyP50Ms:      float64(b.latencies.Percentile(0.5)) / float64(time.Millisecond),
+		LatencyP99Ms:      float64(b.latencies.Percentile(0.99)) / float64(time.Millisecond),
+		BytesIn:           bytesIn,
+		BytesOut:          bytesOut,
+		SelfRedirects:     b.selfRedirects.Load(),
+	}
+}
+
+// ResetBreaker forces the backend's circuit breaker closed
+func (b *backend) ResetBreaker() {
+	b.breaker.Reset()
+}
+
+// SetWeight sets the relative share of traffic the backend should receive
+func (b *backend) SetWeight(weight int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.weight != weight {
+		b.weight = weight
+		stateVersion.Add(1)
+	}
+}
+
+// GetWeight returns the relative share of traffic the backend should receive
+func (b *backend) GetWeight() int {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return b.weight
+}
+
+// GetTags returns a copy of the labels the backend was created with
+func (b *backend) GetTags() map[string]string {
+	tags := make(map[string]string, len(b.tags))
+	for key, value := range b.tags {
+		tags[key] = value
+	}
+	return tags
+}
+
+// GetZone returns the availability zone of the backend, empty if unknown
+func (b *backend) GetZone() string {
+	return b.zone
+}
+
+// GetGroup returns the group of the backend, empty if it belongs to none
+func (b *backend) GetGroup() string {
+	return b.group
+}
+
+// IsStandby reports whether the backend is a standby, see WithStandby
+func (b *backend) IsStandby() bool {
+	return b.standby
+}
+
+// GetConfig returns the BackendConfig the backend was created from, the zero BackendConfig for a
+// backend created without WithConfig
+func (b *backend) GetConfig() BackendConfig {
+	return b.config
+}
+
+// SetPromoted puts a standby backend into rotation while promoted is set
+func (b *backend) SetPromoted(promoted bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.promoted != promoted {
+		b.promoted = promoted
+		stateVersion.Add(1)
+	}
+}
+
+// IsPromoted reports whether a standby backend has been put into rotation
+func (b *backend) IsPromoted() bool {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return b.promoted
+}
+
+// HasTags reports whether the backend carries every one of the given labels
+func HasTags(backend Backend, tags map[string]string) bool {
+	backendTags := backend.GetTags()
+	for key, value := range tags {
+		if backendTags[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// PerformHealthCheck periodically checks if the backend server is alive until Stop is called.
+// Checks run one after another, and a tick that came while a slow check was in flight is skipped
+// rather than starting the next check right away.
+func (b *backend) PerformHealthCheck(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	starting := b.startupGracePeriod > 0
+	graceEnd := time.Now().Add(b.startupGracePeriod)
+
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-ticker.C:
+			start := time.Now()
+			err := b.checkHealth()
+			latency := time.Since(start)
+			// The ticker keeps one tick that came during a check that outlasted the interval,
+			// which would start the next check right away
+			if latency >= interval {
+				select {
+				case <-ticker.C:
+					log.Printf("Health check for %s took %s, skipping the tick that came meanwhile", b.healthCheckURL, latency.Round(time.Millisecond))
+				default:
+				}
+			}
+			if err != nil {
+				log.Printf("Health check failed for %s: %s", b.healthCheckURL, err)
+			} else {
+				log.Printf("Health check passed for %s", b.healthCheckURL)
+				b.markHealthy()
+			}
+			if starting && err != nil && time.Now().Before(graceEnd) {
+				log.Printf("%s is still starting, not counting the failed health check", b.URL)
+			} else if err != nil && b.IsInMaintenance() {
+				log.Printf("%s is in maintenance, not counting the failed health check", b.URL)
+			} else {
+				starting = false
+				b.SetAlive(b.healthWindow.Record(err == nil))
+			}
+			if b.healthEvents != nil {
+				sendHealthEvent(b.healthEvents, HealthEvent{URL: b.URL.String(), Time: start, Passed: err == nil, Err: err, Latency: latency, Alive: b.IsAlive()})
+			}
+		}
+	}
+}
+
+// WatchDrainFile polls the drain file until Stop is called, draining the backend while the
+// file exists and restoring it once removed. It returns immediately if no drain file is set.
+func (b *backend) WatchDrainFile(interval time.Duration) {
+	if b.drainFile == "" {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		_, err := os.Stat(b.drainFile)
+		draining := err == nil
+		if draining != b.IsDraining() {
+			log.Printf("Drain file %s for %s changed, draining: %t", b.drainFile, b.URL, draining)
+			b.SetDraining(draining)
+		}
+
+		select {
+		case <-b.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// WatchMaintenance takes the backend out of rotation while one of its maintenance windows is
+// active, checking at interval until Stop is called. It returns immediately if no windows are set.
+func (b *backend) WatchMaintenance(interval time.Duration) {
+	if len(b.maintenanceWindows) == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		active := inMaintenanceWindow(b.maintenanceWindows, time.Now())
+		b.mutex.Lock()
+		if active != b.inMaintenance {
+			log.Printf("Maintenance window of %s changed, in maintenance: %t", b.URL, active)
+			b.inMaintenance = active
+			stateVersion.Add(1)
+		}
+		b.mutex.Unlock()
+
+		select {
+		case <-b.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// IsInMaintenance reports whether one of the backend's maintenance windows is active
+func (b *backend) IsInMaintenance() bool {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return b.inMaintenance
+}
+
+// KeepWarm periodically sends warm-up requests over the proxy's transport until Stop is called,
+// so requests find an idle connection instead of paying for a new one. It returns immediately
+// if warm-up is disabled.
+func (b *backend) KeepWarm() {
+	if b.warmUpInterval <= 0 || b.warmUpCount <= 0 {
+		return
+	}
+
+	client := &http.Client{Transport: b.transport, Timeout: b.warmUpInterval}
+	ticker := time.NewTicker(b.warmUpInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-ticker.C:
+			// Requests are sent concurrently, otherwise they would all reuse the same connection
+			var wg sync.WaitGroup
+			for i := 0; i < b.warmUpCount; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					b.warmUp(client)
+				}()
+			}
+			wg.Wait()
+		}
+	}
+}
+
+// warmUp sends a single warm-up request, reading the whole response so the connection is reused
+func (b *backend) warmUp(client *http.Client) {
+	req, err := b.newHealthRequest(b.healthCheckURL)
+	if err != nil {
+		return
+	}
+	// Warm-up requests share the proxy's connections, which must not be recycled while in use
+	if b.conns != nil {
+		req = req.WithContext(b.conns.trace(req.Context()))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Printf("Warm-up request to %s failed: %s", b.URL, err)
+		return
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+// RefreshDNS re-resolves the backend host name until Stop is called, closing idle connections
+// when its addresses change so new requests connect to the current ones. It returns immediately
+// if DNS refresh is disabled.
+func (b *backend) RefreshDNS() {
+	if b.dnsDialer == nil {
+		return
+	}
+
+	ticker := time.NewTicker(b.dnsDialer.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-ticker.C:
+			if b.dnsDialer.Refresh(context.Background()) {
+				log.Printf("Addresses of %s changed, closing idle connections", b.URL.Hostname())
+				b.transport.CloseIdleConnections()
+			}
+		}
+	}
+}
+
+// markHealthy records a passing health check, which makes a stale backend fresh again
+func (b *backend) markHealthy() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.lastHealthy = time.Now()
+	if b.stale {
+		log.Printf("%s passed a health check, it is no longer stale", b.URL)
+		b.stale = false
+		stateVersion.Add(1)
+	}
+}
+
+// minStalenessInterval is the shortest interval at which the staleness of a backend is checked,
+// whatever the threshold
+const minStalenessInterval = 10 * time.Millisecond
+
+// WatchStaleness marks the backend stale once it has gone without a passing health check for
+// longer than the staleness threshold, until Stop is called. It runs apart from the health checks
+// so that it notices when they are stuck. It returns immediately if staleness is disabled.
+func (b *backend) WatchStaleness() {
+	if b.staleAfter <= 0 {
+		return
+	}
+
+	interval := b.staleAfter / 4
+	if interval < minStalenessInterval {
+		interval = minStalenessInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-ticker.C:
+			b.mutex.Lock()
+			// Health checks are expected to fail during maintenance
+			if !b.stale && !b.inMaintenance && time.Since(b.lastHealthy) > b.staleAfter {
+				log.Printf("%s has not passed a health check since %s, marking it as stale", b.URL, b.lastHealthy.Format(time.RFC3339))
+				b.stale = true
+				stateVersion.Add(1)
+			}
+			b.mutex.Unlock()
+		}
+	}
+}
+
+// IsStale reports whether the backend went without a passing health check for too long
+func (b *backend) IsStale() bool {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return b.stale
+}
+
+// RecycleConnections checks the age of the upstream connections until Stop is called and closes
+// the idle ones older than the maximum age. Connections in use are closed at a later check, once
+// idle. It returns immediately if no maximum age is set.
+func (b *backend) RecycleConnections() {
+	if b.conns == nil {
+		return
+	}
+
+	interval := b.connMaxAge / 2
+	if interval < minRecycleInterval {
+		interval = minRecycleInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-ticker.C:
+			if closed := b.conns.closeExpired(b.connMaxAge); closed > 0 {
+				log.Printf("Recycled %d idle connections to %s older than %s", closed, b.URL, b.connMaxAge)
+			}
+		}
+	}
+}
+
+// Stop stops the background loops started by PerformHealthCheck, WatchDrainFile, WatchMaintenance,
+// KeepWarm, RefreshDNS, RecycleConnections and WatchStaleness
+func (b *backend) Stop() {
+	b.stopOnce.Do(func() {
+		close(b.stop)
+		if b.healthTransport != nil {
+			b.healthTransport.CloseIdleConnections()
+		}
+	})
+}
+
+// checkHealth checks every health endpoint of the backend and combines the results
+func (b *backend) checkHealth() error {
+	if len(b.healthCheckURLs) == 1 {
+		return b.checkEndpoint(b.healthCheckURLs[0])
+	}
+
+	errs := make([]error, len(b.healthCheckURLs))
+	for i, healthURL := range b.healthCheckURLs {
+		if err := b.checkEndpoint(healthURL); err != nil {
+			errs[i] = fmt.Errorf("%s: %w", healthURL, err)
+		}
+	}
+
+	return b.healthAggregation.combine(errs)
+}
+
+// checkEndpoint checks a single health endpoint of the backend
+func (b *backend) checkEndpoint(healthURL string) error {
+	req, err := b.newHealthRequest(healthURL)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	resp, err := b.healthClient.Do(req)
+	if err != nil {
+		return err
+	}
+	// The body is read so that the connection can be reused by the next probe
+	defer func() {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, maxHealthBodyBytes))
+		resp.Body.Close()
+	}()
+	latency := time.Since(start)
+
+	if b.healthMode != HealthModeReachable && !b.isHealthyStatus(resp.StatusCode) {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	if b.healthLatencyThreshold > 0 && latency > b.healthLatencyThreshold {
+		return fmt.Errorf("health check took %s, exceeding threshold of %s", latency, b.healthLatencyThreshold)
+	}
+
+	return nil
+}
+
+// newHealthRequest builds a health check request to healthURL with the configured method and body
+func (b *backend) newHealthRequest(healthURL string) (*http.Request, error) {
+	if b.healthBody == nil {
+		return http.NewRequest(b.healthMethod, healthURL, nil)
+	}
+
+	req, err := http.NewRequest(b.healthMethod, healthURL, bytes.NewReader(b.healthBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", b.healthContentType)
+	return req, nil
+}
+
+// isHealthyStatus reports whether a health check status code counts as healthy
+func (b *backend) isHealthyStatus(code int) bool {
+	for _, accepted := range b.healthStatusCodes {
+		if code == accepted {
+			return true
+		}
+	}
+	return false
+}
+
+// IsSelectable reports whether new requests may be sent to the backend
+func IsSelectable(backend Backend) bool {
+	return backend.IsAlive() && !backend.IsDraining() && !backend.IsInMaintenance() && !backend.IsStale() && backend.GetBreakerState() != BreakerOpen &&
+		(!backend.IsStandby() || backend.IsPromoted())
+}
+
+// ServerPool represents a pool of backend servers
+type ServerPool interface {
+	GetBackends() []Backend
+	GetAliveBackends() []Backend
+	GetBackendByURL(u *url.URL) (Backend, bool)
+	Snapshot() []BackendStats
+	GetNextValidPeer() Backend
+	GetNextValidPeerMatching(match func(Backend) bool) Backend
+	AddBackend(Backend)
+	RemoveBackend(Backend)
+	GetServerPoolSize() int
+	Pause()
+	Resume()
+	IsPaused() bool
+	SetActiveGroup(group string)
+	GetActiveGroup() string
+	SetTrafficDial(percent int)
+	GetTrafficDial() int
+	SetStrategy(strategy Strategy)
+	GetStrategy() Strategy
+}
+
+// RoundRobinServerPool represents a pool of backend servers using round-robin selection
+// unless a different Strategy is configured
+type RoundRobinServerPool struct {
+	backends []Backend
+	// next counts round-robin selections, the next backend tried is next modulo the pool size.
+	// It is atomic so that selections only need the read lock.
+	next     atomic.Uint64
+	strategy Strategy
+	// candidates caches the selectable backends handed to the strategy
+	candidates atomic.Pointer[candidateCache]
+	// paused rejects all requests without touching the backends, for maintenance
+	paused atomic.Bool
+	// activeGroup is the group of backends receiving requests, see SetActiveGroup
+	activeGroup atomic.Pointer[string]
+	// shedPercent is the percentage of requests shed, the complement of the traffic dial so that
+	// the zero value sheds none
+	shedPercent atomic.Int32
+	mutex       sync.RWMutex
+}
+
+// candidateCache holds the selectable backends of a pool as of a stateVersion
+type candidateCache struct {
+	version  uint64
+	backends []Backend
+}
+
+// NewRoundRobinServerPool creates a new RoundRobinServerPool instance
+func NewRoundRobinServerPool() *RoundRobinServerPool {
+	return &RoundRobinServerPool{
+		backends: make([]Backend, 0),
+	}
+}
+
+// GetBackends returns the list of backend servers in the pool
+func (sp *RoundRobinServerPool) GetBackends() []Backend {
+	sp.mutex.RLock()
+	defer sp.mutex.RUnlock()
+	return sp.backends
+}
+
+// GetAliveBackends returns a copy of the list of backend servers that can currently
+// receive requests, leaving out dead, draining and circuit-broken ones
+func (sp *RoundRobinServerPool) GetAliveBackends() []Backend {
+	sp.mutex.RLock()
+	defer sp.mutex.RUnlock()
+
+	group := sp.GetActiveGroup()
+	alive := make([]Backend, 0, len(sp.backends))
+	for _, backend := range sp.backends {
+		if IsSelectable(backend) && inGroup(backend, group) {
+			alive = append(alive, backend)
+		}
+	}
+	return alive
+}
+
+// GetBackendByURL returns the backend whose URL is u once both are normalized, so that
+// HTTP://Example.com:80/ finds the backend at http://example.com
+func (sp *RoundRobinServerPool) GetBackendByURL(u *url.URL) (Backend, bool) {
+	key := normalizeURL(u)
+
+	sp.mutex.RLock()
+	defer sp.mutex.RUnlock()
+	for _, backend := range sp.backends {
+		if normalizeURL(backend.GetURL()) == key {
+			return backend, true
+		}
+	}
+	return nil, false
+}
+
+// Snapshot returns the stats of every backend in the pool. The pool is locked throughout so that
+// no backend joins or leaves the snapshot half way, and the counters of each backend are read at
+// once, so that for instance its active connections never exceed its total requests.
+func (sp *RoundRobinServerPool) Snapshot() []BackendStats {
+	sp.mutex.RLock()
+	defer sp.mutex.RUnlock()
+
+	stats := make([]BackendStats, 0, len(sp.backends))
+	for _, backend := range sp.backends {
+		stats = append(stats, backend.Stats())
+	}
+	return stats
+}
+
+// normalizeRawURL is normalizeURL for a URL that has yet to be parsed, it returns raw unchanged
+// if it does not parse
+func normalizeRawURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	return normalizeURL(u)
+}
+
+// normalizeURL returns u with the scheme and host lowercased and without the default port of the
+// scheme or a trailing slash
+func normalizeURL(u *url.URL) string {
+	n := *u
+	n.Scheme = strings.ToLower(n.Scheme)
+	n.Host = strings.ToLower(n.Host)
+	if port := n.Port(); (n.Scheme == "http" && port == "80") || (n.Scheme == "https" && port == "443") {
+		n.Host = strings.TrimSuffix(n.Host, ":"+port)
+	}
+	n.Path = strings.TrimSuffix(n.Path, "/")
+	n.RawPath = strings.TrimSuffix(n.RawPath, "/")
+	return n.String()
+}
+
+// GetNextValidPeer returns the next available backend server in a round-robin fashion
+func (sp *RoundRobinServerPool) GetNextValidPeer() Backend {
+	return sp.GetNextValidPeerMatching(nil)
+}
+
+// GetNextValidPeerMatching returns the next available backend server for which match
+// returns true, a nil match accepts every backend
+func (sp *RoundRobinServerPool) GetNextValidPeerMatching(match func(Backend) bool) Backend {
+	sp.mutex.RLock()
+	defer sp.mutex.RUnlock()
+
+	// Nothing to select before backends are registered or after all are removed
+	if len(sp.backends) == 0 {
+		return nil
+	}
+
+	if sp.strategy != nil {
+		candidates := unsaturated(sp.selectableBackends(match))
+		if len(candidates) == 0 {
+			return nil
+		}
+		if rr, ok := sp.strategy.(roundRobinStrategy); !ok || !rr.usesRoundRobin(candidates) {
+			return sp.strategy.Select(candidates)
+		}
+	}
+
+	// Claim a starting position, and move the counter past the backends skipped on the way so
+	// the next selection continues after the one made here
+	group := sp.GetActiveGroup()
+	size := uint64(len(sp.backends))
+	start := sp.next.Add(1) - 1
+	for i := uint64(0); i < size; i++ {
+		backend := sp.backends[(start+i)%size]
+
+		if IsSelectable(backend) && inGroup(backend, group) && !backend.IsSaturated() && (match == nil || match(backend)) {
+			if i > 0 {
+				sp.next.Add(i)
+			}
+			return backend
+		}
+	}
+
+	return nil
+}
+
+// selectableBackends returns the selectable backends for which match returns true. Without
+// a match the same slice is returned until stateVersion changes, so it must not be modified.
+// The caller must hold the read lock.
+func (sp *RoundRobinServerPool) selectableBackends(match func(Backend) bool) []Backend {
+	version := stateVersion.Load()
+	if cached := sp.candidates.Load(); match == nil && cached != nil && cached.version == version {
+		return cached.backends
+	}
+
+	group := sp.GetActiveGroup()
+	candidates := make([]Backend, 0, len(sp.backends))
+	for _, backend := range sp.backends {
+		if IsSelectable(backend) && inGroup(backend, group) && (match == nil || match(backend)) {
+			candidates = append(candidates, backend)
+		}
+	}
+
+	if match == nil {
+		sp.candidates.Store(&candidateCache{version: version, backends: candidates})
+	}
+
+	return candidates
+}
+
+// unsaturated returns the backends that are below their connection cap. Saturation changes with
+// every request, so it is filtered out of the cached candidates rather than cached with them, and
+// the cached slice itself is returned when no backend is saturated.
+func unsaturated(backends []Backend) []Backend {
+	for i, backend := range backends {
+		if !backend.IsSaturated() {
+			continue
+		}
+
+		filtered := append(make([]Backend, 0, len(backends)-1), backends[:i]...)
+		for _, backend := range backends[i+1:] {
+			if !backend.IsSaturated() {
+				filtered = append(filtered, backend)
+			}
+		}
+		return filtered
+	}
+	return backends
+}
+
+// SetStrategy replaces round-robin with the given selection strategy, nil restores round-robin
+func (sp *RoundRobinServerPool) SetStrategy(strategy Strategy) {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+	sp.strategy = strategy
+}
+
+// GetStrategy returns the selection strategy of the pool, nil for round-robin
+func (sp *RoundRobinServerPool) GetStrategy() Strategy {
+	sp.mutex.RLock()
+	defer sp.mutex.RUnlock()
+	return sp.strategy
+}
+
+// AddBackend adds a backend server to the pool, unless it already has a backend with the same
+// normalized URL, see normalizeURL
+func (sp *RoundRobinServerPool) AddBackend(backend Backend) {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+
+	key := normalizeURL(backend.GetURL())
+	for _, b := range sp.backends {
+		if normalizeURL(b.GetURL()) == key {
+			log.Printf("Backend %s is already in the pool as %s, not adding it again", backend.GetURL(), b.GetURL())
+			backend.Stop()
+			return
+		}
+	}
+
+	sp.backends = append(sp.backends, backend)
+	stateVersion.Add(1)
+
+	// Start health check for the new backend
+	go backend.PerformHealthCheck(10 * time.Second) // Adjust the interval as needed
+	go backend.WatchDrainFile(time.Second)
+	go backend.WatchMaintenance(time.Second)
+	go backend.KeepWarm()
+	go backend.RefreshDNS()
+	go backend.RecycleConnections()
+	go backend.WatchStaleness()
+}
+
+// RemoveBackend removes a backend server from the pool and stops its background loops. The
+// backend is found by its normalized URL, so any Backend with the same URL removes it. Requests
+// already being proxied to it are left to complete.
+func (sp *RoundRobinServerPool) RemoveBackend(backend Backend) {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+
+	key := normalizeURL(backend.GetURL())
+	for i, b := range sp.backends {
+		if b != backend && normalizeURL(b.GetURL()) != key {
+			continue
+		}
+
+		backends := make([]Backend, 0, len(sp.backends)-1)
+		backends = append(backends, sp.backends[:i]...)
+		sp.backends = append(backends, sp.backends[i+1:]...)
+		stateVersion.Add(1)
+
+		// Keep pointing at the backend that would have been selected next
+		next := sp.nextIndex(len(sp.backends) + 1)
+		if i < next {
+			next--
+		}
+		if next >= len(sp.backends) {
+			next = 0
+		}
+		sp.next.Store(uint64(next))
+
+		b.Stop()
+		return
+	}
+}
+
+// nextIndex returns the position in a pool of size backends that round-robin selection tries next
+func (sp *RoundRobinServerPool) nextIndex(size int) int {
+	if size == 0 {
+		return 0
+	}
+	return int(sp.next.Load() % uint64(size))
+}
+
+// Pause stops the pool from serving requests until Resume is called. Backends keep being
+// health checked and keep their state.
+func (sp *RoundRobinServerPool) Pause() {
+	sp.paused.Store(true)
+}
+
+// Resume lets a paused pool serve requests again
+func (sp *RoundRobinServerPool) Resume() {
+	sp.paused.Store(false)
+}
+
+// IsPaused reports whether the pool is paused
+func (sp *RoundRobinServerPool) IsPaused() bool {
+	return sp.paused.Load()
+}
+
+// GetServerPoolSize returns the number of backend servers in the pool
+func (sp *RoundRobinServerPool) GetServerPoolSize() int {
+	sp.mutex.RLock()
+	defer sp.mutex.RUnlock()
+	return len(sp.backends)
+}
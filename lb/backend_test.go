@@ -0,0 +1,640 @@
+package lb
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLoadHeaderShiftsLeastLoadSelection(t *testing.T) {
+	var loads [2]atomic.Value
+	loads[0].Store("0.9")
+	loads[1].Store("0.1")
+	var backends []Backend
+	for i := range loads {
+		load := &loads[i]
+		server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(loadHeader, load.Load().(string))
+		})
+		backends = append(backends, newTestBackend(t, server.URL))
+	}
+	report := func() {
+		for _, b := range backends {
+			serve(b, http.MethodGet, "/")
+		}
+	}
+	strategy := &LeastLoadStrategy{}
+
+	report()
+	if got := strategy.Select(backends); got != backends[1] {
+		t.Fatalf("selected %s, want the less loaded %s", got.GetURL(), backends[1].GetURL())
+	}
+
+	// The smoothed value moves towards the new reports over a few responses
+	loads[0].Store("0.1")
+	loads[1].Store("0.9")
+	report()
+	if load := backends[0].GetLoad(); load <= 0.1 || load >= 0.9 {
+		t.Errorf("load after one report = %v, want it smoothed between 0.1 and 0.9", load)
+	}
+	for i := 0; i < 5; i++ {
+		report()
+	}
+	if got := strategy.Select(backends); got != backends[0] {
+		t.Errorf("selected %s after the loads flipped, want %s", got.GetURL(), backends[0].GetURL())
+	}
+}
+
+func TestInvalidLoadHeaderIsIgnored(t *testing.T) {
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(loadHeader, "-1")
+	})
+	b := newTestBackend(t, server.URL)
+	serve(b, http.MethodGet, "/")
+	if load := b.GetLoad(); load != 0 {
+		t.Errorf("load = %v, want negative loads ignored", load)
+	}
+}
+
+func TestEmptyPoolSelectsNothing(t *testing.T) {
+	pool := NewRoundRobinServerPool()
+	if peer := pool.GetNextValidPeer(); peer != nil {
+		t.Fatalf("GetNextValidPeer on an empty pool = %s, want nil", peer.GetURL())
+	}
+
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {})
+	b := newTestBackend(t, server.URL)
+	pool.AddBackend(b)
+	if peer := pool.GetNextValidPeer(); peer != b {
+		t.Fatalf("GetNextValidPeer = %v, want the only backend", peer)
+	}
+	pool.RemoveBackend(b)
+	if peer := pool.GetNextValidPeer(); peer != nil {
+		t.Errorf("GetNextValidPeer after removing every backend = %s, want nil", peer.GetURL())
+	}
+}
+
+func TestSelectionMatchesTags(t *testing.T) {
+	pool := NewRoundRobinServerPool()
+	east := newTestBackend(t, "http://east:3001", WithTags(map[string]string{"region": "us-east", "tier": "premium"}))
+	west := newTestBackend(t, "http://west:3001", WithTags(map[string]string{"region": "us-west"}))
+	untagged := newTestBackend(t, "http://untagged:3001")
+	for _, b := range []Backend{east, west, untagged} {
+		pool.AddBackend(b)
+	}
+
+	premium := map[string]string{"tier": "premium"}
+	for i := 0; i < 6; i++ {
+		if peer := pool.GetNextValidPeerMatching(func(b Backend) bool { return HasTags(b, premium) }); peer != east {
+			t.Fatalf("selected %v for tier=premium, want %s", peer, east.GetURL())
+		}
+	}
+
+	route := Route{Prefix: "/", Tags: map[string]string{"region": "us-west"}}
+	for i := 0; i < 6; i++ {
+		if peer := route.selectBackend(pool, nil); peer != west {
+			t.Fatalf("selected %v for the route tagged region=us-west, want %s", peer, west.GetURL())
+		}
+	}
+
+	if peer := pool.GetNextValidPeerMatching(func(b Backend) bool { return HasTags(b, map[string]string{"region": "eu"}) }); peer != nil {
+		t.Errorf("selected %s although no backend is tagged region=eu", peer.GetURL())
+	}
+}
+
+func TestGetTagsReturnsCopy(t *testing.T) {
+	tags := map[string]string{"region": "us-east"}
+	b := newTestBackend(t, "http://east:3001", WithTags(tags))
+	tags["region"] = "changed"
+	b.GetTags()["region"] = "changed"
+	if got := b.GetTags()["region"]; got != "us-east" {
+		t.Errorf("region = %q, want the tags fixed at creation", got)
+	}
+}
+
+func TestKeepAliveConfiguresTransport(t *testing.T) {
+	b := newTestBackend(t, "http://a:3001", WithKeepAlive(KeepAliveConfig{MaxIdleConns: 7, IdleTimeout: Duration(time.Minute)}))
+	if b.transport.DisableKeepAlives || b.transport.MaxIdleConnsPerHost != 7 || b.transport.IdleConnTimeout != time.Minute {
+		t.Errorf("transport keep-alives = %t, %d idle, %s timeout, want enabled, 7 and 1m", !b.transport.DisableKeepAlives, b.transport.MaxIdleConnsPerHost, b.transport.IdleConnTimeout)
+	}
+
+	disabled := newTestBackend(t, "http://a:3001", WithKeepAlive(KeepAliveConfig{Disable: true}))
+	if !disabled.transport.DisableKeepAlives {
+		t.Error("keep-alives still enabled with Disable set")
+	}
+}
+
+func BenchmarkKeepAlive(b *testing.B) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	for _, bench := range []struct {
+		name   string
+		config KeepAliveConfig
+	}{
+		{"enabled", KeepAliveConfig{}},
+		{"disabled", KeepAliveConfig{Disable: true}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			backend := NewBackend(server.URL, WithKeepAlive(bench.config))
+			defer backend.Stop()
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				backend.ServeHTTP(httptest.NewRecorder(), req)
+			}
+		})
+	}
+}
+
+func TestBytesTransferredCountsBodies(t *testing.T) {
+	response := strings.Repeat("r", 300)
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		io.WriteString(w, response)
+	})
+	b := newTestBackend(t, server.URL)
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(strings.Repeat("q", 100)))
+		b.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	in, out := b.GetBytesTransferred()
+	if in != 200 || out != 600 {
+		t.Errorf("bytes transferred = %d in, %d out, want 200 and 600", in, out)
+	}
+	if stats := b.Stats(); stats.BytesIn != in || stats.BytesOut != out {
+		t.Errorf("stats show %d in, %d out, want %d and %d", stats.BytesIn, stats.BytesOut, in, out)
+	}
+}
+
+func TestDrainFileTracksMarker(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "drain")
+	b := newTestBackend(t, "http://a:3001", WithDrainFile(marker))
+	go b.WatchDrainFile(5 * time.Millisecond)
+
+	if b.IsDraining() {
+		t.Fatal("draining before the marker file exists")
+	}
+	if err := os.WriteFile(marker, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "not draining after the marker file was created", b.IsDraining)
+	if IsSelectable(b) {
+		t.Error("draining backend is still selectable")
+	}
+	if err := os.Remove(marker); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "still draining after the marker file was removed", func() bool { return !b.IsDraining() })
+}
+
+func TestHostModesSetOutgoingHost(t *testing.T) {
+	hosts := make(chan string, 1)
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		hosts <- r.Host
+	})
+	backendHost := strings.TrimPrefix(server.URL, "http://")
+
+	for _, test := range []struct {
+		mode HostMode
+		host string
+		want string
+	}{
+		{"", "", backendHost},
+		{HostModeBackend, "", backendHost},
+		{HostModePreserve, "", "client.example"},
+		{HostModeOverride, "vhost.example", "vhost.example"},
+	} {
+		b := newTestBackend(t, server.URL, WithHostMode(test.mode, test.host))
+		serve(b, http.MethodGet, "http://client.example/")
+		if got := <-hosts; got != test.want {
+			t.Errorf("host mode %q sent Host %q, want %q", test.mode, got, test.want)
+		}
+	}
+}
+
+func TestOversizedResponseHeadersFailCleanly(t *testing.T) {
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/huge" {
+			w.Header().Set("X-Huge", strings.Repeat("x", 64<<10))
+		}
+		io.WriteString(w, "ok")
+	})
+	b := newTestBackend(t, server.URL, WithMaxResponseHeaderBytes(4<<10))
+
+	if w := serve(b, http.MethodGet, "/huge"); w.Code != http.StatusBadGateway || w.Header().Get("X-Huge") != "" {
+		t.Errorf("oversized headers: status %d with X-Huge of %d bytes, want %d without it", w.Code, len(w.Header().Get("X-Huge")), http.StatusBadGateway)
+	}
+	if w := serve(b, http.MethodGet, "/"); w.Code != http.StatusOK || w.Body.String() != "ok" {
+		t.Errorf("regular headers: status %d body %q, want %d ok", w.Code, w.Body.String(), http.StatusOK)
+	}
+}
+
+func TestGetAliveBackendsFiltersUnservable(t *testing.T) {
+	pool, backends := newStrategyPool(nil, "http://a:3001", "http://b:3001", "http://c:3001", "http://d:3001")
+	for _, backend := range backends {
+		defer backend.Stop()
+	}
+	backends[1].SetAlive(false)
+	backends[2].SetDraining(true)
+
+	alive := pool.GetAliveBackends()
+	if len(alive) != 2 || alive[0] != backends[0] || alive[1] != backends[3] {
+		t.Fatalf("alive backends = %v, want a and d", alive)
+	}
+
+	alive[0] = nil
+	if pool.GetAliveBackends()[0] != backends[0] {
+		t.Error("changing the returned slice changed the pool")
+	}
+}
+
+func TestRefusedConnectionMarksBackendDead(t *testing.T) {
+	alive := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {})
+	killed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	killed.Close()
+	balancer := startTestLoadBalancer(t, Config{Backends: []BackendConfig{{URL: alive.URL}, {URL: killed.URL}}})
+	handler := balancer.Handler()
+
+	// Only the first request for the killed backend fails, long before its next health check
+	failed := 0
+	for i := 0; i < 6; i++ {
+		if w := serve(handler, http.MethodGet, "/"); w.Code != http.StatusOK {
+			failed++
+		}
+	}
+	if failed != 1 {
+		t.Errorf("%d requests failed, want only the first one sent to the killed backend", failed)
+	}
+	for _, backend := range balancer.pool.GetBackends() {
+		if backend.GetURL().String() == killed.URL && backend.IsAlive() {
+			t.Error("killed backend still alive after a refused connection")
+		}
+	}
+}
+
+func TestRemoveBackendKeepsNextSelectionValid(t *testing.T) {
+	// Two selections leave c next in the pool
+	tests := []struct {
+		name   string
+		urls   []string
+		remove int
+		want   string
+	}{
+		{"the last backend, selected next", []string{"http://a:3001", "http://b:3001", "http://c:3001"}, 2, "a:3001"},
+		{"a backend before the next one", []string{"http://a:3001", "http://b:3001", "http://c:3001", "http://d:3001"}, 0, "c:3001"},
+		{"a backend after the next one", []string{"http://a:3001", "http://b:3001", "http://c:3001", "http://d:3001"}, 3, "c:3001"},
+	}
+	for _, tt := range tests {
+		pool, backends := newStrategyPool(nil, tt.urls...)
+		pool.GetNextValidPeer()
+		pool.GetNextValidPeer()
+
+		pool.RemoveBackend(backends[tt.remove])
+		if got := pool.GetNextValidPeer(); got == nil || got.GetURL().Host != tt.want {
+			t.Errorf("removing %s: next selection = %v, want %s", tt.name, got, tt.want)
+		}
+		for _, backend := range backends {
+			backend.Stop()
+		}
+	}
+}
+
+func TestReverseProxyErrorsAreLoggedWithBackend(t *testing.T) {
+	// The backend promises a longer body than it sends before closing the connection
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		buf.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\ntruncated")
+		buf.Flush()
+		conn.Close()
+	})
+	b := newTestBackend(t, server.URL)
+
+	logs := captureLog(t)
+	serve(b, http.MethodGet, "/")
+	if want := "Proxy error for " + server.URL + ": httputil: ReverseProxy read error during body copy"; !strings.Contains(logs.String(), want) {
+		t.Errorf("log = %q, want a line containing %q", logs.String(), want)
+	}
+}
+
+func TestConcurrentRoundRobinSelection(t *testing.T) {
+	urls := []string{"http://a:3001", "http://b:3001", "http://c:3001", "http://d:3001"}
+	pool, backends := newStrategyPool(nil, urls...)
+	for _, backend := range backends {
+		defer backend.Stop()
+	}
+
+	// Every selection claims its own position, so 8 goroutines still spread evenly
+	const goroutines, selections = 8, 1000
+	var counts sync.Map
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < selections; i++ {
+				n, _ := counts.LoadOrStore(pool.GetNextValidPeer(), new(atomic.Int32))
+				n.(*atomic.Int32).Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	want := int32(goroutines * selections / len(backends))
+	for _, backend := range backends {
+		n, _ := counts.LoadOrStore(backend, new(atomic.Int32))
+		if got := n.(*atomic.Int32).Load(); got != want {
+			t.Errorf("%s selected %d times, want %d", backend.GetURL(), got, want)
+		}
+	}
+
+	// Selections stay valid while backends change state and join or leave the pool, a is
+	// always available
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			backends[1+i%3].SetAlive(i%2 == 0)
+			extra := NewBackend("http://e:3001")
+			pool.AddBackend(extra)
+			pool.RemoveBackend(extra)
+		}
+	}()
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < selections; i++ {
+				if pool.GetNextValidPeer() == nil {
+					t.Error("no backend selected while one was available")
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	<-done
+}
+
+// lockedRoundRobin is the selection GetNextValidPeer made before the counter became atomic,
+// every caller took the write lock to move the index
+type lockedRoundRobin struct {
+	mutex    sync.Mutex
+	backends []Backend
+	current  int
+}
+
+func (rr *lockedRoundRobin) next() Backend {
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+
+	for i := 0; i < len(rr.backends); i++ {
+		rr.current = (rr.current + 1) % len(rr.backends)
+		if backend := rr.backends[rr.current]; IsSelectable(backend) {
+			return backend
+		}
+	}
+	return nil
+}
+
+func BenchmarkGetNextValidPeer(b *testing.B) {
+	urls := []string{"http://a:3001", "http://b:3001", "http://c:3001", "http://d:3001"}
+	pool, backends := newStrategyPool(nil, urls...)
+	for _, backend := range backends {
+		defer backend.Stop()
+	}
+
+	b.Run("atomic", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				pool.GetNextValidPeer()
+			}
+		})
+	})
+	b.Run("locked", func(b *testing.B) {
+		rr := &lockedRoundRobin{backends: backends}
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				rr.next()
+			}
+		})
+	})
+}
+
+func TestBackendWithoutReverseProxyAnswers500(t *testing.T) {
+	u, _ := url.Parse("http://a:3001")
+	for _, b := range []*backend{{}, {URL: u, alive: true}} {
+		logs := captureLog(t)
+		if w := serve(b, http.MethodGet, "/"); w.Code != http.StatusInternalServerError {
+			t.Errorf("status = %d, want %d", w.Code, http.StatusInternalServerError)
+		}
+		if !strings.Contains(logs.String(), "has no reverse proxy") {
+			t.Errorf("log = %q, want the missing reverse proxy reported", logs.String())
+		}
+	}
+}
+
+func TestGetBackendByURL(t *testing.T) {
+	pool, backends := newStrategyPool(nil, "http://a:3001", "https://b.example/api")
+	for _, backend := range backends {
+		defer backend.Stop()
+	}
+
+	tests := []struct {
+		rawURL string
+		want   Backend
+	}{
+		{"http://a:3001", backends[0]},
+		// URLs match however they are spelled
+		{"HTTP://A:3001/", backends[0]},
+		{"https://b.example:443/api/", backends[1]},
+		{"http://a:3002", nil},
+		{"https://b.example/other", nil},
+	}
+	for _, tt := range tests {
+		u, _ := url.Parse(tt.rawURL)
+		got, ok := pool.GetBackendByURL(u)
+		if got != tt.want || ok != (tt.want != nil) {
+			t.Errorf("GetBackendByURL(%s) = %v, %t, want %v", tt.rawURL, got, ok, tt.want)
+		}
+	}
+}
+
+func TestNormalizeURL(t *testing.T) {
+	tests := []struct {
+		a, b string
+		same bool
+	}{
+		{"http://host:3001", "http://host:3001/", true},
+		{"http://host:3001", "HTTP://HOST:3001", true},
+		{"http://host", "http://host:80", true},
+		{"https://host", "https://host:443/", true},
+		{"http://host:3001/api", "http://host:3001/api/", true},
+		{"http://host:3001", "https://host:3001", false},
+		{"http://host:3001", "http://host:3002", false},
+		{"http://host:443", "https://host:443", false},
+		{"http://host:3001/api", "http://host:3001/API", false},
+	}
+	for _, tt := range tests {
+		a, b := normalizeRawURL(tt.a), normalizeRawURL(tt.b)
+		if (a == b) != tt.same {
+			t.Errorf("%s and %s normalize to %s and %s, same = %t, want %t", tt.a, tt.b, a, b, a == b, tt.same)
+		}
+	}
+}
+
+func TestPoolComparesNormalizedURLs(t *testing.T) {
+	pool, backends := newStrategyPool(nil, "http://host:3001", "http://host:3001/", "https://host:3001")
+	for _, backend := range backends {
+		defer backend.Stop()
+	}
+	got := pool.GetBackends()
+	if len(got) != 2 || got[0] != backends[0] || got[1] != backends[2] {
+		t.Fatalf("pool holds %v, want http://host:3001 once and https://host:3001", got)
+	}
+
+	// Another Backend spelling the same URL removes the one in the pool
+	other := NewBackend("HTTP://HOST:3001/")
+	defer other.Stop()
+	pool.RemoveBackend(other)
+	if got := pool.GetBackends(); len(got) != 1 || got[0] != backends[2] {
+		t.Errorf("after removing HTTP://HOST:3001/ the pool holds %v, want https://host:3001", got)
+	}
+
+	cfg := &FileConfig{Backends: []BackendConfig{{URL: "http://host:3001"}, {URL: "http://host:3001/"}}}
+	if err := cfg.Validate(); err == nil {
+		t.Error("Validate accepted http://host:3001 and http://host:3001/ as two backends")
+	}
+	cfg.Backends[1].URL = "https://host:3001"
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Validate rejected http and https on the same host: %s", err)
+	}
+}
+
+func TestReloadKeepsBackendSpelledDifferently(t *testing.T) {
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {})
+	pool := NewRoundRobinServerPool()
+	ApplyConfig(pool, &FileConfig{Backends: []BackendConfig{{URL: server.URL}}})
+	before := pool.GetBackends()
+	defer func() {
+		for _, backend := range pool.GetBackends() {
+			backend.Stop()
+		}
+	}()
+
+	ApplyConfig(pool, &FileConfig{Backends: []BackendConfig{{URL: strings.ToUpper(server.URL) + "/"}}})
+	if after := pool.GetBackends(); len(after) != 1 || after[0] != before[0] {
+		t.Errorf("reloading %s/ in upper case replaced the backend: %v, want %v", server.URL, after, before)
+	}
+}
+
+func TestRecoveredBackendRampsUpUntilStable(t *testing.T) {
+	fragile := newTestServer(t, func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "fragile") })
+	sturdy := newTestServer(t, func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "sturdy") })
+	balancer := startTestLoadBalancer(t, Config{Backends: []BackendConfig{
+		{URL: fragile.URL, Ramp: RampConfig{Requests: 2, Interval: Duration(200 * time.Millisecond), Stable: 5}},
+		{URL: sturdy.URL},
+	}})
+	count := func(requests int) int {
+		n := 0
+		for i := 0; i < requests; i++ {
+			if serve(balancer.Handler(), http.MethodGet, "/").Body.String() == "fragile" {
+				n++
+			}
+		}
+		return n
+	}
+
+	// The ramp only applies after a recovery
+	if n := count(10); n != 5 {
+		t.Errorf("fragile backend served %d of 10 requests before failing, want its share of 5", n)
+	}
+	recovered := balancer.pool.GetBackends()[0]
+	recovered.SetAlive(false)
+	recovered.SetAlive(true)
+
+	if n := count(10); n != 2 {
+		t.Errorf("recovered backend served %d of 10 requests, want the 2 of its ramp", n)
+	}
+	if stats := balancer.Snapshot(); !stats[0].Throttled {
+		t.Errorf("recovered backend stats = %+v, want it throttled while ramping", stats[0])
+	}
+
+	// The gate opens again every interval, until 5 requests in a row succeeded
+	time.Sleep(250 * time.Millisecond)
+	if n := count(10); n != 2 {
+		t.Errorf("recovered backend served %d of 10 requests after an interval, want 2 more", n)
+	}
+	time.Sleep(250 * time.Millisecond)
+	if n := count(10); n <= 2 {
+		t.Errorf("recovered backend served %d of 10 requests after its 5th success, want the gate open", n)
+	}
+	if n := count(10); n != 5 {
+		t.Errorf("stable backend served %d of 10 requests, want its full share of 5", n)
+	}
+
+	cfg := &FileConfig{Backends: []BackendConfig{{URL: fragile.URL, Ramp: RampConfig{Requests: -1}}}}
+	if err := cfg.Validate(); err == nil {
+		t.Error("Validate accepted a negative ramp")
+	}
+}
+
+func TestProxyErrorsCloseIdleConnections(t *testing.T) {
+	for _, tt := range []struct {
+		resetAfter int
+		wantOpened int32
+	}{
+		// The request after the error reuses the idle connection left
+		{0, 2},
+		// The idle connection was closed, the request after the error opens a fresh one
+		{1, 3},
+	} {
+		var held sync.WaitGroup
+		held.Add(2)
+		server, opened, _ := newConnCountingServer(t, func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/hold":
+				held.Done()
+				held.Wait()
+			case "/fail":
+				conn, _, _ := w.(http.Hijacker).Hijack()
+				conn.Close()
+			}
+		})
+		b := newTestBackend(t, server.URL, WithConnectionReset(tt.resetAfter))
+
+		// Two requests at once leave two idle connections in the pool
+		var wg sync.WaitGroup
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				serve(b, http.MethodGet, "/hold")
+			}()
+		}
+		wg.Wait()
+
+		// A POST is not retried by the transport, so the error costs a single connection
+		if code := serve(b, http.MethodPost, "/fail").Code; code != http.StatusBadGateway {
+			t.Fatalf("reset after %d: failing request answered %d, want %d", tt.resetAfter, code, http.StatusBadGateway)
+		}
+		if code := serve(b, http.MethodGet, "/").Code; code != http.StatusOK {
+			t.Errorf("reset after %d: request after recovery answered %d, want %d", tt.resetAfter, code, http.StatusOK)
+		}
+		if got := opened.Load(); got != tt.wantOpened {
+			t.Errorf("reset after %d: %d connections opened, want %d", tt.resetAfter, got, tt.wantOpened)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package lb
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// SetActiveGroup sends all new requests to the backends of group, e.g. "blue" or "green", and
+// none to the backends of other groups, which keep being health checked. Backends without a
+// group serve every group. The switch is a single atomic store, so no request sees a mix of
+// both groups. An empty group sends requests to every backend.
+func (sp *RoundRobinServerPool) SetActiveGroup(group string) {
+	sp.activeGroup.Store(&group)
+	stateVersion.Add(1)
+}
+
+// GetActiveGroup returns the group of backends receiving requests, empty for all of them
+func (sp *RoundRobinServerPool) GetActiveGroup() string {
+	if group := sp.activeGroup.Load(); group != nil {
+		return *group
+	}
+	return ""
+}
+
+// inGroup reports whether backend receives requests while group is active
+func inGroup(backend Backend, group string) bool {
+	return group == "" || backend.GetGroup() == "" || backend.GetGroup() == group
+}
+
+// groupReady reports whether the pool has an available backend once group is active
+func groupReady(pool ServerPool, group string) bool {
+	for _, backend := range pool.GetBackends() {
+		if backend.GetGroup() == group && IsSelectable(backend) {
+			return true
+		}
+	}
+	return false
+}
+
+// groupHandler serves the active backend group on GET, and switches it on PUT with a body such
+// as {"group": "green"}. Switching to a group without an available backend is refused.
+func groupHandler(pool ServerPool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"group": pool.GetActiveGroup()})
+		case http.MethodPut:
+			var body struct {
+				Group *string `json:"group"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Group == nil {
+				http.Error(w, `Expected a JSON body such as {"group": "green"}`, http.StatusBadRequest)
+				return
+			}
+			if *body.Group != "" && !groupReady(pool, *body.Group) {
+				http.Error(w, fmt.Sprintf("No backend of group %q is available", *body.Group), http.StatusConflict)
+				return
+			}
+			pool.SetActiveGroup(*body.Group)
+			log.Printf("Switched requests to backend group %q", *body.Group)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", "GET, PUT")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
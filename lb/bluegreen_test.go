@@ -0,0 +1,76 @@
+package lb
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSwitchFromBlueToGreen(t *testing.T) {
+	var backends []BackendConfig
+	groups := make(map[string]string)
+	for _, name := range []string{"blue-1", "blue-2", "green-1", "green-2"} {
+		name := name
+		group, _, _ := strings.Cut(name, "-")
+		url := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, group)
+		}).URL
+		backends = append(backends, BackendConfig{URL: url, Group: group})
+		groups[url] = group
+	}
+	balancer := startTestLoadBalancer(t, Config{Backends: backends, ActiveGroup: "blue"})
+	handler, admin := balancer.Handler(), balancer.AdminHandler()
+	servedBy := func() map[string]int {
+		served := make(map[string]int)
+		for i := 0; i < 8; i++ {
+			served[serve(handler, http.MethodGet, "/").Body.String()]++
+		}
+		return served
+	}
+	switchTo := func(body string) int {
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/group", strings.NewReader(body)))
+		return w.Code
+	}
+
+	if served := servedBy(); served["blue"] != 8 {
+		t.Fatalf("served by %v before the switch, want blue only", served)
+	}
+	if code := switchTo(`{"group": "green"}`); code != http.StatusNoContent {
+		t.Fatalf("PUT /group green = %d, want %d", code, http.StatusNoContent)
+	}
+	// The very next request goes to green, and none to blue anymore
+	if served := servedBy(); served["green"] != 8 {
+		t.Errorf("served by %v after the switch, want green only", served)
+	}
+	var active struct{ Group string }
+	json.NewDecoder(serve(admin, http.MethodGet, "/group").Body).Decode(&active)
+	if active.Group != "green" {
+		t.Errorf("GET /group = %q, want green", active.Group)
+	}
+
+	// The inactive group stays in the pool, ready to switch back to
+	for _, stats := range balancer.Snapshot() {
+		if groups[stats.URL] == "blue" && !stats.Alive {
+			t.Errorf("inactive blue backend %s not alive", stats.URL)
+		}
+	}
+
+	// A group without an available backend cannot take the traffic
+	for _, backend := range balancer.pool.GetBackends() {
+		if groups[backend.GetURL().String()] == "blue" {
+			backend.SetAlive(false)
+		}
+	}
+	for _, body := range []string{`{"group": "blue"}`, `{"group": "red"}`} {
+		if code := switchTo(body); code != http.StatusConflict {
+			t.Errorf("PUT /group %s = %d, want %d", body, code, http.StatusConflict)
+		}
+	}
+	if served := servedBy(); served["green"] != 8 {
+		t.Errorf("served by %v after refused switches, want green only", served)
+	}
+}
@@ -0,0 +1,132 @@
+package lb
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// defaultBodyLogMaxBytes is the length logged of each body when BodyLogConfig sets no limit
+const defaultBodyLogMaxBytes = 4 << 10
+
+// redactedHeaders are always logged without their values, as they carry credentials
+var redactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// BodyLogConfig configures logging of the headers and bodies of a sample of requests and their
+// responses, for debugging
+type BodyLogConfig struct {
+	// SampleRate is the fraction of requests logged, from 0 to 1. 0 disables body logging.
+	SampleRate float64
+	// MaxBytes is the length at which each logged body is truncated, 4 KiB by default. Bodies
+	// are still proxied in full.
+	MaxBytes int
+	// RedactHeaders are logged without their values, along with Authorization,
+	// Proxy-Authorization, Cookie and Set-Cookie
+	RedactHeaders []string
+}
+
+// cappedBuffer keeps the first max bytes written to it and drops the rest
+type cappedBuffer struct {
+	bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (cb *cappedBuffer) Write(p []byte) (int, error) {
+	if room := cb.max - cb.Len(); len(p) > room {
+		cb.truncated = true
+		if room > 0 {
+			cb.Buffer.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return cb.Buffer.Write(p)
+}
+
+// String returns the kept bytes, marked when some were dropped
+func (cb *cappedBuffer) String() string {
+	if cb.truncated {
+		return fmt.Sprintf("%q (truncated)", cb.Bytes())
+	}
+	return fmt.Sprintf("%q", cb.Bytes())
+}
+
+// teeReadCloser copies the body read from a request to a buffer
+type teeReadCloser struct {
+	io.ReadCloser
+	copy io.Writer
+}
+
+func (tr *teeReadCloser) Read(p []byte) (int, error) {
+	n, err := tr.ReadCloser.Read(p)
+	tr.copy.Write(p[:n])
+	return n, err
+}
+
+// bodyLogResponseWriter copies the body written to a response to a buffer
+type bodyLogResponseWriter struct {
+	statusResponseWriter
+	body *cappedBuffer
+}
+
+func (bw *bodyLogResponseWriter) Write(p []byte) (int, error) {
+	n, err := bw.statusResponseWriter.Write(p)
+	bw.body.Write(p[:n])
+	return n, err
+}
+
+// bodyLogHandler logs the headers and bodies of a sample of the requests and responses passing
+// through to next. Bodies are copied while they stream, so proxying is unaffected.
+func bodyLogHandler(config BodyLogConfig, next http.Handler) http.Handler {
+	maxBytes := config.MaxBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultBodyLogMaxBytes
+	}
+	redact := make(map[string]bool)
+	for _, name := range append(redactedHeaders, config.RedactHeaders...) {
+		redact[http.CanonicalHeaderKey(name)] = true
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rand.Float64() >= config.SampleRate {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		requestHeaders := formatHeaders(r.Header, redact)
+		requestBody := &cappedBuffer{max: maxBytes}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = &teeReadCloser{ReadCloser: r.Body, copy: requestBody}
+		}
+		bw := &bodyLogResponseWriter{statusResponseWriter: statusResponseWriter{ResponseWriter: w}, body: &cappedBuffer{max: maxBytes}}
+
+		next.ServeHTTP(bw, r)
+
+		log.Printf("Sampled %s %s: request headers %s, request body %s; response %d, response headers %s, response body %s",
+			r.Method, r.URL.RequestURI(), requestHeaders, requestBody, bw.Status(), formatHeaders(w.Header(), redact), bw.body)
+	})
+}
+
+// formatHeaders formats header for the log with the values of the redacted headers hidden
+func formatHeaders(header http.Header, redact map[string]bool) string {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fields := make([]string, 0, len(names))
+	for _, name := range names {
+		value := strings.Join(header[name], ", ")
+		if redact[http.CanonicalHeaderKey(name)] {
+			value = "[REDACTED]"
+		}
+		fields = append(fields, fmt.Sprintf("%s: %q", name, value))
+	}
+	return "{" + strings.Join(fields, "; ") + "}"
+}
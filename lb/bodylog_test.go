@@ -0,0 +1,74 @@
+package lb
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBodyLogSamplesAtConfiguredRate(t *testing.T) {
+	handler := bodyLogHandler(BodyLogConfig{SampleRate: 0.25}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	logs := captureLog(t)
+
+	const requests = 2000
+	for i := 0; i < requests; i++ {
+		serve(handler, http.MethodGet, "/")
+	}
+	// 500 expected, with a standard deviation of about 19
+	if n := strings.Count(logs.String(), "Sampled GET /"); n < 400 || n > 600 {
+		t.Errorf("%d of %d requests logged, want about a quarter", n, requests)
+	}
+}
+
+func TestBodyLogTruncatesAndRedacts(t *testing.T) {
+	received := make(chan string, 1)
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- string(body)
+		w.Header().Set("Set-Cookie", "session=secret")
+		w.Header().Set("X-Visible", "shown")
+		io.WriteString(w, "response from the backend")
+	})
+	balancer := startTestLoadBalancer(t, Config{
+		Backends: []BackendConfig{{URL: server.URL}},
+		BodyLog:  BodyLogConfig{SampleRate: 1, MaxBytes: 8, RedactHeaders: []string{"x-api-key"}},
+	})
+	logs := captureLog(t)
+
+	r := httptest.NewRequest(http.MethodPost, "/orders?id=1", strings.NewReader("request for the backend"))
+	r.Header.Set("Authorization", "Bearer secret")
+	r.Header.Set("X-Api-Key", "secret")
+	r.Header.Set("X-Trace", "visible")
+	w := httptest.NewRecorder()
+	balancer.Handler().ServeHTTP(w, r)
+
+	// Bodies are proxied in full
+	if got := <-received; got != "request for the backend" {
+		t.Errorf("backend received %q, want the whole body", got)
+	}
+	if got := w.Body.String(); got != "response from the backend" {
+		t.Errorf("client received %q, want the whole body", got)
+	}
+
+	line := logs.String()
+	for _, want := range []string{
+		"Sampled POST /orders?id=1",
+		`request body "request " (truncated)`,
+		`response body "response" (truncated)`,
+		`Authorization: "[REDACTED]"`,
+		`X-Api-Key: "[REDACTED]"`,
+		`Set-Cookie: "[REDACTED]"`,
+		`X-Trace: "visible"`,
+		`X-Visible: "shown"`,
+		"response 200",
+	} {
+		if !strings.Contains(line, want) {
+			t.Errorf("log %q does not contain %q", line, want)
+		}
+	}
+	if strings.Contains(line, "secret") {
+		t.Errorf("log %q leaks a redacted value", line)
+	}
+}
@@ -0,0 +1,100 @@
+package lb
+
+import (
+	"sync"
+	"time"
+)
+
+// BreakerState is the state of a backend's circuit breaker
+type BreakerState string
+
+const (
+	// BreakerClosed lets requests through
+	BreakerClosed BreakerState = "closed"
+	// BreakerOpen keeps the backend out of rotation until the cooldown has passed
+	BreakerOpen BreakerState = "open"
+	// BreakerHalfOpen lets requests through again, the next result closes or reopens the breaker
+	BreakerHalfOpen BreakerState = "half-open"
+)
+
+// circuitBreaker takes a backend out of rotation after consecutive failed requests
+type circuitBreaker struct {
+	// threshold is the number of consecutive failures that opens the breaker, 0 disables it
+	threshold int
+	cooldown  time.Duration
+	state     BreakerState
+	failures  int
+	timer     *time.Timer
+	mutex     sync.Mutex
+}
+
+// newCircuitBreaker creates a closed circuitBreaker
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		state:     BreakerClosed,
+	}
+}
+
+// State returns the current state of the breaker
+func (cb *circuitBreaker) State() BreakerState {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	return cb.state
+}
+
+// RecordSuccess closes the breaker and clears the failure count
+func (cb *circuitBreaker) RecordSuccess() {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	cb.close()
+}
+
+// RecordFailure counts a failed request, opening the breaker when the threshold is reached
+// or when the trial requests of a half-open breaker fail
+func (cb *circuitBreaker) RecordFailure() {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	if cb.threshold <= 0 || cb.state == BreakerOpen {
+		return
+	}
+
+	cb.failures++
+	if cb.state == BreakerHalfOpen || cb.failures >= cb.threshold {
+		cb.state = BreakerOpen
+		cb.timer = time.AfterFunc(cb.cooldown, cb.halfOpen)
+		stateVersion.Add(1)
+	}
+}
+
+// Reset forces the breaker closed
+func (cb *circuitBreaker) Reset() {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	cb.close()
+}
+
+// halfOpen lets requests through again once the cooldown of an open breaker has passed
+func (cb *circuitBreaker) halfOpen() {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	if cb.state == BreakerOpen {
+		cb.state = BreakerHalfOpen
+		stateVersion.Add(1)
+	}
+}
+
+func (cb *circuitBreaker) close() {
+	cb.failures = 0
+	if cb.timer != nil {
+		cb.timer.Stop()
+		cb.timer = nil
+	}
+	if cb.state != BreakerClosed {
+		cb.state = BreakerClosed
+		stateVersion.Add(1)
+	}
+}
@@ -0,0 +1,43 @@
+package lb
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerOpensAndHalfOpens(t *testing.T) {
+	cb := newCircuitBreaker(2, 20*time.Millisecond)
+
+	cb.RecordFailure()
+	if state := cb.State(); state != BreakerClosed {
+		t.Fatalf("state after one failure = %s, want %s", state, BreakerClosed)
+	}
+	cb.RecordFailure()
+	if state := cb.State(); state != BreakerOpen {
+		t.Fatalf("state after two failures = %s, want %s", state, BreakerOpen)
+	}
+
+	waitFor(t, "breaker did not half-open after the cooldown", func() bool {
+		return cb.State() == BreakerHalfOpen
+	})
+	// A single failed trial request reopens the breaker
+	cb.RecordFailure()
+	if state := cb.State(); state != BreakerOpen {
+		t.Fatalf("state after a failed trial = %s, want %s", state, BreakerOpen)
+	}
+
+	cb.Reset()
+	if state := cb.State(); state != BreakerClosed {
+		t.Errorf("state after reset = %s, want %s", state, BreakerClosed)
+	}
+}
+
+func TestDisabledCircuitBreakerStaysClosed(t *testing.T) {
+	cb := newCircuitBreaker(0, time.Second)
+	for i := 0; i < 10; i++ {
+		cb.RecordFailure()
+	}
+	if state := cb.State(); state != BreakerClosed {
+		t.Errorf("state of a disabled breaker = %s, want %s", state, BreakerClosed)
+	}
+}
@@ -0,0 +1,317 @@
+package lb
+
+import (
+	"bytes"
+	"container/list"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxCacheEntrySize is the largest response body stored in the response cache
+const maxCacheEntrySize = 1 << 20
+
+// cacheableStatus lists the response status codes that may be cached
+var cacheableStatus = map[int]bool{
+	http.StatusOK:               true,
+	http.StatusMovedPermanently: true,
+	http.StatusNotFound:         true,
+}
+
+// perResponseHeaders describe a single response rather than the resource, so they are not
+// replayed from the cache: the date and age, the timings and IDs of the request it answered, and
+// the hop-by-hop headers
+var perResponseHeaders = []string{
+	"Date", "Age", "X-Cache", upstreamTimeHeader, totalTimeHeader, requestIDHeader,
+	"Traceparent", "Tracestate", "Traceresponse", "Server-Timing",
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// cacheEntry is a response stored in the response cache. generated is when the backend generated
+// it, going back by the Age it came with, so that the Age of a cached response keeps counting.
+type cacheEntry struct {
+	key       string
+	base      string
+	header    http.Header
+	status    int
+	body      []byte
+	generated time.Time
+	expires   time.Time
+}
+
+// responseCache is an in-memory LRU cache of backend responses to GET requests. Responses are
+// only stored when the backend marks them fresh for some time with Cache-Control or Expires.
+type responseCache struct {
+	capacity int
+	entries  map[string]*list.Element
+	order    *list.List
+	// varies holds, for every URL with cached responses, the request headers named by the Vary
+	// header of the last response to it
+	varies map[string]*variants
+	mutex  sync.Mutex
+}
+
+// variants tracks the cached responses to a single URL
+type variants struct {
+	vary  []string
+	count int
+}
+
+// newResponseCache creates a responseCache holding at most capacity responses
+func newResponseCache(capacity int) *responseCache {
+	return &responseCache{
+		capacity: capacity,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+		varies:   make(map[string]*variants),
+	}
+}
+
+// cacheKey extends the base key of a request with the values of the request headers the
+// response varies on
+func cacheKey(base string, vary []string, r *http.Request) string {
+	key := base
+	for _, name := range vary {
+		key += "\n" + name + ": " + strings.Join(r.Header.Values(name), ",")
+	}
+	return key
+}
+
+// get returns the fresh cached response to the request, if any
+func (c *responseCache) get(r *http.Request) *cacheEntry {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	base := coalesceKey(r)
+	v, ok := c.varies[base]
+	if !ok {
+		return nil
+	}
+	element, ok := c.entries[cacheKey(base, v.vary, r)]
+	if !ok {
+		return nil
+	}
+
+	entry := element.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.remove(element)
+		return nil
+	}
+
+	c.order.MoveToFront(element)
+	return entry
+}
+
+// put stores the response to the request if the backend allows it to be cached, without its
+// perResponseHeaders
+func (c *responseCache) put(r *http.Request, status int, header http.Header, body []byte) {
+	if !cacheableStatus[status] || header.Get("Set-Cookie") != "" {
+		return
+	}
+
+	ttl, ok := freshness(header)
+	if !ok {
+		return
+	}
+
+	var vary []string
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name == "*" {
+				return
+			} else if name != "" {
+				vary = append(vary, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+
+	now := time.Now()
+	generated := now
+	if age, err := strconv.Atoi(header.Get("Age")); err == nil && age > 0 {
+		generated = now.Add(-time.Duration(age) * time.Second)
+	}
+	header = header.Clone()
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			header.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range perResponseHeaders {
+		header.Del(name)
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	base := coalesceKey(r)
+	v, ok := c.varies[base]
+	if !ok {
+		v = &variants{}
+		c.varies[base] = v
+	}
+	v.vary = vary
+	entry := &cacheEntry{
+		key:       cacheKey(base, vary, r),
+		base:      base,
+		header:    header,
+		status:    status,
+		body:      body,
+		generated: generated,
+		expires:   now.Add(ttl),
+	}
+
+	if element, ok := c.entries[entry.key]; ok {
+		element.Value = entry
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.entries[entry.key] = c.order.PushFront(entry)
+	v.count++
+	for c.order.Len() > c.capacity {
+		c.remove(c.order.Back())
+	}
+}
+
+// remove drops a cached response, forgetting the URL once none of its responses are cached
+func (c *responseCache) remove(element *list.Element) {
+	entry := element.Value.(*cacheEntry)
+	c.order.Remove(element)
+	delete(c.entries, entry.key)
+
+	if v := c.varies[entry.base]; v != nil {
+		if v.count--; v.count <= 0 {
+			delete(c.varies, entry.base)
+		}
+	}
+}
+
+// freshness returns how long a response may be served from the cache, from the s-maxage or
+// max-age directives of Cache-Control or else the Expires header. It reports false when the
+// response must not be cached.
+func freshness(header http.Header) (time.Duration, bool) {
+	directives := make(map[string]string)
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			directives[strings.ToLower(name)] = strings.Trim(arg, `"`)
+		}
+	}
+
+	for _, name := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := directives[name]; ok {
+			return 0, false
+		}
+	}
+
+	for _, name := range []string{"s-maxage", "max-age"} {
+		if arg, ok := directives[name]; ok {
+			seconds, err := strconv.Atoi(arg)
+			if err != nil || seconds <= 0 {
+				return 0, false
+			}
+			return time.Duration(seconds) * time.Second, true
+		}
+	}
+
+	if expires := header.Get("Expires"); expires != "" {
+		at, err := http.ParseTime(expires)
+		if err != nil {
+			return 0, false
+		}
+		if ttl := time.Until(at); ttl > 0 {
+			return ttl, true
+		}
+	}
+
+	return 0, false
+}
+
+// cacheableRequest reports whether the response to the request may be served from or stored
+// in the cache
+func cacheableRequest(r *http.Request) bool {
+	if r.Method != http.MethodGet || r.Header.Get("Authorization") != "" {
+		return false
+	}
+
+	cacheControl := strings.ToLower(r.Header.Get("Cache-Control"))
+	return !strings.Contains(cacheControl, "no-store") && !strings.Contains(cacheControl, "no-cache")
+}
+
+// cacheHandler serves GET requests from the cache when a fresh response is stored, without
+// selecting a backend, and stores cacheable responses passed back by next
+func cacheHandler(cache *responseCache, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !cacheableRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if entry := cache.get(r); entry != nil {
+			for key, values := range entry.header {
+				w.Header()[key] = append([]string(nil), values...)
+			}
+			now := time.Now()
+			w.Header().Set("Date", now.UTC().Format(http.TimeFormat))
+			w.Header().Set("Age", strconv.Itoa(int(now.Sub(entry.generated)/time.Second)))
+			w.Header().Set("X-Cache", "HIT")
+			w.WriteHeader(entry.status)
+			w.Write(entry.body)
+			return
+		}
+
+		w.Header().Set("X-Cache", "MISS")
+		cw := &cachingResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(cw, r)
+		if cw.header != nil && !cw.incomplete {
+			cache.put(r, cw.status, cw.header, cw.body.Bytes())
+		}
+	})
+}
+
+// cachingResponseWriter passes a response through to the client while keeping a copy of it
+// for the cache, giving up on the copy once the body exceeds maxCacheEntrySize
+type cachingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	header http.Header
+	body   bytes.Buffer
+	// incomplete is set when the copy is incomplete and must not be cached
+	incomplete bool
+}
+
+func (cw *cachingResponseWriter) WriteHeader(status int) {
+	if cw.header == nil {
+		cw.status = status
+		cw.header = cw.ResponseWriter.Header().Clone()
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *cachingResponseWriter) Write(p []byte) (int, error) {
+	if cw.header == nil {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if !cw.incomplete {
+		if cw.body.Len()+len(p) > maxCacheEntrySize {
+			cw.incomplete = true
+			cw.body = bytes.Buffer{}
+		} else {
+			cw.body.Write(p)
+		}
+	}
+
+	n, err := cw.ResponseWriter.Write(p)
+	// The client went away, the copy may be missing the rest of the body
+	if err != nil {
+		cw.incomplete = true
+	}
+	return n, err
+}
+
+// Unwrap returns the underlying ResponseWriter so http.ResponseController can reach it
+func (cw *cachingResponseWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
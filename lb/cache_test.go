@@ -0,0 +1,146 @@
+package lb
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestResponseCache(t *testing.T) {
+	var hits atomic.Int32
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		n := hits.Add(1)
+		switch r.URL.Path {
+		case "/cached":
+			w.Header().Set("Cache-Control", "max-age=60")
+		case "/expires":
+			w.Header().Set("Expires", time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+		case "/no-store":
+			w.Header().Set("Cache-Control", "no-store, max-age=60")
+		}
+		fmt.Fprint(w, n)
+	})
+	handler := startTestLoadBalancer(t, Config{Backends: []BackendConfig{{URL: server.URL}}, CacheSize: 10}).Handler()
+
+	for _, tt := range []struct {
+		path   string
+		cached bool
+	}{
+		{"/cached", true},
+		{"/expires", true},
+		{"/no-store", false},
+		{"/uncacheable", false},
+	} {
+		hits.Store(0)
+		first := serve(handler, http.MethodGet, tt.path)
+		second := serve(handler, http.MethodGet, tt.path)
+
+		want, wantCache := int32(2), "MISS"
+		if tt.cached {
+			want, wantCache = 1, "HIT"
+		}
+		if n := hits.Load(); n != want {
+			t.Errorf("%s: %d backend requests for two identical GETs, want %d", tt.path, n, want)
+		}
+		if got := second.Header().Get("X-Cache"); got != wantCache {
+			t.Errorf("%s: second response X-Cache = %q, want %q", tt.path, got, wantCache)
+		}
+		if tt.cached && second.Body.String() != first.Body.String() {
+			t.Errorf("%s: cached body %q differs from the original %q", tt.path, second.Body.String(), first.Body.String())
+		}
+	}
+}
+
+func TestResponseCacheKeysByVary(t *testing.T) {
+	var hits atomic.Int32
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Language")
+		fmt.Fprint(w, r.Header.Get("Accept-Language"))
+	})
+	handler := startTestLoadBalancer(t, Config{Backends: []BackendConfig{{URL: server.URL}}, CacheSize: 10}).Handler()
+
+	get := func(language string) string {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept-Language", language)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Body.String()
+	}
+	for _, language := range []string{"en", "fr", "en", "fr"} {
+		if got := get(language); got != language {
+			t.Errorf("Accept-Language %s served the response for %q", language, got)
+		}
+	}
+	if n := hits.Load(); n != 2 {
+		t.Errorf("%d backend requests, want one for each language", n)
+	}
+}
+
+func TestResponseCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := newResponseCache(2)
+	header := http.Header{"Cache-Control": {"max-age=60"}}
+	request := func(path string) *http.Request {
+		return httptest.NewRequest(http.MethodGet, path, nil)
+	}
+
+	cache.put(request("/a"), http.StatusOK, header, nil)
+	cache.put(request("/b"), http.StatusOK, header, nil)
+	cache.get(request("/a"))
+	cache.put(request("/c"), http.StatusOK, header, nil)
+
+	for path, want := range map[string]bool{"/a": true, "/b": false, "/c": true} {
+		if cached := cache.get(request(path)) != nil; cached != want {
+			t.Errorf("%s cached = %t, want %t", path, cached, want)
+		}
+	}
+}
+
+func TestCacheHitDoesNotReplayPerResponseHeaders(t *testing.T) {
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Age", "10")
+		w.Header().Set("Date", "Mon, 02 Jan 2006 15:04:05 GMT")
+		w.Header().Set(requestIDHeader, r.Header.Get(requestIDHeader))
+		w.Header().Set("Traceresponse", "00-"+r.Header.Get(requestIDHeader))
+		w.Header().Set("Connection", "X-Hop")
+		w.Header().Set("X-Hop", "1")
+		w.Header().Set("X-Resource", "kept")
+		fmt.Fprint(w, "body")
+	})
+	handler := startTestLoadBalancer(t, Config{
+		Backends:  []BackendConfig{{URL: server.URL}},
+		CacheSize: 10,
+		Proxy:     ProxyOptions{TimingHeaders: true},
+	}).Handler()
+	get := func(requestID string) http.Header {
+		r := httptest.NewRequest(http.MethodGet, "/resource", nil)
+		r.Header.Set(requestIDHeader, requestID)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Header()
+	}
+
+	if miss := get("first"); miss.Get("X-Cache") != "MISS" || miss.Get(upstreamTimeHeader) == "" {
+		t.Fatalf("first response headers = %v, want a MISS with timings", miss)
+	}
+	hit := get("second")
+	if hit.Get("X-Cache") != "HIT" || hit.Get("X-Resource") != "kept" {
+		t.Fatalf("second response headers = %v, want a HIT keeping X-Resource", hit)
+	}
+	for _, name := range []string{requestIDHeader, "Traceresponse", upstreamTimeHeader, totalTimeHeader, "X-Hop"} {
+		if got := hit.Get(name); got != "" {
+			t.Errorf("HIT replayed %s: %q from the first response", name, got)
+		}
+	}
+	if date, err := http.ParseTime(hit.Get("Date")); err != nil || time.Since(date) > time.Minute {
+		t.Errorf("HIT Date = %q, want the current time", hit.Get("Date"))
+	}
+	if got := hit.Get("Age"); got != "10" && got != "11" {
+		t.Errorf("HIT Age = %q, want the 10 seconds it came with", got)
+	}
+}
@@ -0,0 +1,96 @@
+package lb
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// certCheckInterval is how often handshakes look for a new certificate on disk
+const certCheckInterval = time.Second
+
+// CertReloader serves the certificate of a TLS listener from a certificate and key file,
+// reloading them when they change so that certificates can be rotated without a restart. Use
+// its GetCertificate as tls.Config.GetCertificate.
+type CertReloader struct {
+	certFile, keyFile string
+
+	cert atomic.Pointer[tls.Certificate]
+	// mutex serializes checks of the files, made by handshakes at most every certCheckInterval
+	mutex           sync.Mutex
+	checked         time.Time
+	certMod, keyMod time.Time
+}
+
+// NewCertReloader loads the certificate and key at certFile and keyFile
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	cr := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if err := cr.reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// GetCertificate returns the current certificate, first reloading it if the files changed since
+// the last check. A certificate that fails to load is logged and the previous one kept.
+func (cr *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mutex.Lock()
+	if time.Since(cr.checked) >= certCheckInterval {
+		cr.checked = time.Now()
+		if cr.changed() {
+			if err := cr.reload(); err != nil {
+				log.Printf("Error reloading TLS certificate, keeping the previous one: %s", err)
+			} else {
+				log.Printf("Reloaded TLS certificate from %s", cr.certFile)
+			}
+		}
+	}
+	cr.mutex.Unlock()
+
+	return cr.cert.Load(), nil
+}
+
+// changed reports whether either file was modified since it was last loaded, it must be called
+// with the mutex held
+func (cr *CertReloader) changed() bool {
+	certMod, keyMod, err := cr.modTimes()
+	if err != nil {
+		log.Printf("Error checking TLS certificate: %s", err)
+		return false
+	}
+	return !certMod.Equal(cr.certMod) || !keyMod.Equal(cr.keyMod)
+}
+
+// reload loads the certificate and key, it must be called with the mutex held
+func (cr *CertReloader) reload() error {
+	// The times are taken first so that a file written during the load is loaded again later
+	certMod, keyMod, err := cr.modTimes()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading TLS certificate: %w", err)
+	}
+
+	cr.cert.Store(&cert)
+	cr.certMod, cr.keyMod = certMod, keyMod
+	return nil
+}
+
+// modTimes returns the modification times of the certificate and key files
+func (cr *CertReloader) modTimes() (certMod, keyMod time.Time, err error) {
+	certInfo, err := os.Stat(cr.certFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	keyInfo, err := os.Stat(cr.keyFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
@@ -0,0 +1,116 @@
+package lb
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self-signed certificate for name and its key to certFile and keyFile, with
+// modification times at mod
+func writeCert(t *testing.T, certFile, keyFile, name string, mod time.Time) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for file, block := range map[string]*pem.Block{
+		certFile: {Type: "CERTIFICATE", Bytes: der},
+		keyFile:  {Type: "EC PRIVATE KEY", Bytes: keyDER},
+	} {
+		if err := os.WriteFile(file, pem.EncodeToMemory(block), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		// Files rewritten within the resolution of the file system clock still look modified
+		if err := os.Chtimes(file, mod, mod); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCertReloaderServesRotatedCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	mod := time.Now().Add(-time.Minute)
+	writeCert(t, certFile, keyFile, "old", mod)
+	certs, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("NewCertReloader: %s", err)
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.Listener = tls.NewListener(server.Listener, &tls.Config{GetCertificate: certs.GetCertificate})
+	server.Start()
+	defer server.Close()
+	served := func() string {
+		t.Helper()
+		// Every request makes a new handshake
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			DisableKeepAlives: true,
+		}}
+		resp, err := client.Get("https://" + server.Listener.Addr().String())
+		if err != nil {
+			t.Fatalf("GET: %s", err)
+		}
+		resp.Body.Close()
+		return resp.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	// Handshakes look at the files at most every certCheckInterval, skip the wait
+	nextCheck := func() {
+		certs.mutex.Lock()
+		certs.checked = time.Time{}
+		certs.mutex.Unlock()
+	}
+
+	if got := served(); got != "old" {
+		t.Fatalf("certificate = %s, want old", got)
+	}
+
+	writeCert(t, certFile, keyFile, "new", mod.Add(time.Second))
+	nextCheck()
+	if got := served(); got != "new" {
+		t.Errorf("certificate after rotation = %s, want new", got)
+	}
+
+	// A broken certificate keeps the previous one in use
+	logs := captureLog(t)
+	if err := os.WriteFile(certFile, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(certFile, mod.Add(2*time.Second), mod.Add(2*time.Second))
+	nextCheck()
+	if got := served(); got != "new" {
+		t.Errorf("certificate after a broken rotation = %s, want new", got)
+	}
+	if !strings.Contains(logs.String(), "keeping the previous one") {
+		t.Errorf("log = %q, want the reload error reported", logs.String())
+	}
+}
@@ -0,0 +1,77 @@
+package lb
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// clientIPKey is the context key under which the client IP resolved from a header is stored
+type clientIPKey struct{}
+
+// ClientIP returns the IP address of the client that sent the request: the one read from
+// Config.ClientIPHeader when set and sent by a trusted proxy, or else the address of the
+// connection. Selectors can use it to hash clients to backends, as the limits and logs of the
+// load balancer do.
+func ClientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+	return connectionIP(r)
+}
+
+// connectionIP returns the IP address the request's connection comes from, whatever its headers say
+func connectionIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// inRanges reports whether ip is a valid address in one of the ranges
+func inRanges(ip string, ranges []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, ipNet := range ranges {
+		if ipNet.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// headerClientIP returns the client IP given in header, falling back to the first address in
+// X-Forwarded-For. It returns false if neither holds a valid IP address.
+func headerClientIP(r *http.Request, header string) (string, bool) {
+	if ip := strings.TrimSpace(r.Header.Get(header)); net.ParseIP(ip) != nil {
+		return ip, true
+	}
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		first, _, _ := strings.Cut(forwarded, ",")
+		if ip := strings.TrimSpace(first); net.ParseIP(ip) != nil {
+			return ip, true
+		}
+	}
+	return "", false
+}
+
+// clientIPHandler takes the client IP of requests from header, e.g. True-Client-IP or
+// CF-Connecting-IP, for everything after it. The header is only believed on connections from
+// one of the trusted proxy ranges, as clients can send it themselves. Other requests, and those
+// without a valid address in the header or X-Forwarded-For, keep the address of their connection.
+func clientIPHandler(header string, trusted []*net.IPNet, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !inRanges(connectionIP(r), trusted) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if ip, ok := headerClientIP(r, header); ok {
+			r = r.WithContext(context.WithValue(r.Context(), clientIPKey{}, ip))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
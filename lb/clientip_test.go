@@ -0,0 +1,101 @@
+package lb
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// trustedProxy is the connection address of httptest requests, trusted with the client IP header
+const trustedProxy = "192.0.2.1:1234"
+
+func TestClientIPHeaderIsUsedByLogsAndSelectors(t *testing.T) {
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {})
+	selected := make(chan string, 1)
+	selector := func(r *http.Request, candidates []Backend) Backend {
+		selected <- ClientIP(r)
+		return nil
+	}
+	out := &logBuffer{}
+	handler := startTestLoadBalancer(t, Config{
+		Backends:        []BackendConfig{{URL: server.URL}},
+		ClientIPHeader:  "True-Client-IP",
+		TrustedProxies:  []string{"192.0.2.0/24"},
+		Proxy:           ProxyOptions{Selector: selector},
+		AccessLog:       out,
+		AccessLogFormat: AccessLogJSON,
+	}).Handler()
+
+	tests := []struct {
+		name, remoteAddr string
+		header           map[string]string
+		want             string
+	}{
+		{"custom header", trustedProxy, map[string]string{"True-Client-IP": "203.0.113.7", "X-Forwarded-For": "198.51.100.2"}, "203.0.113.7"},
+		{"X-Forwarded-For fallback", trustedProxy, map[string]string{"X-Forwarded-For": "198.51.100.2, 10.0.0.1"}, "198.51.100.2"},
+		{"invalid header", trustedProxy, map[string]string{"True-Client-IP": "unknown"}, "192.0.2.1"},
+		{"untrusted connection", "198.51.100.9:1234", map[string]string{"True-Client-IP": "203.0.113.7"}, "198.51.100.9"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = tt.remoteAddr
+		for name, value := range tt.header {
+			r.Header.Set(name, value)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+
+		if got := <-selected; got != tt.want {
+			t.Errorf("%s: selector saw client IP %s, want %s", tt.name, got, tt.want)
+		}
+		var entry AccessLogEntry
+		lines := out.String()
+		out.buf.Reset()
+		if err := json.Unmarshal([]byte(lines), &entry); err != nil || entry.ClientIP != tt.want {
+			t.Errorf("%s: access log %q, want client IP %s", tt.name, lines, tt.want)
+		}
+	}
+}
+
+func TestClientIPHeaderIsUsedByPerClientLimit(t *testing.T) {
+	var slow atomic.Int32
+	release := make(chan struct{})
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			slow.Add(1)
+			<-release
+		}
+	})
+	handler := startTestLoadBalancer(t, Config{
+		Backends:         []BackendConfig{{URL: server.URL}},
+		MaxRequestsPerIP: 1,
+		ClientIPHeader:   "CF-Connecting-IP",
+		TrustedProxies:   []string{"192.0.2.0/24"},
+	}).Handler()
+	from := func(ip, path string) int {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.RemoteAddr = trustedProxy
+		r.Header.Set("CF-Connecting-IP", ip)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		from("203.0.113.7", "/slow")
+	}()
+	waitFor(t, "slow request did not reach the backend", func() bool { return slow.Load() == 1 })
+
+	// Clients behind the same proxy are told apart by the header
+	if code := from("203.0.113.7", "/"); code != http.StatusTooManyRequests {
+		t.Errorf("second request of the client = %d, want %d", code, http.StatusTooManyRequests)
+	}
+	if code := from("203.0.113.8", "/"); code != http.StatusOK {
+		t.Errorf("request of another client behind the proxy = %d, want %d", code, http.StatusOK)
+	}
+	close(release)
+	<-done
+}
@@ -0,0 +1,75 @@
+package lb
+
+import (
+	"bytes"
+	"net/http"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// coalescedResponse captures a backend response in memory so it can be replayed to every
+// request that was waiting on it
+type coalescedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newCoalescedResponse() *coalescedResponse {
+	return &coalescedResponse{header: make(http.Header)}
+}
+
+func (cr *coalescedResponse) Header() http.Header {
+	return cr.header
+}
+
+func (cr *coalescedResponse) WriteHeader(status int) {
+	if cr.status == 0 {
+		cr.status = status
+	}
+}
+
+func (cr *coalescedResponse) Write(p []byte) (int, error) {
+	if cr.status == 0 {
+		cr.status = http.StatusOK
+	}
+	return cr.body.Write(p)
+}
+
+// writeTo copies the captured response to w. Header values are copied so waiters never
+// share slices that a later handler could modify.
+func (cr *coalescedResponse) writeTo(w http.ResponseWriter) {
+	for key, values := range cr.header {
+		w.Header()[key] = append([]string(nil), values...)
+	}
+
+	status := cr.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.WriteHeader(status)
+	w.Write(cr.body.Bytes())
+}
+
+// coalesceKey identifies requests that can share a single upstream call
+func coalesceKey(r *http.Request) string {
+	return r.Method + " " + r.Host + r.URL.RequestURI()
+}
+
+// canCoalesce reports whether the request may share its response with identical requests
+func canCoalesce(r *http.Request, route Route) bool {
+	return route.Coalesce && r.Method == http.MethodGet
+}
+
+// serveCoalesced makes a single call to forward for identical concurrent requests and writes
+// its response to each of them. The upstream call runs with the context of the first request,
+// so if that client goes away the waiting requests see the same error.
+func serveCoalesced(group *singleflight.Group, w http.ResponseWriter, r *http.Request, forward func(http.ResponseWriter)) {
+	v, _, _ := group.Do(coalesceKey(r), func() (interface{}, error) {
+		resp := newCoalescedResponse()
+		forward(resp)
+		return resp, nil
+	})
+
+	v.(*coalescedResponse).writeTo(w)
+}
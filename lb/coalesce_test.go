@@ -0,0 +1,58 @@
+package lb
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIdenticalGetsShareOneUpstreamCall(t *testing.T) {
+	var hits atomic.Int32
+	release := make(chan struct{})
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		<-release
+		fmt.Fprint(w, "shared")
+	})
+	routes := []Route{{Prefix: "/items", Coalesce: true}}
+	handler := startTestLoadBalancer(t, Config{Backends: []BackendConfig{{URL: server.URL}}, Routes: routes}).Handler()
+
+	for _, tt := range []struct {
+		path string
+		want int32
+	}{
+		{"/items?page=1", 1},
+		{"/other", 5},
+	} {
+		hits.Store(0)
+		release = make(chan struct{})
+		codes := make([]int, 5)
+		bodies := make([]string, 5)
+		var wg sync.WaitGroup
+		for i := range codes {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				w := serve(handler, http.MethodGet, tt.path)
+				codes[i], bodies[i] = w.Code, w.Body.String()
+			}(i)
+		}
+		// Let the other requests catch up with the first one before it is answered
+		waitFor(t, "no request reached the backend", func() bool { return hits.Load() > 0 })
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+		wg.Wait()
+
+		if got := hits.Load(); got != tt.want {
+			t.Errorf("%s: %d upstream calls for 5 identical requests, want %d", tt.path, got, tt.want)
+		}
+		for i := range codes {
+			if codes[i] != http.StatusOK || bodies[i] != "shared" {
+				t.Errorf("%s: request %d got %d %q, want %d %q", tt.path, i, codes[i], bodies[i], http.StatusOK, "shared")
+			}
+		}
+	}
+}
@@ -0,0 +1,447 @@
+package lb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Duration is a time.Duration that is written as a string such as "2s" in the config file
+type Duration time.Duration
+
+// UnmarshalJSON parses a duration string such as "1.5s" or "300ms"
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(duration)
+	return nil
+}
+
+// MarshalJSON writes the duration as a string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// FileConfig describes the load balancer configuration file
+type FileConfig struct {
+	Backends []BackendConfig `json:"backends"`
+	Routes   []Route         `json:"routes,omitempty"`
+	// ActiveGroup is the group of backends receiving requests, e.g. blue or green. Empty sends
+	// requests to all backends at startup and keeps the active group on reload.
+	ActiveGroup string `json:"activeGroup,omitempty"`
+}
+
+// BackendConfig describes a single backend server in the config file
+type BackendConfig struct {
+	URL string `json:"url"`
+	// Weight defaults to 1 when omitted
+	Weight *int `json:"weight,omitempty"`
+	// Tags label the backend so routes can select it, they are fixed once the backend is added
+	Tags map[string]string `json:"tags,omitempty"`
+	// KeepAlive tunes reuse of upstream connections, it is fixed once the backend is added
+	KeepAlive KeepAliveConfig `json:"keepAlive,omitempty"`
+	// Ramp lets a recovered backend take only a few requests at first, it is fixed once the
+	// backend is added
+	Ramp RampConfig `json:"ramp,omitempty"`
+	// HealthStatusCodes are the health check responses that count as healthy, defaults to 200.
+	// Redirects are not followed, so a 3xx is only healthy when listed here.
+	HealthStatusCodes []int `json:"healthStatusCodes,omitempty"`
+	// HealthMode is strict (default), requiring HealthStatusCodes, or reachable, accepting any response
+	HealthMode HealthMode `json:"healthMode,omitempty"`
+	// HealthPaths are the health endpoints checked instead of /health
+	HealthPaths []string `json:"healthPaths,omitempty"`
+	// HealthAggregation combines the results of HealthPaths: all (default), any or quorum
+	HealthAggregation HealthAggregation `json:"healthAggregation,omitempty"`
+	// HealthMethod is the HTTP method of health checks, GET (default), HEAD or POST
+	HealthMethod string `json:"healthMethod,omitempty"`
+	// HealthBody is the body of POST health checks, sent with HealthContentType, application/json
+	// by default
+	HealthBody        string `json:"healthBody,omitempty"`
+	HealthContentType string `json:"healthContentType,omitempty"`
+	// HealthTimeout fails a health check when the backend takes longer to respond, 5s by default
+	HealthTimeout Duration `json:"healthTimeout,omitempty"`
+	// Zone is the availability zone of the backend, used by the locality strategy
+	Zone string `json:"zone,omitempty"`
+	// Group places the backend in a deployment, e.g. blue or green, that only receives requests
+	// while it is the activeGroup. Backends without a group receive requests of every group.
+	Group string `json:"group,omitempty"`
+	// Standby only sends requests to the backend while too few primary backends are available,
+	// it is fixed once the backend is added
+	Standby bool `json:"standby,omitempty"`
+	// ProxyProtocol sends the client address to the backend in a PROXY protocol header, v1 or v2
+	ProxyProtocol ProxyProtocol `json:"proxyProtocol,omitempty"`
+	// AcceptEncoding replaces the Accept-Encoding header sent to the backend, "strip" removes it
+	AcceptEncoding string `json:"acceptEncoding,omitempty"`
+	// RemoveHeaders are removed from requests before they are sent to the backend
+	RemoveHeaders []string `json:"removeHeaders,omitempty"`
+	// StatusRemap replaces status codes of backend responses, e.g. {"418": 400}
+	StatusRemap map[int]int `json:"statusRemap,omitempty"`
+	// MaxConnections caps the active connections of the backend, 0 means no cap
+	MaxConnections int `json:"maxConnections,omitempty"`
+	// MaxRPS caps the requests sent to the backend per second, 0 means no cap. It is fixed once
+	// the backend is added.
+	MaxRPS float64 `json:"maxRPS,omitempty"`
+	// ResetConnectionsAfter closes the idle connections to the backend after this many
+	// consecutive errors proxying to it, 0 keeps them
+	ResetConnectionsAfter int `json:"resetConnectionsAfter,omitempty"`
+	// DrainFile drains the backend while a marker file exists at this path
+	DrainFile string `json:"drainFile,omitempty"`
+	// Maintenance schedules windows during which the backend receives no requests and failed
+	// health checks are not counted against it
+	Maintenance []MaintenanceWindow `json:"maintenance,omitempty"`
+	// HostMode sets the Host header sent to the backend: backend (default), preserve or override
+	HostMode HostMode `json:"hostMode,omitempty"`
+	// Host is the Host header sent when HostMode is override
+	Host string `json:"host,omitempty"`
+	// StartupGracePeriod keeps a newly added backend out of rotation until it passes a health
+	// check, without counting failed checks against it for this long
+	StartupGracePeriod Duration `json:"startupGracePeriod,omitempty"`
+}
+
+// KeepAliveConfig tunes reuse of connections to a backend, zero values keep the transport defaults
+type KeepAliveConfig struct {
+	// Disable opens a new connection for every request
+	Disable bool `json:"disable,omitempty"`
+	// MaxIdleConns is the number of idle connections kept open to the backend
+	MaxIdleConns int `json:"maxIdleConns,omitempty"`
+	// IdleTimeout closes idle connections after this long
+	IdleTimeout Duration `json:"idleTimeout,omitempty"`
+}
+
+// RampConfig gates the requests sent to a backend that recovered from failed health checks, until
+// it proves stable
+type RampConfig struct {
+	// Requests is the number of requests let through per Interval while ramping, 0 disables the ramp
+	Requests int `json:"requests,omitempty"`
+	// Interval defaults to 1s
+	Interval Duration `json:"interval,omitempty"`
+	// Stable is the number of successful responses in a row after which the backend gets full
+	// traffic, it defaults to Requests. A failed request starts the count over.
+	Stable int `json:"stable,omitempty"`
+}
+
+// GetWeight returns the configured weight, or 1 if none was set
+func (bc BackendConfig) GetWeight() int {
+	if bc.Weight == nil {
+		return 1
+	}
+	return *bc.Weight
+}
+
+// options returns the backend options for the settings of the backend
+func (bc BackendConfig) options() []BackendOption {
+	return []BackendOption{
+		WithTags(bc.Tags),
+		WithKeepAlive(bc.KeepAlive),
+		WithRamp(bc.Ramp),
+		WithHealthStatusCodes(bc.HealthStatusCodes...),
+		WithHealthMode(bc.HealthMode),
+		WithHealthMethod(bc.HealthMethod),
+		WithHealthBody(bc.HealthBody, bc.HealthContentType),
+		WithHealthTimeout(time.Duration(bc.HealthTimeout)),
+		WithHealthEndpoints(bc.HealthPaths, bc.HealthAggregation),
+		WithDrainFile(bc.DrainFile),
+		WithMaintenanceWindows(bc.Maintenance...),
+		WithMaxConnections(bc.MaxConnections),
+		WithMaxRPS(bc.MaxRPS),
+		WithConnectionReset(bc.ResetConnectionsAfter),
+		WithProxyProtocol(bc.ProxyProtocol),
+		WithAcceptEncoding(bc.AcceptEncoding),
+		WithRemovedHeaders(bc.RemoveHeaders...),
+		WithStatusRemap(bc.StatusRemap),
+		WithHostMode(bc.HostMode, bc.Host),
+		WithZone(bc.Zone),
+		WithGroup(bc.Group),
+		WithStandby(bc.Standby),
+		WithStartupGracePeriod(time.Duration(bc.StartupGracePeriod)),
+		WithConfig(bc),
+	}
+}
+
+// LoadConfig reads and validates the config file at path
+func LoadConfig(path string) (*FileConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config FileConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("validating %s: %w", path, err)
+	}
+
+	return &config, nil
+}
+
+// CheckConfig validates the config file at path without applying it, returning a summary of
+// its contents. Unlike LoadConfig it also rejects unknown fields, which are usually typos.
+func CheckConfig(path string) (string, error) {
+	config, err := LoadConfig(path)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&FileConfig{}); err != nil {
+		return "", fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	return fmt.Sprintf("%s: OK, %d backends, %d routes", path, len(config.Backends), len(config.Routes)), nil
+}
+
+// Validate checks the backends and routes for invalid settings
+func (c *FileConfig) Validate() error {
+	seen := make(map[string]bool)
+	for i, bc := range c.Backends {
+		u, err := url.Parse(bc.URL)
+		if err != nil {
+			return fmt.Errorf("backend %d: invalid url %q: %w", i, bc.URL, err)
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("backend %d: url %q must include a scheme and host", i, bc.URL)
+		}
+		// http://host:3001 and http://host:3001/ are the same backend, https://host:3001 is another
+		if seen[normalizeURL(u)] {
+			return fmt.Errorf("backend %d: duplicate url %q", i, bc.URL)
+		}
+		seen[normalizeURL(u)] = true
+
+		if bc.GetWeight() < 0 {
+			return fmt.Errorf("backend %d: weight must not be negative", i)
+		}
+		switch bc.HostMode {
+		case "", HostModeBackend, HostModePreserve:
+		case HostModeOverride:
+			if bc.Host == "" {
+				return fmt.Errorf("backend %d: host is required with hostMode %q", i, bc.HostMode)
+			}
+		default:
+			return fmt.Errorf("backend %d: unknown hostMode %q", i, bc.HostMode)
+		}
+		switch bc.HealthMethod {
+		case "", http.MethodGet, http.MethodHead, http.MethodPost:
+		default:
+			return fmt.Errorf("backend %d: healthMethod must be GET, HEAD or POST, got %q", i, bc.HealthMethod)
+		}
+		if (bc.HealthBody != "" || bc.HealthContentType != "") && bc.HealthMethod != http.MethodPost {
+			return fmt.Errorf("backend %d: healthBody and healthContentType require healthMethod POST", i)
+		}
+		for _, path := range bc.HealthPaths {
+			if !strings.HasPrefix(path, "/") {
+				return fmt.Errorf("backend %d: health path %q must start with /", i, path)
+			}
+		}
+		switch bc.HealthMode {
+		case "", HealthModeStrict:
+		case HealthModeReachable:
+			if len(bc.HealthStatusCodes) > 0 {
+				return fmt.Errorf("backend %d: healthStatusCodes cannot be used with healthMode %q", i, bc.HealthMode)
+			}
+		default:
+			return fmt.Errorf("backend %d: unknown healthMode %q", i, bc.HealthMode)
+		}
+		switch bc.HealthAggregation {
+		case "", HealthAggregationAll, HealthAggregationAny, HealthAggregationQuorum:
+		default:
+			return fmt.Errorf("backend %d: unknown healthAggregation %q", i, bc.HealthAggregation)
+		}
+		for _, code := range bc.HealthStatusCodes {
+			if code < 100 || code > 599 {
+				return fmt.Errorf("backend %d: invalid health status code %d", i, code)
+			}
+		}
+		switch bc.ProxyProtocol {
+		case "", ProxyProtocolV1, ProxyProtocolV2:
+		default:
+			return fmt.Errorf("backend %d: unknown proxyProtocol %q", i, bc.ProxyProtocol)
+		}
+		if bc.HealthTimeout < 0 {
+			return fmt.Errorf("backend %d: healthTimeout must not be negative", i)
+		}
+		for j, window := range bc.Maintenance {
+			if !window.End.After(window.Start) {
+				return fmt.Errorf("backend %d: maintenance window %d must end after it starts", i, j)
+			}
+		}
+		if bc.MaxConnections < 0 {
+			return fmt.Errorf("backend %d: maxConnections must not be negative", i)
+		}
+		if bc.MaxRPS < 0 {
+			return fmt.Errorf("backend %d: maxRPS must not be negative", i)
+		}
+		if bc.ResetConnectionsAfter < 0 {
+			return fmt.Errorf("backend %d: resetConnectionsAfter must not be negative", i)
+		}
+		if err := validateHeaderNames(bc.RemoveHeaders); err != nil {
+			return fmt.Errorf("backend %d: removeHeaders: %w", i, err)
+		}
+		if err := validateStatusRemap(bc.StatusRemap); err != nil {
+			return fmt.Errorf("backend %d: statusRemap: %w", i, err)
+		}
+		if bc.KeepAlive.MaxIdleConns < 0 || bc.KeepAlive.IdleTimeout < 0 {
+			return fmt.Errorf("backend %d: keep-alive settings must not be negative", i)
+		}
+		if bc.Ramp.Requests < 0 || bc.Ramp.Interval < 0 || bc.Ramp.Stable < 0 {
+			return fmt.Errorf("backend %d: ramp settings must not be negative", i)
+		}
+	}
+
+	for i, route := range c.Routes {
+		if !strings.HasPrefix(route.Prefix, "/") {
+			return fmt.Errorf("route %d: prefix %q must start with /", i, route.Prefix)
+		}
+		if route.Timeout < 0 {
+			return fmt.Errorf("route %d: timeout must not be negative", i)
+		}
+		if route.Deadline < 0 {
+			return fmt.Errorf("route %d: deadline must not be negative", i)
+		}
+		if route.Retries < 0 {
+			return fmt.Errorf("route %d: retries must not be negative", i)
+		}
+		if route.StripPrefix != "" && !strings.HasPrefix(route.StripPrefix, "/") {
+			return fmt.Errorf("route %d: stripPrefix %q must start with /", i, route.StripPrefix)
+		}
+		if route.AddPrefix != "" && !strings.HasPrefix(route.AddPrefix, "/") {
+			return fmt.Errorf("route %d: addPrefix %q must start with /", i, route.AddPrefix)
+		}
+		if err := validateHeaderNames(route.RemoveHeaders); err != nil {
+			return fmt.Errorf("route %d: removeHeaders: %w", i, err)
+		}
+		if route.Strategy != "" {
+			if _, err := NewStrategy(route.Strategy, StrategyConfig{}); err != nil {
+				return fmt.Errorf("route %d: %w", i, err)
+			}
+		}
+		if route.FlushInterval < 0 {
+			return fmt.Errorf("route %d: flushInterval must not be negative", i)
+		}
+		if route.MaxBufferSize < 0 {
+			return fmt.Errorf("route %d: maxBufferSize must not be negative", i)
+		}
+	}
+
+	if c.ActiveGroup != "" {
+		found := false
+		for _, bc := range c.Backends {
+			if bc.Group == c.ActiveGroup {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("no backend belongs to activeGroup %q", c.ActiveGroup)
+		}
+	}
+
+	return nil
+}
+
+// validateHeaderNames checks that names are usable as header names
+func validateHeaderNames(names []string) error {
+	for _, name := range names {
+		if name == "" || strings.ContainsAny(name, " \t\r\n:") {
+			return fmt.Errorf("invalid header name %q", name)
+		}
+	}
+	return nil
+}
+
+// changedSettings returns the JSON names of the settings that differ between the BackendConfig
+// of a backend and the one it is reloaded with, leaving out the URL, which may be spelled
+// differently, and the weight, which is updated in place
+func changedSettings(old, reloaded BackendConfig) []string {
+	var changed []string
+	oldValue, newValue := reflect.ValueOf(old), reflect.ValueOf(reloaded)
+	for i := 0; i < oldValue.NumField(); i++ {
+		field := oldValue.Type().Field(i)
+		if field.Name == "URL" || field.Name == "Weight" {
+			continue
+		}
+		if !reflect.DeepEqual(oldValue.Field(i).Interface(), newValue.Field(i).Interface()) {
+			changed = append(changed, strings.Split(field.Tag.Get("json"), ",")[0])
+		}
+	}
+	return changed
+}
+
+// validateStatusRemap checks that remap only maps between status codes of responses with a
+// body, so that its headers and body still match the remapped status
+func validateStatusRemap(remap map[int]int) error {
+	for from, to := range remap {
+		for _, code := range []int{from, to} {
+			if code < 200 || code > 599 {
+				return fmt.Errorf("invalid status code %d", code)
+			}
+			if code == http.StatusNoContent || code == http.StatusNotModified {
+				return fmt.Errorf("status code %d has no body and cannot be remapped", code)
+			}
+		}
+	}
+	return nil
+}
+
+// ApplyConfig brings the pool in line with config: new backends are added, backends no longer
+// listed are removed and drained, the weights of the remaining ones are updated in place and those
+// with any other setting changed are replaced, since the settings are fixed once a backend is
+// created
+func ApplyConfig(pool ServerPool, config *FileConfig, opts ...BackendOption) {
+	current := make(map[string]Backend)
+	for _, backend := range pool.GetBackends() {
+		current[normalizeURL(backend.GetURL())] = backend
+	}
+
+	wanted := make(map[string]bool)
+	for _, bc := range config.Backends {
+		// URLs have already been validated by LoadConfig
+		u, _ := url.Parse(bc.URL)
+		key := normalizeURL(u)
+		wanted[key] = true
+
+		if existing, ok := current[key]; ok {
+			changed := changedSettings(existing.GetConfig(), bc)
+			if len(changed) == 0 {
+				existing.SetWeight(bc.GetWeight())
+				continue
+			}
+			pool.RemoveBackend(existing)
+			log.Printf("Replacing backend %s, changed: %s", u, strings.Join(changed, ", "))
+		}
+
+		backend := NewBackend(bc.URL, append(bc.options(), opts...)...)
+		backend.SetWeight(bc.GetWeight())
+		pool.AddBackend(backend)
+		log.Printf("Added backend %s", u)
+	}
+
+	for key, backend := range current {
+		if !wanted[key] {
+			pool.RemoveBackend(backend)
+			log.Printf("Removed backend %s, draining %d active connections", backend.GetURL(), backend.GetActiveConnections())
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package lb
+
+import (
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// countingReader counts the bytes read from a request body
+type countingReader struct {
+	io.ReadCloser
+	count *atomic.Int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.ReadCloser.Read(p)
+	cr.count.Add(int64(n))
+	return n, err
+}
+
+// countingResponseWriter counts the bytes written to a response body
+type countingResponseWriter struct {
+	http.ResponseWriter
+	count *atomic.Int64
+}
+
+func (cw *countingResponseWriter) Write(p []byte) (int, error) {
+	n, err := cw.ResponseWriter.Write(p)
+	cw.count.Add(int64(n))
+	return n, err
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer for flushing and hijacking
+func (cw *countingResponseWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// statusResponseWriter records the status code written to a response
+type statusResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusResponseWriter) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusResponseWriter) Write(p []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(p)
+}
+
+// Status returns the status code of the response, 200 if none was written explicitly
+func (sw *statusResponseWriter) Status() int {
+	if sw.status == 0 {
+		return http.StatusOK
+	}
+	return sw.status
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer for flushing and hijacking
+func (sw *statusResponseWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// Timing headers added to responses when enabled
+const (
+	upstreamTimeHeader = "X-LB-Upstream-Time"
+	totalTimeHeader    = "X-LB-Total-Time"
+)
+
+// requestTimingKey is the context key under which the requestTiming of a request is stored
+type requestTimingKey struct{}
+
+// requestTiming records when the handler started on a request and when its latest attempt to
+// proxy it to a backend started
+type requestTiming struct {
+	start         time.Time
+	upstreamStart time.Time
+}
+
+// timingResponseWriter adds the time spent proxying to the backend and the total time spent on
+// the request as headers when the response headers are written
+type timingResponseWriter struct {
+	http.ResponseWriter
+	timing      *requestTiming
+	wroteHeader bool
+}
+
+func (tw *timingResponseWriter) WriteHeader(status int) {
+	if !tw.wroteHeader {
+		tw.wroteHeader = true
+		now := time.Now()
+		if !tw.timing.upstreamStart.IsZero() {
+			tw.Header().Set(upstreamTimeHeader, now.Sub(tw.timing.upstreamStart).String())
+		}
+		tw.Header().Set(totalTimeHeader, now.Sub(tw.timing.start).String())
+	}
+	tw.ResponseWriter.WriteHeader(status)
+}
+
+func (tw *timingResponseWriter) Write(p []byte) (int, error) {
+	if !tw.wroteHeader {
+		tw.WriteHeader(http.StatusOK)
+	}
+	return tw.ResponseWriter.Write(p)
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer for flushing and hijacking
+func (tw *timingResponseWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
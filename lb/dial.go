@@ -0,0 +1,51 @@
+package lb
+
+import (
+	"encoding/json"
+	"log"
+	"math/rand"
+	"net/http"
+)
+
+// SetTrafficDial lets percent of requests through, from 0 to 100, and sheds the others with 503
+// before a backend is selected, to relieve all backends alike during an incident
+func (sp *RoundRobinServerPool) SetTrafficDial(percent int) {
+	sp.shedPercent.Store(int32(100 - percent))
+}
+
+// GetTrafficDial returns the percentage of requests let through, 100 unless turned down
+func (sp *RoundRobinServerPool) GetTrafficDial() int {
+	return 100 - int(sp.shedPercent.Load())
+}
+
+// shedByDial reports whether a request is shed at the traffic dial of the pool
+func shedByDial(pool ServerPool) bool {
+	dial := pool.GetTrafficDial()
+	return dial < 100 && rand.Intn(100) >= dial
+}
+
+// dialHandler serves the traffic dial on GET, and sets it on PUT with a body such as
+// {"percent": 50}
+func dialHandler(pool ServerPool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]int{"percent": pool.GetTrafficDial()})
+		case http.MethodPut:
+			var body struct {
+				Percent *int `json:"percent"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Percent == nil || *body.Percent < 0 || *body.Percent > 100 {
+				http.Error(w, `Expected a JSON body such as {"percent": 50}, from 0 to 100`, http.StatusBadRequest)
+				return
+			}
+			pool.SetTrafficDial(*body.Percent)
+			log.Printf("Traffic dial set to %d%%", *body.Percent)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", "GET, PUT")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
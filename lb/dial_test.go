@@ -0,0 +1,75 @@
+package lb
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestTrafficDialShedsItsShareOfRequests(t *testing.T) {
+	var proxied atomic.Int32
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		proxied.Add(1)
+	})
+	balancer := startTestLoadBalancer(t, Config{Backends: []BackendConfig{{URL: server.URL}}})
+	setDial := func(body string) int {
+		r := httptest.NewRequest(http.MethodPut, "/dial", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		balancer.AdminHandler().ServeHTTP(w, r)
+		return w.Code
+	}
+	count := func(n int) (shed int) {
+		for i := 0; i < n; i++ {
+			switch code := serve(balancer.Handler(), http.MethodGet, "/").Code; code {
+			case http.StatusServiceUnavailable:
+				shed++
+			case http.StatusOK:
+			default:
+				t.Fatalf("request answered %d, want 200 or 503", code)
+			}
+		}
+		return shed
+	}
+
+	if shed := count(100); shed != 0 {
+		t.Errorf("at the default dial %d of 100 requests were shed, want none", shed)
+	}
+	if code := setDial(`{"percent": 50}`); code != http.StatusNoContent {
+		t.Fatalf("PUT dial 50 = %d, want %d", code, http.StatusNoContent)
+	}
+	if got := serve(balancer.AdminHandler(), http.MethodGet, "/dial").Body.String(); !strings.Contains(got, `"percent":50`) {
+		t.Errorf("GET dial = %s, want percent 50", got)
+	}
+	proxied.Store(0)
+	shed := count(2000)
+	if shed < 800 || shed > 1200 {
+		t.Errorf("at dial 50 %d of 2000 requests were shed, want about half", shed)
+	}
+	// Shed requests never reach a backend
+	if got := int(proxied.Load()); got != 2000-shed {
+		t.Errorf("backend served %d requests, want %d", got, 2000-shed)
+	}
+
+	setDial(`{"percent": 0}`)
+	if shed := count(100); shed != 100 {
+		t.Errorf("at dial 0 %d of 100 requests were shed, want all", shed)
+	}
+	for _, body := range []string{`{"percent": 101}`, `{"percent": -1}`, `{}`} {
+		if code := setDial(body); code != http.StatusBadRequest {
+			t.Errorf("PUT dial %s = %d, want %d", body, code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestTrafficDialAtStartup(t *testing.T) {
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {})
+	balancer := startTestLoadBalancer(t, Config{Backends: []BackendConfig{{URL: server.URL}}, TrafficDial: 30})
+	if got := balancer.pool.GetTrafficDial(); got != 30 {
+		t.Errorf("traffic dial = %d, want 30", got)
+	}
+	if _, err := NewLoadBalancer(Config{Backends: []BackendConfig{{URL: server.URL}}, TrafficDial: 101}); err == nil {
+		t.Error("NewLoadBalancer accepted a traffic dial of 101")
+	}
+}
@@ -0,0 +1,141 @@
+package lb
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// hostResolver looks up the addresses of a host, net.Resolver implements it
+type hostResolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// resolvedHost holds the addresses a host name last resolved to
+type resolvedHost struct {
+	addrs      []string
+	resolvedAt time.Time
+	next       int
+}
+
+// dnsDialer dials backends by host name using addresses it resolves itself and refreshes every
+// interval, spreading new connections over all of them. IP addresses are dialed directly.
+type dnsDialer struct {
+	resolver hostResolver
+	dialer   *net.Dialer
+	interval time.Duration
+	hosts    map[string]*resolvedHost
+	mutex    sync.Mutex
+}
+
+// newDNSDialer creates a dnsDialer re-resolving host names every interval
+func newDNSDialer(resolver hostResolver, interval time.Duration) *dnsDialer {
+	return &dnsDialer{
+		resolver: resolver,
+		dialer:   &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second},
+		interval: interval,
+		hosts:    make(map[string]*resolvedHost),
+	}
+}
+
+// DialContext connects to address, resolving its host first if the cached addresses are stale
+func (d *dnsDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || net.ParseIP(host) != nil {
+		return d.dialer.DialContext(ctx, network, address)
+	}
+
+	addrs, err := d.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	for _, addr := range addrs {
+		conn, err := d.dialer.DialContext(ctx, network, net.JoinHostPort(addr, port))
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+// lookup returns the addresses of host, starting at the next one in rotation
+func (d *dnsDialer) lookup(ctx context.Context, host string) ([]string, error) {
+	d.mutex.Lock()
+	resolved, ok := d.hosts[host]
+	d.mutex.Unlock()
+
+	if !ok || time.Since(resolved.resolvedAt) >= d.interval {
+		if _, err := d.resolve(ctx, host); err != nil && !ok {
+			return nil, err
+		}
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	resolved = d.hosts[host]
+	start := resolved.next % len(resolved.addrs)
+	resolved.next++
+	return append(append([]string(nil), resolved.addrs[start:]...), resolved.addrs[:start]...), nil
+}
+
+// resolve looks up host and stores its addresses, reporting whether they changed. When the lookup
+// fails the previous addresses are kept.
+func (d *dnsDialer) resolve(ctx context.Context, host string) (bool, error) {
+	addrs, err := d.resolver.LookupHost(ctx, host)
+	if err == nil && len(addrs) == 0 {
+		err = &net.DNSError{Err: "no addresses found", Name: host, IsNotFound: true}
+	}
+	if err != nil {
+		return false, err
+	}
+	sort.Strings(addrs)
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	previous, ok := d.hosts[host]
+	changed := ok && !equalStrings(previous.addrs, addrs)
+	next := 0
+	if ok {
+		next = previous.next
+	}
+	d.hosts[host] = &resolvedHost{addrs: addrs, resolvedAt: time.Now(), next: next}
+	return changed, nil
+}
+
+// Refresh re-resolves every host dialed so far, reporting whether any of their addresses changed
+func (d *dnsDialer) Refresh(ctx context.Context) bool {
+	d.mutex.Lock()
+	hosts := make([]string, 0, len(d.hosts))
+	for host := range d.hosts {
+		hosts = append(hosts, host)
+	}
+	d.mutex.Unlock()
+
+	changed := false
+	for _, host := range hosts {
+		if hostChanged, _ := d.resolve(ctx, host); hostChanged {
+			changed = true
+		}
+	}
+	return changed
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
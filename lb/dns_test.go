@@ -0,0 +1,90 @@
+package lb
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeResolver resolves every host to the addresses it is currently set to
+type fakeResolver struct {
+	addrs []string
+	mutex sync.Mutex
+}
+
+func (fr *fakeResolver) set(addrs ...string) {
+	fr.mutex.Lock()
+	defer fr.mutex.Unlock()
+	fr.addrs = addrs
+}
+
+func (fr *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	fr.mutex.Lock()
+	defer fr.mutex.Unlock()
+	return append([]string(nil), fr.addrs...), nil
+}
+
+// newServerOn starts a server answering with name on the given loopback address
+func newServerOn(t *testing.T, address, name string) *httptest.Server {
+	t.Helper()
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Skipf("cannot listen on %s: %s", address, err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, name)
+	}))
+	server.Listener.Close()
+	server.Listener = listener
+	server.Start()
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestDNSDialerFollowsAddressChanges(t *testing.T) {
+	// The same port on two loopback addresses, as a service name moving to a new instance
+	old := newServerOn(t, "127.0.0.1:0", "old")
+	_, port, _ := net.SplitHostPort(old.Listener.Addr().String())
+	newServerOn(t, "127.0.0.2:"+port, "new")
+
+	resolver := &fakeResolver{addrs: []string{"127.0.0.1"}}
+	dialer := newDNSDialer(resolver, 30*time.Millisecond)
+	client := &http.Client{Transport: &http.Transport{DialContext: dialer.DialContext, DisableKeepAlives: true}}
+	get := func() string {
+		resp, err := client.Get("http://backend.internal:" + port)
+		if err != nil {
+			t.Fatalf("GET: %s", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	if got := get(); got != "old" {
+		t.Fatalf("first request reached %q, want old", got)
+	}
+	resolver.set("127.0.0.2")
+	if got := get(); got != "old" {
+		t.Errorf("request within the interval reached %q, want the cached old address", got)
+	}
+	time.Sleep(40 * time.Millisecond)
+	if got := get(); got != "new" {
+		t.Errorf("request after the interval reached %q, want new", got)
+	}
+
+	resolver.set("127.0.0.1")
+	if !dialer.Refresh(context.Background()) {
+		t.Error("Refresh did not report the changed address")
+	}
+	if dialer.Refresh(context.Background()) {
+		t.Error("Refresh reported a change for the same address")
+	}
+	if got := get(); got != "old" {
+		t.Errorf("request after Refresh reached %q, want old", got)
+	}
+}
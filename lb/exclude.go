@@ -0,0 +1,69 @@
+package lb
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// excludeHeader lists backends a request should not be sent to, e.g. by a client retrying a
+// request that failed on one of them
+const excludeHeader = "X-LB-Exclude"
+
+// backendSet is a set of backends keyed by their normalized URL
+type backendSet map[string]bool
+
+// has reports whether backend is in the set
+func (bs backendSet) has(backend Backend) bool {
+	return len(bs) > 0 && bs[normalizeURL(backend.GetURL())]
+}
+
+// parseCIDRs parses a list of CIDR ranges, a bare IP address is taken as a range of one
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client range %q: %w", cidr, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// excludedBackends returns the backends listed in the X-LB-Exclude header of r, which is only
+// honored on connections from one of the trusted ranges. The connection address is checked
+// rather than ClientIP, which may come from a header. The header is removed from the request so
+// that it does not reach the backend, also when no range is trusted.
+func excludedBackends(r *http.Request, trusted []*net.IPNet) backendSet {
+	values := r.Header.Values(excludeHeader)
+	if len(values) == 0 {
+		return nil
+	}
+	r.Header.Del(excludeHeader)
+	if len(trusted) == 0 {
+		return nil
+	}
+	if !inRanges(connectionIP(r), trusted) {
+		return nil
+	}
+
+	excluded := make(backendSet)
+	for _, value := range values {
+		for _, raw := range strings.Split(value, ",") {
+			if u, err := url.Parse(strings.TrimSpace(raw)); err == nil && u.Host != "" {
+				excluded[normalizeURL(u)] = true
+			}
+		}
+	}
+	return excluded
+}
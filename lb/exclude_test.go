@@ -0,0 +1,87 @@
+package lb
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestExcludeHeaderSkipsListedBackends(t *testing.T) {
+	var backends []BackendConfig
+	urls := make(map[string]string)
+	for _, name := range []string{"a", "b", "c"} {
+		name := name
+		server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			// The header is meant for the load balancer only
+			if r.Header.Get("X-LB-Exclude") != "" {
+				w.WriteHeader(http.StatusBadRequest)
+			}
+			io.WriteString(w, name)
+		})
+		backends = append(backends, BackendConfig{URL: server.URL})
+		urls[name] = server.URL
+	}
+	// httptest requests come from 192.0.2.1
+	handler := startTestLoadBalancer(t, Config{Backends: backends, ExcludeHeaderClients: []string{"192.0.2.0/24"}}).Handler()
+	served := func(remoteAddr string, exclude ...string) map[string]bool {
+		served := make(map[string]bool)
+		for i := 0; i < 6; i++ {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = remoteAddr
+			var excluded []string
+			for _, name := range exclude {
+				excluded = append(excluded, urls[name])
+			}
+			r.Header.Set("X-LB-Exclude", strings.Join(excluded, ", "))
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("excluding %v from %s: status %d, want %d", exclude, remoteAddr, w.Code, http.StatusOK)
+			}
+			served[w.Body.String()] = true
+		}
+		return served
+	}
+
+	tests := []struct {
+		remoteAddr string
+		exclude    []string
+		want       string
+	}{
+		{"192.0.2.1:1234", []string{"a"}, "b,c"},
+		{"192.0.2.1:1234", []string{"a", "c"}, "b"},
+		// Excluded backends are still used when no alternative remains
+		{"192.0.2.1:1234", []string{"a", "b", "c"}, "a,b,c"},
+		// Untrusted clients cannot steer requests
+		{"203.0.113.5:1234", []string{"a"}, "a,b,c"},
+	}
+	for _, tt := range tests {
+		got := served(tt.remoteAddr, tt.exclude...)
+		var names []string
+		for _, name := range []string{"a", "b", "c"} {
+			if got[name] {
+				names = append(names, name)
+			}
+		}
+		if strings.Join(names, ",") != tt.want {
+			t.Errorf("excluding %v from %s: served by %v, want %s", tt.exclude, tt.remoteAddr, names, tt.want)
+		}
+	}
+}
+
+func TestExcludeHeaderIsStrippedWithoutTrustedClients(t *testing.T) {
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("X-LB-Exclude"))
+	})
+	handler := startTestLoadBalancer(t, Config{Backends: []BackendConfig{{URL: server.URL}}}).Handler()
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-LB-Exclude", server.URL)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Body.String() != "" {
+		t.Errorf("status %d, backend received X-LB-Exclude %q, want %d without the header", w.Code, w.Body.String(), http.StatusOK)
+	}
+}
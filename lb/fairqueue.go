@@ -0,0 +1,191 @@
+package lb
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// FairQueueConfig configures weighted fair queuing of requests between tenants
+type FairQueueConfig struct {
+	// Header identifies the tenant of a request, requests without it share the "" tenant
+	Header string
+	// Capacity is the number of requests proxied at once, further requests are queued per tenant.
+	// 0 disables fair queuing.
+	Capacity int
+	// Weights are the relative shares of the capacity given to tenants under contention,
+	// tenants not listed have weight 1
+	Weights map[string]int
+	// Timeout bounds how long a request waits in its queue before it gets 503, 0 waits as long as
+	// the client does
+	Timeout time.Duration
+}
+
+// errQueueTimeout is returned by fairQueue.acquire when a request waited in its queue for too long
+var errQueueTimeout = errors.New("timed out waiting in the request queue")
+
+// fairQueue hands out a fixed number of slots to requests of several tenants. While all slots are
+// taken requests are queued per tenant, and freed slots go to the queued request with the
+// smallest virtual finish time, so that each tenant with queued requests gets a share of the
+// slots proportional to its weight regardless of how many requests it sends.
+type fairQueue struct {
+	capacity int
+	weights  map[string]int
+	timeout  time.Duration
+
+	mutex    sync.Mutex
+	inFlight int
+	// virtual is the virtual time, the finish time of the last request given a slot
+	virtual float64
+	tenants map[string]*tenantQueue
+	queued  int
+}
+
+// tenantQueue holds the queued requests of one tenant in arrival order
+type tenantQueue struct {
+	waiters []*queueWaiter
+	// finish is the virtual finish time of the tenant's last queued request
+	finish float64
+}
+
+// queueWaiter is a queued request, ready is closed once it is given a slot
+type queueWaiter struct {
+	tenant  string
+	finish  float64
+	ready   chan struct{}
+	granted bool
+}
+
+// newFairQueue creates a fairQueue from config
+func newFairQueue(config FairQueueConfig) *fairQueue {
+	return &fairQueue{
+		capacity: config.Capacity,
+		weights:  config.Weights,
+		timeout:  config.Timeout,
+		tenants:  make(map[string]*tenantQueue),
+	}
+}
+
+// weight returns the weight of tenant, 1 unless configured otherwise
+func (fq *fairQueue) weight(tenant string) int {
+	if weight, ok := fq.weights[tenant]; ok && weight > 0 {
+		return weight
+	}
+	return 1
+}
+
+// acquire waits for a slot for a request of tenant, returning an error if ctx is done or the
+// queue timeout passes first. Every successful acquire must be followed by a release.
+func (fq *fairQueue) acquire(ctx context.Context, tenant string) error {
+	fq.mutex.Lock()
+	if fq.inFlight < fq.capacity && fq.queued == 0 {
+		fq.inFlight++
+		fq.mutex.Unlock()
+		return nil
+	}
+
+	queue, ok := fq.tenants[tenant]
+	if !ok {
+		queue = &tenantQueue{}
+		fq.tenants[tenant] = queue
+	}
+	if queue.finish < fq.virtual {
+		queue.finish = fq.virtual
+	}
+	queue.finish += 1 / float64(fq.weight(tenant))
+	waiter := &queueWaiter{tenant: tenant, finish: queue.finish, ready: make(chan struct{})}
+	queue.waiters = append(queue.waiters, waiter)
+	fq.queued++
+	fq.mutex.Unlock()
+
+	var timeout <-chan time.Time
+	if fq.timeout > 0 {
+		timer := time.NewTimer(fq.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	var err error
+	select {
+	case <-waiter.ready:
+		return nil
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-timeout:
+		err = errQueueTimeout
+	}
+
+	fq.mutex.Lock()
+	defer fq.mutex.Unlock()
+	if waiter.granted {
+		// The slot was handed over while giving up, pass it on
+		fq.inFlight--
+		fq.dispatch()
+		return err
+	}
+	fq.remove(waiter)
+	return err
+}
+
+// release frees the slot of a request and gives it to the next queued one
+func (fq *fairQueue) release() {
+	fq.mutex.Lock()
+	defer fq.mutex.Unlock()
+	fq.inFlight--
+	fq.dispatch()
+}
+
+// dispatch gives free slots to the queued requests with the smallest finish times, it must be
+// called with the mutex held
+func (fq *fairQueue) dispatch() {
+	for fq.inFlight < fq.capacity && fq.queued > 0 {
+		var next *tenantQueue
+		for _, queue := range fq.tenants {
+			if len(queue.waiters) > 0 && (next == nil || queue.waiters[0].finish < next.waiters[0].finish) {
+				next = queue
+			}
+		}
+
+		waiter := next.waiters[0]
+		fq.remove(waiter)
+		fq.virtual = waiter.finish
+		fq.inFlight++
+		waiter.granted = true
+		close(waiter.ready)
+	}
+}
+
+// remove takes waiter off its tenant's queue, it must be called with the mutex held
+func (fq *fairQueue) remove(waiter *queueWaiter) {
+	queue := fq.tenants[waiter.tenant]
+	for i, queued := range queue.waiters {
+		if queued == waiter {
+			queue.waiters = append(queue.waiters[:i], queue.waiters[i+1:]...)
+			fq.queued--
+			break
+		}
+	}
+	// Idle tenants are forgotten so the map does not grow with every tenant ever seen
+	if len(queue.waiters) == 0 {
+		delete(fq.tenants, waiter.tenant)
+	}
+}
+
+// fairQueueHandler proxies requests once the fair queue gives them a slot, identifying their
+// tenant by header. Requests that time out in the queue get 503 Service Unavailable.
+func fairQueueHandler(queue *fairQueue, header string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := queue.acquire(r.Context(), r.Header.Get(header)); err != nil {
+			if errors.Is(err, errQueueTimeout) {
+				http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			}
+			// A client that went away gets no response
+			return
+		}
+		defer queue.release()
+
+		next.ServeHTTP(w, r)
+	})
+}
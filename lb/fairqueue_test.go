@@ -0,0 +1,95 @@
+package lb
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFairQueueSharesSlotsByWeight(t *testing.T) {
+	queue := newFairQueue(FairQueueConfig{Capacity: 1, Weights: map[string]int{"gold": 3}})
+	if err := queue.acquire(context.Background(), "holder"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both tenants queue more requests than they get slots for under contention
+	const perTenant = 30
+	granted := make(chan string)
+	for _, tenant := range []string{"gold", "free"} {
+		for i := 0; i < perTenant; i++ {
+			tenant := tenant
+			go func() {
+				if err := queue.acquire(context.Background(), tenant); err == nil {
+					granted <- tenant
+				}
+			}()
+		}
+	}
+	waitFor(t, "requests were not queued", func() bool {
+		queue.mutex.Lock()
+		defer queue.mutex.Unlock()
+		return queue.queued == 2*perTenant
+	})
+
+	// The slot is handed on one request at a time, gold gets 3 of every 4
+	counts := make(map[string]int)
+	queue.release()
+	for i := 0; i < 2*perTenant; i++ {
+		tenant := <-granted
+		if i < 20 {
+			counts[tenant]++
+		}
+		queue.release()
+	}
+	if counts["gold"] != 15 || counts["free"] != 5 {
+		t.Errorf("first 20 slots went to %v, want 15 gold and 5 free", counts)
+	}
+}
+
+func TestFairQueueDoesNotHoldBackALoneTenant(t *testing.T) {
+	queue := newFairQueue(FairQueueConfig{Capacity: 2, Weights: map[string]int{"gold": 100}})
+	// Without contention the weights do not matter
+	for i := 0; i < 2; i++ {
+		if err := queue.acquire(context.Background(), "free"); err != nil {
+			t.Fatalf("acquire %d: %s", i+1, err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := queue.acquire(ctx, "free"); err == nil {
+		t.Fatal("acquired a slot beyond the capacity")
+	}
+	queue.release()
+	if err := queue.acquire(context.Background(), "free"); err != nil {
+		t.Errorf("acquire after a release: %s", err)
+	}
+}
+
+func TestFairQueueTimeoutAnswersServiceUnavailable(t *testing.T) {
+	release := make(chan struct{})
+	var hits atomic.Int32
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		<-release
+	})
+	defer close(release)
+	handler := startTestLoadBalancer(t, Config{
+		Backends:  []BackendConfig{{URL: server.URL}},
+		FairQueue: FairQueueConfig{Header: "X-Tenant", Capacity: 1, Timeout: 20 * time.Millisecond},
+	}).Handler()
+
+	go serve(handler, http.MethodGet, "/")
+	waitFor(t, "first request did not reach the backend", func() bool { return hits.Load() == 1 })
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-Tenant", "acme")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusServiceUnavailable || hits.Load() != 1 {
+		t.Errorf("queued request: status %d after %d backend requests, want %d without reaching it", w.Code, hits.Load(), http.StatusServiceUnavailable)
+	}
+}
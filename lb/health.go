@@ -0,0 +1,200 @@
+package lb
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HealthEvent is the result of a health check of a backend, see WithHealthEvents
+type HealthEvent struct {
+	URL  string
+	Time time.Time
+	// Passed reports whether the check passed, Err says why it did not
+	Passed  bool
+	Err     error
+	Latency time.Duration
+	// Alive is whether the backend is in rotation after the check
+	Alive bool
+}
+
+// sendHealthEvent delivers event to events without waiting, dropping it when the channel is full
+// so that a slow consumer cannot hold up health checks
+func sendHealthEvent(events chan<- HealthEvent, event HealthEvent) {
+	select {
+	case events <- event:
+	default:
+	}
+}
+
+// defaultHealthTimeout bounds each health check unless WithHealthTimeout sets another limit
+const defaultHealthTimeout = 5 * time.Second
+
+// maxHealthBodyBytes is the most of a health check response body read so that its connection can
+// be reused, longer bodies close the connection
+const maxHealthBodyBytes = 64 << 10
+
+// newHealthTransport creates the transport of a backend's health checks, separate from the one
+// proxying requests so that probes neither wait for nor take up its connections. It keeps one
+// idle connection per health endpoint for the next probe to reuse, and gives up on connecting
+// and TLS handshakes within timeout.
+func newHealthTransport(endpoints int, timeout time.Duration) *http.Transport {
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}).DialContext,
+		TLSHandshakeTimeout:   timeout,
+		MaxIdleConns:          endpoints,
+		MaxIdleConnsPerHost:   endpoints,
+		IdleConnTimeout:       90 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+}
+
+// healthWindow keeps the results of the most recent health checks of a backend in a
+// ring buffer and decides whether the backend is healthy from their failure rate
+type healthWindow struct {
+	results []bool
+	next    int
+	count   int
+	// maxFailureRate is the largest fraction of failed checks at which the backend stays healthy
+	maxFailureRate float64
+	mutex          sync.Mutex
+}
+
+// newHealthWindow creates a healthWindow over the last size checks
+func newHealthWindow(size int, maxFailureRate float64) *healthWindow {
+	if size < 1 {
+		size = 1
+	}
+
+	return &healthWindow{
+		results:        make([]bool, size),
+		maxFailureRate: maxFailureRate,
+	}
+}
+
+// Record adds the result of a health check and reports whether the backend is healthy,
+// which is the case while failed checks in the window are at most maxFailureRate
+func (hw *healthWindow) Record(passed bool) bool {
+	hw.mutex.Lock()
+	defer hw.mutex.Unlock()
+
+	hw.results[hw.next] = passed
+	hw.next = (hw.next + 1) % len(hw.results)
+	if hw.count < len(hw.results) {
+		hw.count++
+	}
+
+	failures := 0
+	for i := 0; i < hw.count; i++ {
+		if !hw.results[i] {
+			failures++
+		}
+	}
+
+	return float64(failures)/float64(hw.count) <= hw.maxFailureRate
+}
+
+// errorWindowSize is the number of recent responses a backend's error rate is computed over
+const errorWindowSize = 100
+
+// errorWindow keeps whether each of the most recent responses of a backend was an error
+// in a ring buffer, giving a rolling error rate
+type errorWindow struct {
+	errors []bool
+	next   int
+	count  int
+	failed int
+	mutex  sync.Mutex
+}
+
+// newErrorWindow creates an errorWindow over the last size responses
+func newErrorWindow(size int) *errorWindow {
+	if size < 1 {
+		size = 1
+	}
+
+	return &errorWindow{errors: make([]bool, size)}
+}
+
+// Record adds the outcome of a response to the window
+func (ew *errorWindow) Record(failed bool) {
+	ew.mutex.Lock()
+	defer ew.mutex.Unlock()
+
+	if ew.count == len(ew.errors) {
+		if ew.errors[ew.next] {
+			ew.failed--
+		}
+	} else {
+		ew.count++
+	}
+	ew.errors[ew.next] = failed
+	if failed {
+		ew.failed++
+	}
+	ew.next = (ew.next + 1) % len(ew.errors)
+}
+
+// Rate returns the fraction of responses in the window that were errors, 0 before any response
+func (ew *errorWindow) Rate() float64 {
+	ew.mutex.Lock()
+	defer ew.mutex.Unlock()
+
+	if ew.count == 0 {
+		return 0
+	}
+	return float64(ew.failed) / float64(ew.count)
+}
+
+// HealthMode decides which health check responses count as healthy
+type HealthMode string
+
+const (
+	// HealthModeStrict requires one of the backend's healthy status codes
+	HealthModeStrict HealthMode = "strict"
+	// HealthModeReachable accepts any HTTP response, only failing checks on connection errors
+	HealthModeReachable HealthMode = "reachable"
+)
+
+// HealthAggregation decides whether a backend with several health endpoints is healthy
+type HealthAggregation string
+
+const (
+	// HealthAggregationAll requires every endpoint to pass
+	HealthAggregationAll HealthAggregation = "all"
+	// HealthAggregationAny requires at least one endpoint to pass
+	HealthAggregationAny HealthAggregation = "any"
+	// HealthAggregationQuorum requires more than half of the endpoints to pass
+	HealthAggregationQuorum HealthAggregation = "quorum"
+)
+
+// combine returns nil when the results of the health endpoints, nil for each one that passed,
+// make the backend healthy, or an error describing the failures
+func (ha HealthAggregation) combine(errs []error) error {
+	var failed []string
+	for _, err := range errs {
+		if err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+	passed := len(errs) - len(failed)
+
+	var healthy bool
+	switch ha {
+	case HealthAggregationAny:
+		healthy = passed > 0
+	case HealthAggregationQuorum:
+		healthy = passed > len(errs)/2
+	default:
+		healthy = len(failed) == 0
+	}
+	if healthy {
+		return nil
+	}
+
+	return fmt.Errorf("%d of %d health endpoints passed, %s required: %s", passed, len(errs), ha, strings.Join(failed, "; "))
+}
@@ -0,0 +1,372 @@
+package lb
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSlowHealthCheckMarksBackendDead(t *testing.T) {
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+	})
+	b := newTestBackend(t, server.URL, WithHealthLatencyThreshold(10*time.Millisecond))
+	if err := b.checkHealth(); err == nil {
+		t.Fatal("checkHealth passed a health check slower than the threshold")
+	}
+
+	go b.PerformHealthCheck(10 * time.Millisecond)
+	waitFor(t, "backend with a slow health endpoint still alive", func() bool { return !b.IsAlive() })
+}
+
+func TestFastHealthCheckPassesThreshold(t *testing.T) {
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {})
+	b := newTestBackend(t, server.URL, WithHealthLatencyThreshold(time.Second))
+	if err := b.checkHealth(); err != nil {
+		t.Errorf("checkHealth failed a fast health check: %s", err)
+	}
+}
+
+func TestHealthCheckDoesNotFollowRedirects(t *testing.T) {
+	var followed atomic.Bool
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/elsewhere" {
+			followed.Store(true)
+			return
+		}
+		http.Redirect(w, r, "/elsewhere", http.StatusFound)
+	})
+
+	if err := newTestBackend(t, server.URL).checkHealth(); err == nil {
+		t.Error("a 302 passed the health check without being accepted")
+	}
+	if err := newTestBackend(t, server.URL, WithHealthStatusCodes(http.StatusOK, http.StatusFound)).checkHealth(); err != nil {
+		t.Errorf("a 302 failed the health check although it is accepted: %s", err)
+	}
+	if followed.Load() {
+		t.Error("the health check followed the redirect")
+	}
+}
+
+func TestHealthWindowFollowsFailureRate(t *testing.T) {
+	// At most half of the last 4 checks may fail
+	window := newHealthWindow(4, 0.5)
+	pattern := []struct {
+		passed  bool
+		healthy bool
+	}{
+		{false, false}, // 1 of 1 failed
+		{true, true},   // 1 of 2
+		{false, false}, // 2 of 3
+		{true, true},   // 2 of 4
+		{false, true},  // the first failure leaves the window, still 2 of 4
+		{false, false}, // 3 of 4
+		{true, true},   // 2 of 4
+		{false, false}, // 3 of 4
+		{true, true},   // 2 of 4
+	}
+	for i, check := range pattern {
+		if healthy := window.Record(check.passed); healthy != check.healthy {
+			t.Errorf("check %d (passed %t): healthy = %t, want %t", i, check.passed, healthy, check.healthy)
+		}
+	}
+}
+
+func TestStartupGracePeriodIgnoresEarlyFailures(t *testing.T) {
+	// The backend fails two checks while starting, passes one, then fails again
+	var hits atomic.Int32
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if n := hits.Add(1); n != 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+	events := make(chan HealthEvent, 10)
+	b := newTestBackend(t, server.URL,
+		WithStartupGracePeriod(time.Minute),
+		// A single counted failure in the window would keep the backend out of rotation
+		WithHealthWindow(4, 0),
+		WithHealthEvents(events),
+	)
+	if b.IsAlive() {
+		t.Fatal("starting backend in rotation before passing a health check")
+	}
+
+	go b.PerformHealthCheck(10 * time.Millisecond)
+	for i, want := range []bool{false, false, true, false} {
+		select {
+		case event := <-events:
+			if event.Alive != want {
+				t.Errorf("check %d (passed %t): alive = %t, want %t", i+1, event.Passed, event.Alive, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no health event for check %d", i+1)
+		}
+	}
+}
+
+func TestHealthEventsDescribeEveryCheck(t *testing.T) {
+	var failing atomic.Bool
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	})
+	events := make(chan HealthEvent, 1)
+	b := newTestBackend(t, server.URL, WithHealthEvents(events))
+	start := time.Now()
+	go b.PerformHealthCheck(10 * time.Millisecond)
+
+	next := func() HealthEvent {
+		t.Helper()
+		select {
+		case event := <-events:
+			return event
+		case <-time.After(time.Second):
+			t.Fatal("no health event delivered")
+			return HealthEvent{}
+		}
+	}
+	event := next()
+	if event.URL != server.URL || !event.Passed || event.Err != nil || !event.Alive {
+		t.Errorf("event of a passing check = %+v, want it passed and alive for %s", event, server.URL)
+	}
+	if event.Time.Before(start) || event.Latency <= 0 {
+		t.Errorf("event time %s and latency %s, want a check started after %s that took some time", event.Time, event.Latency, start)
+	}
+
+	failing.Store(true)
+	// Drain the event of a check that may have started before the backend failed
+	for event = next(); event.Passed; event = next() {
+	}
+	if event.Err == nil || event.Alive {
+		t.Errorf("event of a failing check = %+v, want an error and the backend down", event)
+	}
+}
+
+func TestSlowHealthEventConsumerDoesNotStallChecks(t *testing.T) {
+	var hits atomic.Int32
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) { hits.Add(1) })
+	// Nobody receives from the channel
+	b := newTestBackend(t, server.URL, WithHealthEvents(make(chan HealthEvent)))
+	go b.PerformHealthCheck(5 * time.Millisecond)
+
+	waitFor(t, "health checks stalled on an unread events channel", func() bool { return hits.Load() >= 5 })
+}
+
+func TestStalledHealthCheckMakesBackendStale(t *testing.T) {
+	var stalled atomic.Bool
+	release := make(chan struct{})
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if stalled.Load() {
+			<-release
+		}
+	})
+	b := newTestBackend(t, server.URL, WithStaleness(50*time.Millisecond), WithHealthTimeout(time.Minute))
+	go b.PerformHealthCheck(10 * time.Millisecond)
+	go b.WatchStaleness()
+
+	// Passing checks keep the backend fresh
+	time.Sleep(100 * time.Millisecond)
+	if b.IsStale() {
+		t.Fatal("backend stale while its health checks pass")
+	}
+
+	// A check that never returns leaves the last known state in place, but it is not trusted
+	stalled.Store(true)
+	waitFor(t, "backend did not become stale while its health check was stuck", b.IsStale)
+	if !b.IsAlive() || IsSelectable(b) {
+		t.Errorf("stale backend: alive %t, selectable %t, want alive but not selectable", b.IsAlive(), IsSelectable(b))
+	}
+
+	stalled.Store(false)
+	close(release)
+	waitFor(t, "backend stayed stale after passing a health check", func() bool { return !b.IsStale() && IsSelectable(b) })
+}
+
+func TestHeadHealthCheck(t *testing.T) {
+	// The backend generates no body for HEAD and rejects anything else
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+
+	if err := newTestBackend(t, server.URL, WithHealthMethod(http.MethodHead)).checkHealth(); err != nil {
+		t.Errorf("HEAD health check failed: %s", err)
+	}
+	if err := newTestBackend(t, server.URL).checkHealth(); err == nil {
+		t.Error("default GET health check passed against a HEAD-only endpoint")
+	}
+}
+
+func TestPostHealthCheckSendsConfiguredBody(t *testing.T) {
+	const payload = `{"check":"ready"}`
+	// The readiness endpoint answers 200 only for a POST of the expected JSON payload
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" || string(body) != payload {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	})
+
+	bc := BackendConfig{URL: server.URL, HealthMethod: http.MethodPost, HealthBody: payload}
+	b := newTestBackend(t, server.URL, bc.options()...)
+	// The body is sent again with every check
+	for i := 0; i < 2; i++ {
+		if err := b.checkHealth(); err != nil {
+			t.Fatalf("POST health check %d failed: %s", i+1, err)
+		}
+	}
+
+	for _, tt := range []struct {
+		name string
+		opts []BackendOption
+	}{
+		{"GET", nil},
+		{"POST without a body", []BackendOption{WithHealthMethod(http.MethodPost)}},
+		{"POST of another body", []BackendOption{WithHealthMethod(http.MethodPost), WithHealthBody(`{}`, "")}},
+		{"POST as text", []BackendOption{WithHealthMethod(http.MethodPost), WithHealthBody(payload, "text/plain")}},
+	} {
+		if err := newTestBackend(t, server.URL, tt.opts...).checkHealth(); err == nil {
+			t.Errorf("%s health check passed, want it rejected", tt.name)
+		}
+	}
+}
+
+func TestReachableHealthModeAcceptsAnyResponse(t *testing.T) {
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	closed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	closed.Close()
+
+	tests := []struct {
+		mode      HealthMode
+		url       string
+		wantAlive bool
+	}{
+		{HealthModeReachable, server.URL, true},
+		{HealthModeStrict, server.URL, false},
+		// A backend that cannot be reached is down in either mode
+		{HealthModeReachable, closed.URL, false},
+		{HealthModeStrict, closed.URL, false},
+	}
+	for _, tt := range tests {
+		err := newTestBackend(t, tt.url, WithHealthMode(tt.mode)).checkHealth()
+		if alive := err == nil; alive != tt.wantAlive {
+			t.Errorf("%s mode against %s: alive = %t (%v), want %t", tt.mode, tt.url, alive, err, tt.wantAlive)
+		}
+	}
+
+	cfg := &FileConfig{Backends: []BackendConfig{{URL: server.URL, HealthMode: HealthModeReachable, HealthStatusCodes: []int{204}}}}
+	if err := cfg.Validate(); err == nil {
+		t.Error("Validate accepted healthStatusCodes with the reachable health mode")
+	}
+}
+
+func TestHealthChecksReuseTheirConnection(t *testing.T) {
+	server, opened, closed := newConnCountingServer(t, func(w http.ResponseWriter, r *http.Request) {})
+	b := NewBackend(server.URL).(*backend)
+	defer b.Stop()
+
+	for i := 0; i < 5; i++ {
+		if err := b.checkHealth(); err != nil {
+			t.Fatalf("health check %d: %s", i+1, err)
+		}
+	}
+	if n := opened.Load(); n != 1 {
+		t.Errorf("5 health checks opened %d connections, want 1", n)
+	}
+
+	// Proxied requests have their own transport, and Stop closes the idle probe connection
+	serve(b, http.MethodGet, "/")
+	if n := opened.Load(); n != 2 {
+		t.Errorf("health checks and a proxied request opened %d connections, want 2", n)
+	}
+	b.Stop()
+	waitFor(t, "idle health check connection was not closed by Stop", func() bool { return closed.Load() == 1 })
+}
+
+func TestWarmUpRequestsFollowCadence(t *testing.T) {
+	var hits, conns atomic.Int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { hits.Add(1) }))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+	b := newTestBackend(t, server.URL, WithWarmUp(20*time.Millisecond, 2))
+
+	start := time.Now()
+	go b.KeepWarm()
+	// 2 requests on each tick
+	waitFor(t, "fewer than 6 warm-up requests", func() bool { return hits.Load() >= 6 })
+	if elapsed := time.Since(start); elapsed < 60*time.Millisecond {
+		t.Errorf("6 warm-up requests after %s, want 3 ticks of 20ms", elapsed)
+	}
+	if n := conns.Load(); n != 2 {
+		t.Errorf("warm-up opened %d connections, want the same 2 kept idle between ticks", n)
+	}
+}
+
+func TestHealthEndpointAggregation(t *testing.T) {
+	// /health passes and /db-health fails, /cache-health passes when checked
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/db-health" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+
+	for _, tt := range []struct {
+		aggregation HealthAggregation
+		paths       []string
+		healthy     bool
+	}{
+		{HealthAggregationAll, []string{"/health", "/db-health"}, false},
+		{HealthAggregationAny, []string{"/health", "/db-health"}, true},
+		{HealthAggregationQuorum, []string{"/health", "/db-health"}, false},
+		{HealthAggregationQuorum, []string{"/health", "/db-health", "/cache-health"}, true},
+		{"", []string{"/health", "/db-health"}, false},
+	} {
+		err := newTestBackend(t, server.URL, WithHealthEndpoints(tt.paths, tt.aggregation)).checkHealth()
+		if healthy := err == nil; healthy != tt.healthy {
+			t.Errorf("%q over %v: healthy = %t (%v), want %t", tt.aggregation, tt.paths, healthy, err, tt.healthy)
+		}
+	}
+}
+
+func TestSlowHealthChecksDoNotOverlap(t *testing.T) {
+	var inFlight, overlapping, checks atomic.Int32
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		checks.Add(1)
+		if inFlight.Add(1) > 1 {
+			overlapping.Add(1)
+		}
+		defer inFlight.Add(-1)
+		time.Sleep(120 * time.Millisecond)
+	})
+	b := newTestBackend(t, server.URL)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		b.PerformHealthCheck(20 * time.Millisecond)
+	}()
+
+	// Each check outlasts several ticks
+	time.Sleep(500 * time.Millisecond)
+	b.Stop()
+	<-done
+
+	if n := overlapping.Load(); n != 0 {
+		t.Errorf("%d health checks started while another was in flight, want none", n)
+	}
+	if n := checks.Load(); n < 2 || n > 5 {
+		t.Errorf("%d health checks in 500ms of 120ms each, want them one after another", n)
+	}
+}
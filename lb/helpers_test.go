@@ -0,0 +1,116 @@
+package lb
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestServer starts a server answering with handler, closed when the test ends
+func newTestServer(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// newTestBackend creates a backend for rawURL, stopped when the test ends
+func newTestBackend(t *testing.T, rawURL string, opts ...BackendOption) *backend {
+	t.Helper()
+	b := NewBackend(rawURL, opts...).(*backend)
+	t.Cleanup(b.Stop)
+	return b
+}
+
+// serve sends a request with method to target through handler and returns the response
+func serve(handler http.Handler, method, target string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+	return w
+}
+
+// waitFor polls condition until it holds, failing the test with message after a second
+func waitFor(t *testing.T, message string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal(message)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// startTestLoadBalancer creates a load balancer for cfg and starts it until the test ends
+func startTestLoadBalancer(t *testing.T, cfg Config) *LoadBalancer {
+	t.Helper()
+	balancer, err := NewLoadBalancer(cfg)
+	if err != nil {
+		t.Fatalf("NewLoadBalancer: %s", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	balancer.Start(ctx)
+	return balancer
+}
+
+// weights returns the weight of every backend of the pool by URL
+func weights(pool ServerPool) map[string]int {
+	weights := make(map[string]int)
+	for _, backend := range pool.GetBackends() {
+		weights[backend.GetURL().String()] = backend.GetWeight()
+	}
+	return weights
+}
+
+// newFailingServer starts a server that drops every connection without answering, counting the
+// requests in hits
+func newFailingServer(t *testing.T, hits *atomic.Int32) *httptest.Server {
+	t.Helper()
+	return newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	})
+}
+
+// logBuffer collects log output, safe to read while background goroutines are logging
+type logBuffer struct {
+	buf   bytes.Buffer
+	mutex sync.Mutex
+}
+
+func (bw *logBuffer) Write(p []byte) (int, error) {
+	bw.mutex.Lock()
+	defer bw.mutex.Unlock()
+	return bw.buf.Write(p)
+}
+
+func (bw *logBuffer) String() string {
+	bw.mutex.Lock()
+	defer bw.mutex.Unlock()
+	return bw.buf.String()
+}
+
+// captureLog sends the standard logger's output to a buffer until the test ends
+func captureLog(tb testing.TB) *logBuffer {
+	tb.Helper()
+	logs := &logBuffer{}
+	previous := log.Writer()
+	log.SetOutput(logs)
+	tb.Cleanup(func() { log.SetOutput(previous) })
+	return logs
+}
+
+// intPtr returns a pointer to n, for optional config fields such as BackendConfig.Weight
+func intPtr(n int) *int {
+	return &n
+}
@@ -0,0 +1,31 @@
+package lb
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ResponseHook transforms a backend response before it is sent to the client. It may change the
+// headers, or replace resp.Body with a wrapper, in which case it should also fix up or remove the
+// Content-Length header. Returning an error fails the request with 502 Bad Gateway.
+type ResponseHook func(resp *http.Response) error
+
+// SetResponseHeader returns a ResponseHook that sets a header on every response, e.g. a
+// Content-Security-Policy
+func SetResponseHeader(name, value string) ResponseHook {
+	return func(resp *http.Response) error {
+		resp.Header.Set(name, value)
+		return nil
+	}
+}
+
+// ParseResponseHeader parses a "Name: value" header for SetResponseHeader
+func ParseResponseHeader(header string) (ResponseHook, error) {
+	name, value, ok := strings.Cut(header, ":")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" {
+		return nil, fmt.Errorf("invalid response header %q, expected Name: value", header)
+	}
+	return SetResponseHeader(name, strings.TrimSpace(value)), nil
+}
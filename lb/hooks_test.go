@@ -0,0 +1,123 @@
+package lb
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResponseHooksRunInOrder(t *testing.T) {
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "see http://internal:3001/docs")
+	})
+	rewriteBody := func(resp *http.Response) error {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		resp.Body = io.NopCloser(bytes.NewReader(bytes.ReplaceAll(body, []byte("http://internal:3001"), []byte("https://example.com"))))
+		resp.Header.Del("Content-Length")
+		return nil
+	}
+	// Runs after SetResponseHeader, so it sees the header the first hook set
+	checkOrder := func(resp *http.Response) error {
+		resp.Header.Set("X-Seen-CSP", fmt.Sprint(resp.Header.Get("Content-Security-Policy") != ""))
+		return nil
+	}
+	balancer := startTestLoadBalancer(t, Config{
+		Backends:      []BackendConfig{{URL: server.URL}},
+		ResponseHooks: []ResponseHook{SetResponseHeader("Content-Security-Policy", "default-src 'self'"), rewriteBody, checkOrder},
+	})
+
+	w := serve(balancer.Handler(), http.MethodGet, "/")
+	if got := w.Header().Get("Content-Security-Policy"); got != "default-src 'self'" {
+		t.Errorf("Content-Security-Policy = %q, want the hook's value", got)
+	}
+	if got := w.Header().Get("X-Seen-CSP"); got != "true" {
+		t.Errorf("later hook saw the header of the earlier one: %q, want true", got)
+	}
+	if got := w.Body.String(); got != "see https://example.com/docs" {
+		t.Errorf("body = %q, want the rewritten URL", got)
+	}
+}
+
+func TestFailingResponseHookAnswersBadGateway(t *testing.T) {
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {})
+	failing := func(resp *http.Response) error { return fmt.Errorf("rejected") }
+	b := newTestBackend(t, server.URL, WithResponseHooks(failing))
+
+	if w := serve(b, http.MethodGet, "/"); w.Code != http.StatusBadGateway {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusBadGateway)
+	}
+}
+
+func TestParseResponseHeader(t *testing.T) {
+	if _, err := ParseResponseHeader("no colon"); err == nil {
+		t.Error("header without a colon parsed")
+	}
+	hook, err := ParseResponseHeader(" X-Frame-Options :  DENY ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := &http.Response{Header: make(http.Header)}
+	hook(resp)
+	if got := resp.Header.Get("X-Frame-Options"); got != "DENY" {
+		t.Errorf("X-Frame-Options = %q, want DENY", got)
+	}
+}
+
+func TestStatusRemapRewritesClientStatus(t *testing.T) {
+	teapot := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Reason", "teapot")
+		w.WriteHeader(http.StatusTeapot)
+		io.WriteString(w, "short and stout")
+	}
+	shared := newTestServer(t, teapot)
+	own := newTestServer(t, teapot)
+	balancer := startTestLoadBalancer(t, Config{
+		Backends: []BackendConfig{
+			{URL: shared.URL, Tags: map[string]string{"name": "shared"}},
+			// The table of a backend takes precedence over the one shared by all
+			{URL: own.URL, Tags: map[string]string{"name": "own"}, StatusRemap: map[int]int{http.StatusTeapot: http.StatusUnprocessableEntity}},
+		},
+		Routes: []Route{
+			{Prefix: "/shared", Tags: map[string]string{"name": "shared"}},
+			{Prefix: "/own", Tags: map[string]string{"name": "own"}},
+		},
+		StatusRemap: map[int]int{http.StatusTeapot: http.StatusBadRequest},
+	})
+	front := httptest.NewServer(balancer.Handler())
+	defer front.Close()
+
+	for _, tt := range []struct {
+		path   string
+		status int
+	}{{"/shared", http.StatusBadRequest}, {"/own", http.StatusUnprocessableEntity}} {
+		resp, err := http.Get(front.URL + tt.path)
+		if err != nil {
+			t.Fatalf("GET %s: %s", tt.path, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tt.status || resp.Status != fmt.Sprintf("%d %s", tt.status, http.StatusText(tt.status)) {
+			t.Errorf("%s: status %q, want %d", tt.path, resp.Status, tt.status)
+		}
+		// Headers and body are those the backend sent
+		if string(body) != "short and stout" || resp.ContentLength != int64(len(body)) || resp.Header.Get("X-Reason") != "teapot" {
+			t.Errorf("%s: body %q of length %d with X-Reason %q, want the backend's", tt.path, body, resp.ContentLength, resp.Header.Get("X-Reason"))
+		}
+	}
+}
+
+func TestStatusRemapRejectsCodesWithoutBody(t *testing.T) {
+	for _, remap := range []map[int]int{{418: 204}, {304: 200}, {418: 99}} {
+		cfg := &FileConfig{Backends: []BackendConfig{{URL: "http://a:3001", StatusRemap: remap}}}
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("Validate accepted statusRemap %v", remap)
+		}
+	}
+}
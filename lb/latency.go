@@ -0,0 +1,129 @@
+package lb
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// latencyWindowSize is the number of recent responses a backend's latency percentiles are computed over
+const latencyWindowSize = 100
+
+// latencyMaxAge is how long a response counts towards the latency percentiles. Samples expire so
+// that a backend that was slow, and so stopped being selected, is eventually tried again.
+const latencyMaxAge = 30 * time.Second
+
+// latencyBuckets are the upper bounds of the latency histogram buckets, growing by 25% from
+// 500µs to a minute. Latencies above the last bound fall in the last bucket.
+var latencyBuckets = func() []time.Duration {
+	var buckets []time.Duration
+	for bound := 500 * time.Microsecond; bound < time.Minute; bound = bound * 5 / 4 {
+		buckets = append(buckets, bound)
+	}
+	return append(buckets, time.Minute)
+}()
+
+// requestStartKey is the context key under which the time a request was sent to the backend is stored
+type requestStartKey struct{}
+
+// withRequestStart records in the context that a request to the backend starts now
+func withRequestStart(ctx context.Context) context.Context {
+	return context.WithValue(ctx, requestStartKey{}, time.Now())
+}
+
+// requestDuration returns the time since the request was sent to the backend
+func requestDuration(ctx context.Context) (time.Duration, bool) {
+	start, ok := ctx.Value(requestStartKey{}).(time.Time)
+	if !ok {
+		return 0, false
+	}
+	return time.Since(start), true
+}
+
+// latencyWindow keeps a histogram of the latencies of the most recent responses of a backend,
+// bucketed so percentiles can be read without sorting the samples
+type latencyWindow struct {
+	samples []latencySample
+	next    int
+	count   int
+	buckets []int
+	mutex   sync.Mutex
+}
+
+// latencySample is a response latency recorded in a latencyWindow
+type latencySample struct {
+	bucket int
+	at     time.Time
+}
+
+// newLatencyWindow creates a latencyWindow over the last size responses
+func newLatencyWindow(size int) *latencyWindow {
+	if size < 1 {
+		size = 1
+	}
+
+	return &latencyWindow{
+		samples: make([]latencySample, size),
+		buckets: make([]int, len(latencyBuckets)),
+	}
+}
+
+// Record adds the latency of a response to the window
+func (lw *latencyWindow) Record(latency time.Duration) {
+	bucket := 0
+	for bucket < len(latencyBuckets)-1 && latency > latencyBuckets[bucket] {
+		bucket++
+	}
+
+	lw.mutex.Lock()
+	defer lw.mutex.Unlock()
+
+	if lw.count == len(lw.samples) {
+		lw.buckets[lw.samples[lw.next].bucket]--
+	} else {
+		lw.count++
+	}
+	lw.samples[lw.next] = latencySample{bucket: bucket, at: time.Now()}
+	lw.buckets[bucket]++
+	lw.next = (lw.next + 1) % len(lw.samples)
+}
+
+// expire drops the samples older than latencyMaxAge, oldest first
+func (lw *latencyWindow) expire() {
+	cutoff := time.Now().Add(-latencyMaxAge)
+	for lw.count > 0 {
+		oldest := (lw.next - lw.count + len(lw.samples)) % len(lw.samples)
+		if lw.samples[oldest].at.After(cutoff) {
+			return
+		}
+		lw.buckets[lw.samples[oldest].bucket]--
+		lw.count--
+	}
+}
+
+// Percentile returns the upper bound of the bucket holding the given percentile, between 0 and 1,
+// of the latencies in the window, 0 when there is no recent response
+func (lw *latencyWindow) Percentile(p float64) time.Duration {
+	lw.mutex.Lock()
+	defer lw.mutex.Unlock()
+
+	lw.expire()
+	if lw.count == 0 {
+		return 0
+	}
+
+	rank := int(math.Ceil(p * float64(lw.count)))
+	if rank < 1 {
+		rank = 1
+	}
+
+	seen := 0
+	for bucket, count := range lw.buckets {
+		seen += count
+		if seen >= rank {
+			return latencyBuckets[bucket]
+		}
+	}
+	return latencyBuckets[len(latencyBuckets)-1]
+}
@@ -0,0 +1,56 @@
+package lb
+
+import (
+	"net/http"
+	"sync"
+)
+
+// clientLimiter counts the requests in flight from each client IP
+type clientLimiter struct {
+	limit    int
+	inFlight map[string]int
+	mutex    sync.Mutex
+}
+
+// newClientLimiter creates a clientLimiter allowing limit concurrent requests per client IP
+func newClientLimiter(limit int) *clientLimiter {
+	return &clientLimiter{limit: limit, inFlight: make(map[string]int)}
+}
+
+// acquire counts a new request from ip, reporting false if the client is already at its limit
+func (cl *clientLimiter) acquire(ip string) bool {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	if cl.inFlight[ip] >= cl.limit {
+		return false
+	}
+	cl.inFlight[ip]++
+	return true
+}
+
+// release counts a request from ip as completed
+func (cl *clientLimiter) release(ip string) {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	// Clients are forgotten when idle so the map does not grow with every IP ever seen
+	if cl.inFlight[ip]--; cl.inFlight[ip] <= 0 {
+		delete(cl.inFlight, ip)
+	}
+}
+
+// clientLimitHandler rejects requests with 429 Too Many Requests while their client already has
+// the limiter's maximum number of requests in flight
+func clientLimitHandler(limiter *clientLimiter, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := ClientIP(r)
+		if !limiter.acquire(ip) {
+			http.Error(w, "Too many concurrent requests", http.StatusTooManyRequests)
+			return
+		}
+		defer limiter.release(ip)
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,62 @@
+package lb
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestConcurrentRequestsPerClientAreLimited(t *testing.T) {
+	var slow atomic.Int32
+	release := make(chan struct{})
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			slow.Add(1)
+			<-release
+		}
+	})
+	handler := startTestLoadBalancer(t, Config{Backends: []BackendConfig{{URL: server.URL}}, MaxRequestsPerIP: 2}).Handler()
+	from := func(ip, path string) int {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.RemoteAddr = ip + ":40000"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			from("10.0.0.1", "/slow")
+		}()
+	}
+	waitFor(t, "slow requests did not reach the backend", func() bool { return slow.Load() == 2 })
+
+	if code := from("10.0.0.1", "/"); code != http.StatusTooManyRequests {
+		t.Errorf("third concurrent request from one client = %d, want %d", code, http.StatusTooManyRequests)
+	}
+	if code := from("10.0.0.2", "/"); code != http.StatusOK {
+		t.Errorf("request from another client = %d, want %d", code, http.StatusOK)
+	}
+
+	close(release)
+	wg.Wait()
+	if code := from("10.0.0.1", "/"); code != http.StatusOK {
+		t.Errorf("request after the others completed = %d, want %d", code, http.StatusOK)
+	}
+}
+
+func TestClientLimiterForgetsIdleClients(t *testing.T) {
+	limiter := newClientLimiter(1)
+	if !limiter.acquire("10.0.0.1") || limiter.acquire("10.0.0.1") {
+		t.Fatal("limit of 1 not enforced")
+	}
+	limiter.release("10.0.0.1")
+	if len(limiter.inFlight) != 0 {
+		t.Errorf("limiter still tracks %d idle clients", len(limiter.inFlight))
+	}
+}
@@ -0,0 +1,456 @@
+package lb
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Config configures a LoadBalancer. The zero value of a field selects its default.
+type Config struct {
+	// Backends and Routes are the initial backends and routes, as listed in a config file
+	Backends []BackendConfig
+	Routes   []Route
+	// ActiveGroup is the group of backends receiving requests at startup, see FileConfig
+	ActiveGroup string
+	// Strategy is the name of the backend selection strategy, round-robin by default
+	Strategy       string
+	StrategyConfig StrategyConfig
+
+	// HealthLatencyThreshold marks backends unhealthy when a health check is slower, 0 disables it
+	HealthLatencyThreshold time.Duration
+	// HealthWindow and HealthFailureRate mark a backend unhealthy once more than HealthFailureRate
+	// of its last HealthWindow health checks failed, by default on the first failed check
+	HealthWindow      int
+	HealthFailureRate float64
+
+	// StaleAfter takes backends out of rotation while their last passing health check is older,
+	// 0 disables it. Health checks run every 10s, so it should be well above that.
+	StaleAfter time.Duration
+
+	// BreakerThreshold opens the circuit breaker of a backend after this many consecutive failed
+	// requests, 0 disables it. BreakerCooldown defaults to 30s.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+
+	// MaxResponseHeaderBytes limits the size of backend response headers, 1 MiB by default
+	MaxResponseHeaderBytes int64
+	// WarmUpInterval keeps WarmUpCount (2 by default) idle connections open to every backend by
+	// sending requests to its health check URL at this interval, 0 disables it
+	WarmUpInterval time.Duration
+	WarmUpCount    int
+	// DNSRefreshInterval re-resolves backend host names at this interval, 0 disables it
+	DNSRefreshInterval time.Duration
+	// ConnectionMaxAge closes idle upstream connections open for longer, 0 disables it
+	ConnectionMaxAge time.Duration
+	// HealthEvents receives the result of every health check of every backend, events are
+	// dropped while it is full
+	HealthEvents chan<- HealthEvent
+	// ResponseHooks transform every backend response
+	ResponseHooks []ResponseHook
+	// StatusRemap replaces status codes of the responses of every backend, e.g. 418 with 400.
+	// The statusRemap of a backend takes precedence.
+	StatusRemap map[int]int
+	// SelfHosts are the host names of the load balancer, backend redirects to them are reported
+	SelfHosts []string
+
+	// Proxy tunes how requests are proxied
+	Proxy ProxyOptions
+	// MaintenancePage is a file served with 503 while paused or no backend is available
+	MaintenancePage string
+	// Favicon and RobotsTxt are files served for /favicon.ico and /robots.txt by the load
+	// balancer itself, read once at startup. LocalFileNone answers with 204 No Content, empty
+	// proxies the requests like any other.
+	Favicon   string
+	RobotsTxt string
+	// CacheSize is the number of cacheable GET responses kept in memory, 0 disables the cache
+	CacheSize int
+	// MaxRequestsPerIP limits the concurrent requests of a client IP, 0 disables the limit
+	MaxRequestsPerIP int
+	// FairQueue shares the backends between tenants under contention, see FairQueueConfig
+	FairQueue FairQueueConfig
+	// ClientIPHeader is the request header holding the client IP, e.g. True-Client-IP, when the
+	// load balancer sits behind a proxy or CDN that sets it. Requests without it fall back to
+	// X-Forwarded-For and then to the connection address. Empty uses the connection address only.
+	// The client IP is used by the per-client limits, the logs and ClientIP. It requires
+	// TrustedProxies.
+	ClientIPHeader string
+	// TrustedProxies are the address ranges, e.g. 10.0.0.0/8, of the proxies whose ClientIPHeader
+	// and X-Forwarded-For are believed. Requests from other addresses keep their connection address.
+	TrustedProxies []string
+	// ExcludeHeaderClients are the client IP ranges, e.g. 10.0.0.0/8, allowed to list backends to
+	// avoid in the X-LB-Exclude header. Empty ignores the header.
+	ExcludeHeaderClients []string
+	// AllowedMethods are the request methods proxied, others get 405. Methods are matched exactly,
+	// as they are case-sensitive. Empty allows all.
+	AllowedMethods []string
+	// MaxURLLength answers requests whose path and query are longer than this many bytes with
+	// 414 URI Too Long, 0 means no limit
+	MaxURLLength int
+	// NormalizePaths collapses duplicate slashes and resolves dot segments of request paths before
+	// routing, for backends sensitive to them. By default paths are forwarded as sent by the client.
+	NormalizePaths bool
+	// ConnectionStickiness sends every request on a client connection to the same backend while it
+	// stays available. It needs ConnContext and ConnState set on the http.Server.
+	ConnectionStickiness bool
+	// SRV adds and removes backends as the DNS SRV records of a name change, alongside Backends
+	SRV SRVConfig
+	// TrafficDial is the percentage of requests proxied at startup, the others are answered with
+	// 503. It ranges from 1 to 100 and 0 selects 100, turn the dial down to 0 at runtime on the
+	// admin API.
+	TrafficDial int
+	// StandbyThreshold promotes the standby backends while fewer than this many primary backends
+	// are available, 1 by default so that they take over once no primary is left
+	StandbyThreshold int
+	// AccessLog receives a line for every proxied request in AccessLogFormat, text (default) or
+	// json. Nil disables the access log.
+	AccessLog       io.Writer
+	AccessLogFormat AccessLogFormat
+	// BodyLog logs the headers and bodies of a sample of requests and responses, see BodyLogConfig
+	BodyLog BodyLogConfig
+	// Autoscale calls a webhook when the active connections call for more backends
+	Autoscale AutoscaleConfig
+	// StatePath is a file the round-robin position and weights are saved to and restored from
+	StatePath string
+}
+
+// defaultBreakerCooldown is how long an open circuit breaker keeps a backend out of rotation
+// when Config.BreakerCooldown is not set
+const defaultBreakerCooldown = 30 * time.Second
+
+// defaultWarmUpCount is the number of idle connections kept warm when Config.WarmUpCount is not set
+const defaultWarmUpCount = 2
+
+// LoadBalancer distributes HTTP requests over a pool of backend servers. Create one with
+// NewLoadBalancer, call Start to add the backends and serve Handler.
+type LoadBalancer struct {
+	config      Config
+	pool        *RoundRobinServerPool
+	router      *Router
+	handler     http.Handler
+	backendOpts []BackendOption
+	// affinities is set when Config.ConnectionStickiness is
+	affinities *connAffinities
+
+	// The pool holds the configured backends and those discovered from SRV records, guarded by
+	// membership so that a reload and a lookup do not remove each other's backends
+	membership sync.Mutex
+	configured []BackendConfig
+	discovered []BackendConfig
+}
+
+// NewLoadBalancer validates cfg and creates a LoadBalancer from it. No backend is contacted
+// before Start is called.
+func NewLoadBalancer(cfg Config) (*LoadBalancer, error) {
+	if err := (&FileConfig{Backends: cfg.Backends, Routes: cfg.Routes, ActiveGroup: cfg.ActiveGroup}).Validate(); err != nil {
+		return nil, err
+	}
+
+	if cfg.Strategy == "" {
+		cfg.Strategy = "round-robin"
+	}
+	strategy, err := NewStrategy(cfg.Strategy, cfg.StrategyConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Proxy.Overflow == "" {
+		cfg.Proxy.Overflow = OverflowReject
+	} else if _, err := ParseOverflowPolicy(string(cfg.Proxy.Overflow)); err != nil {
+		return nil, err
+	}
+	if cfg.MaintenancePage != "" {
+		page, err := loadMaintenancePage(cfg.MaintenancePage)
+		if err != nil {
+			return nil, fmt.Errorf("loading maintenance page: %w", err)
+		}
+		cfg.Proxy.maintenancePage = page
+	}
+	var trustedProxies []*net.IPNet
+	if cfg.ClientIPHeader != "" {
+		if err := validateHeaderNames([]string{cfg.ClientIPHeader}); err != nil {
+			return nil, fmt.Errorf("client IP header: %w", err)
+		}
+		if len(cfg.TrustedProxies) == 0 {
+			return nil, fmt.Errorf("client IP header: trusted proxies must be set, or any client could send the header")
+		}
+		nets, err := parseCIDRs(cfg.TrustedProxies)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxies: %w", err)
+		}
+		trustedProxies = nets
+	}
+	if err := validateStatusRemap(cfg.StatusRemap); err != nil {
+		return nil, fmt.Errorf("status remap: %w", err)
+	}
+	if len(cfg.ExcludeHeaderClients) > 0 {
+		nets, err := parseCIDRs(cfg.ExcludeHeaderClients)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Proxy.excludeClients = nets
+	}
+	localFiles, err := loadLocalFiles(map[string]string{"/favicon.ico": cfg.Favicon, "/robots.txt": cfg.RobotsTxt})
+	if err != nil {
+		return nil, err
+	}
+	if cfg.BreakerCooldown <= 0 {
+		cfg.BreakerCooldown = defaultBreakerCooldown
+	}
+	if cfg.FairQueue.Capacity < 0 || cfg.FairQueue.Timeout < 0 {
+		return nil, fmt.Errorf("fair queue capacity and timeout must not be negative")
+	}
+	if cfg.FairQueue.Capacity > 0 && cfg.FairQueue.Header == "" {
+		return nil, fmt.Errorf("fair queuing requires a tenant header")
+	}
+	for tenant, weight := range cfg.FairQueue.Weights {
+		if weight <= 0 {
+			return nil, fmt.Errorf("fair queue weight of tenant %q must be positive", tenant)
+		}
+	}
+	if cfg.Autoscale.WebhookURL != "" {
+		if cfg.Autoscale.HighWater <= 0 {
+			return nil, fmt.Errorf("the autoscaling webhook requires a positive high-water mark")
+		}
+		if cfg.Autoscale.LowWater > cfg.Autoscale.HighWater {
+			return nil, fmt.Errorf("the autoscaling low-water mark must not exceed the high-water mark")
+		}
+	}
+	if cfg.SRV.Name != "" {
+		switch cfg.SRV.Scheme {
+		case "":
+			cfg.SRV.Scheme = "http"
+		case "http", "https":
+		default:
+			return nil, fmt.Errorf("SRV backends must use http or https, got %q", cfg.SRV.Scheme)
+		}
+		if cfg.SRV.Interval <= 0 {
+			cfg.SRV.Interval = defaultSRVInterval
+		}
+		if cfg.SRV.Resolver == nil {
+			cfg.SRV.Resolver = net.DefaultResolver
+		}
+	}
+	if cfg.MaxURLLength < 0 {
+		return nil, fmt.Errorf("max URL length must not be negative")
+	}
+	if cfg.TrafficDial < 0 || cfg.TrafficDial > 100 {
+		return nil, fmt.Errorf("traffic dial must be between 1 and 100, got %d", cfg.TrafficDial)
+	}
+	if cfg.StandbyThreshold < 0 {
+		return nil, fmt.Errorf("standby threshold must not be negative")
+	}
+	if cfg.StandbyThreshold == 0 {
+		cfg.StandbyThreshold = defaultStandbyThreshold
+	}
+	switch cfg.AccessLogFormat {
+	case "":
+		cfg.AccessLogFormat = AccessLogText
+	case AccessLogText, AccessLogJSON:
+	default:
+		return nil, fmt.Errorf("unknown access log format %q", cfg.AccessLogFormat)
+	}
+	if cfg.BodyLog.SampleRate < 0 || cfg.BodyLog.SampleRate > 1 {
+		return nil, fmt.Errorf("body log sample rate must be between 0 and 1, got %g", cfg.BodyLog.SampleRate)
+	}
+	if err := validateHeaderNames(cfg.BodyLog.RedactHeaders); err != nil {
+		return nil, fmt.Errorf("body log redacted headers: %w", err)
+	}
+	if cfg.WarmUpCount <= 0 {
+		cfg.WarmUpCount = defaultWarmUpCount
+	}
+
+	lb := &LoadBalancer{
+		config: cfg,
+		pool:   NewRoundRobinServerPool(),
+		router: newRouter(cfg.Routes, cfg.StrategyConfig),
+		backendOpts: []BackendOption{
+			WithHealthLatencyThreshold(cfg.HealthLatencyThreshold),
+			WithHealthWindow(cfg.HealthWindow, cfg.HealthFailureRate),
+			WithStaleness(cfg.StaleAfter),
+			WithCircuitBreaker(cfg.BreakerThreshold, cfg.BreakerCooldown),
+			WithMaxResponseHeaderBytes(cfg.MaxResponseHeaderBytes),
+			WithWarmUp(cfg.WarmUpInterval, cfg.WarmUpCount),
+			WithResponseHooks(cfg.ResponseHooks...),
+			WithStatusRemap(cfg.StatusRemap),
+			WithHealthEvents(cfg.HealthEvents),
+			WithDNSRefresh(cfg.DNSRefreshInterval),
+			WithConnectionMaxAge(cfg.ConnectionMaxAge),
+			WithSelfRedirectDetection(cfg.SelfHosts),
+		},
+	}
+	lb.pool.SetStrategy(strategy)
+	if cfg.TrafficDial > 0 {
+		lb.pool.SetTrafficDial(cfg.TrafficDial)
+	}
+	if cfg.ConnectionStickiness {
+		lb.affinities = newConnAffinities()
+	}
+
+	var handler http.Handler = proxyHandler(lb.pool, lb.router, cfg.Proxy)
+	// Cached responses are served without waiting for a share of the backends
+	if cfg.FairQueue.Capacity > 0 {
+		handler = fairQueueHandler(newFairQueue(cfg.FairQueue), cfg.FairQueue.Header, handler)
+	}
+	if cfg.CacheSize > 0 {
+		handler = cacheHandler(newResponseCache(cfg.CacheSize), handler)
+		// A paused pool rejects every request, cached responses included
+		handler = pausedHandler(lb.pool, cfg.Proxy.maintenancePage, handler)
+	}
+	// Cached responses are logged too, the body log shows what clients were sent
+	if cfg.BodyLog.SampleRate > 0 {
+		handler = bodyLogHandler(cfg.BodyLog, handler)
+	}
+	if cfg.MaxRequestsPerIP > 0 {
+		handler = clientLimitHandler(newClientLimiter(cfg.MaxRequestsPerIP), handler)
+	}
+	if len(cfg.AllowedMethods) > 0 {
+		handler = methodHandler(newMethodSet(cfg.AllowedMethods), handler)
+	}
+	if cfg.NormalizePaths {
+		handler = normalizePathHandler(handler)
+	}
+	if cfg.MaxURLLength > 0 {
+		handler = maxURLLengthHandler(cfg.MaxURLLength, handler)
+	}
+	// Requests are logged as the client sent them, including those rejected on the way
+	if cfg.AccessLog != nil {
+		handler = accessLogHandler(cfg.AccessLogFormat, cfg.AccessLog, handler)
+	}
+	if cfg.ClientIPHeader != "" {
+		handler = clientIPHandler(cfg.ClientIPHeader, trustedProxies, handler)
+	}
+
+	// The probes are matched by hand, as a ServeMux would redirect requests with unclean paths
+	// rather than leave them to NormalizePaths
+	readyz := readyzHandler(lb.pool)
+	lb.handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/livez":
+			livezHandler(w, r)
+		case "/readyz":
+			readyz(w, r)
+		default:
+			// Browsers and crawlers ask every site for these, they need not take up a backend
+			if file, ok := localFiles[r.URL.Path]; ok {
+				serveLocalFile(w, file)
+				return
+			}
+			handler.ServeHTTP(w, r)
+		}
+	})
+
+	return lb, nil
+}
+
+// Start adds the configured backends to the pool, which starts health checking them, and
+// restores the saved state. The background work stops when ctx is done.
+func (lb *LoadBalancer) Start(ctx context.Context) {
+	lb.pool.SetActiveGroup(lb.config.ActiveGroup)
+	lb.setConfiguredBackends(lb.config.Backends)
+	if lb.config.SRV.Name != "" {
+		go lb.discoverSRV(ctx, lb.config.SRV)
+	}
+
+	if lb.config.StatePath != "" {
+		if err := lb.pool.LoadState(lb.config.StatePath); err != nil {
+			log.Printf("Error loading state, starting fresh: %s", err)
+		}
+		go persistState(ctx, lb.pool, lb.config.StatePath, 10*time.Second)
+	}
+	go watchStandbys(ctx, lb.pool, lb.config.StandbyThreshold, standbyCheckInterval)
+	if lb.config.Autoscale.WebhookURL != "" {
+		go newAutoscaler(lb.config.Autoscale).watch(ctx, lb.pool, autoscaleSampleInterval)
+	}
+
+	go func() {
+		<-ctx.Done()
+		for _, backend := range lb.pool.GetBackends() {
+			backend.Stop()
+		}
+	}()
+}
+
+// Reload brings the backends, routes and active backend group in line with config, see ApplyConfig
+func (lb *LoadBalancer) Reload(config *FileConfig) {
+	lb.setConfiguredBackends(config.Backends)
+	lb.router.SetRoutes(config.Routes)
+	// Backends of a new group are added first, so the group is ready when requests move to it
+	if config.ActiveGroup != "" && config.ActiveGroup != lb.pool.GetActiveGroup() {
+		lb.pool.SetActiveGroup(config.ActiveGroup)
+		log.Printf("Switched requests to backend group %q", config.ActiveGroup)
+	}
+}
+
+// setConfiguredBackends replaces the backends listed in the configuration
+func (lb *LoadBalancer) setConfiguredBackends(backends []BackendConfig) {
+	lb.membership.Lock()
+	defer lb.membership.Unlock()
+	lb.configured = backends
+	lb.applyBackends()
+}
+
+// setDiscoveredBackends replaces the backends discovered from SRV records
+func (lb *LoadBalancer) setDiscoveredBackends(backends []BackendConfig) {
+	lb.membership.Lock()
+	defer lb.membership.Unlock()
+	lb.discovered = backends
+	lb.applyBackends()
+}
+
+// applyBackends brings the pool in line with the configured and discovered backends, the
+// configured settings winning for a backend that is both. It must be called with membership held.
+func (lb *LoadBalancer) applyBackends() {
+	backends := append([]BackendConfig(nil), lb.configured...)
+	for _, discovered := range lb.discovered {
+		duplicate := false
+		for _, configured := range lb.configured {
+			if normalizeRawURL(configured.URL) == normalizeRawURL(discovered.URL) {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			backends = append(backends, discovered)
+		}
+	}
+	ApplyConfig(lb.pool, &FileConfig{Backends: backends}, lb.backendOpts...)
+}
+
+// Handler returns the handler proxying requests to the backends, which also answers the
+// /livez and /readyz probes
+func (lb *LoadBalancer) Handler() http.Handler {
+	return lb.handler
+}
+
+// ConnContext is meant for http.Server.ConnContext, it lets requests on the connection c stick to
+// one backend when Config.ConnectionStickiness is set
+func (lb *LoadBalancer) ConnContext(ctx context.Context, c net.Conn) context.Context {
+	if lb.affinities == nil {
+		return ctx
+	}
+	return lb.affinities.add(ctx, c)
+}
+
+// ConnState is meant for http.Server.ConnState, it forgets the backend of connections that are
+// closed or hijacked
+func (lb *LoadBalancer) ConnState(c net.Conn, state http.ConnState) {
+	if lb.affinities != nil && (state == http.StateClosed || state == http.StateHijacked) {
+		lb.affinities.remove(c)
+	}
+}
+
+// Snapshot returns the stats of every backend, see RoundRobinServerPool.Snapshot
+func (lb *LoadBalancer) Snapshot() []BackendStats {
+	return lb.pool.Snapshot()
+}
+
+// AdminHandler returns the handler of the admin API, to be served on a separate listener
+func (lb *LoadBalancer) AdminHandler() http.Handler {
+	return adminHandler(lb.pool, lb.config.StrategyConfig)
+}
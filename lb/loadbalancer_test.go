@@ -0,0 +1,143 @@
+package lb
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestReloadAddsRemovesAndReweighsBackends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lb.json")
+	writeConfig := func(config string) *FileConfig {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := LoadConfig(path)
+		if err != nil {
+			t.Fatalf("LoadConfig: %s", err)
+		}
+		return loaded
+	}
+
+	initial := writeConfig(`{"backends": [{"url": "http://a:3001"}, {"url": "http://b:3001", "weight": 2}]}`)
+	balancer := startTestLoadBalancer(t, Config{Backends: initial.Backends})
+	want := map[string]int{"http://a:3001": 1, "http://b:3001": 2}
+	if got := weights(balancer.pool); !reflect.DeepEqual(got, want) {
+		t.Fatalf("backends = %v, want %v", got, want)
+	}
+
+	balancer.Reload(writeConfig(`{"backends": [{"url": "http://b:3001", "weight": 5}, {"url": "http://c:3001"}]}`))
+	want = map[string]int{"http://b:3001": 5, "http://c:3001": 1}
+	if got := weights(balancer.pool); !reflect.DeepEqual(got, want) {
+		t.Errorf("backends after reload = %v, want %v", got, want)
+	}
+}
+
+func TestReloadReplacesBackendsWithChangedSettings(t *testing.T) {
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("X-Internal"))
+	})
+	balancer := startTestLoadBalancer(t, Config{Backends: []BackendConfig{{URL: server.URL}}})
+	get := func() string {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("X-Internal", "secret")
+		w := httptest.NewRecorder()
+		balancer.Handler().ServeHTTP(w, r)
+		return w.Body.String()
+	}
+	before := balancer.pool.GetBackends()[0]
+
+	// A new weight is applied to the backend in place
+	balancer.Reload(&FileConfig{Backends: []BackendConfig{{URL: server.URL + "/", Weight: intPtr(3)}}})
+	if got := balancer.pool.GetBackends(); len(got) != 1 || got[0] != before || got[0].GetWeight() != 3 {
+		t.Fatalf("backends after reweighing = %v, want the same backend with weight 3", got)
+	}
+	if got := get(); got != "secret" {
+		t.Fatalf("backend received X-Internal %q, want it forwarded", got)
+	}
+
+	// Any other setting takes a new backend
+	balancer.Reload(&FileConfig{Backends: []BackendConfig{{URL: server.URL, Weight: intPtr(3), RemoveHeaders: []string{"X-Internal"}}}})
+	after := balancer.pool.GetBackends()
+	if len(after) != 1 || after[0] == before || after[0].GetWeight() != 3 {
+		t.Fatalf("backends after changing removeHeaders = %v, want a new backend with weight 3", after)
+	}
+	if got := get(); got != "" {
+		t.Errorf("backend received X-Internal %q after reload, want it removed", got)
+	}
+
+	if got := changedSettings(BackendConfig{URL: "http://a:3001", MaxConnections: 5}, BackendConfig{URL: "http://A:3001/", Weight: intPtr(2), MaxConnections: 10, HostMode: HostModePreserve}); !reflect.DeepEqual(got, []string{"maxConnections", "hostMode"}) {
+		t.Errorf("changedSettings = %v, want [maxConnections hostMode]", got)
+	}
+}
+
+func TestLoadBalancerServesOverHTTP(t *testing.T) {
+	var hits atomic.Int32
+	names := []string{"a", "b"}
+	var backends []BackendConfig
+	for _, name := range names {
+		name := name
+		backends = append(backends, BackendConfig{URL: newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			hits.Add(1)
+			io.WriteString(w, name)
+		}).URL})
+	}
+
+	balancer, err := NewLoadBalancer(Config{Backends: backends, Strategy: "smooth-weighted"})
+	if err != nil {
+		t.Fatalf("NewLoadBalancer: %s", err)
+	}
+	server := httptest.NewServer(balancer.Handler())
+	defer server.Close()
+	get := func() (int, string) {
+		resp, err := http.Get(server.URL + "/")
+		if err != nil {
+			t.Fatalf("GET: %s", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	// Backends are only added to the pool by Start
+	if code, _ := get(); code != http.StatusServiceUnavailable || hits.Load() != 0 {
+		t.Errorf("before Start: status %d after %d backend requests, want %d and none", code, hits.Load(), http.StatusServiceUnavailable)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	balancer.Start(ctx)
+	var got []string
+	for i := 0; i < 4; i++ {
+		code, body := get()
+		if code != http.StatusOK {
+			t.Fatalf("status = %d, want %d", code, http.StatusOK)
+		}
+		got = append(got, body)
+	}
+	if strings.Join(got, "") != "abab" {
+		t.Errorf("responses came from %v, want the backends in turn", got)
+	}
+}
+
+func TestNewLoadBalancerRejectsInvalidConfig(t *testing.T) {
+	for name, cfg := range map[string]Config{
+		"backend without scheme": {Backends: []BackendConfig{{URL: "localhost:3001"}}},
+		"duplicate backend":      {Backends: []BackendConfig{{URL: "http://a:3001"}, {URL: "http://a:3001/"}}},
+		"unknown strategy":       {Strategy: "fastest"},
+		"unknown overflow":       {Proxy: ProxyOptions{Overflow: "drop"}},
+		"untrusted client IP":    {ClientIPHeader: "X-Forwarded-For"},
+	} {
+		if _, err := NewLoadBalancer(cfg); err == nil {
+			t.Errorf("%s: NewLoadBalancer succeeded, want an error", name)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package lb
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// LocalFileNone answers requests for a locally served file with an empty 204 No Content
+const LocalFileNone = "none"
+
+// loadLocalFiles reads the files served by the load balancer itself rather than by the backends,
+// keyed by request path. Sources are files read once like the maintenance page, LocalFileNone
+// for an empty response, or empty to leave the path to the backends.
+func loadLocalFiles(sources map[string]string) (map[string]*maintenancePage, error) {
+	files := make(map[string]*maintenancePage)
+	for path, source := range sources {
+		if source == "" {
+			continue
+		}
+		if source == LocalFileNone {
+			files[path] = nil
+			continue
+		}
+		page, err := loadMaintenancePage(source)
+		if err != nil {
+			return nil, fmt.Errorf("loading %s: %w", path, err)
+		}
+		files[path] = page
+	}
+	return files, nil
+}
+
+// serveLocalFile answers with the file, or with 204 No Content when it is nil. Both are cacheable
+// for a day, so browsers and crawlers do not ask again on every visit.
+func serveLocalFile(w http.ResponseWriter, file *maintenancePage) {
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	if file == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Content-Type", file.contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(file.body)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(file.body)
+}
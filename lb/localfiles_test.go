@@ -0,0 +1,66 @@
+package lb
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+func TestFaviconAndRobotsAreServedLocally(t *testing.T) {
+	var proxied atomic.Int32
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		proxied.Add(1)
+	})
+	robots := filepath.Join(t.TempDir(), "robots.txt")
+	if err := os.WriteFile(robots, []byte("User-agent: *\nDisallow: /\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	handler := startTestLoadBalancer(t, Config{
+		Backends:  []BackendConfig{{URL: server.URL}},
+		Favicon:   LocalFileNone,
+		RobotsTxt: robots,
+	}).Handler()
+
+	w := serve(handler, http.MethodGet, "/favicon.ico")
+	if w.Code != http.StatusNoContent || w.Body.Len() != 0 {
+		t.Errorf("/favicon.ico answered %d with %q, want an empty 204", w.Code, w.Body.String())
+	}
+	w = serve(handler, http.MethodGet, "/robots.txt")
+	if w.Code != http.StatusOK || w.Body.String() != "User-agent: *\nDisallow: /\n" {
+		t.Errorf("/robots.txt answered %d with %q, want the configured file", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("Cache-Control"); got != "public, max-age=86400" {
+		t.Errorf("/robots.txt Cache-Control = %q, want it cacheable for a day", got)
+	}
+	if got := proxied.Load(); got != 0 {
+		t.Errorf("backend received %d requests for the local files, want none", got)
+	}
+
+	serve(handler, http.MethodGet, "/index.html")
+	if got := proxied.Load(); got != 1 {
+		t.Errorf("backend received %d requests for /index.html, want 1", got)
+	}
+}
+
+func TestLocalFilesAreProxiedUnlessConfigured(t *testing.T) {
+	var proxied atomic.Int32
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		proxied.Add(1)
+	})
+	handler := startTestLoadBalancer(t, Config{Backends: []BackendConfig{{URL: server.URL}}}).Handler()
+
+	for _, path := range []string{"/favicon.ico", "/robots.txt"} {
+		if code := serve(handler, http.MethodGet, path).Code; code != http.StatusOK {
+			t.Errorf("%s answered %d, want the backend's 200", path, code)
+		}
+	}
+	if got := proxied.Load(); got != 2 {
+		t.Errorf("backend received %d requests, want 2", got)
+	}
+
+	if _, err := NewLoadBalancer(Config{Backends: []BackendConfig{{URL: server.URL}}, Favicon: filepath.Join(t.TempDir(), "missing.ico")}); err == nil {
+		t.Error("NewLoadBalancer accepted a missing favicon file")
+	}
+}
@@ -0,0 +1,59 @@
+package lb
+
+import (
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// maintenancePage is a page read from disk once and served from memory whenever the load
+// balancer cannot proxy a request, because it is paused or no backend is available
+type maintenancePage struct {
+	contentType string
+	body        []byte
+}
+
+// loadMaintenancePage reads the page at path. Its Content-Type is taken from the file extension,
+// or sniffed from the contents when the extension is unknown.
+func loadMaintenancePage(path string) (*maintenancePage, error) {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	contentType := mime.TypeByExtension(filepath.Ext(path))
+	if contentType == "" {
+		contentType = http.DetectContentType(body)
+	}
+	return &maintenancePage{contentType: contentType, body: body}, nil
+}
+
+// pausedHandler answers requests with 503 while the pool is paused, before next gets to serve
+// them from the cache
+func pausedHandler(pool ServerPool, page *maintenancePage, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if pool.IsPaused() {
+			serveUnavailable(w, page, "Service is paused for maintenance")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// serveUnavailable answers 503 Service Unavailable with the maintenance page, or with message
+// as plain text when there is none
+func serveUnavailable(w http.ResponseWriter, page *maintenancePage, message string) {
+	if page == nil {
+		http.Error(w, message, http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", page.contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(page.body)))
+	// The page stands in for the real response, which caches must not replace with it
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write(page.body)
+}
@@ -0,0 +1,136 @@
+package lb
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPauseAndResume(t *testing.T) {
+	var hits atomic.Int32
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+	})
+	page := filepath.Join(t.TempDir(), "maintenance.html")
+	if err := os.WriteFile(page, []byte("<h1>Back soon</h1>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	balancer := startTestLoadBalancer(t, Config{
+		Backends:        []BackendConfig{{URL: server.URL}},
+		CacheSize:       10,
+		MaintenancePage: page,
+	})
+	handler, admin := balancer.Handler(), balancer.AdminHandler()
+
+	// A cached response is rejected while paused as well
+	serve(handler, http.MethodGet, "/cached")
+	if w := serve(admin, http.MethodPost, "/pause"); w.Code != http.StatusNoContent {
+		t.Fatalf("POST /pause = %d, want %d", w.Code, http.StatusNoContent)
+	}
+	for _, path := range []string{"/cached", "/other"} {
+		w := serve(handler, http.MethodGet, path)
+		if w.Code != http.StatusServiceUnavailable || w.Body.String() != "<h1>Back soon</h1>" {
+			t.Errorf("%s while paused: %d %q, want %d with the maintenance page", path, w.Code, w.Body.String(), http.StatusServiceUnavailable)
+		}
+	}
+	if n := hits.Load(); n != 1 {
+		t.Errorf("backend received %d requests, want only the one before pausing", n)
+	}
+	if !balancer.pool.GetBackends()[0].IsAlive() {
+		t.Error("pausing the pool changed the state of its backend")
+	}
+
+	if w := serve(admin, http.MethodPost, "/resume"); w.Code != http.StatusNoContent {
+		t.Fatalf("POST /resume = %d, want %d", w.Code, http.StatusNoContent)
+	}
+	if w := serve(handler, http.MethodGet, "/other"); w.Code != http.StatusOK {
+		t.Errorf("status after resuming = %d, want %d", w.Code, http.StatusOK)
+	}
+	if w := serve(admin, http.MethodGet, "/pause"); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /pause = %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestMaintenancePageWhenAllBackendsAreDown(t *testing.T) {
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {})
+	for _, tt := range []struct {
+		name, body, contentType string
+	}{
+		{"maintenance.html", "<h1>Back soon</h1>", "text/html; charset=utf-8"},
+		{"maintenance.json", `{"error": "maintenance"}`, "application/json"},
+		// Unknown extensions are sniffed from the contents
+		{"maintenance.page", "<!DOCTYPE html><p>Back soon</p>", "text/html; charset=utf-8"},
+	} {
+		page := filepath.Join(t.TempDir(), tt.name)
+		if err := os.WriteFile(page, []byte(tt.body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		balancer := startTestLoadBalancer(t, Config{Backends: []BackendConfig{{URL: server.URL}}, MaintenancePage: page})
+		balancer.pool.GetBackends()[0].SetAlive(false)
+		// The page is served from memory once loaded
+		os.Remove(page)
+
+		w := serve(balancer.Handler(), http.MethodGet, "/")
+		if w.Code != http.StatusServiceUnavailable || w.Body.String() != tt.body {
+			t.Errorf("%s: %d %q, want %d with the page", tt.name, w.Code, w.Body.String(), http.StatusServiceUnavailable)
+		}
+		if got := w.Header().Get("Content-Type"); got != tt.contentType {
+			t.Errorf("%s: Content-Type = %q, want %q", tt.name, got, tt.contentType)
+		}
+		if got := w.Header().Get("Cache-Control"); got != "no-store" {
+			t.Errorf("%s: Cache-Control = %q, want no-store", tt.name, got)
+		}
+	}
+}
+
+func TestMissingMaintenancePageFailsStartup(t *testing.T) {
+	_, err := NewLoadBalancer(Config{MaintenancePage: filepath.Join(t.TempDir(), "missing.html")})
+	if err == nil {
+		t.Error("NewLoadBalancer succeeded with a missing maintenance page")
+	}
+}
+
+func TestMaintenanceWindowExcludesBackendWithoutFailingIt(t *testing.T) {
+	// The backend fails its health checks throughout its maintenance
+	failing := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	end := time.Now().Add(200 * time.Millisecond)
+	events := make(chan HealthEvent, 100)
+	b := newTestBackend(t, failing.URL,
+		WithMaintenanceWindows(MaintenanceWindow{Start: time.Now().Add(-time.Hour), End: end}),
+		WithHealthEvents(events),
+	)
+	other := newTestBackend(t, "http://other:3001")
+	pool := NewRoundRobinServerPool()
+	pool.AddBackend(b)
+	pool.AddBackend(other)
+	go b.WatchMaintenance(10 * time.Millisecond)
+
+	waitFor(t, "maintenance window was not noticed", b.IsInMaintenance)
+	for i := 0; i < 4; i++ {
+		if peer := pool.GetNextValidPeer(); peer != other {
+			t.Fatalf("selection %d during maintenance = %s, want the other backend", i, peer.GetURL())
+		}
+	}
+
+	go b.PerformHealthCheck(10 * time.Millisecond)
+	// Checks ending before the window does are not counted
+	for {
+		event := <-events
+		if time.Now().After(end) {
+			break
+		}
+		if event.Passed || !event.Alive {
+			t.Fatalf("check during maintenance: passed %t, alive %t, want a failed check not counted", event.Passed, event.Alive)
+		}
+	}
+	// Once the window is over failed checks count again
+	waitFor(t, "failing backend still alive after its maintenance window", func() bool {
+		return !b.IsInMaintenance() && !b.IsAlive()
+	})
+}
@@ -0,0 +1,108 @@
+package lb
+
+import (
+	"context"
+	"net"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// minRecycleInterval is the shortest interval at which connection ages are checked, whatever the
+// maximum age
+const minRecycleInterval = 10 * time.Millisecond
+
+// connTracker records when each open upstream connection of a backend was dialed and whether it
+// is idle in the transport's pool
+type connTracker struct {
+	mutex sync.Mutex
+	conns map[*trackedConn]bool
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{conns: make(map[*trackedConn]bool)}
+}
+
+// dialer wraps dial so that the connections it opens are tracked until they are closed
+func (ct *connTracker) dialer(dial func(ctx context.Context, network, address string) (net.Conn, error)) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+
+		tracked := &trackedConn{Conn: conn, tracker: ct, dialed: time.Now()}
+		ct.mutex.Lock()
+		// A connection dialed for a request that got another one goes straight to the idle pool
+		ct.conns[tracked] = true
+		ct.mutex.Unlock()
+		return tracked, nil
+	}
+}
+
+// trace follows a request's connection, which is busy from when the request gets it until it is
+// put back in the idle pool
+func (ct *connTracker) trace(ctx context.Context) context.Context {
+	var conn *trackedConn
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			tracked, ok := info.Conn.(*trackedConn)
+			if !ok {
+				return
+			}
+			conn = tracked
+			ct.setIdle(conn, false)
+		},
+		PutIdleConn: func(err error) {
+			// A connection that could not be put back is closed by the transport
+			if conn != nil && err == nil {
+				ct.setIdle(conn, true)
+			}
+		},
+	})
+}
+
+// setIdle records whether a connection that is still open is idle
+func (ct *connTracker) setIdle(conn *trackedConn, idle bool) {
+	ct.mutex.Lock()
+	defer ct.mutex.Unlock()
+	if _, ok := ct.conns[conn]; ok {
+		ct.conns[conn] = idle
+	}
+}
+
+// closeExpired closes the idle connections dialed more than maxAge ago and returns how many it
+// closed. Connections in use are left alone, and closed at a later call once idle. The transport
+// drops a closed connection from its pool, and retries a request it had just picked it for.
+func (ct *connTracker) closeExpired(maxAge time.Duration) int {
+	ct.mutex.Lock()
+	var expired []*trackedConn
+	for conn, idle := range ct.conns {
+		if idle && time.Since(conn.dialed) > maxAge {
+			expired = append(expired, conn)
+		}
+	}
+	ct.mutex.Unlock()
+
+	for _, conn := range expired {
+		conn.Close()
+	}
+	return len(expired)
+}
+
+// trackedConn is a connection that leaves its tracker when closed
+type trackedConn struct {
+	net.Conn
+	tracker *connTracker
+	dialed  time.Time
+	once    sync.Once
+}
+
+func (tc *trackedConn) Close() error {
+	tc.once.Do(func() {
+		tc.tracker.mutex.Lock()
+		delete(tc.tracker.conns, tc)
+		tc.tracker.mutex.Unlock()
+	})
+	return tc.Conn.Close()
+}
@@ -0,0 +1,88 @@
+package lb
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newConnCountingServer starts a server counting the connections it accepted and those that
+// have since been closed
+func newConnCountingServer(t *testing.T, handler http.HandlerFunc) (server *httptest.Server, opened, closed *atomic.Int32) {
+	t.Helper()
+	opened, closed = new(atomic.Int32), new(atomic.Int32)
+	server = httptest.NewUnstartedServer(handler)
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateNew:
+			opened.Add(1)
+		case http.StateClosed:
+			closed.Add(1)
+		}
+	}
+	server.Start()
+	t.Cleanup(server.Close)
+	return server, opened, closed
+}
+
+func TestIdleConnectionsAreClosedAfterMaxAge(t *testing.T) {
+	server, opened, closed := newConnCountingServer(t, func(w http.ResponseWriter, r *http.Request) {})
+	b := newTestBackend(t, server.URL, WithConnectionMaxAge(50*time.Millisecond))
+	go b.RecycleConnections()
+
+	// The connection is kept alive and reused while it is younger than the maximum age
+	serve(b, http.MethodGet, "/")
+	serve(b, http.MethodGet, "/")
+	if n := opened.Load(); n != 1 {
+		t.Fatalf("opened %d connections before the maximum age, want 1", n)
+	}
+
+	waitFor(t, "idle connection was not closed after the maximum age", func() bool {
+		return closed.Load() == 1
+	})
+	if w := serve(b, http.MethodGet, "/"); w.Code != http.StatusOK {
+		t.Errorf("status after recycling = %d, want %d", w.Code, http.StatusOK)
+	}
+	if n := opened.Load(); n != 2 {
+		t.Errorf("opened %d connections, want a new one after recycling", n)
+	}
+}
+
+func TestBusyConnectionsOutliveMaxAge(t *testing.T) {
+	var closed *atomic.Int32
+	var closedDuringRequest atomic.Int32
+	server, _, closed := newConnCountingServer(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		closedDuringRequest.Store(closed.Load())
+	})
+	b := newTestBackend(t, server.URL, WithConnectionMaxAge(20*time.Millisecond))
+	go b.RecycleConnections()
+
+	// A request running past the maximum age completes on its connection
+	if w := serve(b, http.MethodGet, "/"); w.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if n := closedDuringRequest.Load(); n != 0 {
+		t.Errorf("closed %d connections while in use, want 0", n)
+	}
+	waitFor(t, "connection was not closed once idle", func() bool {
+		return closed.Load() == 1
+	})
+}
+
+func TestConnectionsAreKeptWithoutMaxAge(t *testing.T) {
+	server, opened, _ := newConnCountingServer(t, func(w http.ResponseWriter, r *http.Request) {})
+	b := newTestBackend(t, server.URL)
+	go b.RecycleConnections()
+
+	for i := 0; i < 3; i++ {
+		serve(b, http.MethodGet, "/")
+		time.Sleep(20 * time.Millisecond)
+	}
+	if n := opened.Load(); n != 1 {
+		t.Errorf("opened %d connections, want 1", n)
+	}
+}
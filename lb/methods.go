@@ -0,0 +1,46 @@
+package lb
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// methodSet is the set of request methods the load balancer proxies
+type methodSet map[string]bool
+
+// newMethodSet returns the set of methods such as GET, HEAD and POST. Methods are case-sensitive,
+// so get is a method of its own rather than GET.
+func newMethodSet(list []string) methodSet {
+	methods := make(methodSet)
+	for _, method := range list {
+		if method = strings.TrimSpace(method); method != "" {
+			methods[method] = true
+		}
+	}
+	return methods
+}
+
+// allow returns the value of the Allow header listing the methods
+func (m methodSet) allow() string {
+	methods := make([]string, 0, len(m))
+	for method := range m {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	return strings.Join(methods, ", ")
+}
+
+// methodHandler rejects requests whose method is not in methods with 405 Method Not Allowed
+// before they reach a backend, e.g. to keep TRACE and CONNECT away from backends
+func methodHandler(methods methodSet, next http.Handler) http.Handler {
+	allow := methods.allow()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !methods[r.Method] {
+			w.Header().Set("Allow", allow)
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,43 @@
+package lb
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+func TestAllowedMethods(t *testing.T) {
+	var hits atomic.Int32
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) { hits.Add(1) })
+	handler := startTestLoadBalancer(t, Config{
+		Backends:       []BackendConfig{{URL: server.URL}},
+		AllowedMethods: []string{"POST", " GET ", "HEAD", ""},
+	}).Handler()
+
+	for _, tt := range []struct {
+		method string
+		code   int
+	}{
+		{http.MethodGet, http.StatusOK},
+		{http.MethodPost, http.StatusOK},
+		{http.MethodTrace, http.StatusMethodNotAllowed},
+		{http.MethodDelete, http.StatusMethodNotAllowed},
+		// Methods are case-sensitive
+		{"get", http.StatusMethodNotAllowed},
+	} {
+		hits.Store(0)
+		w := serve(handler, tt.method, "/")
+		if w.Code != tt.code {
+			t.Errorf("%s: status = %d, want %d", tt.method, w.Code, tt.code)
+		}
+		if tt.code != http.StatusMethodNotAllowed {
+			continue
+		}
+		if got := w.Header().Get("Allow"); got != "GET, HEAD, POST" {
+			t.Errorf("%s: Allow = %q, want %q", tt.method, got, "GET, HEAD, POST")
+		}
+		if hits.Load() != 0 {
+			t.Errorf("%s: rejected request reached the backend", tt.method)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package lb
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// OverflowPolicy decides what happens to a request when every backend it may use is alive but
+// has reached its connection cap
+type OverflowPolicy string
+
+const (
+	// OverflowReject answers with 503 Service Unavailable right away
+	OverflowReject OverflowPolicy = "reject"
+	// OverflowQueue waits for a backend to drop below its cap, up to the queue timeout
+	OverflowQueue OverflowPolicy = "queue"
+	// OverflowLeastSaturated sends the request over the cap to the backend with the lowest
+	// share of its cap in use
+	OverflowLeastSaturated OverflowPolicy = "least-saturated"
+)
+
+// slotReleased wakes the queued requests whenever a backend finishes a request or comes back up,
+// so that they retry selection
+var slotReleased broadcast
+
+// broadcast wakes every goroutine waiting on it at once
+type broadcast struct {
+	ch atomic.Pointer[chan struct{}]
+}
+
+// wait returns a channel that is closed on the next notify
+func (b *broadcast) wait() <-chan struct{} {
+	for {
+		if ch := b.ch.Load(); ch != nil {
+			return *ch
+		}
+		ch := make(chan struct{})
+		if b.ch.CompareAndSwap(nil, &ch) {
+			return ch
+		}
+	}
+}
+
+// notify wakes the goroutines waiting, it is cheap when there are none
+func (b *broadcast) notify() {
+	if b.ch.Load() == nil {
+		return
+	}
+	if ch := b.ch.Swap(nil); ch != nil {
+		close(*ch)
+	}
+}
+
+// ParseOverflowPolicy returns the OverflowPolicy with the given name, an empty name selects OverflowReject
+func ParseOverflowPolicy(name string) (OverflowPolicy, error) {
+	switch policy := OverflowPolicy(name); policy {
+	case "":
+		return OverflowReject, nil
+	case OverflowReject, OverflowQueue, OverflowLeastSaturated:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown overflow policy %q", name)
+	}
+}
+
+// selectOverflow applies the overflow policy after the route found no backend to use, leaving
+// out the excluded backends unless no other one is saturated. It returns nil when the backends
+// are unavailable rather than saturated, or the policy finds none.
+func selectOverflow(pool ServerPool, r *http.Request, route Route, opts ProxyOptions, excluded backendSet) Backend {
+	saturated := saturatedBackends(pool, route, excluded)
+	// Like the other selections, excluded backends are only used when no other one is left
+	if len(saturated) == 0 && len(excluded) > 0 {
+		excluded = nil
+		saturated = saturatedBackends(pool, route, nil)
+	}
+	if len(saturated) == 0 {
+		return nil
+	}
+
+	switch opts.Overflow {
+	case OverflowLeastSaturated:
+		return leastSaturated(saturated)
+	case OverflowQueue:
+		return waitForBackend(pool, r, route, opts.OverflowQueueTimeout, excluded)
+	default:
+		return nil
+	}
+}
+
+// saturatedBackends returns the backends the route may use, other than the excluded ones, that
+// are only held back by their connection cap or request rate cap
+func saturatedBackends(pool ServerPool, route Route, excluded backendSet) []Backend {
+	var saturated []Backend
+	for _, backend := range pool.GetAliveBackends() {
+		if backend.IsSaturated() && HasTags(backend, route.Tags) && !excluded.has(backend) {
+			saturated = append(saturated, backend)
+		}
+	}
+	return saturated
+}
+
+// leastSaturated returns the backend using the smallest share of its connection cap. Backends at
+// their request rate cap are left alone, as going over it is what the cap is there to prevent.
+func leastSaturated(backends []Backend) Backend {
+	var selected Backend
+	var selectedUsage float64
+	for _, backend := range backends {
+		if backend.IsThrottled() {
+			continue
+		}
+		usage := float64(backend.GetActiveConnections()) / float64(backend.GetMaxConnections())
+		if selected == nil || usage < selectedUsage {
+			selected = backend
+			selectedUsage = usage
+		}
+	}
+	return selected
+}
+
+// waitForBackend retries selection, leaving out the excluded backends, until a backend drops
+// below its cap, the timeout passes or the client goes away. It retries whenever a backend
+// finishes a request or comes back up, and when a backend at its request rate cap is next let a
+// request through.
+func waitForBackend(pool ServerPool, r *http.Request, route Route, timeout time.Duration, excluded backendSet) Backend {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		// Waiting starts before selecting, so that a slot released in between is not missed
+		released := slotReleased.wait()
+		if peer := route.selectBackend(pool, excluded); peer != nil {
+			return peer
+		}
+
+		// A nil channel never fires when no backend is throttled
+		var refilled <-chan time.Time
+		var refill *time.Timer
+		if until := throttledUntil(saturatedBackends(pool, route, excluded)); !until.IsZero() {
+			refill = time.NewTimer(time.Until(until))
+			refilled = refill.C
+		}
+
+		woken := true
+		select {
+		case <-r.Context().Done():
+			woken = false
+		case <-timer.C:
+			woken = false
+		case <-released:
+		case <-refilled:
+		}
+		if refill != nil {
+			refill.Stop()
+		}
+		if !woken {
+			return nil
+		}
+	}
+}
+
+// throttledUntil returns the earliest time one of the backends at their request rate cap is let
+// a request through, the zero time if none of them is throttled
+func throttledUntil(backends []Backend) time.Time {
+	var earliest time.Time
+	for _, backend := range backends {
+		if until := backend.ThrottledUntil(); !until.IsZero() && (earliest.IsZero() || until.Before(earliest)) {
+			earliest = until
+		}
+	}
+	return earliest
+}
@@ -0,0 +1,170 @@
+package lb
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startSaturatedLoadBalancer starts a load balancer with the overflow options of proxy over two
+// backends capped at one connection each, and fills both caps with requests that are held until
+// the returned function is called
+func startSaturatedLoadBalancer(t *testing.T, proxy ProxyOptions) (http.Handler, func()) {
+	t.Helper()
+	var held atomic.Int32
+	release := make(chan struct{})
+	slow := func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			held.Add(1)
+			<-release
+		}
+	}
+	backends := []BackendConfig{
+		{URL: newTestServer(t, slow).URL, MaxConnections: 1},
+		{URL: newTestServer(t, slow).URL, MaxConnections: 1},
+	}
+	handler := startTestLoadBalancer(t, Config{Backends: backends, Proxy: proxy}).Handler()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serve(handler, http.MethodGet, "/slow")
+		}()
+	}
+	waitFor(t, "held requests did not reach both backends", func() bool { return held.Load() == 2 })
+
+	var once sync.Once
+	releaseAll := func() {
+		once.Do(func() {
+			close(release)
+			wg.Wait()
+		})
+	}
+	t.Cleanup(releaseAll)
+	return handler, releaseAll
+}
+
+func TestOverflowPolicies(t *testing.T) {
+	t.Run("reject", func(t *testing.T) {
+		handler, _ := startSaturatedLoadBalancer(t, ProxyOptions{Overflow: OverflowReject})
+		if w := serve(handler, http.MethodGet, "/"); w.Code != http.StatusServiceUnavailable {
+			t.Errorf("status = %d, want %d", w.Code, http.StatusServiceUnavailable)
+		}
+	})
+
+	t.Run("least-saturated", func(t *testing.T) {
+		handler, _ := startSaturatedLoadBalancer(t, ProxyOptions{Overflow: OverflowLeastSaturated})
+		if w := serve(handler, http.MethodGet, "/"); w.Code != http.StatusOK {
+			t.Errorf("status = %d, want %d over the cap", w.Code, http.StatusOK)
+		}
+	})
+
+	t.Run("queue", func(t *testing.T) {
+		handler, release := startSaturatedLoadBalancer(t, ProxyOptions{Overflow: OverflowQueue, OverflowQueueTimeout: time.Second})
+		time.AfterFunc(50*time.Millisecond, release)
+		start := time.Now()
+		if w := serve(handler, http.MethodGet, "/"); w.Code != http.StatusOK {
+			t.Errorf("status = %d, want %d once a backend is free", w.Code, http.StatusOK)
+		}
+		if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+			t.Errorf("queued request served after %s, before a backend was free", elapsed)
+		}
+	})
+
+	t.Run("queue timeout", func(t *testing.T) {
+		handler, _ := startSaturatedLoadBalancer(t, ProxyOptions{Overflow: OverflowQueue, OverflowQueueTimeout: 30 * time.Millisecond})
+		if w := serve(handler, http.MethodGet, "/"); w.Code != http.StatusServiceUnavailable {
+			t.Errorf("status = %d, want %d after the queue timeout", w.Code, http.StatusServiceUnavailable)
+		}
+	})
+}
+
+func TestOverflowHonorsExcludeHeader(t *testing.T) {
+	for _, tt := range []struct {
+		overflow OverflowPolicy
+		release  []string
+	}{
+		// Both backends use the same share of their cap, a would be picked first
+		{OverflowLeastSaturated, nil},
+		// a frees up first but is excluded, the request waits for b
+		{OverflowQueue, []string{"a", "b"}},
+	} {
+		var held atomic.Int32
+		releases := map[string]chan struct{}{"a": make(chan struct{}), "b": make(chan struct{})}
+		var backends []BackendConfig
+		urls := make(map[string]string)
+		for _, name := range []string{"a", "b"} {
+			name, release := name, releases[name]
+			server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/slow" {
+					held.Add(1)
+					<-release
+				}
+				io.WriteString(w, name)
+			})
+			backends = append(backends, BackendConfig{URL: server.URL, MaxConnections: 1})
+			urls[name] = server.URL
+		}
+		handler := startTestLoadBalancer(t, Config{
+			Backends:             backends,
+			Proxy:                ProxyOptions{Overflow: tt.overflow, OverflowQueueTimeout: time.Second},
+			ExcludeHeaderClients: []string{"192.0.2.0/24"},
+		}).Handler()
+		var wg sync.WaitGroup
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				serve(handler, http.MethodGet, "/slow")
+			}()
+		}
+		waitFor(t, "held requests did not reach both backends", func() bool { return held.Load() == 2 })
+
+		served := make(chan string, 1)
+		go func() {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("X-LB-Exclude", urls["a"])
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			served <- w.Body.String()
+		}()
+		for _, name := range tt.release {
+			time.Sleep(30 * time.Millisecond)
+			close(releases[name])
+			delete(releases, name)
+		}
+		if got := <-served; got != "b" {
+			t.Errorf("%s: request excluding a served by %q, want b", tt.overflow, got)
+		}
+		for _, release := range releases {
+			close(release)
+		}
+		wg.Wait()
+	}
+}
+
+func TestQueuedRequestWakesWhenThrottledBackendRefills(t *testing.T) {
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {})
+	handler := startTestLoadBalancer(t, Config{
+		Backends: []BackendConfig{{URL: server.URL, MaxRPS: 10}},
+		Proxy:    ProxyOptions{Overflow: OverflowQueue, OverflowQueueTimeout: time.Second},
+	}).Handler()
+
+	// The burst uses up the cap, the next request waits the 100ms until a token refills
+	for i := 0; i < 10; i++ {
+		serve(handler, http.MethodGet, "/")
+	}
+	start := time.Now()
+	if code := serve(handler, http.MethodGet, "/").Code; code != http.StatusOK {
+		t.Fatalf("queued request answered %d, want %d", code, http.StatusOK)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond || elapsed > 500*time.Millisecond {
+		t.Errorf("queued request served after %s, want about 100ms", elapsed)
+	}
+}
@@ -0,0 +1,59 @@
+package lb
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// normalizePath collapses duplicate slashes and resolves . and .. segments of an escaped path,
+// keeping a trailing slash. Escaped slashes are left alone as they are not segment separators.
+func normalizePath(escaped string) string {
+	if escaped == "" {
+		return "/"
+	}
+
+	cleaned := path.Clean("/" + escaped)
+	if strings.HasSuffix(escaped, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// normalizePathHandler normalizes the path of requests with normalizePath before passing them on,
+// so that routes match and backends receive the same path however it was spelled
+func normalizePathHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		escaped := r.URL.EscapedPath()
+		if normalized := normalizePath(escaped); normalized != escaped {
+			p, err := url.PathUnescape(normalized)
+			if err != nil {
+				http.Error(w, "Invalid request path", http.StatusBadRequest)
+				return
+			}
+
+			u := *r.URL
+			u.Path, u.RawPath = p, normalized
+			r = r.Clone(r.Context())
+			r.URL = &u
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// maxURLLengthHandler answers 414 URI Too Long to requests whose target, the path and query as
+// sent by the client, is longer than max bytes, before they reach a backend
+func maxURLLengthHandler(max int, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target := r.RequestURI
+		if target == "" {
+			target = r.URL.RequestURI()
+		}
+		if len(target) > max {
+			http.Error(w, "URI Too Long", http.StatusRequestURITooLong)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,86 @@
+package lb
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestPathNormalization(t *testing.T) {
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.EscapedPath())
+	})
+	backends := []BackendConfig{{URL: server.URL}}
+	normalized := startTestLoadBalancer(t, Config{Backends: backends, NormalizePaths: true}).Handler()
+	raw := startTestLoadBalancer(t, Config{Backends: backends}).Handler()
+
+	tests := []struct {
+		path, normalized string
+	}{
+		{"/api//users", "/api/users"},
+		{"//api///users/", "/api/users/"},
+		{"/api/./users/../orders", "/api/orders"},
+		{"/api/../../etc", "/etc"},
+		{"/a/b/..", "/a"},
+		// An escaped slash is part of a segment
+		{"/files/a%2Fb//c", "/files/a%2Fb/c"},
+		{"/clean/path", "/clean/path"},
+	}
+	for _, tt := range tests {
+		if got := serve(normalized, http.MethodGet, tt.path).Body.String(); got != tt.normalized {
+			t.Errorf("normalized %s: backend got %s, want %s", tt.path, got, tt.normalized)
+		}
+		if got := serve(raw, http.MethodGet, tt.path).Body.String(); got != tt.path {
+			t.Errorf("raw %s: backend got %s, want it unchanged", tt.path, got)
+		}
+	}
+}
+
+func TestNormalizedPathsMatchRoutes(t *testing.T) {
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.Path)
+	})
+	routes := []Route{{Prefix: "/admin", AddPrefix: "/internal"}}
+	handler := startTestLoadBalancer(t, Config{Backends: []BackendConfig{{URL: server.URL}}, Routes: routes, NormalizePaths: true}).Handler()
+
+	// Spelled differently, the path still falls under the /admin route
+	for _, path := range []string{"/admin", "//admin", "/public/../admin"} {
+		if got := serve(handler, http.MethodGet, path).Body.String(); got != "/internal/admin" {
+			t.Errorf("GET %s: backend got %s, want /internal/admin", path, got)
+		}
+	}
+}
+
+func TestOverlyLongURLsAreAnswered414(t *testing.T) {
+	var proxied atomic.Int32
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		proxied.Add(1)
+	})
+	handler := startTestLoadBalancer(t, Config{Backends: []BackendConfig{{URL: server.URL}}, MaxURLLength: 64}).Handler()
+
+	tests := []struct {
+		target string
+		want   int
+	}{
+		{"/" + strings.Repeat("a", 63), http.StatusOK},
+		{"/" + strings.Repeat("a", 64), http.StatusRequestURITooLong},
+		// The query counts towards the limit
+		{"/search?q=" + strings.Repeat("x", 100), http.StatusRequestURITooLong},
+		{"/search?q=short", http.StatusOK},
+	}
+	for _, tt := range tests {
+		if code := serve(handler, http.MethodGet, tt.target).Code; code != tt.want {
+			t.Errorf("GET of a %d byte URL = %d, want %d", len(tt.target), code, tt.want)
+		}
+	}
+	if got := proxied.Load(); got != 2 {
+		t.Errorf("backend received %d requests, want only the 2 within the limit", got)
+	}
+
+	unlimited := startTestLoadBalancer(t, Config{Backends: []BackendConfig{{URL: server.URL}}}).Handler()
+	if code := serve(unlimited, http.MethodGet, "/"+strings.Repeat("a", 4096)).Code; code != http.StatusOK {
+		t.Errorf("GET of a long URL without a limit = %d, want %d", code, http.StatusOK)
+	}
+}
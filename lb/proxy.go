@@ -0,0 +1,264 @@
+package lb
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
+)
+
+// proxyAttemptKey is the context key under which the current proxyAttempt is stored
+type proxyAttemptKey struct{}
+
+// proxyAttempt records the outcome of proxying a request to a single backend
+type proxyAttempt struct {
+	// retryable tells the backend not to write an error response so that another backend can be tried
+	retryable bool
+	// route is the route the request matched, applied by the backend's director
+	route Route
+	err   error
+}
+
+// ProxyOptions tunes how the proxy handler serves requests
+type ProxyOptions struct {
+	// FastMode skips the per-request diagnostic logging
+	FastMode bool
+	// InstanceID identifies this load balancer in the X-LB-Instance response header
+	InstanceID string
+	// TimingHeaders adds the X-LB-Upstream-Time and X-LB-Total-Time headers to responses
+	TimingHeaders bool
+	// Overflow decides what happens to requests when every backend is at its connection cap
+	Overflow OverflowPolicy
+	// OverflowQueueTimeout bounds how long requests wait for a backend with the queue policy
+	OverflowQueueTimeout time.Duration
+	// BackendTrailer sends the URL of the backend that served a response in the X-LB-Backend
+	// trailer, for responses streamed without a Content-Length
+	BackendTrailer bool
+	// excludeClients are the client ranges whose X-LB-Exclude header is honored, loaded from
+	// Config.ExcludeHeaderClients
+	excludeClients []*net.IPNet
+	// Selector, when set, picks the backend of each request before the pool's strategy does
+	Selector SelectorFunc
+	// maintenancePage is served instead of a plain text error while the pool is paused or no
+	// backend is available, loaded from Config.MaintenancePage
+	maintenancePage *maintenancePage
+}
+
+// instanceHeader is the response header identifying the load balancer that handled a request
+const instanceHeader = "X-LB-Instance"
+
+// backendTrailer is the response trailer identifying the backend that served a request
+const backendTrailer = "X-LB-Backend"
+
+// proxyHandler forwards requests to backends selected from the pool, applying the
+// timeout and retry policy of the matched route
+func proxyHandler(pool ServerPool, router *Router, opts ProxyOptions) http.HandlerFunc {
+	var coalesced singleflight.Group
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if opts.TimingHeaders {
+			timing := &requestTiming{start: time.Now()}
+			w = &timingResponseWriter{ResponseWriter: w, timing: timing}
+			r = r.WithContext(context.WithValue(r.Context(), requestTimingKey{}, timing))
+		}
+
+		if !opts.FastMode {
+			logRequest(r)
+		}
+
+		if opts.InstanceID != "" {
+			w.Header().Set(instanceHeader, opts.InstanceID)
+		}
+
+		ctx, span := startRequestSpan(r)
+		r = r.WithContext(ctx)
+		sw := &statusResponseWriter{ResponseWriter: w}
+		w = sw
+		defer func() { endRequestSpan(span, sw.Status()) }()
+
+		if pool.IsPaused() {
+			serveUnavailable(w, opts.maintenancePage, "Service is paused for maintenance")
+			return
+		}
+		if shedByDial(pool) {
+			http.Error(w, "Service is shedding load", http.StatusServiceUnavailable)
+			return
+		}
+
+		route := router.Match(r)
+
+		if deadline := time.Duration(route.Deadline); deadline > 0 {
+			ctx, cancel := context.WithTimeout(r.Context(), deadline)
+			defer cancel()
+			r = r.WithContext(ctx)
+		}
+
+		if canCoalesce(r, route) {
+			serveCoalesced(&coalesced, w, r, func(w http.ResponseWriter) {
+				forward(pool, w, r, route, span, opts)
+			})
+			return
+		}
+
+		forward(pool, w, r, route, span, opts)
+	}
+}
+
+// forward proxies the request to a backend, retrying on other backends as the route allows
+func forward(pool ServerPool, w http.ResponseWriter, r *http.Request, route Route, span trace.Span, opts ProxyOptions) {
+	// A request body can only be read once, so requests with a body are only retried
+	// when the route buffers bodies and this one fits in the buffer
+	retries := route.Retries
+	var body []byte
+	if retries > 0 && r.Body != nil && r.Body != http.NoBody {
+		var buffered bool
+		var err error
+		body, buffered, err = bufferBody(r, route)
+		if err != nil {
+			http.Error(w, "Error reading request body", http.StatusBadRequest)
+			return
+		}
+		if !buffered {
+			retries = 0
+		}
+	}
+
+	excluded := excludedBackends(r, opts.excludeClients)
+
+	for attempt := 0; ; attempt++ {
+		if body != nil {
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+
+		var peer Backend
+		// A retry goes to another backend than the one the connection sticks to
+		if attempt == 0 {
+			if peer = stickyBackend(pool, r, route); peer != nil && excluded.has(peer) {
+				peer = nil
+			}
+		}
+		if peer == nil && opts.Selector != nil {
+			peer = selectWith(opts.Selector, pool, r, route, excluded)
+		}
+		if peer == nil {
+			peer = route.selectBackend(pool, excluded)
+		}
+		// Excluded backends are still used when no other one is left
+		if peer == nil && len(excluded) > 0 {
+			peer = route.selectBackend(pool, nil)
+		}
+		if peer == nil {
+			peer = selectOverflow(pool, r, route, opts, excluded)
+		}
+		if peer == nil {
+			serveUnavailable(w, opts.maintenancePage, "No backend server is available")
+			return
+		}
+
+		if !opts.FastMode {
+			log.Printf("Selected peer at %s", peer.GetURL())
+		}
+		span.SetAttributes(backendURLKey.String(peer.GetURL().String()))
+		stick(r, peer)
+		recordBackend(r, peer)
+
+		err := serveAttempt(peer, w, r, route, attempt < retries)
+		if err == nil {
+			// The server only sends trailers with chunked responses, others go without it
+			if opts.BackendTrailer {
+				w.Header().Set(http.TrailerPrefix+backendTrailer, peer.GetURL().String())
+			}
+			if !opts.FastMode {
+				log.Println("Response from backend server")
+			}
+			return
+		}
+		if attempt >= retries {
+			return
+		}
+		if err := r.Context().Err(); err != nil {
+			if errors.Is(err, context.DeadlineExceeded) {
+				log.Printf("Deadline of %s exceeded after %d attempts", time.Duration(route.Deadline), attempt+1)
+				http.Error(w, "Gateway Timeout", http.StatusGatewayTimeout)
+			}
+			// A client that went away has cancelled the request, it is not retried for no one
+			return
+		}
+
+		log.Printf("Attempt %d of %d to %s failed, retrying: %s", attempt+1, retries+1, peer.GetURL(), err)
+		span.AddEvent("retry", trace.WithAttributes(backendURLKey.String(peer.GetURL().String())))
+	}
+}
+
+// logRequest prints details of an incoming request
+func logRequest(r *http.Request) {
+	log.Printf("Received request from %s", ClientIP(r))
+	log.Printf("%s %s %s", r.Method, r.URL, r.Proto)
+	log.Println("Host:", r.Host)
+	log.Println("User-Agent:", r.UserAgent())
+	log.Println("Accept:", r.Header.Get("Accept"))
+}
+
+// defaultMaxBufferSize is the largest request body buffered for retries when a route sets no limit
+const defaultMaxBufferSize = 1 << 20
+
+// bufferBody reads the request body into memory so it can be replayed on retries. It reports
+// false, leaving the body readable as before, when the route does not buffer bodies or the
+// body is larger than the route's limit.
+func bufferBody(r *http.Request, route Route) ([]byte, bool, error) {
+	if !route.BufferBody {
+		return nil, false, nil
+	}
+
+	limit := route.MaxBufferSize
+	if limit <= 0 {
+		limit = defaultMaxBufferSize
+	}
+	if r.ContentLength > limit {
+		return nil, false, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		return nil, false, err
+	}
+
+	if int64(len(body)) > limit {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		return nil, false, nil
+	}
+
+	r.Body.Close()
+	r.ContentLength = int64(len(body))
+	return body, true, nil
+}
+
+// serveAttempt proxies the request to peer within the route's timeout, returning the proxy
+// error if any. When retryable is set a failed attempt leaves the response untouched.
+func serveAttempt(peer Backend, w http.ResponseWriter, r *http.Request, route Route, retryable bool) error {
+	ctx := r.Context()
+	if timeout := time.Duration(route.Timeout); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	if timing, ok := r.Context().Value(requestTimingKey{}).(*requestTiming); ok {
+		timing.upstreamStart = time.Now()
+	}
+
+	attempt := &proxyAttempt{retryable: retryable, route: route}
+	peer.ServeHTTP(w, r.WithContext(context.WithValue(ctx, proxyAttemptKey{}, attempt)))
+
+	return attempt.err
+}
@@ -0,0 +1,216 @@
+package lb
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFastModeSkipsRequestLogging(t *testing.T) {
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {})
+
+	for _, fast := range []bool{false, true} {
+		balancer := startTestLoadBalancer(t, Config{
+			Backends: []BackendConfig{{URL: server.URL}},
+			Proxy:    ProxyOptions{FastMode: fast},
+		})
+		logs := captureLog(t)
+		serve(balancer.Handler(), http.MethodGet, "/")
+		if logged := strings.Contains(logs.String(), "Selected peer"); logged == fast {
+			t.Errorf("fast mode %t: request logged = %t, want %t", fast, logged, !fast)
+		}
+	}
+}
+
+func BenchmarkProxy(b *testing.B) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	// The log lines are still formatted in normal mode, only their output is dropped
+	previous := log.Writer()
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(previous)
+
+	for _, mode := range []struct {
+		name string
+		fast bool
+	}{{"normal", false}, {"fast", true}} {
+		b.Run(mode.name, func(b *testing.B) {
+			balancer, err := NewLoadBalancer(Config{
+				Backends: []BackendConfig{{URL: server.URL}},
+				Proxy:    ProxyOptions{FastMode: mode.fast},
+			})
+			if err != nil {
+				b.Fatalf("NewLoadBalancer: %s", err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			balancer.Start(ctx)
+			handler := balancer.Handler()
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					serve(handler, http.MethodGet, "/")
+				}
+			})
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "req/s")
+		})
+	}
+}
+
+func TestInstanceHeader(t *testing.T) {
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {})
+
+	for _, id := range []string{"lb-eu-1", ""} {
+		balancer := startTestLoadBalancer(t, Config{
+			Backends: []BackendConfig{{URL: server.URL}},
+			Proxy:    ProxyOptions{InstanceID: id},
+		})
+		w := serve(balancer.Handler(), http.MethodGet, "/")
+		if got := w.Header().Values(instanceHeader); strings.Join(got, ", ") != id {
+			t.Errorf("instance %q: %s = %q", id, instanceHeader, got)
+		}
+	}
+}
+
+func TestTimingHeaders(t *testing.T) {
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+	})
+
+	for _, enabled := range []bool{true, false} {
+		balancer := startTestLoadBalancer(t, Config{
+			Backends: []BackendConfig{{URL: server.URL}},
+			Proxy:    ProxyOptions{TimingHeaders: enabled},
+		})
+		w := serve(balancer.Handler(), http.MethodGet, "/")
+
+		if !enabled {
+			if w.Header().Get(upstreamTimeHeader) != "" || w.Header().Get(totalTimeHeader) != "" {
+				t.Errorf("timing headers sent while disabled: %v", w.Header())
+			}
+			continue
+		}
+		upstream, err := time.ParseDuration(w.Header().Get(upstreamTimeHeader))
+		if err != nil {
+			t.Fatalf("%s: %s", upstreamTimeHeader, err)
+		}
+		total, err := time.ParseDuration(w.Header().Get(totalTimeHeader))
+		if err != nil {
+			t.Fatalf("%s: %s", totalTimeHeader, err)
+		}
+		// The backend takes 20ms, the load balancer adds its own time on top
+		if upstream < 20*time.Millisecond || upstream > time.Second || total < upstream {
+			t.Errorf("upstream time %s, total %s, want at least 20ms upstream within the total", upstream, total)
+		}
+	}
+}
+
+func TestStatusCodesTellFailuresApart(t *testing.T) {
+	closed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	closed.Close()
+	garbage := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		buf.WriteString("not HTTP\r\n\r\n")
+		buf.Flush()
+		conn.Close()
+	})
+	slow := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	})
+	up := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		name string
+		cfg  Config
+		// down marks every backend dead once the load balancer started
+		down bool
+		want int
+	}{
+		{"refused connection", Config{Backends: []BackendConfig{{URL: closed.URL}}}, false, http.StatusBadGateway},
+		{"invalid response", Config{Backends: []BackendConfig{{URL: garbage.URL}}}, false, http.StatusBadGateway},
+		{"timeout", Config{
+			Backends: []BackendConfig{{URL: slow.URL}},
+			Routes:   []Route{{Prefix: "/", Timeout: Duration(20 * time.Millisecond)}},
+		}, false, http.StatusGatewayTimeout},
+		{"no backends", Config{}, false, http.StatusServiceUnavailable},
+		{"all backends down", Config{Backends: []BackendConfig{{URL: up.URL}}}, true, http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		balancer := startTestLoadBalancer(t, tt.cfg)
+		if tt.down {
+			for _, backend := range balancer.pool.GetBackends() {
+				backend.SetAlive(false)
+			}
+		}
+		if w := serve(balancer.Handler(), http.MethodGet, "/"); w.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+
+	// Backends at capacity are no capacity either
+	handler, _ := startSaturatedLoadBalancer(t, ProxyOptions{})
+	if w := serve(handler, http.MethodGet, "/"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("saturated: status = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestBackendDownAfterSelectionIsUnavailable(t *testing.T) {
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {})
+	b := newTestBackend(t, server.URL)
+	b.SetAlive(false)
+
+	if w := serve(b, http.MethodGet, "/"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestBackendTrailerFollowsStreamedBody(t *testing.T) {
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 3; i++ {
+			io.WriteString(w, "chunk\n")
+			w.(http.Flusher).Flush()
+		}
+	})
+
+	for _, enabled := range []bool{true, false} {
+		balancer := startTestLoadBalancer(t, Config{
+			Backends: []BackendConfig{{URL: server.URL}},
+			Proxy:    ProxyOptions{BackendTrailer: enabled},
+		})
+		front := httptest.NewServer(balancer.Handler())
+		resp, err := http.Get(front.URL + "/stream")
+		if err != nil {
+			t.Fatalf("GET: %s", err)
+		}
+		// Trailers are only known once the body has been read
+		if got := resp.Trailer.Get("X-LB-Backend"); got != "" {
+			t.Errorf("trailer before the body = %q, want it empty", got)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		front.Close()
+
+		if string(body) != strings.Repeat("chunk\n", 3) {
+			t.Errorf("body = %q, want the 3 chunks", body)
+		}
+		want := ""
+		if enabled {
+			want = server.URL
+		}
+		if got := resp.Trailer.Get("X-LB-Backend"); got != want {
+			t.Errorf("trailer enabled %t: X-LB-Backend = %q, want %q", enabled, got, want)
+		}
+	}
+}
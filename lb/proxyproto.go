@@ -0,0 +1,255 @@
+package lb
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProxyProtocol is a version of the PROXY protocol, which passes the client address to a backend
+// in a header at the start of the connection
+type ProxyProtocol string
+
+const (
+	// ProxyProtocolV1 sends the human-readable version 1 header
+	ProxyProtocolV1 ProxyProtocol = "v1"
+	// ProxyProtocolV2 sends the binary version 2 header
+	ProxyProtocolV2 ProxyProtocol = "v2"
+)
+
+// proxyProtocolV2Signature starts every PROXY protocol version 2 header
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// clientAddrKey is the context key under which the address of the client a request to the
+// backend is made for is stored
+type clientAddrKey struct{}
+
+// proxyProtocolDialer wraps dial so every new connection starts with a PROXY protocol header
+// carrying the client address found in the context
+func proxyProtocolDialer(version ProxyProtocol, dial func(ctx context.Context, network, address string) (net.Conn, error)) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+
+		// The destination is the address the client connected to, the load balancer itself
+		var src, dst *net.TCPAddr
+		if addr, ok := ctx.Value(clientAddrKey{}).(string); ok {
+			src, _ = net.ResolveTCPAddr("tcp", addr)
+		}
+		if addr, ok := ctx.Value(http.LocalAddrContextKey).(net.Addr); ok {
+			dst, _ = addr.(*net.TCPAddr)
+		}
+		if dst == nil {
+			dst, _ = conn.RemoteAddr().(*net.TCPAddr)
+		}
+
+		if _, err := conn.Write(proxyProtocolHeader(version, src, dst)); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("writing PROXY protocol header: %w", err)
+		}
+		return conn, nil
+	}
+}
+
+// proxyProtocolHeader encodes a PROXY protocol header for a connection from src to dst. The
+// addresses are reported as unknown unless both are known and of the same family.
+func proxyProtocolHeader(version ProxyProtocol, src, dst *net.TCPAddr) []byte {
+	family := "UNKNOWN"
+	if src != nil && dst != nil {
+		if src.IP.To4() != nil && dst.IP.To4() != nil {
+			family = "TCP4"
+		} else if src.IP.To4() == nil && dst.IP.To4() == nil {
+			family = "TCP6"
+		}
+	}
+
+	if version != ProxyProtocolV2 {
+		if family == "UNKNOWN" {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, src.IP, dst.IP, src.Port, dst.Port))
+	}
+
+	var header bytes.Buffer
+	header.Write(proxyProtocolV2Signature)
+	var addrs []byte
+	switch family {
+	case "TCP4":
+		// Version 2, PROXY command, TCP over IPv4
+		header.Write([]byte{0x21, 0x11})
+		addrs = append(append(addrs, src.IP.To4()...), dst.IP.To4()...)
+	case "TCP6":
+		// Version 2, PROXY command, TCP over IPv6
+		header.Write([]byte{0x21, 0x21})
+		addrs = append(append(addrs, src.IP.To16()...), dst.IP.To16()...)
+	default:
+		// Version 2, LOCAL command, unspecified family
+		header.Write([]byte{0x20, 0x00})
+	}
+	if addrs != nil {
+		addrs = binary.BigEndian.AppendUint16(addrs, uint16(src.Port))
+		addrs = binary.BigEndian.AppendUint16(addrs, uint16(dst.Port))
+	}
+	binary.Write(&header, binary.BigEndian, uint16(len(addrs)))
+	header.Write(addrs)
+	return header.Bytes()
+}
+
+// proxyProtocolHeaderTimeout bounds how long a client has to send its PROXY protocol header
+const proxyProtocolHeaderTimeout = 5 * time.Second
+
+// ProxyProtocolListener accepts connections that start with a PROXY protocol header, such as
+// those of an L4 load balancer in front of this one, and reports the client address from the
+// header as their remote address
+type ProxyProtocolListener struct {
+	net.Listener
+}
+
+// Accept waits for the next connection. The header is read on first use of the connection, in the
+// goroutine serving it, so a slow client does not hold up accepting others.
+func (pl *ProxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := pl.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtocolConn{Conn: conn}, nil
+}
+
+// proxyProtocolConn is a connection whose PROXY protocol header is read before any other data
+type proxyProtocolConn struct {
+	net.Conn
+	reader *bufio.Reader
+	remote net.Addr
+	err    error
+	once   sync.Once
+}
+
+func (pc *proxyProtocolConn) readHeader() {
+	pc.once.Do(func() {
+		pc.Conn.SetReadDeadline(time.Now().Add(proxyProtocolHeaderTimeout))
+		pc.reader = bufio.NewReader(pc.Conn)
+		pc.remote, pc.err = readProxyProtocolHeader(pc.reader)
+		pc.Conn.SetReadDeadline(time.Time{})
+		if pc.err != nil {
+			log.Printf("Invalid PROXY protocol header from %s: %s", pc.Conn.RemoteAddr(), pc.err)
+		}
+	})
+}
+
+func (pc *proxyProtocolConn) Read(p []byte) (int, error) {
+	pc.readHeader()
+	if pc.err != nil {
+		return 0, pc.err
+	}
+	return pc.reader.Read(p)
+}
+
+// RemoteAddr returns the client address from the PROXY protocol header, or the address of the
+// peer when the header carries none
+func (pc *proxyProtocolConn) RemoteAddr() net.Addr {
+	pc.readHeader()
+	if pc.remote != nil {
+		return pc.remote
+	}
+	return pc.Conn.RemoteAddr()
+}
+
+// readProxyProtocolHeader reads a version 1 or 2 PROXY protocol header, returning the client
+// address it carries or nil for headers without one
+func readProxyProtocolHeader(r *bufio.Reader) (net.Addr, error) {
+	start, err := r.Peek(len(proxyProtocolV2Signature))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(start, proxyProtocolV2Signature) {
+		return readProxyProtocolV2(r)
+	}
+	if bytes.HasPrefix(start, []byte("PROXY ")) {
+		return readProxyProtocolV1(r)
+	}
+	return nil, errors.New("missing PROXY protocol header")
+}
+
+// proxyProtocolV1MaxLength is the longest version 1 header allowed by the specification
+const proxyProtocolV1MaxLength = 107
+
+func readProxyProtocolV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < proxyProtocolV1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("version 1 header is not terminated by CRLF")
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed version 1 header %q", strings.TrimSpace(string(line)))
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("malformed version 1 source address %s:%s", fields[2], fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyProtocolV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, len(proxyProtocolV2Signature)+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	verCmd, family := header[12], header[13]
+	addrs := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, addrs); err != nil {
+		return nil, err
+	}
+
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("unsupported version %d", verCmd>>4)
+	}
+	// The LOCAL command is sent by the proxy for its own connections, such as health checks
+	if verCmd&0x0f == 0 {
+		return nil, nil
+	}
+
+	switch family {
+	case 0x11:
+		if len(addrs) < 12 {
+			return nil, errors.New("truncated IPv4 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(addrs[0:4]), Port: int(binary.BigEndian.Uint16(addrs[8:]))}, nil
+	case 0x21:
+		if len(addrs) < 36 {
+			return nil, errors.New("truncated IPv6 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(addrs[0:16]), Port: int(binary.BigEndian.Uint16(addrs[32:]))}, nil
+	default:
+		// Other families, such as UNIX sockets, carry no client IP
+		return nil, nil
+	}
+}
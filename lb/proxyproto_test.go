@@ -0,0 +1,148 @@
+package lb
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newProxyProtocolV1Server starts a backend on a raw listener that reads the PROXY protocol v1
+// line at the start of every connection itself, answers one HTTP request and sends each line
+// to lines
+func newProxyProtocolV1Server(t *testing.T, lines chan<- string) net.Listener {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				lines <- line
+				if _, err := http.ReadRequest(reader); err != nil {
+					return
+				}
+				io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+			}()
+		}
+	}()
+	return listener
+}
+
+func TestProxyProtocolV1ConveysClientAddress(t *testing.T) {
+	lines := make(chan string, 1)
+	listener := newProxyProtocolV1Server(t, lines)
+	b := newTestBackend(t, "http://"+listener.Addr().String(), WithProxyProtocol(ProxyProtocolV1))
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "203.0.113.7:5555"
+	w := httptest.NewRecorder()
+	b.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	// Without the address the client connected to, the backend address stands in as destination
+	port := listener.Addr().(*net.TCPAddr).Port
+	if got, want := <-lines, fmt.Sprintf("PROXY TCP4 203.0.113.7 127.0.0.1 5555 %d\r\n", port); got != want {
+		t.Errorf("PROXY header = %q, want %q", got, want)
+	}
+}
+
+func TestProxyProtocolV2ConveysClientAddress(t *testing.T) {
+	remotes := make(chan string, 1)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remotes <- r.RemoteAddr
+	}))
+	server.Listener = &ProxyProtocolListener{Listener: server.Listener}
+	server.Start()
+	defer server.Close()
+	b := newTestBackend(t, server.URL, WithProxyProtocol(ProxyProtocolV2))
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "203.0.113.7:5555"
+	b.ServeHTTP(httptest.NewRecorder(), r)
+	if got := <-remotes; got != r.RemoteAddr {
+		t.Errorf("backend parsing the v2 header saw the client at %s, want %s", got, r.RemoteAddr)
+	}
+}
+
+func TestProxyProtocolListenerRecoversClientIP(t *testing.T) {
+	forwardedFor := make(chan string, 1)
+	backend := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		forwardedFor <- r.Header.Get("X-Forwarded-For")
+	})
+	balancer := startTestLoadBalancer(t, Config{Backends: []BackendConfig{{URL: backend.URL}}})
+	server := httptest.NewUnstartedServer(balancer.Handler())
+	server.Listener = &ProxyProtocolListener{Listener: server.Listener}
+	server.Start()
+	defer server.Close()
+
+	// An L4 load balancer in front announces the client before the request
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "PROXY TCP4 198.51.100.9 10.0.0.1 40000 80\r\nGET / HTTP/1.1\r\nHost: lb\r\nConnection: close\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("reading the response: %s", err)
+	}
+	resp.Body.Close()
+
+	if got := <-forwardedFor; got != "198.51.100.9" {
+		t.Errorf("backend got X-Forwarded-For %q, want the client from the PROXY header", got)
+	}
+}
+
+func TestReadProxyProtocolHeader(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 5555}
+	dst := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}
+	tests := []struct {
+		name   string
+		header string
+		want   string
+		err    bool
+	}{
+		{"v1 TCP4", "PROXY TCP4 198.51.100.9 10.0.0.1 40000 80\r\n", "198.51.100.9:40000", false},
+		{"v1 TCP6", string(proxyProtocolHeader(ProxyProtocolV1, src, dst)), "[2001:db8::7]:5555", false},
+		{"v1 UNKNOWN", "PROXY UNKNOWN\r\n", "", false},
+		{"v2 TCP6", string(proxyProtocolHeader(ProxyProtocolV2, src, dst)), "[2001:db8::7]:5555", false},
+		{"v2 without addresses", string(proxyProtocolHeader(ProxyProtocolV2, nil, nil)), "", false},
+		{"v1 without CRLF", "PROXY TCP4 198.51.100.9 10.0.0.1 40000 80\n", "", true},
+		{"v1 malformed", "PROXY TCP4 198.51.100.9\r\n", "", true},
+		{"missing", "GET / HTTP/1.1\r\n\r\n", "", true},
+	}
+	for _, tt := range tests {
+		addr, err := readProxyProtocolHeader(bufio.NewReader(strings.NewReader(tt.header + "GET / HTTP/1.1\r\n\r\n")))
+		if (err != nil) != tt.err {
+			t.Errorf("%s: error = %v, want an error: %t", tt.name, err, tt.err)
+			continue
+		}
+		got := ""
+		if addr != nil {
+			got = addr.String()
+		}
+		if got != tt.want {
+			t.Errorf("%s: client = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
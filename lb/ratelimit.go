@@ -0,0 +1,58 @@
+package lb
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// tokenBucket caps the rate of requests sent to a backend. It holds up to burst tokens, refilled
+// continuously, and every request takes one.
+type tokenBucket struct {
+	rate  float64
+	burst float64
+
+	mutex  sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a full bucket allowing rate requests per second in bursts of up to burst
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// refill adds the tokens accrued since the last refill. The caller must hold the lock.
+func (tb *tokenBucket) refill(now time.Time) {
+	tb.tokens = math.Min(tb.burst, tb.tokens+now.Sub(tb.last).Seconds()*tb.rate)
+	tb.last = now
+}
+
+// ready reports whether a token is available, without taking it
+func (tb *tokenBucket) ready() bool {
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+	tb.refill(time.Now())
+	return tb.tokens >= 1
+}
+
+// nextToken returns when a token is next available, the zero time if one is available now
+func (tb *tokenBucket) nextToken() time.Time {
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+	now := time.Now()
+	tb.refill(now)
+	if tb.tokens >= 1 {
+		return time.Time{}
+	}
+	return now.Add(time.Duration((1 - tb.tokens) / tb.rate * float64(time.Second)))
+}
+
+// take takes a token. Requests selected at the same moment may all find the bucket ready, the
+// tokens they take beyond the last one are paid back out of the next refills.
+func (tb *tokenBucket) take() {
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+	tb.refill(time.Now())
+	tb.tokens--
+}
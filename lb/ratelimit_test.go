@@ -0,0 +1,64 @@
+package lb
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestThrottledBackendIsSkippedUntilTokensRefill(t *testing.T) {
+	fragile := newTestServer(t, func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "fragile") })
+	sturdy := newTestServer(t, func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "sturdy") })
+	balancer := startTestLoadBalancer(t, Config{Backends: []BackendConfig{
+		{URL: fragile.URL, MaxRPS: 5},
+		{URL: sturdy.URL},
+	}})
+	count := func(requests int) int {
+		n := 0
+		for i := 0; i < requests; i++ {
+			if serve(balancer.Handler(), http.MethodGet, "/").Body.String() == "fragile" {
+				n++
+			}
+		}
+		return n
+	}
+
+	// A burst uses up the cap, the other backend takes the rest
+	if n := count(20); n != 5 {
+		t.Errorf("fragile backend served %d of a burst of 20, want its cap of 5", n)
+	}
+	if stats := balancer.Snapshot(); !stats[0].Throttled {
+		t.Errorf("fragile backend stats = %+v, want it throttled", stats[0])
+	}
+	if n := count(4); n != 0 {
+		t.Errorf("fragile backend served %d requests while throttled, want none", n)
+	}
+
+	// Tokens refill at 5 per second
+	time.Sleep(250 * time.Millisecond)
+	if n := count(6); n < 1 || n > 2 {
+		t.Errorf("fragile backend served %d requests after 250ms, want the 1 or 2 refilled tokens", n)
+	}
+}
+
+func TestTokenBucketRefillsAtRate(t *testing.T) {
+	start := time.Now()
+	bucket := &tokenBucket{rate: 10, burst: 2, last: start}
+
+	// 10 per second refill one token every 100ms, up to the burst
+	for _, tt := range []struct {
+		after  time.Duration
+		tokens float64
+	}{
+		{50 * time.Millisecond, 0.5},
+		{150 * time.Millisecond, 1.5},
+		{time.Hour, 2},
+	} {
+		bucket.refill(start.Add(tt.after))
+		if math.Abs(bucket.tokens-tt.tokens) > 1e-9 {
+			t.Errorf("tokens after %s = %.2f, want %.2f", tt.after, bucket.tokens, tt.tokens)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package lb
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// selfRedirectTarget returns the Location of a redirect response if it points at one of hosts,
+// the host names the load balancer is reached by. Clients following such a redirect come back
+// to the load balancer, and a backend that keeps doing so sends them round in a loop. Relative
+// redirects stay on the host the client used and are not reported.
+func selfRedirectTarget(resp *http.Response, hosts map[string]bool) (string, bool) {
+	if len(hosts) == 0 || resp.StatusCode < 300 || resp.StatusCode >= 400 {
+		return "", false
+	}
+
+	location := resp.Header.Get("Location")
+	u, err := url.Parse(location)
+	if err != nil || u.Host == "" {
+		return "", false
+	}
+	return location, hosts[strings.ToLower(u.Hostname())]
+}
+
+// hostSet returns the set of host names, lowercased and without any ports, for selfRedirectTarget
+func hostSet(hosts []string) map[string]bool {
+	set := make(map[string]bool, len(hosts))
+	for _, host := range hosts {
+		if host = strings.TrimSpace(host); host == "" {
+			continue
+		}
+		if u, err := url.Parse("//" + host); err == nil && u.Hostname() != "" {
+			host = u.Hostname()
+		}
+		set[strings.ToLower(host)] = true
+	}
+	return set
+}
@@ -0,0 +1,47 @@
+package lb
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestSelfRedirectIsFlagged(t *testing.T) {
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/loop":
+			http.Redirect(w, r, "https://LB.example.com:8443/loop", http.StatusFound)
+		case "/elsewhere":
+			http.Redirect(w, r, "https://login.example.com/", http.StatusFound)
+		case "/relative":
+			http.Redirect(w, r, "/other", http.StatusFound)
+		}
+	})
+	balancer := startTestLoadBalancer(t, Config{
+		Backends:  []BackendConfig{{URL: server.URL}},
+		SelfHosts: []string{"lb.example.com:8443", "lb.internal"},
+	})
+
+	logs := captureLog(t)
+	for _, path := range []string{"/loop", "/elsewhere", "/relative", "/"} {
+		serve(balancer.Handler(), http.MethodGet, path)
+	}
+	if !strings.Contains(logs.String(), "redirected /loop to the load balancer itself (https://LB.example.com:8443/loop)") {
+		t.Errorf("no warning for the self redirect in %q", logs.String())
+	}
+	if stats := getStats(t, balancer); stats[0].SelfRedirects != 1 {
+		t.Errorf("/stats self redirects = %d, want only /loop counted", stats[0].SelfRedirects)
+	}
+}
+
+func TestHostSet(t *testing.T) {
+	set := hostSet([]string{" LB.example.com:8443 ", "[::1]:80", "", "lb.internal"})
+	for _, host := range []string{"lb.example.com", "::1", "lb.internal"} {
+		if !set[host] {
+			t.Errorf("host set %v is missing %s", set, host)
+		}
+	}
+	if len(set) != 3 {
+		t.Errorf("host set %v, want 3 hosts", set)
+	}
+}
@@ -0,0 +1,207 @@
+package lb
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Route applies a timeout and retry policy to requests whose path starts with Prefix
+type Route struct {
+	Prefix string `json:"prefix"`
+	// Methods restricts the route to the given HTTP methods, all methods match when empty
+	Methods []string `json:"methods,omitempty"`
+	// Timeout bounds each attempt to proxy the request, 0 means no timeout
+	Timeout Duration `json:"timeout,omitempty"`
+	// Deadline bounds the whole request including backend selection and retries, 0 means no
+	// deadline. Requests that run out of time get a 504 Gateway Timeout.
+	Deadline Duration `json:"deadline,omitempty"`
+	// Retries is the number of other backends tried after a failed attempt
+	Retries int `json:"retries,omitempty"`
+	// BufferBody buffers request bodies in memory so requests with a body can be retried
+	BufferBody bool `json:"bufferBody,omitempty"`
+	// MaxBufferSize is the largest body in bytes that is buffered, larger requests are not retried.
+	// Defaults to 1 MiB.
+	MaxBufferSize int64 `json:"maxBufferSize,omitempty"`
+	// Tags restricts the route to backends carrying all of these labels
+	Tags map[string]string `json:"tags,omitempty"`
+	// StripPrefix is removed from the start of the path before forwarding
+	StripPrefix string `json:"stripPrefix,omitempty"`
+	// AddPrefix is prepended to the path before forwarding, after StripPrefix is removed
+	AddPrefix string `json:"addPrefix,omitempty"`
+	// Stream flushes every write of the response to the client immediately, for server-sent
+	// events and other streaming endpoints
+	Stream bool `json:"stream,omitempty"`
+	// FlushInterval flushes the response to the client periodically, ignored when Stream is set
+	FlushInterval Duration `json:"flushInterval,omitempty"`
+	// AcceptEncoding replaces the Accept-Encoding header sent to backends, "strip" removes it.
+	// It takes precedence over the setting of the backend.
+	AcceptEncoding string `json:"acceptEncoding,omitempty"`
+	// RemoveHeaders are removed from requests before they are forwarded, along with those of the
+	// backend
+	RemoveHeaders []string `json:"removeHeaders,omitempty"`
+	// Coalesce shares one upstream call between identical concurrent GET requests. Only enable
+	// it for responses that do not depend on who is asking.
+	Coalesce bool `json:"coalesce,omitempty"`
+	// Strategy selects the backends of requests on the route by another strategy than the pool's,
+	// e.g. least-connections for long-lived connections
+	Strategy string `json:"strategy,omitempty"`
+
+	// strategy is the instance of Strategy, created by the router so that it keeps its state
+	// from one request to the next
+	strategy Strategy
+}
+
+// flushInterval returns the reverse proxy flush interval for the route, 0 keeps the default buffering
+func (rt Route) flushInterval() time.Duration {
+	if rt.Stream {
+		return -1
+	}
+	return time.Duration(rt.FlushInterval)
+}
+
+// rewritePath applies the route's prefix rewriting to the path of an outgoing request
+func (rt Route) rewritePath(u *url.URL) {
+	if rt.StripPrefix == "" && rt.AddPrefix == "" {
+		return
+	}
+
+	u.Path = rt.rewrite(u.Path)
+	if u.RawPath != "" {
+		u.RawPath = rt.rewrite(u.RawPath)
+	}
+}
+
+func (rt Route) rewrite(path string) string {
+	if strip := strings.TrimSuffix(rt.StripPrefix, "/"); strip != "" && hasPathPrefix(path, strip) {
+		path = strings.TrimPrefix(path, strip)
+		if path == "" {
+			path = "/"
+		}
+	}
+
+	if add := strings.TrimSuffix(rt.AddPrefix, "/"); add != "" {
+		if path == "/" {
+			return add
+		}
+		path = add + path
+	}
+
+	return path
+}
+
+// selectBackend returns the next available backend from the pool that the route may use, other
+// than the excluded ones
+func (rt Route) selectBackend(pool ServerPool, excluded backendSet) Backend {
+	if rt.strategy != nil {
+		alive := pool.GetAliveBackends()
+		candidates := make([]Backend, 0, len(alive))
+		for _, backend := range alive {
+			if !backend.IsSaturated() && HasTags(backend, rt.Tags) && !excluded.has(backend) {
+				candidates = append(candidates, backend)
+			}
+		}
+		if len(candidates) == 0 {
+			return nil
+		}
+		return rt.strategy.Select(candidates)
+	}
+
+	if len(rt.Tags) == 0 && len(excluded) == 0 {
+		return pool.GetNextValidPeer()
+	}
+
+	return pool.GetNextValidPeerMatching(func(backend Backend) bool {
+		return HasTags(backend, rt.Tags) && !excluded.has(backend)
+	})
+}
+
+// matches reports whether the route applies to the request
+func (rt Route) matches(r *http.Request) bool {
+	if !hasPathPrefix(r.URL.Path, rt.Prefix) {
+		return false
+	}
+
+	if len(rt.Methods) == 0 {
+		return true
+	}
+	for _, method := range rt.Methods {
+		if strings.EqualFold(method, r.Method) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hasPathPrefix reports whether path is prefix or lies below it, "/api" matches "/api/users" but not "/apix"
+func hasPathPrefix(path, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return prefix == "" || path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// Router matches requests to the route with the longest matching prefix
+type Router struct {
+	routes []Route
+	// strategyConfig configures the strategies of routes that set one
+	strategyConfig StrategyConfig
+	mutex          sync.RWMutex
+}
+
+// NewRouter creates a new Router instance
+func NewRouter(routes []Route) *Router {
+	return newRouter(routes, StrategyConfig{})
+}
+
+// newRouter creates a Router whose route strategies are configured by config
+func newRouter(routes []Route, config StrategyConfig) *Router {
+	router := &Router{strategyConfig: config}
+	router.SetRoutes(routes)
+	return router
+}
+
+// SetRoutes replaces the routes of the router. Route strategies start afresh.
+func (rt *Router) SetRoutes(routes []Route) {
+	sorted := make([]Route, len(routes))
+	copy(sorted, routes)
+	for i := range sorted {
+		if sorted[i].Strategy == "" {
+			continue
+		}
+		// Names have been validated along with the config
+		strategy, err := NewStrategy(sorted[i].Strategy, rt.strategyConfig)
+		if err != nil {
+			log.Printf("Route %s: %s, using the pool's strategy", sorted[i].Prefix, err)
+			continue
+		}
+		if strategy == nil {
+			strategy = &RoundRobinStrategy{}
+		}
+		sorted[i].strategy = strategy
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return len(sorted[i].Prefix) > len(sorted[j].Prefix)
+	})
+
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+	rt.routes = sorted
+}
+
+// Match returns the route for the request, or the default route without timeout or retries
+func (rt *Router) Match(r *http.Request) Route {
+	rt.mutex.RLock()
+	defer rt.mutex.RUnlock()
+
+	for _, route := range rt.routes {
+		if route.matches(r) {
+			return route
+		}
+	}
+
+	return Route{Prefix: "/"}
+}
@@ -0,0 +1,429 @@
+package lb
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRoutePoliciesApplyByMatchedRoute(t *testing.T) {
+	var hits atomic.Int32
+	var backends []BackendConfig
+	for i := 0; i < 3; i++ {
+		backends = append(backends, BackendConfig{URL: newFailingServer(t, &hits).URL})
+	}
+	routes := []Route{
+		{Prefix: "/search", Methods: []string{http.MethodGet}, Retries: 2, Timeout: Duration(2 * time.Second)},
+		{Prefix: "/pay", Methods: []string{http.MethodPost}},
+	}
+	handler := startTestLoadBalancer(t, Config{Backends: backends, Routes: routes}).Handler()
+
+	tests := []struct {
+		method, path string
+		attempts     int32
+	}{
+		{http.MethodGet, "/search?q=lb", 3},
+		{http.MethodPost, "/pay", 1},
+	}
+	for _, tt := range tests {
+		hits.Store(0)
+		w := serve(handler, tt.method, tt.path)
+		if w.Code != http.StatusBadGateway {
+			t.Errorf("%s %s: status = %d, want %d", tt.method, tt.path, w.Code, http.StatusBadGateway)
+		}
+		if got := hits.Load(); got != tt.attempts {
+			t.Errorf("%s %s: %d attempts, want %d", tt.method, tt.path, got, tt.attempts)
+		}
+	}
+}
+
+func TestRouteTimeoutAnswersGatewayTimeout(t *testing.T) {
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/slow" {
+			return
+		}
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	})
+	routes := []Route{{Prefix: "/slow", Timeout: Duration(20 * time.Millisecond)}}
+	handler := startTestLoadBalancer(t, Config{Backends: []BackendConfig{{URL: server.URL}}, Routes: routes}).Handler()
+
+	if w := serve(handler, http.MethodGet, "/slow"); w.Code != http.StatusGatewayTimeout {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusGatewayTimeout)
+	}
+	if w := serve(handler, http.MethodGet, "/fast"); w.Code != http.StatusOK {
+		t.Errorf("status without a route timeout = %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestRouterMatchesLongestPrefix(t *testing.T) {
+	router := NewRouter([]Route{{Prefix: "/api", Retries: 1}, {Prefix: "/api/users", Retries: 2}})
+
+	tests := []struct {
+		path    string
+		retries int
+	}{
+		{"/api/users/42", 2},
+		{"/api/orders", 1},
+		{"/apix", 0},
+	}
+	for _, tt := range tests {
+		r, _ := http.NewRequest(http.MethodGet, "http://lb"+tt.path, nil)
+		if got := router.Match(r).Retries; got != tt.retries {
+			t.Errorf("Match(%s).Retries = %d, want %d", tt.path, got, tt.retries)
+		}
+	}
+}
+
+func TestBufferedBodiesAreRetriedUpToTheLimit(t *testing.T) {
+	// The first request of each case fails whichever backend it reaches, the retry echoes the body
+	var hits atomic.Int32
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if hits.Add(1) == 1 {
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		io.Copy(w, r.Body)
+	}
+	backends := []BackendConfig{{URL: newTestServer(t, handler).URL}, {URL: newTestServer(t, handler).URL}}
+	routes := []Route{{Prefix: "/", Retries: 1, BufferBody: true, MaxBufferSize: 8}}
+	balancer := startTestLoadBalancer(t, Config{Backends: backends, Routes: routes})
+
+	tests := []struct {
+		body     string
+		code     int
+		attempts int32
+	}{
+		{"small", http.StatusOK, 2},
+		{"larger than the buffer", http.StatusBadGateway, 1},
+	}
+	for _, tt := range tests {
+		hits.Store(0)
+		w := httptest.NewRecorder()
+		balancer.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body)))
+		if w.Code != tt.code || hits.Load() != tt.attempts {
+			t.Errorf("body %q: status %d after %d attempts, want %d after %d", tt.body, w.Code, hits.Load(), tt.code, tt.attempts)
+		}
+		if tt.code == http.StatusOK && w.Body.String() != tt.body {
+			t.Errorf("retried body = %q, want %q", w.Body.String(), tt.body)
+		}
+	}
+}
+
+func TestRouteRewritesPath(t *testing.T) {
+	tests := []struct {
+		strip, add, path, want string
+	}{
+		{"/api", "", "/api/users", "/users"},
+		{"/api/", "", "/api/users", "/users"},
+		{"/api", "", "/api", "/"},
+		{"/api", "", "/api/", "/"},
+		{"/api", "", "/apis/users", "/apis/users"},
+		{"", "/v1", "/users", "/v1/users"},
+		{"", "/v1/", "/", "/v1"},
+		{"/api", "/v2", "/api/users", "/v2/users"},
+		{"/api", "/v2", "/api", "/v2"},
+	}
+	for _, tt := range tests {
+		route := Route{StripPrefix: tt.strip, AddPrefix: tt.add}
+		if got := route.rewrite(tt.path); got != tt.want {
+			t.Errorf("strip %q add %q: %s rewritten to %s, want %s", tt.strip, tt.add, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestRewrittenPathReachesBackend(t *testing.T) {
+	paths := make(chan string, 1)
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		paths <- r.URL.RequestURI()
+	})
+	routes := []Route{{Prefix: "/api", StripPrefix: "/api", AddPrefix: "/internal"}}
+	handler := startTestLoadBalancer(t, Config{Backends: []BackendConfig{{URL: server.URL}}, Routes: routes}).Handler()
+
+	for path, want := range map[string]string{
+		"/api/users?id=1": "/internal/users?id=1",
+		"/api":            "/internal",
+		"/other":          "/other",
+	} {
+		serve(handler, http.MethodGet, path)
+		if got := <-paths; got != want {
+			t.Errorf("%s reached the backend as %s, want %s", path, got, want)
+		}
+	}
+}
+
+func TestStreamingRouteFlushesChunks(t *testing.T) {
+	release := make(chan struct{})
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "first\n")
+		w.(http.Flusher).Flush()
+		<-release
+		io.WriteString(w, "second\n")
+	})
+	routes := []Route{{Prefix: "/events", Stream: true}}
+	balancer := startTestLoadBalancer(t, Config{Backends: []BackendConfig{{URL: server.URL}}, Routes: routes})
+	proxy := httptest.NewServer(balancer.Handler())
+	defer proxy.Close()
+	defer close(release)
+
+	resp, err := http.Get(proxy.URL + "/events")
+	if err != nil {
+		t.Fatalf("GET /events: %s", err)
+	}
+	defer resp.Body.Close()
+
+	// The second chunk is only written once the first has reached the client
+	chunk := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(resp.Body).ReadString('\n')
+		chunk <- line
+	}()
+	select {
+	case line := <-chunk:
+		if line != "first\n" {
+			t.Errorf("first chunk = %q, want %q", line, "first\n")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("first chunk did not reach the client before the response ended")
+	}
+}
+
+func TestRouteFlushInterval(t *testing.T) {
+	for _, tt := range []struct {
+		route Route
+		want  time.Duration
+	}{
+		{Route{}, 0},
+		{Route{FlushInterval: Duration(100 * time.Millisecond)}, 100 * time.Millisecond},
+		{Route{Stream: true, FlushInterval: Duration(100 * time.Millisecond)}, -1},
+	} {
+		if got := tt.route.flushInterval(); got != tt.want {
+			t.Errorf("flushInterval of %+v = %s, want %s", tt.route, got, tt.want)
+		}
+	}
+}
+
+func TestDeadlineBoundsRetries(t *testing.T) {
+	var hits atomic.Int32
+	slow := func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}
+	var backends []BackendConfig
+	for i := 0; i < 4; i++ {
+		backends = append(backends, BackendConfig{URL: newTestServer(t, slow).URL})
+	}
+	// The 4 attempts of 50ms would take 200ms, the deadline ends the request during the second
+	routes := []Route{{Prefix: "/", Timeout: Duration(50 * time.Millisecond), Retries: 3, Deadline: Duration(80 * time.Millisecond)}}
+	handler := startTestLoadBalancer(t, Config{Backends: backends, Routes: routes}).Handler()
+
+	start := time.Now()
+	w := serve(handler, http.MethodGet, "/")
+	elapsed := time.Since(start)
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusGatewayTimeout)
+	}
+	if n := hits.Load(); n != 2 {
+		t.Errorf("%d attempts, want 2 within the deadline", n)
+	}
+	if elapsed > 150*time.Millisecond {
+		t.Errorf("request took %s, want it cut off at the 80ms deadline", elapsed)
+	}
+}
+
+func TestAcceptEncodingPolicies(t *testing.T) {
+	encodings := make(chan []string, 1)
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		encodings <- r.Header.Values("Accept-Encoding")
+	})
+	routes := []Route{{Prefix: "/strip", AcceptEncoding: "strip"}, {Prefix: "/br", AcceptEncoding: "br"}}
+
+	for _, tt := range []struct {
+		backendPolicy, path string
+		want                string
+	}{
+		{"", "/", "gzip, br"},
+		{"identity", "/", "identity"},
+		// Once the client's header is stripped the transport asks for gzip on its own, and
+		// decompresses the response itself
+		{"identity", "/strip", "gzip"},
+		{"identity", "/br", "br"},
+		{"strip", "/", "gzip"},
+	} {
+		balancer := startTestLoadBalancer(t, Config{Backends: []BackendConfig{{URL: server.URL, AcceptEncoding: tt.backendPolicy}}, Routes: routes})
+		r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		r.Header.Set("Accept-Encoding", "gzip, br")
+		balancer.Handler().ServeHTTP(httptest.NewRecorder(), r)
+
+		if got := strings.Join(<-encodings, ", "); got != tt.want {
+			t.Errorf("backend policy %q, %s: Accept-Encoding = %q, want %q", tt.backendPolicy, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestStrippedAcceptEncodingSendsDecompressedResponse(t *testing.T) {
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		zw := gzip.NewWriter(w)
+		io.WriteString(zw, "plain text")
+		zw.Close()
+	})
+	balancer := startTestLoadBalancer(t, Config{Backends: []BackendConfig{{URL: server.URL, AcceptEncoding: "strip"}}})
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	balancer.Handler().ServeHTTP(w, r)
+	if w.Header().Get("Content-Encoding") != "" || w.Body.String() != "plain text" {
+		t.Errorf("client got Content-Encoding %q and body %q, want the decompressed text", w.Header().Get("Content-Encoding"), w.Body.String())
+	}
+}
+
+func TestConfiguredHeadersAreRemovedFromProxiedRequests(t *testing.T) {
+	received := make(chan http.Header, 1)
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header
+	})
+	backends := []BackendConfig{{URL: server.URL, RemoveHeaders: []string{"X-Internal-Auth"}}}
+	routes := []Route{{Prefix: "/public", RemoveHeaders: []string{"x-debug"}}}
+	handler := startTestLoadBalancer(t, Config{Backends: backends, Routes: routes}).Handler()
+
+	tests := []struct {
+		path            string
+		removed, passed []string
+	}{
+		{"/public/page", []string{"X-Internal-Auth", "X-Debug", "X-Hop"}, []string{"X-Request-Name"}},
+		// The backend's headers are removed on every route, the route's only on its own
+		{"/private", []string{"X-Internal-Auth", "X-Hop"}, []string{"X-Debug", "X-Request-Name"}},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		r.Header.Set("X-Internal-Auth", "secret")
+		r.Header.Set("X-Debug", "1")
+		r.Header.Set("X-Request-Name", "test")
+		// Hop-by-hop headers listed in Connection are still stripped
+		r.Header.Set("Connection", "X-Hop")
+		r.Header.Set("X-Hop", "1")
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+
+		header := <-received
+		for _, name := range tt.removed {
+			if value := header.Get(name); value != "" {
+				t.Errorf("%s: backend received %s: %s, want it removed", tt.path, name, value)
+			}
+		}
+		for _, name := range tt.passed {
+			if header.Get(name) == "" {
+				t.Errorf("%s: backend did not receive %s", tt.path, name)
+			}
+		}
+	}
+}
+
+func TestClientDisconnectCancelsUpstreamRequest(t *testing.T) {
+	var hits atomic.Int32
+	started := make(chan struct{}, 1)
+	cancelled := make(chan error, 1)
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		started <- struct{}{}
+		select {
+		case <-r.Context().Done():
+			cancelled <- r.Context().Err()
+		case <-time.After(2 * time.Second):
+		}
+	})
+	// The route's timeout and retries wrap the request context the client cancels
+	routes := []Route{{Prefix: "/", Timeout: Duration(time.Second), Retries: 2}}
+	balancer := startTestLoadBalancer(t, Config{Backends: []BackendConfig{{URL: server.URL}}, Routes: routes, BreakerThreshold: 1})
+	front := httptest.NewServer(balancer.Handler())
+	defer front.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r, _ := http.NewRequestWithContext(ctx, http.MethodGet, front.URL+"/work", nil)
+	go func() {
+		<-started
+		cancel()
+	}()
+	if _, err := http.DefaultClient.Do(r); err == nil {
+		t.Fatal("request succeeded after the client cancelled it")
+	}
+
+	select {
+	case err := <-cancelled:
+		if err != context.Canceled {
+			t.Errorf("backend request context ended with %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("backend did not observe the cancellation")
+	}
+	// The client's request is not retried, nor held against the backend
+	time.Sleep(20 * time.Millisecond)
+	if n := hits.Load(); n != 1 {
+		t.Errorf("backend received %d requests, want 1", n)
+	}
+	if stats := balancer.Snapshot(); !stats[0].Alive || stats[0].Breaker != BreakerClosed {
+		t.Errorf("backend after the disconnect = %+v, want it alive with a closed breaker", stats[0])
+	}
+}
+
+func TestRoutesSelectWithTheirOwnStrategy(t *testing.T) {
+	release := make(chan struct{})
+	var held atomic.Int32
+	var backends []BackendConfig
+	for _, name := range []string{"a", "b"} {
+		name := name
+		backends = append(backends, BackendConfig{URL: newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasPrefix(r.URL.Path, "/ws/hold") {
+				held.Add(1)
+				<-release
+			}
+			io.WriteString(w, name)
+		}).URL})
+	}
+	routes := []Route{{Prefix: "/api", Strategy: "round-robin"}, {Prefix: "/ws", Strategy: "least-connections"}}
+	balancer := startTestLoadBalancer(t, Config{Backends: backends, Routes: routes, Strategy: "lowest-cost"})
+	defer close(release)
+	for _, backend := range balancer.pool.GetBackends() {
+		if backend.GetURL().String() == backends[1].URL {
+			backend.SetCost(5)
+		}
+	}
+	handler := balancer.Handler()
+	sequence := func(path string, n int) string {
+		var names []string
+		for i := 0; i < n; i++ {
+			names = append(names, serve(handler, http.MethodGet, path).Body.String())
+		}
+		return strings.Join(names, ",")
+	}
+
+	// The pool's strategy sends everything else to the cheapest backend
+	if got := sequence("/", 4); got != "a,a,a,a" {
+		t.Errorf("default route served by %s, want a,a,a,a", got)
+	}
+	if got := sequence("/api/users", 4); got != "a,b,a,b" && got != "b,a,b,a" {
+		t.Errorf("round-robin route served by %s, want a and b in turn", got)
+	}
+
+	// A long-lived request on one backend sends the next ones to the other
+	go serve(handler, http.MethodGet, "/ws/hold")
+	waitFor(t, "long-lived request did not reach a backend", func() bool { return held.Load() == 1 })
+	idle := serve(handler, http.MethodGet, "/ws/poll").Body.String()
+	if got := sequence("/ws/poll", 3); got != strings.Repeat(idle+",", 2)+idle {
+		t.Errorf("least-connections route served by %s, want the idle backend %s each time", got, idle)
+	}
+}
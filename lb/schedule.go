@@ -0,0 +1,25 @@
+package lb
+
+import "time"
+
+// MaintenanceWindow is a period of scheduled maintenance of a backend, during which it receives
+// no requests and failed health checks are expected
+type MaintenanceWindow struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// contains reports whether t lies within the window
+func (mw MaintenanceWindow) contains(t time.Time) bool {
+	return !t.Before(mw.Start) && t.Before(mw.End)
+}
+
+// inMaintenanceWindow reports whether t lies within any of windows
+func inMaintenanceWindow(windows []MaintenanceWindow, t time.Time) bool {
+	for _, window := range windows {
+		if window.contains(t) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,41 @@
+package lb
+
+import (
+	"log"
+	"net/http"
+)
+
+// SelectorFunc picks the backend for a request among candidates, the backends that are alive and
+// below their connection cap and that the matched route may use. Returning nil leaves the choice
+// to the pool's strategy. A retried request is passed to the selector again for every attempt.
+type SelectorFunc func(r *http.Request, candidates []Backend) Backend
+
+// selectWith asks selector for a backend for the request, returning nil when the selector leaves
+// the choice to the strategy or there is no candidate. A backend that is not one of the candidates,
+// e.g. one from another pool, or that stopped being selectable meanwhile, is ignored as well.
+func selectWith(selector SelectorFunc, pool ServerPool, r *http.Request, route Route, excluded backendSet) Backend {
+	alive := pool.GetAliveBackends()
+	candidates := make([]Backend, 0, len(alive))
+	for _, backend := range alive {
+		if !backend.IsSaturated() && HasTags(backend, route.Tags) && !excluded.has(backend) {
+			candidates = append(candidates, backend)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	selected := selector(r, candidates)
+	if selected == nil {
+		return nil
+	}
+	// Backends are told apart by URL, as a Backend need not be comparable
+	key := normalizeURL(selected.GetURL())
+	for _, candidate := range candidates {
+		if normalizeURL(candidate.GetURL()) == key && IsSelectable(candidate) {
+			return candidate
+		}
+	}
+	log.Printf("Selector picked %s, which is not an available backend of the pool, using the strategy instead", selected.GetURL())
+	return nil
+}
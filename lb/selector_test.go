@@ -0,0 +1,85 @@
+package lb
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// premiumSelector pins requests of premium users to the backend at dedicated while it is a
+// candidate, and leaves the others to the strategy
+func premiumSelector(dedicated string) SelectorFunc {
+	return func(r *http.Request, candidates []Backend) Backend {
+		if r.Header.Get("X-User-Tier") != "premium" {
+			return nil
+		}
+		for _, candidate := range candidates {
+			if candidate.GetURL().String() == dedicated {
+				return candidate
+			}
+		}
+		return nil
+	}
+}
+
+func TestSelectorPinsPremiumUsers(t *testing.T) {
+	var backends []BackendConfig
+	for _, name := range []string{"dedicated", "shared-1", "shared-2"} {
+		name := name
+		backends = append(backends, BackendConfig{URL: newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name)
+		}).URL})
+	}
+	dedicated := backends[0].URL
+	balancer := startTestLoadBalancer(t, Config{Backends: backends, Proxy: ProxyOptions{Selector: premiumSelector(dedicated)}})
+	get := func(tier string) string {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("X-User-Tier", tier)
+		w := httptest.NewRecorder()
+		balancer.Handler().ServeHTTP(w, r)
+		return w.Body.String()
+	}
+
+	for i := 0; i < 5; i++ {
+		if got := get("premium"); got != "dedicated" {
+			t.Fatalf("premium request %d served by %q, want dedicated", i, got)
+		}
+	}
+	// Other users are spread by the round-robin strategy
+	seen := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		seen[get("free")] = true
+	}
+	if len(seen) != 3 {
+		t.Errorf("free requests served by %v, want all 3 backends", seen)
+	}
+
+	// Without the dedicated backend among the candidates the strategy picks a shared one
+	for _, backend := range balancer.pool.GetBackends() {
+		if backend.GetURL().String() == dedicated {
+			backend.SetAlive(false)
+		}
+	}
+	if got := get("premium"); got == "dedicated" || got == "" {
+		t.Errorf("premium request with the dedicated backend down served by %q, want a shared backend", got)
+	}
+}
+
+func TestSelectorPickingForeignBackendFallsBack(t *testing.T) {
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "pool")
+	})
+	foreign := newTestBackend(t, "http://foreign:3001")
+	selector := func(r *http.Request, candidates []Backend) Backend { return foreign }
+	balancer := startTestLoadBalancer(t, Config{Backends: []BackendConfig{{URL: server.URL}}, Proxy: ProxyOptions{Selector: selector}})
+
+	logs := captureLog(t)
+	if w := serve(balancer.Handler(), http.MethodGet, "/"); w.Code != http.StatusOK || w.Body.String() != "pool" {
+		t.Errorf("status %d with body %q, want %d from the pool's backend", w.Code, w.Body.String(), http.StatusOK)
+	}
+	if want := "Selector picked http://foreign:3001"; !strings.Contains(logs.String(), want) {
+		t.Errorf("log = %q, want a line containing %q", logs.String(), want)
+	}
+}
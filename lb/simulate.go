@@ -0,0 +1,23 @@
+package lb
+
+// Simulate runs the selection logic of strategy, nil meaning round-robin, over the backends of
+// config for the given number of requests and returns how many each backend URL received. The
+// backends are never contacted: they are all treated as alive and requests complete instantly.
+func Simulate(config *FileConfig, strategy Strategy, requests int) map[string]int {
+	pool := NewRoundRobinServerPool()
+	pool.SetStrategy(strategy)
+	for _, bc := range config.Backends {
+		// Added directly rather than with AddBackend, which would start health checking them
+		backend := NewBackend(bc.URL, WithTags(bc.Tags), WithZone(bc.Zone))
+		backend.SetWeight(bc.GetWeight())
+		pool.backends = append(pool.backends, backend)
+	}
+
+	counts := make(map[string]int)
+	for i := 0; i < requests; i++ {
+		if backend := pool.GetNextValidPeer(); backend != nil {
+			counts[backend.GetURL().String()]++
+		}
+	}
+	return counts
+}
@@ -0,0 +1,24 @@
+package lb
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSimulateFollowsWeights(t *testing.T) {
+	config := &FileConfig{Backends: []BackendConfig{
+		{URL: "http://a:3001", Weight: intPtr(1)},
+		{URL: "http://b:3001", Weight: intPtr(3)},
+		{URL: "http://c:3001", Weight: intPtr(0)},
+	}}
+
+	want := map[string]int{"http://a:3001": 100, "http://b:3001": 300}
+	if got := Simulate(config, &SmoothWeightedStrategy{}, 400); !reflect.DeepEqual(got, want) {
+		t.Errorf("smooth-weighted distribution = %v, want %v", got, want)
+	}
+
+	got := Simulate(config, &WeightedRandomStrategy{}, 4000)
+	if share := float64(got["http://b:3001"]) / 4000; share < 0.7 || share > 0.8 || got["http://c:3001"] != 0 {
+		t.Errorf("weighted-random distribution = %v, want about 3 in 4 for b and none for c", got)
+	}
+}
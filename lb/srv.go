@@ -0,0 +1,85 @@
+package lb
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SRVResolver looks up DNS SRV records, *net.Resolver is one
+type SRVResolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// SRVConfig discovers backends from the DNS SRV records of a name
+type SRVConfig struct {
+	// Name is the full name of the records, e.g. _http._tcp.api.example.com. Empty disables
+	// discovery.
+	Name string
+	// Scheme of the backend URLs, http by default
+	Scheme string
+	// Interval between lookups, 30s by default
+	Interval time.Duration
+	// Resolver looks up the records, net.DefaultResolver by default
+	Resolver SRVResolver
+}
+
+// defaultSRVInterval is how often SRV records are looked up when SRVConfig.Interval is not set
+const defaultSRVInterval = 30 * time.Second
+
+// srvBackends maps SRV records to backends, with their SRV weight. Only the records with the
+// lowest priority, the ones clients should use, are primaries, the others are standbys which
+// receive requests once too few primaries are available.
+func srvBackends(scheme string, records []*net.SRV) []BackendConfig {
+	if len(records) == 0 {
+		return nil
+	}
+	lowest := records[0].Priority
+	for _, record := range records {
+		if record.Priority < lowest {
+			lowest = record.Priority
+		}
+	}
+
+	backends := make([]BackendConfig, 0, len(records))
+	for _, record := range records {
+		// A weight of 0 only means "rarely" in SRV records, not never
+		weight := int(record.Weight)
+		if weight == 0 {
+			weight = 1
+		}
+		host := strings.TrimSuffix(record.Target, ".")
+		backends = append(backends, BackendConfig{
+			URL:     fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(host, strconv.Itoa(int(record.Port)))),
+			Weight:  &weight,
+			Standby: record.Priority != lowest,
+		})
+	}
+	return backends
+}
+
+// discoverSRV looks up the SRV records of the config until ctx is done, bringing the discovered
+// backends in line with them. A failed lookup keeps the backends found before.
+func (lb *LoadBalancer) discoverSRV(ctx context.Context, config SRVConfig) {
+	ticker := time.NewTicker(config.Interval)
+	defer ticker.Stop()
+
+	for {
+		_, records, err := config.Resolver.LookupSRV(ctx, "", "", config.Name)
+		if err != nil {
+			log.Printf("Error looking up SRV records of %s, keeping the current backends: %s", config.Name, err)
+		} else {
+			lb.setDiscoveredBackends(srvBackends(config.Scheme, records))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
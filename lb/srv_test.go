@@ -0,0 +1,90 @@
+package lb
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSRVResolver answers SRV lookups with the records or error last set, counting the lookups
+type fakeSRVResolver struct {
+	mutex   sync.Mutex
+	records []*net.SRV
+	err     error
+	lookups int
+}
+
+func (fr *fakeSRVResolver) set(err error, records ...*net.SRV) {
+	fr.mutex.Lock()
+	defer fr.mutex.Unlock()
+	fr.records, fr.err = records, err
+}
+
+func (fr *fakeSRVResolver) lookupCount() int {
+	fr.mutex.Lock()
+	defer fr.mutex.Unlock()
+	return fr.lookups
+}
+
+func (fr *fakeSRVResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	fr.mutex.Lock()
+	defer fr.mutex.Unlock()
+	fr.lookups++
+	return name, fr.records, fr.err
+}
+
+// standbys returns whether every backend of balancer is a standby by URL
+func standbys(balancer *LoadBalancer) map[string]bool {
+	standbys := make(map[string]bool)
+	for _, stats := range balancer.Snapshot() {
+		standbys[stats.URL] = stats.Standby
+	}
+	return standbys
+}
+
+func TestSRVRecordsUpdateThePool(t *testing.T) {
+	resolver := &fakeSRVResolver{}
+	resolver.set(nil,
+		&net.SRV{Target: "a.example.", Port: 3001, Priority: 10, Weight: 3},
+		&net.SRV{Target: "b.example.", Port: 3002, Priority: 10, Weight: 0},
+		&net.SRV{Target: "backup.example.", Port: 3001, Priority: 20, Weight: 5},
+	)
+	balancer := startTestLoadBalancer(t, Config{
+		Backends: []BackendConfig{{URL: "http://static:3001"}},
+		SRV:      SRVConfig{Name: "_http._tcp.api.example", Interval: 10 * time.Millisecond, Resolver: resolver},
+	})
+	waitForWeights := func(message string, want map[string]int) {
+		t.Helper()
+		waitFor(t, message, func() bool { return reflect.DeepEqual(weights(balancer.pool), want) })
+	}
+
+	// SRV weights become pool weights, with 0 as the least, and higher priorities are standbys
+	waitForWeights("pool did not follow the initial records", map[string]int{
+		"http://static:3001": 1, "http://a.example:3001": 3, "http://b.example:3002": 1, "http://backup.example:3001": 5,
+	})
+	if got, want := standbys(balancer), map[string]bool{
+		"http://static:3001": false, "http://a.example:3001": false, "http://b.example:3002": false, "http://backup.example:3001": true,
+	}; !reflect.DeepEqual(got, want) {
+		t.Errorf("standbys = %v, want %v", got, want)
+	}
+
+	// Records that change add, remove and reweigh the discovered backends only
+	resolver.set(nil,
+		&net.SRV{Target: "a.example.", Port: 3001, Priority: 10, Weight: 1},
+		&net.SRV{Target: "c.example.", Port: 3001, Priority: 10, Weight: 2},
+	)
+	want := map[string]int{"http://static:3001": 1, "http://a.example:3001": 1, "http://c.example:3001": 2}
+	waitForWeights("pool did not follow the changed records", want)
+
+	// A failed lookup keeps the backends found before
+	resolver.set(errors.New("no such host"))
+	failedFrom := resolver.lookupCount()
+	waitFor(t, "records were not looked up again", func() bool { return resolver.lookupCount() >= failedFrom+2 })
+	if got := weights(balancer.pool); !reflect.DeepEqual(got, want) {
+		t.Errorf("backends after a failed lookup = %v, want %v", got, want)
+	}
+}
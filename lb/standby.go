@@ -0,0 +1,69 @@
+package lb
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// standbyCheckInterval is how often the backends are looked at for changes that promote or
+// demote the standby backends
+const standbyCheckInterval = 100 * time.Millisecond
+
+// defaultStandbyThreshold promotes the standby backends once no primary backend is available
+const defaultStandbyThreshold = 1
+
+// promoteStandbys puts the standby backends of the pool into rotation while fewer than threshold
+// primary backends are selectable, and takes them out of it otherwise. It returns whether the
+// standby backends are promoted.
+func promoteStandbys(pool ServerPool, threshold int) bool {
+	// Only the primaries of the active backend group count
+	primaries := 0
+	for _, backend := range pool.GetAliveBackends() {
+		if !backend.IsStandby() {
+			primaries++
+		}
+	}
+
+	promote := primaries < threshold
+	for _, backend := range pool.GetBackends() {
+		if backend.IsStandby() {
+			backend.SetPromoted(promote)
+		}
+	}
+	return promote
+}
+
+// watchStandbys looks at the pool right away and then every interval until ctx is done. A look
+// only recounts the primary backends when stateVersion moved since the last one, as it does when
+// a backend of any pool joins or leaves, goes up or down, drains or trips its breaker. The standby
+// backends are then promoted while fewer than threshold primaries are selectable, and demoted as
+// soon as threshold of them are, see promoteStandbys.
+func watchStandbys(ctx context.Context, pool ServerPool, threshold int, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// The version is read before promoting, so the bump from SetPromoted is only seen at the next
+	// tick, whose recount finds the standbys already as they should be
+	var version uint64
+	promoted := false
+	for {
+		if current := stateVersion.Load(); current != version {
+			version = current
+			if promote := promoteStandbys(pool, threshold); promote != promoted {
+				promoted = promote
+				if promoted {
+					log.Printf("Fewer than %d primary backends are available, promoting the standby backends", threshold)
+				} else {
+					log.Printf("Enough primary backends are available again, demoting the standby backends")
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
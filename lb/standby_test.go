@@ -0,0 +1,60 @@
+package lb
+
+import (
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestStandbysTakeOverBelowThreshold(t *testing.T) {
+	var backends []BackendConfig
+	names := make(map[string]string)
+	for _, name := range []string{"p1", "p2", "p3", "standby"} {
+		name := name
+		url := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name)
+		}).URL
+		backends = append(backends, BackendConfig{URL: url, Standby: name == "standby"})
+		names[url] = name
+	}
+	balancer := startTestLoadBalancer(t, Config{Backends: backends, StandbyThreshold: 2})
+	setAlive := func(name string, alive bool) {
+		for _, backend := range balancer.pool.GetBackends() {
+			if names[backend.GetURL().String()] == name {
+				backend.SetAlive(alive)
+			}
+		}
+	}
+	servedByStandby := func() bool {
+		for i := 0; i < 8; i++ {
+			if serve(balancer.Handler(), http.MethodGet, "/").Body.String() == "standby" {
+				return true
+			}
+		}
+		return false
+	}
+
+	if servedByStandby() {
+		t.Fatal("standby served requests while all primaries were available")
+	}
+	// Two primaries left are still enough
+	setAlive("p1", false)
+	time.Sleep(2 * standbyCheckInterval)
+	if servedByStandby() {
+		t.Fatal("standby promoted with 2 primaries left")
+	}
+
+	setAlive("p2", false)
+	waitFor(t, "standby not promoted with 1 primary left", servedByStandby)
+	if stats := balancer.Snapshot(); !stats[3].Promoted {
+		t.Errorf("standby stats = %+v, want it promoted", stats[3])
+	}
+
+	// The standby is demoted once the primaries recover
+	setAlive("p2", true)
+	waitFor(t, "standby still serving after the primaries recovered", func() bool { return !servedByStandby() })
+	if stats := balancer.Snapshot(); stats[3].Promoted {
+		t.Errorf("standby stats = %+v, want it demoted", stats[3])
+	}
+}
@@ -0,0 +1,100 @@
+package lb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// poolState is the selection state of a pool persisted across restarts
+type poolState struct {
+	Index   int            `json:"index"`
+	Weights map[string]int `json:"weights"`
+}
+
+// SaveState writes the round-robin index and the backend weights to path
+func (sp *RoundRobinServerPool) SaveState(path string) error {
+	sp.mutex.RLock()
+	state := poolState{
+		Index:   sp.nextIndex(len(sp.backends)),
+		Weights: make(map[string]int, len(sp.backends)),
+	}
+	for _, backend := range sp.backends {
+		state.Weights[backend.GetURL().String()] = backend.GetWeight()
+	}
+	sp.mutex.RUnlock()
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a crash never leaves a truncated state file behind
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadState restores the round-robin index and the weights of the backends in the pool from
+// a file written by SaveState. A missing file is not an error.
+func (sp *RoundRobinServerPool) LoadState(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var state poolState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+
+	if len(sp.backends) > 0 && state.Index >= 0 {
+		sp.next.Store(uint64(state.Index % len(sp.backends)))
+	}
+	for _, backend := range sp.backends {
+		if weight, ok := state.Weights[backend.GetURL().String()]; ok && weight >= 0 {
+			backend.SetWeight(weight)
+		}
+	}
+
+	return nil
+}
+
+// persistState saves the pool state to path every interval until ctx is done
+func persistState(ctx context.Context, pool *RoundRobinServerPool, path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := pool.SaveState(path); err != nil {
+				log.Printf("Error saving state to %s: %s", path, err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package lb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStateResumesIndexAndWeights(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	urls := []string{"http://a:3001", "http://b:3001", "http://c:3001"}
+
+	pool, backends := newStrategyPool(nil, urls...)
+	for _, backend := range backends {
+		defer backend.Stop()
+	}
+	backends[2].SetWeight(4)
+	pool.GetNextValidPeer()
+	pool.GetNextValidPeer()
+	if err := pool.SaveState(path); err != nil {
+		t.Fatalf("SaveState: %s", err)
+	}
+	want := pool.GetNextValidPeer()
+
+	restarted, restartedBackends := newStrategyPool(nil, urls...)
+	for _, backend := range restartedBackends {
+		defer backend.Stop()
+	}
+	if err := restarted.LoadState(path); err != nil {
+		t.Fatalf("LoadState: %s", err)
+	}
+	if got := restarted.GetNextValidPeer(); got.GetURL().Host != want.GetURL().Host {
+		t.Errorf("restarted pool resumed at %s, want %s", got.GetURL().Host, want.GetURL().Host)
+	}
+	if got := weights(restarted); got["http://c:3001"] != 4 || got["http://a:3001"] != 1 {
+		t.Errorf("restarted weights = %v, want c at 4 and the others at 1", got)
+	}
+}
+
+func TestLoadStateDegradesGracefully(t *testing.T) {
+	pool, backends := newStrategyPool(nil, "http://a:3001")
+	defer backends[0].Stop()
+	dir := t.TempDir()
+
+	if err := pool.LoadState(filepath.Join(dir, "missing.json")); err != nil {
+		t.Errorf("LoadState of a missing file: %s, want no error", err)
+	}
+
+	corrupt := filepath.Join(dir, "corrupt.json")
+	if err := os.WriteFile(corrupt, []byte("{"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.LoadState(corrupt); err == nil {
+		t.Error("LoadState of a corrupt file succeeded, want an error")
+	}
+	if got := pool.GetNextValidPeer(); got != backends[0] {
+		t.Errorf("pool selected %v after a failed load, want its backend", got)
+	}
+}
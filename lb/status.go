@@ -0,0 +1,99 @@
+package lb
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// BackendStats describes the state of a backend server, as returned by Snapshot and served on /stats
+type BackendStats struct {
+	URL               string       `json:"url"`
+	Alive             bool         `json:"alive"`
+	Draining          bool         `json:"draining"`
+	Stale             bool         `json:"stale"`
+	Standby           bool         `json:"standby"`
+	Promoted          bool         `json:"promoted"`
+	Maintenance       bool         `json:"maintenance"`
+	Breaker           BreakerState `json:"breaker"`
+	Weight            int          `json:"weight"`
+	ActiveConnections int          `json:"activeConnections"`
+	Throttled         bool         `json:"throttled"`
+	TotalRequests     int64        `json:"totalRequests"`
+	Load              float64      `json:"load"`
+	Cost              float64      `json:"cost"`
+	ErrorRate         float64      `json:"errorRate"`
+	LatencyP50Ms      float64      `json:"latencyP50Ms"`
+	LatencyP99Ms      float64      `json:"latencyP99Ms"`
+	BytesIn           int64        `json:"bytesIn"`
+	BytesOut          int64        `json:"bytesOut"`
+	SelfRedirects     int64        `json:"selfRedirects"`
+}
+
+// InFlightRequest describes a request being proxied to a backend, as served on /debug/connections
+type InFlightRequest struct {
+	// ID numbers the requests of a backend in the order they were sent to it
+	ID       int64     `json:"id"`
+	Method   string    `json:"method"`
+	Path     string    `json:"path"`
+	ClientIP string    `json:"clientIP"`
+	Start    time.Time `json:"start"`
+}
+
+// livezHandler reports that the load balancer process is running
+func livezHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+// readyzHandler reports whether the pool is serving and has at least one alive backend to send traffic to
+func readyzHandler(pool ServerPool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		alive := len(pool.GetAliveBackends())
+
+		w.Header().Set("Content-Type", "text/plain")
+		if pool.IsPaused() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("paused for maintenance"))
+			return
+		}
+		if alive == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("no backend server is available"))
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "%d of %d backend servers available", alive, pool.GetServerPoolSize())
+	}
+}
+
+// statsHandler serves the state of every backend server in the pool as JSON
+func statsHandler(pool ServerPool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stats := pool.Snapshot()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"paused": pool.IsPaused(), "backends": stats})
+	}
+}
+
+// connectionsHandler serves the requests in flight to every backend server in the pool as JSON,
+// for finding stuck requests
+func connectionsHandler(pool ServerPool) http.HandlerFunc {
+	type backendRequests struct {
+		URL      string            `json:"url"`
+		Requests []InFlightRequest `json:"requests"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		backends := pool.GetBackends()
+		dump := make([]backendRequests, 0, len(backends))
+		for _, backend := range backends {
+			dump = append(dump, backendRequests{URL: backend.GetURL().String(), Requests: backend.InFlight()})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"backends": dump})
+	}
+}
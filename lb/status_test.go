@@ -0,0 +1,190 @@
+package lb
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestProbesWithAllBackendsDown(t *testing.T) {
+	var hits atomic.Int32
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) { hits.Add(1) })
+	balancer := startTestLoadBalancer(t, Config{Backends: []BackendConfig{{URL: server.URL}}})
+	handler := balancer.Handler()
+
+	if w := serve(handler, http.MethodGet, "/readyz"); w.Code != http.StatusOK {
+		t.Errorf("/readyz with an alive backend = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	for _, backend := range balancer.pool.GetBackends() {
+		backend.SetAlive(false)
+	}
+	if w := serve(handler, http.MethodGet, "/livez"); w.Code != http.StatusOK {
+		t.Errorf("/livez with all backends down = %d, want %d", w.Code, http.StatusOK)
+	}
+	if w := serve(handler, http.MethodGet, "/readyz"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz with all backends down = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	if n := hits.Load(); n != 0 {
+		t.Errorf("backend received %d probe requests, want the probes kept off the proxy path", n)
+	}
+}
+
+func TestStatsShowsBytesTransferred(t *testing.T) {
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	})
+	balancer := startTestLoadBalancer(t, Config{Backends: []BackendConfig{{URL: server.URL}}})
+	serve(balancer.Handler(), http.MethodGet, "/")
+
+	if stats := getStats(t, balancer); len(stats) != 1 || stats[0].BytesOut != 5 {
+		t.Errorf("/stats backends = %+v, want one backend with 5 bytes out", stats)
+	}
+}
+
+func TestSnapshotIsConsistentWhileRequestsAreInFlight(t *testing.T) {
+	slow := func(w http.ResponseWriter, r *http.Request) { time.Sleep(time.Millisecond) }
+	backends := []BackendConfig{{URL: newTestServer(t, slow).URL}, {URL: newTestServer(t, slow).URL}}
+	balancer := startTestLoadBalancer(t, Config{Backends: backends})
+
+	const clients, requests = 8, 25
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < requests; j++ {
+				serve(balancer.Handler(), http.MethodGet, "/")
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	var previous int64
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		snapshot := balancer.Snapshot()
+		if len(snapshot) != len(backends) {
+			t.Fatalf("snapshot of %d backends, want %d", len(snapshot), len(backends))
+		}
+		var total int64
+		for _, stats := range snapshot {
+			if stats.ActiveConnections < 0 || int64(stats.ActiveConnections) > stats.TotalRequests {
+				t.Fatalf("%s: %d active connections for %d requests", stats.URL, stats.ActiveConnections, stats.TotalRequests)
+			}
+			total += stats.TotalRequests
+		}
+		if total < previous {
+			t.Fatalf("total requests went from %d down to %d", previous, total)
+		}
+		previous = total
+		time.Sleep(100 * time.Microsecond)
+	}
+
+	var total int64
+	for _, stats := range balancer.Snapshot() {
+		if stats.ActiveConnections != 0 {
+			t.Errorf("%s: %d active connections once idle, want 0", stats.URL, stats.ActiveConnections)
+		}
+		total += stats.TotalRequests
+	}
+	if total != clients*requests {
+		t.Errorf("snapshot counts %d requests, want %d", total, clients*requests)
+	}
+}
+
+func TestSnapshotIsACopy(t *testing.T) {
+	balancer := startTestLoadBalancer(t, Config{Backends: []BackendConfig{{URL: "http://a:3001"}}})
+	snapshot := balancer.Snapshot()
+	snapshot[0].Alive = false
+	snapshot[0].Weight = 10
+
+	if stats := balancer.Snapshot()[0]; !stats.Alive || stats.Weight != 1 {
+		t.Errorf("snapshot after changing a copy = %+v, want it alive with weight 1", stats)
+	}
+}
+
+// inFlight decodes the requests listed by /debug/connections of balancer by backend URL
+func inFlight(t *testing.T, balancer *LoadBalancer) map[string][]InFlightRequest {
+	t.Helper()
+	var dump struct {
+		Backends []struct {
+			URL      string            `json:"url"`
+			Requests []InFlightRequest `json:"requests"`
+		} `json:"backends"`
+	}
+	w := serve(balancer.AdminHandler(), http.MethodGet, "/debug/connections")
+	if err := json.NewDecoder(w.Body).Decode(&dump); err != nil {
+		t.Fatalf("decoding /debug/connections: %s", err)
+	}
+	requests := make(map[string][]InFlightRequest)
+	for _, backend := range dump.Backends {
+		requests[backend.URL] = backend.Requests
+	}
+	return requests
+}
+
+func TestConnectionsDumpListsInFlightRequests(t *testing.T) {
+	release := make(chan struct{})
+	var held atomic.Int32
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/stuck" {
+			held.Add(1)
+			<-release
+		}
+	})
+	balancer := startTestLoadBalancer(t, Config{Backends: []BackendConfig{{URL: server.URL}}})
+
+	start := time.Now()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// httptest requests come from 192.0.2.1
+		serve(balancer.Handler(), http.MethodPost, "/stuck")
+	}()
+	waitFor(t, "request did not reach the backend", func() bool { return held.Load() == 1 })
+	serve(balancer.Handler(), http.MethodGet, "/done")
+
+	requests := inFlight(t, balancer)[server.URL]
+	if len(requests) != 1 {
+		t.Fatalf("in-flight requests = %+v, want only the stuck one", requests)
+	}
+	if got := requests[0]; got.Method != http.MethodPost || got.Path != "/stuck" || got.ClientIP != "192.0.2.1" || got.Start.Before(start) || got.Start.After(time.Now()) {
+		t.Errorf("in-flight request = %+v, want POST /stuck from 192.0.2.1 started after %s", got, start)
+	}
+
+	close(release)
+	<-done
+	if requests := inFlight(t, balancer)[server.URL]; len(requests) != 0 {
+		t.Errorf("in-flight requests after completion = %+v, want none", requests)
+	}
+}
+
+func TestPanickingProxyReleasesInFlightRequest(t *testing.T) {
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {})
+	b := newTestBackend(t, server.URL, WithResponseHooks(func(resp *http.Response) error { panic("hook failed") }))
+
+	var recovered interface{}
+	func() {
+		defer func() { recovered = recover() }()
+		serve(b, http.MethodGet, "/")
+	}()
+	if recovered == nil {
+		t.Fatal("proxying did not panic")
+	}
+	if requests, active := b.InFlight(), b.GetActiveConnections(); len(requests) != 0 || active != 0 {
+		t.Errorf("after a panic: %d in-flight requests and %d active connections, want none", len(requests), active)
+	}
+}
@@ -0,0 +1,85 @@
+package lb
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// connAffinityKey is the context key under which the connAffinity of a client connection is stored
+type connAffinityKey struct{}
+
+// connAffinity remembers the backend that served the last request on a client connection
+type connAffinity struct {
+	mutex   sync.Mutex
+	backend Backend
+}
+
+// connAffinities tracks the connAffinity of every open client connection, so that it can be
+// released once the connection closes
+type connAffinities struct {
+	mutex sync.Mutex
+	conns map[net.Conn]*connAffinity
+}
+
+func newConnAffinities() *connAffinities {
+	return &connAffinities{conns: make(map[net.Conn]*connAffinity)}
+}
+
+// add starts tracking c, returning ctx carrying its connAffinity
+func (ca *connAffinities) add(ctx context.Context, c net.Conn) context.Context {
+	affinity := &connAffinity{}
+	ca.mutex.Lock()
+	ca.conns[c] = affinity
+	ca.mutex.Unlock()
+	return context.WithValue(ctx, connAffinityKey{}, affinity)
+}
+
+// remove stops tracking c and forgets its backend
+func (ca *connAffinities) remove(c net.Conn) {
+	ca.mutex.Lock()
+	affinity := ca.conns[c]
+	delete(ca.conns, c)
+	ca.mutex.Unlock()
+
+	if affinity != nil {
+		affinity.set(nil)
+	}
+}
+
+// stickyBackend returns the backend that served the previous request on the connection of r, if
+// it is still alive, below its connection cap and usable by the route
+func stickyBackend(pool ServerPool, r *http.Request, route Route) Backend {
+	affinity, ok := r.Context().Value(connAffinityKey{}).(*connAffinity)
+	if !ok {
+		return nil
+	}
+
+	affinity.mutex.Lock()
+	backend := affinity.backend
+	affinity.mutex.Unlock()
+	if backend == nil || backend.IsSaturated() || !HasTags(backend, route.Tags) {
+		return nil
+	}
+	// The backend may have failed its health checks or been removed from the pool since
+	for _, alive := range pool.GetAliveBackends() {
+		if alive == backend {
+			return backend
+		}
+	}
+	return nil
+}
+
+// stick makes backend serve the following requests on the connection of r
+func stick(r *http.Request, backend Backend) {
+	if affinity, ok := r.Context().Value(connAffinityKey{}).(*connAffinity); ok {
+		affinity.set(backend)
+	}
+}
+
+func (a *connAffinity) set(backend Backend) {
+	a.mutex.Lock()
+	a.backend = backend
+	a.mutex.Unlock()
+}
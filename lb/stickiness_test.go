@@ -0,0 +1,97 @@
+package lb
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// startStickyServer serves a load balancer with connection stickiness over three backends that
+// answer with their name, and returns the URLs of the backends by name
+func startStickyServer(t *testing.T) (*LoadBalancer, *httptest.Server, map[string]string) {
+	t.Helper()
+	var backends []BackendConfig
+	urls := make(map[string]string)
+	for _, name := range []string{"a", "b", "c"} {
+		name := name
+		url := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name)
+		}).URL
+		backends = append(backends, BackendConfig{URL: url})
+		urls[name] = url
+	}
+	balancer := startTestLoadBalancer(t, Config{Backends: backends, ConnectionStickiness: true})
+
+	server := httptest.NewUnstartedServer(balancer.Handler())
+	server.Config.ConnContext = balancer.ConnContext
+	server.Config.ConnState = balancer.ConnState
+	server.Start()
+	t.Cleanup(server.Close)
+	return balancer, server, urls
+}
+
+// getWith sends a GET for the root of server with client and returns the name of the backend
+func getWith(t *testing.T, client *http.Client, server *httptest.Server) string {
+	t.Helper()
+	resp, err := client.Get(server.URL + "/")
+	if err != nil {
+		t.Fatalf("GET: %s", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return string(body)
+}
+
+func TestRequestsOnOneConnectionStickToOneBackend(t *testing.T) {
+	balancer, server, urls := startStickyServer(t)
+
+	// A single keep-alive connection carries every request
+	transport := &http.Transport{MaxConnsPerHost: 1}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: transport}
+	first := getWith(t, client, server)
+	for i := 0; i < 5; i++ {
+		if got := getWith(t, client, server); got != first {
+			t.Fatalf("request %d on the connection served by %s, want %s like the first", i+2, got, first)
+		}
+	}
+
+	// Every new connection is assigned by the strategy
+	fresh := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	seen := make(map[string]bool)
+	for i := 0; i < len(urls); i++ {
+		seen[getWith(t, fresh, server)] = true
+	}
+	if len(seen) != len(urls) {
+		t.Errorf("new connections served by %v, want all %d backends", seen, len(urls))
+	}
+
+	// The connection moves to another backend once its own is down, and sticks to that one
+	for _, backend := range balancer.pool.GetBackends() {
+		if backend.GetURL().String() == urls[first] {
+			backend.SetAlive(false)
+		}
+	}
+	second := getWith(t, client, server)
+	if second == first {
+		t.Fatalf("request after %s went down served by it", first)
+	}
+	if got := getWith(t, client, server); got != second {
+		t.Errorf("request after moving served by %s, want %s", got, second)
+	}
+}
+
+func TestClosedConnectionsAreForgotten(t *testing.T) {
+	balancer, server, _ := startStickyServer(t)
+
+	transport := &http.Transport{}
+	client := &http.Client{Transport: transport}
+	getWith(t, client, server)
+	transport.CloseIdleConnections()
+	waitFor(t, "closed connection was not forgotten", func() bool {
+		balancer.affinities.mutex.Lock()
+		defer balancer.affinities.mutex.Unlock()
+		return len(balancer.affinities.conns) == 0
+	})
+}
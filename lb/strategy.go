@@ -0,0 +1,510 @@
+package lb
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Strategy selects a backend among the alive backends of a pool
+type Strategy interface {
+	Name() string
+	Select(candidates []Backend) Backend
+}
+
+// roundRobinStrategy is implemented by strategies that leave the selection among some candidates
+// to the round-robin built into the pool
+type roundRobinStrategy interface {
+	usesRoundRobin(candidates []Backend) bool
+}
+
+// StrategyConfig holds the settings of the strategies that take any
+type StrategyConfig struct {
+	// Zone is the zone preferred by the locality strategy
+	Zone string
+	// ErrorRateThreshold is the error rate above which the error-rate strategy reduces weights
+	ErrorRateThreshold float64
+	// LatencyPercentile is the percentile compared by the latency-percentile strategy
+	LatencyPercentile float64
+	// TieBreak is the name of the tie-break of the least-connections strategy
+	TieBreak string
+	// ExcludeLast keeps any strategy from selecting the same backend twice in a row while
+	// another one is available, see ExcludeLastStrategy
+	ExcludeLast bool
+}
+
+// NewStrategy returns the strategy with the given name. Round-robin is built into the pool, so
+// for "round-robin" it returns nil, which SetStrategy takes to mean round-robin.
+func NewStrategy(name string, config StrategyConfig) (Strategy, error) {
+	strategy, err := newStrategy(name, config)
+	// Round-robin takes the backends in turn, so it does not select one twice in a row anyway
+	if err != nil || strategy == nil || !config.ExcludeLast {
+		return strategy, err
+	}
+	return &ExcludeLastStrategy{Strategy: strategy}, nil
+}
+
+// newStrategy returns the strategy with the given name, without the options wrapping it
+func newStrategy(name string, config StrategyConfig) (Strategy, error) {
+	switch name {
+	case "round-robin":
+		return nil, nil
+	case "least-load":
+		return &LeastLoadStrategy{}, nil
+	case "lowest-cost":
+		return &CostStrategy{}, nil
+	case "weighted-random":
+		return &WeightedRandomStrategy{}, nil
+	case "smooth-weighted":
+		return &SmoothWeightedStrategy{}, nil
+	case "locality":
+		return &LocalityStrategy{Zone: config.Zone}, nil
+	case "error-rate":
+		return &ErrorRateStrategy{Threshold: config.ErrorRateThreshold}, nil
+	case "latency-percentile":
+		return &LatencyPercentileStrategy{Percentile: config.LatencyPercentile}, nil
+	case "least-connections":
+		tieBreak, err := ParseTieBreak(config.TieBreak)
+		if err != nil {
+			return nil, err
+		}
+		return &LeastConnectionsStrategy{TieBreak: tieBreak}, nil
+	default:
+		return nil, fmt.Errorf("unknown strategy %q", name)
+	}
+}
+
+// RoundRobinStrategy takes the candidates in turn. Pools have round-robin built in, this is for
+// routes that use round-robin while the pool's strategy is another one.
+type RoundRobinStrategy struct {
+	next atomic.Uint64
+}
+
+// Name returns the name of the strategy
+func (s *RoundRobinStrategy) Name() string {
+	return "round-robin"
+}
+
+// Select returns the candidate after the one selected last time
+func (s *RoundRobinStrategy) Select(candidates []Backend) Backend {
+	if len(candidates) == 0 {
+		return nil
+	}
+	return candidates[(s.next.Add(1)-1)%uint64(len(candidates))]
+}
+
+// ExcludeLastStrategy leaves the backend it selected last out of the candidates of the next
+// selection, so that strategies picking at random do not send consecutive requests to the same
+// backend. With a single candidate, or none of the others acceptable to the strategy, the last
+// one is selected again.
+type ExcludeLastStrategy struct {
+	Strategy Strategy
+	last     atomic.Pointer[Backend]
+}
+
+// Name returns the name of the wrapped strategy
+func (s *ExcludeLastStrategy) Name() string {
+	return s.Strategy.Name()
+}
+
+// Select returns the selection of the wrapped strategy among the candidates other than the last
+// one selected
+func (s *ExcludeLastStrategy) Select(candidates []Backend) Backend {
+	var selected Backend
+	if last := s.last.Load(); last != nil && len(candidates) > 1 {
+		for i, backend := range candidates {
+			if backend != *last {
+				continue
+			}
+			// The candidates may be cached by the pool, so they are copied rather than modified
+			others := make([]Backend, 0, len(candidates)-1)
+			others = append(append(others, candidates[:i]...), candidates[i+1:]...)
+			selected = s.Strategy.Select(others)
+			break
+		}
+	}
+	// The strategy may refuse every other candidate, e.g. for a weight of 0
+	if selected == nil {
+		selected = s.Strategy.Select(candidates)
+	}
+	if selected != nil {
+		s.last.Store(&selected)
+	}
+	return selected
+}
+
+// SmoothWeightedStrategy spreads requests over the candidates in proportion to their weights with
+// the smooth weighted round-robin of nginx, which interleaves the backends rather than sending
+// runs of requests to the heaviest one: weights 5, 1 and 1 give a a b a c a a. Backends with a
+// weight of 0 are never selected.
+//
+// While every candidate has the same weight a pool using it leaves the selection to its own
+// round-robin, so that the sequence is the one of RoundRobinServerPool, also when backends are
+// skipped. Select takes the candidates in order then, for routes and simulations.
+type SmoothWeightedStrategy struct {
+	mutex sync.Mutex
+	// current is the running weight of each backend, the highest one is selected next
+	current map[Backend]int
+	// next is the round-robin position while the weights are equal
+	next uint64
+}
+
+// Name returns the name of the strategy
+func (s *SmoothWeightedStrategy) Name() string {
+	return "smooth-weighted"
+}
+
+// usesRoundRobin reports whether the pool's round-robin selects among candidates, which is the
+// case while they all have the same weight
+func (s *SmoothWeightedStrategy) usesRoundRobin(candidates []Backend) bool {
+	weight, equal := equalWeights(candidates)
+	return equal && weight > 0
+}
+
+// Select returns the candidate with the highest running weight, or the next one in order while
+// all weights are equal
+func (s *SmoothWeightedStrategy) Select(candidates []Backend) Backend {
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if weight, equal := equalWeights(candidates); equal {
+		if weight <= 0 {
+			return nil
+		}
+		selected := candidates[s.next%uint64(len(candidates))]
+		s.next++
+		return selected
+	}
+
+	// Backends that are no longer candidates are forgotten
+	if s.current == nil || len(s.current) > len(candidates) {
+		current := make(map[Backend]int, len(candidates))
+		for _, backend := range candidates {
+			current[backend] = s.current[backend]
+		}
+		s.current = current
+	}
+
+	var selected Backend
+	total := 0
+	for _, backend := range candidates {
+		weight := backend.GetWeight()
+		if weight <= 0 {
+			continue
+		}
+		s.current[backend] += weight
+		total += weight
+		// Ties go to the earliest candidate
+		if selected == nil || s.current[backend] > s.current[selected] {
+			selected = backend
+		}
+	}
+	if selected == nil {
+		return nil
+	}
+
+	s.current[selected] -= total
+	return selected
+}
+
+// equalWeights reports whether every backend has the same weight, and which
+func equalWeights(backends []Backend) (int, bool) {
+	weight := backends[0].GetWeight()
+	for _, backend := range backends[1:] {
+		if backend.GetWeight() != weight {
+			return 0, false
+		}
+	}
+	return weight, true
+}
+
+// LeastLoadStrategy prefers the backend reporting the lowest load through the
+// X-Backend-Load response header. Ties are broken by active connections.
+type LeastLoadStrategy struct{}
+
+// Name returns the name of the strategy
+func (s *LeastLoadStrategy) Name() string {
+	return "least-load"
+}
+
+// Select returns the candidate with the lowest smoothed load
+func (s *LeastLoadStrategy) Select(candidates []Backend) Backend {
+	var selected Backend
+	for _, backend := range candidates {
+		if selected == nil {
+			selected = backend
+			continue
+		}
+
+		load, selectedLoad := backend.GetLoad(), selected.GetLoad()
+		if load < selectedLoad || (load == selectedLoad && backend.GetActiveConnections() < selected.GetActiveConnections()) {
+			selected = backend
+		}
+	}
+
+	return selected
+}
+
+// CostStrategy prefers the backend with the lowest cost, a metric updated from outside the load
+// balancer with SetCost, e.g. through the admin API. Ties are broken by active connections.
+type CostStrategy struct{}
+
+// Name returns the name of the strategy
+func (s *CostStrategy) Name() string {
+	return "lowest-cost"
+}
+
+// Select returns the candidate with the lowest cost
+func (s *CostStrategy) Select(candidates []Backend) Backend {
+	var selected Backend
+	var selectedCost float64
+	for _, backend := range candidates {
+		cost := backend.GetCost()
+		if selected == nil || cost < selectedCost || (cost == selectedCost && backend.GetActiveConnections() < selected.GetActiveConnections()) {
+			selected = backend
+			selectedCost = cost
+		}
+	}
+
+	return selected
+}
+
+// TieBreak decides which backend LeastConnectionsStrategy picks when several have the fewest connections
+type TieBreak string
+
+const (
+	// TieBreakLowestIndex picks the first tied backend in pool order
+	TieBreakLowestIndex TieBreak = "lowest-index"
+	// TieBreakRoundRobin rotates through the tied backends
+	TieBreakRoundRobin TieBreak = "round-robin"
+	// TieBreakRandom picks a tied backend at random
+	TieBreakRandom TieBreak = "random"
+)
+
+// ParseTieBreak returns the TieBreak with the given name, an empty name selects TieBreakLowestIndex
+func ParseTieBreak(name string) (TieBreak, error) {
+	switch tieBreak := TieBreak(name); tieBreak {
+	case "":
+		return TieBreakLowestIndex, nil
+	case TieBreakLowestIndex, TieBreakRoundRobin, TieBreakRandom:
+		return tieBreak, nil
+	default:
+		return "", fmt.Errorf("unknown tie-break %q", name)
+	}
+}
+
+// LeastConnectionsStrategy prefers the backend with the fewest active connections
+type LeastConnectionsStrategy struct {
+	TieBreak TieBreak
+	next     atomic.Uint64
+}
+
+// Name returns the name of the strategy
+func (s *LeastConnectionsStrategy) Name() string {
+	return "least-connections"
+}
+
+// Select returns the candidate with the fewest active connections, breaking ties with s.TieBreak
+func (s *LeastConnectionsStrategy) Select(candidates []Backend) Backend {
+	var tied []Backend
+	fewest := 0
+	for _, backend := range candidates {
+		connections := backend.GetActiveConnections()
+		switch {
+		case len(tied) == 0 || connections < fewest:
+			tied = append(tied[:0], backend)
+			fewest = connections
+		case connections == fewest:
+			tied = append(tied, backend)
+		}
+	}
+
+	if len(tied) == 0 {
+		return nil
+	}
+
+	switch s.TieBreak {
+	case TieBreakRoundRobin:
+		return tied[(s.next.Add(1)-1)%uint64(len(tied))]
+	case TieBreakRandom:
+		return tied[rand.Intn(len(tied))]
+	default:
+		return tied[0]
+	}
+}
+
+// WeightedRandomStrategy picks backends at random in proportion to their weights. The
+// cumulative weight distribution is cached until the candidates or stateVersion change.
+type WeightedRandomStrategy struct {
+	mutex      sync.Mutex
+	version    uint64
+	candidates []Backend
+	cumulative []int
+}
+
+// Name returns the name of the strategy
+func (s *WeightedRandomStrategy) Name() string {
+	return "weighted-random"
+}
+
+// Select returns a random candidate, backends with a weight of 0 are never selected
+func (s *WeightedRandomStrategy) Select(candidates []Backend) Backend {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if version := stateVersion.Load(); version != s.version || !sameBackends(candidates, s.candidates) {
+		s.rebuild(candidates, version)
+	}
+
+	total := 0
+	if len(s.cumulative) > 0 {
+		total = s.cumulative[len(s.cumulative)-1]
+	}
+	// Every candidate has weight 0, none of them may receive traffic
+	if total <= 0 {
+		return nil
+	}
+
+	target := rand.Intn(total)
+	return s.candidates[sort.SearchInts(s.cumulative, target+1)]
+}
+
+// rebuild recomputes the cumulative weight distribution of the candidates
+func (s *WeightedRandomStrategy) rebuild(candidates []Backend, version uint64) {
+	cumulative := make([]int, len(candidates))
+	total := 0
+	for i, backend := range candidates {
+		// A backend with weight 0 shares its cumulative weight with the previous one and so
+		// covers no range of targets, making it unselectable
+		if weight := backend.GetWeight(); weight > 0 {
+			total += weight
+		}
+		cumulative[i] = total
+	}
+
+	s.version = version
+	s.candidates = candidates
+	s.cumulative = cumulative
+}
+
+// sameBackends reports whether a and b are the same slice, which the pool guarantees
+// to hold the same backends as long as stateVersion is unchanged
+func sameBackends(a, b []Backend) bool {
+	return len(a) == len(b) && (len(a) == 0 || &a[0] == &b[0])
+}
+
+// LocalityStrategy rotates through the backends in the load balancer's own zone, spilling
+// over to the other zones only when no backend in the zone is available
+type LocalityStrategy struct {
+	Zone string
+	next atomic.Uint64
+}
+
+// Name returns the name of the strategy
+func (s *LocalityStrategy) Name() string {
+	return "locality"
+}
+
+// Select returns the next candidate in the local zone, or the next remote one if there is none
+func (s *LocalityStrategy) Select(candidates []Backend) Backend {
+	local := make([]Backend, 0, len(candidates))
+	for _, backend := range candidates {
+		if backend.GetZone() == s.Zone {
+			local = append(local, backend)
+		}
+	}
+
+	if len(local) == 0 {
+		local = candidates
+	}
+	if len(local) == 0 {
+		return nil
+	}
+
+	return local[(s.next.Add(1)-1)%uint64(len(local))]
+}
+
+// minErrorRateWeight is the fraction of its weight a backend keeps however many errors it
+// returns, so it keeps receiving some traffic and its error rate can recover
+const minErrorRateWeight = 0.05
+
+// ErrorRateStrategy picks backends at random in proportion to their weights, shifting traffic
+// away from backends whose rolling 5xx rate is above Threshold. The weight of such a backend is
+// scaled by the fraction of its responses that succeeded.
+type ErrorRateStrategy struct {
+	Threshold float64
+}
+
+// Name returns the name of the strategy
+func (s *ErrorRateStrategy) Name() string {
+	return "error-rate"
+}
+
+// Select returns a random candidate weighted by its weight and error rate
+func (s *ErrorRateStrategy) Select(candidates []Backend) Backend {
+	// Error rates change with every response, so unlike WeightedRandomStrategy the
+	// distribution is recomputed on each selection
+	cumulative := make([]float64, len(candidates))
+	total := 0.0
+	for i, backend := range candidates {
+		if weight := backend.GetWeight(); weight > 0 {
+			total += float64(weight) * s.errorFactor(backend.GetErrorRate())
+		}
+		cumulative[i] = total
+	}
+	if total <= 0 {
+		return nil
+	}
+
+	target := rand.Float64() * total
+	i := sort.Search(len(cumulative), func(i int) bool { return cumulative[i] > target })
+	if i == len(cumulative) {
+		i--
+	}
+	return candidates[i]
+}
+
+// errorFactor returns how much of its weight a backend with the given error rate keeps
+func (s *ErrorRateStrategy) errorFactor(rate float64) float64 {
+	if rate <= s.Threshold {
+		return 1
+	}
+	if factor := 1 - rate; factor > minErrorRateWeight {
+		return factor
+	}
+	return minErrorRateWeight
+}
+
+// LatencyPercentileStrategy prefers the backend with the lowest recent response time at
+// Percentile, e.g. 0.95 for the p95, so backends with slow tails receive less traffic than their
+// average latency would suggest. Ties are broken by active connections.
+type LatencyPercentileStrategy struct {
+	Percentile float64
+}
+
+// Name returns the name of the strategy
+func (s *LatencyPercentileStrategy) Name() string {
+	return "latency-percentile"
+}
+
+// Select returns the candidate with the lowest latency percentile
+func (s *LatencyPercentileStrategy) Select(candidates []Backend) Backend {
+	var selected Backend
+	var selectedLatency time.Duration
+	for _, backend := range candidates {
+		latency := backend.GetLatencyPercentile(s.Percentile)
+		if selected == nil || latency < selectedLatency || (latency == selectedLatency && backend.GetActiveConnections() < selected.GetActiveConnections()) {
+			selected = backend
+			selectedLatency = latency
+		}
+	}
+
+	return selected
+}
@@ -0,0 +1,349 @@
+package lb
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newStrategyPool returns a pool of backends that are never health checked against, selecting
+// with strategy
+func newStrategyPool(strategy Strategy, urls ...string) (*RoundRobinServerPool, []Backend) {
+	pool := NewRoundRobinServerPool()
+	backends := make([]Backend, 0, len(urls))
+	for _, u := range urls {
+		backend := NewBackend(u)
+		pool.AddBackend(backend)
+		backends = append(backends, backend)
+	}
+	pool.SetStrategy(strategy)
+	return pool, backends
+}
+
+func TestSmoothWeightedEqualWeightsMatchRoundRobin(t *testing.T) {
+	urls := []string{"http://a:3001", "http://b:3001", "http://c:3001", "http://d:3001"}
+	roundRobin, rrBackends := newStrategyPool(nil, urls...)
+	smooth, swBackends := newStrategyPool(&SmoothWeightedStrategy{}, urls...)
+	defer func() {
+		for i := range urls {
+			rrBackends[i].Stop()
+			swBackends[i].Stop()
+		}
+	}()
+
+	for i := 0; i < 24; i++ {
+		// A backend skipped for a while must not send the two out of step
+		switch i {
+		case 5:
+			rrBackends[1].SetAlive(false)
+			swBackends[1].SetAlive(false)
+		case 13:
+			rrBackends[1].SetAlive(true)
+			swBackends[1].SetAlive(true)
+		}
+
+		want := roundRobin.GetNextValidPeer().GetURL().Host
+		if got := smooth.GetNextValidPeer().GetURL().Host; got != want {
+			t.Fatalf("selection %d: smooth-weighted picked %s, round-robin %s", i, got, want)
+		}
+	}
+}
+
+func TestSmoothWeightedInterleaves(t *testing.T) {
+	pool, backends := newStrategyPool(&SmoothWeightedStrategy{}, "http://a:3001", "http://b:3001", "http://c:3001")
+	for _, backend := range backends {
+		defer backend.Stop()
+	}
+	backends[0].SetWeight(5)
+
+	var got string
+	for i := 0; i < 7; i++ {
+		got += pool.GetNextValidPeer().GetURL().Hostname()
+	}
+	if want := "aabacaa"; got != want {
+		t.Errorf("sequence = %s, want %s", got, want)
+	}
+}
+
+// stubBackend is a Backend with fixed metrics for strategies to select from, the methods it does
+// not override panic
+type stubBackend struct {
+	Backend
+	url         *url.URL
+	connections int
+	weight      int
+}
+
+func newStubBackends(connections ...int) []Backend {
+	backends := make([]Backend, 0, len(connections))
+	for i, active := range connections {
+		backends = append(backends, &stubBackend{url: &url.URL{Scheme: "http", Host: fmt.Sprintf("b%d:3001", i)}, connections: active, weight: 1})
+	}
+	return backends
+}
+
+func (sb *stubBackend) GetURL() *url.URL          { return sb.url }
+func (sb *stubBackend) GetActiveConnections() int { return sb.connections }
+func (sb *stubBackend) GetWeight() int            { return sb.weight }
+
+func TestLeastConnectionsTieBreaks(t *testing.T) {
+	// Backends 1 and 3 tie on the fewest connections
+	candidates := newStubBackends(4, 1, 2, 1)
+
+	counts := func(tieBreak TieBreak, selections int) map[Backend]int {
+		strategy := &LeastConnectionsStrategy{TieBreak: tieBreak}
+		counts := make(map[Backend]int)
+		for i := 0; i < selections; i++ {
+			counts[strategy.Select(candidates)]++
+		}
+		return counts
+	}
+
+	if got := counts(TieBreakLowestIndex, 10); got[candidates[1]] != 10 {
+		t.Errorf("lowest-index picked %v, want backend 1 every time", got)
+	}
+	if got := counts(TieBreakRoundRobin, 10); got[candidates[1]] != 5 || got[candidates[3]] != 5 {
+		t.Errorf("round-robin picked %v, want backends 1 and 3 in turn", got)
+	}
+	random := counts(TieBreakRandom, 1000)
+	if len(random) != 2 || random[candidates[1]] < 400 || random[candidates[3]] < 400 {
+		t.Errorf("random picked %v, want backends 1 and 3 about as often", random)
+	}
+
+	if tieBreak, err := ParseTieBreak(""); err != nil || tieBreak != TieBreakLowestIndex {
+		t.Errorf("ParseTieBreak(\"\") = %q, %v, want the deterministic lowest-index default", tieBreak, err)
+	}
+	if _, err := ParseTieBreak("sideways"); err == nil {
+		t.Error("ParseTieBreak accepted an unknown tie-break")
+	}
+}
+
+func TestWeightedRandomFollowsWeights(t *testing.T) {
+	candidates := newStubBackends(0, 0, 0)
+	candidates[0].(*stubBackend).weight = 3
+	candidates[2].(*stubBackend).weight = 0
+	strategy := &WeightedRandomStrategy{}
+
+	counts := make(map[Backend]int)
+	for i := 0; i < 4000; i++ {
+		counts[strategy.Select(candidates)]++
+	}
+	if counts[candidates[2]] != 0 {
+		t.Errorf("backend with weight 0 selected %d times", counts[candidates[2]])
+	}
+	if share := float64(counts[candidates[0]]) / 4000; share < 0.7 || share > 0.8 {
+		t.Errorf("backend with weight 3 of 4 got %.2f of the requests, want about 0.75", share)
+	}
+
+	// The cached distribution is rebuilt once the state changes
+	candidates[0].(*stubBackend).weight = 0
+	stateVersion.Add(1)
+	for i := 0; i < 100; i++ {
+		if got := strategy.Select(candidates); got != candidates[1] {
+			t.Fatalf("selected %s, want the only backend left with a weight", got.GetURL())
+		}
+	}
+}
+
+func BenchmarkWeightedRandom(b *testing.B) {
+	candidates := newStubBackends(make([]int, 100)...)
+	for i, backend := range candidates {
+		backend.(*stubBackend).weight = i%5 + 1
+	}
+
+	b.Run("cached", func(b *testing.B) {
+		strategy := &WeightedRandomStrategy{}
+		for i := 0; i < b.N; i++ {
+			strategy.Select(candidates)
+		}
+	})
+	b.Run("rebuilt", func(b *testing.B) {
+		strategy := &WeightedRandomStrategy{}
+		for i := 0; i < b.N; i++ {
+			strategy.rebuild(candidates, stateVersion.Load())
+			strategy.Select(candidates)
+		}
+	})
+}
+
+func TestLocalityPrefersOwnZoneAndSpillsOver(t *testing.T) {
+	pool := NewRoundRobinServerPool()
+	pool.SetStrategy(&LocalityStrategy{Zone: "eu-1a"})
+	local := []*backend{
+		newTestBackend(t, "http://a:3001", WithZone("eu-1a")),
+		newTestBackend(t, "http://b:3001", WithZone("eu-1a")),
+	}
+	remote := newTestBackend(t, "http://c:3001", WithZone("eu-1b"))
+	for _, b := range append(local, remote) {
+		pool.AddBackend(b)
+	}
+
+	seen := make(map[string]int)
+	for i := 0; i < 10; i++ {
+		seen[pool.GetNextValidPeer().GetURL().Host]++
+	}
+	if seen["a:3001"] != 5 || seen["b:3001"] != 5 {
+		t.Errorf("selections = %v, want the two local backends alternating", seen)
+	}
+
+	local[0].SetAlive(false)
+	if got := pool.GetNextValidPeer(); got != Backend(local[1]) {
+		t.Errorf("with one local backend down selected %s, want the other local one", got.GetURL())
+	}
+
+	local[1].SetAlive(false)
+	for i := 0; i < 3; i++ {
+		if got := pool.GetNextValidPeer(); got != Backend(remote) {
+			t.Errorf("with the local zone down selected %v, want the remote backend", got)
+		}
+	}
+}
+
+func TestZeroWeightDrainsWeightedPools(t *testing.T) {
+	for _, strategy := range []Strategy{&WeightedRandomStrategy{}, &SmoothWeightedStrategy{}} {
+		pool, backends := newStrategyPool(strategy, "http://a:3001", "http://b:3001", "http://c:3001")
+		backends[1].SetWeight(0)
+
+		for i := 0; i < 200; i++ {
+			if got := pool.GetNextValidPeer(); got == backends[1] {
+				t.Fatalf("%s: selected the backend with weight 0", strategy.Name())
+			}
+		}
+		if len(pool.GetBackends()) != 3 || !backends[1].IsAlive() {
+			t.Errorf("%s: backend with weight 0 no longer alive in the pool", strategy.Name())
+		}
+
+		backends[1].SetWeight(2)
+		selected := false
+		for i := 0; i < 200 && !selected; i++ {
+			selected = pool.GetNextValidPeer() == backends[1]
+		}
+		if !selected {
+			t.Errorf("%s: backend not selected again after raising its weight", strategy.Name())
+		}
+
+		for _, backend := range backends {
+			backend.SetWeight(0)
+		}
+		if got := pool.GetNextValidPeer(); got != nil {
+			t.Errorf("%s: selected %s with every weight at 0, want none", strategy.Name(), got.GetURL())
+		}
+		for _, backend := range backends {
+			backend.Stop()
+		}
+	}
+}
+
+func TestErrorRateShiftsTrafficFromFailingBackend(t *testing.T) {
+	// One backend answers 4 of every 5 requests with a 500
+	var hits atomic.Int32
+	failing := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if hits.Add(1)%5 != 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	})
+	healthy := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {})
+
+	pool := NewRoundRobinServerPool()
+	pool.SetStrategy(&ErrorRateStrategy{Threshold: 0.1})
+	bad, good := newTestBackend(t, failing.URL), newTestBackend(t, healthy.URL)
+	pool.AddBackend(bad)
+	pool.AddBackend(good)
+	for i := 0; i < 50; i++ {
+		serve(bad, http.MethodGet, "/")
+		serve(good, http.MethodGet, "/")
+	}
+	if rate := bad.GetErrorRate(); rate != 0.8 {
+		t.Fatalf("error rate of the failing backend = %.2f, want 0.80", rate)
+	}
+
+	// The failing backend keeps a fifth of its weight: 0.2 / 1.2 of the traffic
+	selected := 0
+	for i := 0; i < 2000; i++ {
+		if pool.GetNextValidPeer() == Backend(bad) {
+			selected++
+		}
+	}
+	if share := float64(selected) / 2000; share < 0.12 || share > 0.22 {
+		t.Errorf("failing backend got %.2f of the traffic, want about 0.17", share)
+	}
+}
+
+func TestLatencyPercentilePrefersLowTail(t *testing.T) {
+	// spiky answers at once except for one request in 10, which takes 100ms: a lower average
+	// than steady at 20ms, but a worse p95
+	var hits atomic.Int32
+	spiky := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if hits.Add(1)%10 == 0 {
+			time.Sleep(100 * time.Millisecond)
+		}
+	})
+	steady := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+	})
+
+	pool := NewRoundRobinServerPool()
+	spikyBackend, steadyBackend := newTestBackend(t, spiky.URL), newTestBackend(t, steady.URL)
+	pool.AddBackend(spikyBackend)
+	pool.AddBackend(steadyBackend)
+	for i := 0; i < 10; i++ {
+		serve(spikyBackend, http.MethodGet, "/")
+		serve(steadyBackend, http.MethodGet, "/")
+	}
+
+	for _, tt := range []struct {
+		percentile float64
+		want       Backend
+	}{
+		{0.95, steadyBackend},
+		{0.5, spikyBackend},
+	} {
+		pool.SetStrategy(&LatencyPercentileStrategy{Percentile: tt.percentile})
+		for i := 0; i < 10; i++ {
+			if got := pool.GetNextValidPeer(); got != tt.want {
+				t.Fatalf("p%.0f: selected %s, want %s", tt.percentile*100, got.GetURL(), tt.want.GetURL())
+			}
+		}
+	}
+}
+
+func TestExcludeLastNeverRepeatsWithAlternatives(t *testing.T) {
+	for _, name := range []string{"weighted-random", "least-connections"} {
+		strategy, err := NewStrategy(name, StrategyConfig{ExcludeLast: true})
+		if err != nil {
+			t.Fatalf("NewStrategy(%s): %s", name, err)
+		}
+		// Left to themselves the strategies would keep picking the first backend
+		candidates := newStubBackends(0, 5, 5)
+		candidates[0].(*stubBackend).weight = 100
+
+		var last Backend
+		for i := 0; i < 200; i++ {
+			selected := strategy.Select(candidates)
+			if selected == nil || selected == last {
+				t.Fatalf("%s: selection %d picked %v again", name, i, selected)
+			}
+			last = selected
+		}
+	}
+}
+
+func TestExcludeLastKeepsASingleCandidate(t *testing.T) {
+	strategy, _ := NewStrategy("weighted-random", StrategyConfig{ExcludeLast: true})
+	candidates := newStubBackends(0, 0)
+	only := candidates[:1]
+	for i := 0; i < 3; i++ {
+		if selected := strategy.Select(only); selected != only[0] {
+			t.Fatalf("selection %d = %v, want the only candidate", i, selected)
+		}
+	}
+
+	// The last backend is only a stand-in for the others when they are all refused
+	candidates[1].(*stubBackend).weight = 0
+	if selected := strategy.Select(candidates); selected != candidates[0] {
+		t.Errorf("selection with the other at weight 0 = %v, want the last one again", selected)
+	}
+}
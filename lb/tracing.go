@@ -0,0 +1,81 @@
+package lb
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName identifies the spans created by the load balancer
+const tracerName = "github.com/zerbinidamata/lb-challenge/lb"
+
+// backendURLKey is the span attribute holding the URL of the selected backend
+const backendURLKey = attribute.Key("lb.backend.url")
+
+// SetupTracing installs the global tracer provider and W3C trace context propagation.
+// The exporter is one of none, stdout or otlp; otlp is configured through the standard
+// OTEL_EXPORTER_OTLP_* environment variables.
+func SetupTracing(exporter string) error {
+	var spanExporter sdktrace.SpanExporter
+	var err error
+	switch exporter {
+	case "", "none":
+		return nil
+	case "stdout":
+		spanExporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case "otlp":
+		spanExporter, err = otlptracehttp.New(context.Background())
+	default:
+		return fmt.Errorf("unknown trace exporter %q", exporter)
+	}
+	if err != nil {
+		return err
+	}
+
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(spanExporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "lb"))),
+	))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	return nil
+}
+
+// startRequestSpan starts a server span for an incoming request, continuing the trace of
+// the client if the request carries a traceparent header
+func startRequestSpan(r *http.Request) (context.Context, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+	return otel.Tracer(tracerName).Start(ctx, "proxy "+r.Method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("url.path", r.URL.Path),
+		),
+	)
+}
+
+// endRequestSpan records the response status on the span and ends it
+func endRequestSpan(span trace.Span, status int) {
+	span.SetAttributes(attribute.Int("http.response.status_code", status))
+	if status >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+	span.End()
+}
+
+// injectTraceContext adds the trace context of the request to its headers for the backend
+func injectTraceContext(req *http.Request) {
+	otel.GetTextMapPropagator().Inject(req.Context(), propagation.HeaderCarrier(req.Header))
+}
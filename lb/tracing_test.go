@@ -0,0 +1,55 @@
+package lb
+
+import (
+	"net/http"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// recordSpans installs a tracer provider recording spans in memory until the test ends
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	recorder := tracetest.NewSpanRecorder()
+	provider, propagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(provider)
+		otel.SetTextMapPropagator(propagator)
+	})
+	return recorder
+}
+
+func TestProxiedRequestIsTraced(t *testing.T) {
+	traceparents := make(chan string, 1)
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		traceparents <- r.Header.Get("traceparent")
+		w.WriteHeader(http.StatusTeapot)
+	})
+	recorder := recordSpans(t)
+	serve(startTestLoadBalancer(t, Config{Backends: []BackendConfig{{URL: server.URL}}}).Handler(), http.MethodGet, "/")
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("%d spans ended, want 1", len(spans))
+	}
+	attributes := make(map[string]string)
+	for _, kv := range spans[0].Attributes() {
+		attributes[string(kv.Key)] = kv.Value.Emit()
+	}
+	if got := attributes[string(backendURLKey)]; got != server.URL {
+		t.Errorf("span %s = %q, want %q", backendURLKey, got, server.URL)
+	}
+	if got := attributes["http.response.status_code"]; got != "418" {
+		t.Errorf("span status code = %q, want 418", got)
+	}
+
+	traceID := spans[0].SpanContext().TraceID().String()
+	if got := <-traceparents; len(got) < 36 || got[3:35] != traceID {
+		t.Errorf("backend got traceparent %q, want one in trace %s", got, traceID)
+	}
+}
@@ -0,0 +1,53 @@
+package lb
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime/debug"
+)
+
+// Build information, set at build time with e.g.
+//
+//	go build -ldflags "-X github.com/zerbinidamata/lb-challenge/lb.Version=v1.2.0 -X github.com/zerbinidamata/lb-challenge/lb.Commit=$(git rev-parse HEAD) -X github.com/zerbinidamata/lb-challenge/lb.BuildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	Version   = "dev"
+	Commit    = ""
+	BuildTime = ""
+)
+
+// BuildInfo describes the build of the load balancer on /version
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildTime string `json:"buildTime"`
+}
+
+// GetBuildInfo returns the build information of the load balancer. A commit and build time not
+// set with ldflags are taken from the version control information Go stamps into binaries built
+// in a git checkout, the build time then being the time of the commit, and are "unknown" without it.
+func GetBuildInfo() BuildInfo {
+	info := BuildInfo{Version: Version, Commit: Commit, BuildTime: BuildTime}
+	if build, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range build.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = setting.Value
+			case setting.Key == "vcs.time" && info.BuildTime == "":
+				info.BuildTime = setting.Value
+			}
+		}
+	}
+	if info.Commit == "" {
+		info.Commit = "unknown"
+	}
+	if info.BuildTime == "" {
+		info.BuildTime = "unknown"
+	}
+	return info
+}
+
+// versionHandler serves the build information of the load balancer
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(GetBuildInfo())
+}
@@ -0,0 +1,42 @@
+package lb
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestVersionReportsBuildInfo(t *testing.T) {
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "backend") })
+	balancer := startTestLoadBalancer(t, Config{Backends: []BackendConfig{{URL: server.URL}}})
+	version := func() map[string]string {
+		w := serve(balancer.AdminHandler(), http.MethodGet, "/version")
+		var fields map[string]string
+		if err := json.Unmarshal(w.Body.Bytes(), &fields); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("GET /version = %d %q, want a JSON object", w.Code, w.Body.String())
+		}
+		return fields
+	}
+
+	// Test binaries carry no version control information
+	want := map[string]string{"version": "dev", "commit": "unknown", "buildTime": "unknown"}
+	if got := version(); !reflect.DeepEqual(got, want) {
+		t.Errorf("GET /version without ldflags = %v, want %v", got, want)
+	}
+
+	defer func(version, commit, buildTime string) {
+		Version, Commit, BuildTime = version, commit, buildTime
+	}(Version, Commit, BuildTime)
+	Version, Commit, BuildTime = "v1.2.0", "4f9c2e1", "2026-10-14T06:00:00Z"
+	want = map[string]string{"version": "v1.2.0", "commit": "4f9c2e1", "buildTime": "2026-10-14T06:00:00Z"}
+	if got := version(); !reflect.DeepEqual(got, want) {
+		t.Errorf("GET /version = %v, want %v", got, want)
+	}
+
+	// The proxy listener forwards /version to the backends like any other path
+	if got := serve(balancer.Handler(), http.MethodGet, "/version").Body.String(); got != "backend" {
+		t.Errorf("GET /version on the proxy = %q, want it proxied", got)
+	}
+}